@@ -0,0 +1,142 @@
+import { Fnv1a } from "./shared.js";
+
+/**
+ * Header a client asks for delta-encoded element patches with, set to
+ * DELTA_FORMAT, and the server answers with when it sends them.
+ *
+ * @constant {string}
+ */
+export const DELTA_HEADER = "X-Resilient-Delta";
+
+/**
+ * The delta format the client decodes.
+ *
+ * @constant {string}
+ */
+export const DELTA_FORMAT = "1";
+
+/**
+ * SSE field of an element patch sent whole, naming the dictionary slot its
+ * elements are kept in.
+ *
+ * @constant {string}
+ */
+export const DICT_FIELD = "resilient-dict";
+
+/**
+ * SSE field carrying the elements of an element patch as a diff against a
+ * dictionary slot, in place of its `data: elements` lines: the slot, the
+ * FNV-1a hash of the elements it rebuilds and the diff in base64. Without
+ * data lines the event never reaches Datastar undecoded.
+ *
+ * @constant {string}
+ */
+export const DELTA_FIELD = "resilient-delta";
+
+// matches a DICT_FIELD or DELTA_FIELD line, capturing the field and its value
+const deltaFieldLine = new RegExp(`^(${DICT_FIELD}|${DELTA_FIELD}): ?(.*)$`, "m");
+
+const elementsLine = /^data: elements (.*)$/gm;
+
+const utf8 = new TextDecoder("utf-8", { fatal: true });
+
+/**
+ * Rebuilds the element patches of one delta-encoded response. It keeps the
+ * response's dictionary, so a new one is needed for every response; on a
+ * reconnect the server starts over too.
+ *
+ * @example
+ * const delta = new DeltaDecoder();
+ * event = delta.decode(event); // "resilient-delta: 3 72288045 HQACMjUP" -> "data: elements ..."
+ */
+export class DeltaDecoder {
+  constructor() {
+    this.encoder = new TextEncoder();
+    /** @type {Uint8Array[]} */
+    this.slots = [];
+  }
+
+  /**
+   * Takes a complete event, keeping the elements of a patch sent whole and
+   * rebuilding those of a diff. It throws, failing the stream, on a diff it
+   * can't rebuild, or rebuilds into elements whose hash doesn't match.
+   *
+   * @param {string} event - The event, including the blank line ending it
+   * @returns {string} The event as Datastar expects it
+   */
+  decode(event) {
+    const m = deltaFieldLine.exec(event);
+    if (!m) return event;
+
+    if (m[1] === DICT_FIELD) {
+      const elements = [];
+      for (const [, line] of event.matchAll(elementsLine)) elements.push(line);
+      this.slots[Number(m[2])] = this.encoder.encode(elements.join("\n"));
+      return event;
+    }
+
+    const [slot, sum, diff] = m[2].split(" ");
+    const base = this.slots[Number(slot)];
+    if (!base) throw new Error(`delta: slot ${slot} is empty`);
+    const payload = ApplyDiff(base, Uint8Array.from(atob(diff), (c) => c.charCodeAt(0)));
+    const actual = Fnv1a(payload);
+    if (actual !== sum) {
+      throw new Error(`delta: rebuilt elements hash to ${actual}, want ${sum}`);
+    }
+    this.slots[Number(slot)] = payload;
+
+    const lines = utf8.decode(payload).split("\n").map((line) => `data: elements ${line}`);
+    return event.slice(0, m.index) + lines.join("\n") + event.slice(m.index + m[0].length);
+  }
+}
+
+/**
+ * Applies a diff to base: a sequence of operations, each a uvarint holding a
+ * length n shifted left by one and the kind in the low bit. An insert (0) is
+ * followed by the n bytes to insert, a copy (1) by the uvarint offset of the
+ * n bytes to copy from base.
+ *
+ * @param {Uint8Array} base - The bytes the diff was made against
+ * @param {Uint8Array} diff - The diff
+ * @returns {Uint8Array} The bytes the diff rebuilds
+ */
+export function ApplyDiff(base, diff) {
+  const parts = [];
+  let size = 0;
+  let pos = 0;
+
+  const uvarint = () => {
+    let value = 0;
+    for (let shift = 1; ; shift *= 128) {
+      if (pos >= diff.length) throw new Error("delta: truncated diff");
+      const b = diff[pos++];
+      value += (b & 0x7f) * shift;
+      if (b < 0x80) return value;
+    }
+  };
+
+  while (pos < diff.length) {
+    const op = uvarint();
+    const n = Math.floor(op / 2);
+    let part;
+    if (op % 2 === 0) {
+      if (pos + n > diff.length) throw new Error("delta: truncated diff");
+      part = diff.subarray(pos, pos + n);
+      pos += n;
+    } else {
+      const at = uvarint();
+      if (at + n > base.length) throw new Error("delta: copy out of range");
+      part = base.subarray(at, at + n);
+    }
+    parts.push(part);
+    size += n;
+  }
+
+  const payload = new Uint8Array(size);
+  let at = 0;
+  for (const part of parts) {
+    payload.set(part, at);
+    at += part.length;
+  }
+  return payload;
+}
@@ -0,0 +1,151 @@
+import { EventFields, Fnv1a } from "./shared.js";
+
+/**
+ * SSE field of the checksum blocks a resilientsse server with a DriftMonitor
+ * sends: {"conn":7,"id":42,"keys":["count"],"sum":"9f3a01bc"}. The blocks
+ * have no data, so Datastar never sees them.
+ *
+ * @constant {string}
+ */
+export const CHECKSUM_FIELD = "resilient-checksum";
+
+/**
+ * Response header carrying the URL drift is reported to.
+ *
+ * @constant {string}
+ */
+export const DRIFT_HEADER = "X-Resilient-Drift";
+
+/**
+ * Mirrors the signals the streams of one Retryer patched, and checks them
+ * against the checksums the server sends. A checksum covers the keys it
+ * lists: the mirror hashes the same keys the same way, and calls onDrift
+ * with a report for the server when the sums differ.
+ *
+ * @example
+ * const mirror = new SignalMirror((report) => post(report));
+ * event = mirror.take(event); // for every event, in order
+ */
+export class SignalMirror {
+  /**
+   * @param {(report: {conn: number, id: number, expected: string, actual: string}) => void} onDrift
+   */
+  constructor(onDrift) {
+    this.onDrift = onDrift;
+    this.signals = {};
+  }
+
+  /**
+   * Takes a complete event, applying its signal patch or checking its
+   * checksum.
+   *
+   * @param {string} event - The event, including the blank line ending it
+   * @returns {string} The event, unchanged
+   */
+  take(event) {
+    let type = "";
+    let checksum = null;
+    const data = [];
+    for (const [name, value] of EventFields(event)) {
+      if (name === "event") type = value;
+      else if (name === "data") data.push(value);
+      else if (name === CHECKSUM_FIELD) checksum = value;
+    }
+
+    if (type === "datastar-patch-signals") {
+      this.patch(data);
+    } else if (checksum !== null) {
+      this.check(JSON.parse(checksum));
+    }
+    return event;
+  }
+
+  /**
+   * Applies the data lines of a signal patch.
+   *
+   * @private
+   * @param {string[]} data - The event's data lines
+   */
+  patch(data) {
+    const json = [];
+    let onlyIfMissing = false;
+    for (const line of data) {
+      if (line.startsWith("signals ")) json.push(line.slice("signals ".length));
+      if (line.startsWith("onlyIfMissing ")) {
+        onlyIfMissing = line.slice("onlyIfMissing ".length).trim() === "true";
+      }
+    }
+    if (json.length > 0) {
+      mergePatch(this.signals, JSON.parse(json.join("\n")), onlyIfMissing);
+    }
+  }
+
+  /**
+   * Compares the mirrored signals with a checksum block.
+   *
+   * @private
+   * @param {{conn: number, id: number, keys: string[], sum: string}} block
+   */
+  check({ conn, id, keys, sum }) {
+    const state = {};
+    for (const key of keys) {
+      if (Object.hasOwn(this.signals, key)) state[key] = this.signals[key];
+    }
+    const actual = SignalsChecksum(state);
+    if (actual !== sum) {
+      this.onDrift({ conn, id, expected: sum, actual });
+    }
+  }
+}
+
+/**
+ * Hashes signals the way a resilientsse server does: the 32-bit FNV-1a hash,
+ * in hex, of their JSON encoding with object keys sorted.
+ *
+ * @param {object} signals - The signals to hash
+ * @returns {string} The checksum
+ */
+export function SignalsChecksum(signals) {
+  return Fnv1a(new TextEncoder().encode(canonicalJSON(signals)));
+}
+
+// canonicalJSON encodes value as Go's encoding/json does: object keys sorted,
+// and the line and paragraph separators escaped
+function canonicalJSON(value) {
+  if (Array.isArray(value)) {
+    return `[${value.map(canonicalJSON).join(",")}]`;
+  }
+  if (isObject(value)) {
+    const keys = Object.keys(value).sort();
+    return `{${keys.map((k) => `${quote(k)}:${canonicalJSON(value[k])}`).join(",")}}`;
+  }
+  return quote(value);
+}
+
+function quote(value) {
+  return JSON.stringify(value)
+    .replace(/\u2028/g, "\\u2028")
+    .replace(/\u2029/g, "\\u2029");
+}
+
+function isObject(value) {
+  return value !== null && typeof value === "object" && !Array.isArray(value);
+}
+
+// mergePatch applies a signal patch to signals as Datastar does: objects are
+// merged key by key, null removes a key, and anything else replaces it
+function mergePatch(signals, patch, onlyIfMissing) {
+  for (const [key, value] of Object.entries(patch)) {
+    if (value === null) {
+      if (!onlyIfMissing) delete signals[key];
+    } else if (isObject(value)) {
+      if (!isObject(signals[key])) {
+        if (onlyIfMissing && Object.hasOwn(signals, key)) continue;
+        signals[key] = {};
+      }
+      mergePatch(signals[key], value, onlyIfMissing);
+    } else if (!onlyIfMissing || !Object.hasOwn(signals, key)) {
+      signals[key] = value;
+    }
+  }
+}
@@ -5,5 +5,6 @@ export {
   CONNECT_EVENT,
   CONNECTED_EVENT,
   DISCONNECTED_EVENT,
+  DRIFT_EVENT,
   ContentType,
 } from "./shared.js";
@@ -3,9 +3,15 @@ import {
   Logger,
   ElementIndex,
   FetchIdToElement,
+  ContentType,
+  DRIFT_EVENT,
 } from "./shared.js";
 import { Retryer } from "./retryer.js";
 import { FetchReturn } from "./datastar.js";
+import { TxBuffer } from "./tx.js";
+import { DRIFT_HEADER, SignalMirror } from "./drift.js";
+import { SERIALIZER_HEADER, SignalDecoders, SignalsDecoder } from "./serializers.js";
+import { DELTA_FORMAT, DELTA_HEADER, DeltaDecoder } from "./delta.js";
 
 const FetchIdHeader = "X-Fetch-Id";
 
@@ -31,9 +37,148 @@ export function ToggleInterceptorLogging(enabled) {
   InterceptorLogger.enabled = enabled;
 }
 
+/**
+ * The signals each Retryer's streams patched, for streams that send
+ * checksums (see SignalMirror)
+ *
+ * @type {WeakMap<Retryer, SignalMirror>}
+ */
+const SignalMirrors = new WeakMap();
+
+/**
+ * Returns the function decoding the events of an SSE response before
+ * Datastar sees them, or null if the response needs none.
+ *
+ * @param {Object} params
+ * @param {string} params.url
+ * @param {Response} params.response
+ * @param {Retryer|null} params.retryer
+ * @returns {((event: string) => string)|null}
+ */
+const eventDecoder = function ({ url, response, retryer }) {
+  const decoders = [];
+
+  // signals are decoded first: everything after expects JSON
+  const serializer = response.headers.get(SERIALIZER_HEADER);
+  if (serializer) {
+    decoders.push(SignalsDecoder(serializer));
+  }
+
+  // element patches are rebuilt against this response's own dictionary
+  if (response.headers.get(DELTA_HEADER) === DELTA_FORMAT) {
+    const delta = new DeltaDecoder();
+    decoders.push((event) => delta.decode(event));
+  }
+
+  const driftURL = response.headers.get(DRIFT_HEADER);
+  if (driftURL && retryer) {
+    let mirror = SignalMirrors.get(retryer);
+    if (!mirror) {
+      mirror = new SignalMirror((report) =>
+        reportDrift({ url: new URL(driftURL, response.url || url), report, retryer })
+      );
+      SignalMirrors.set(retryer, mirror);
+    }
+    decoders.push((event) => mirror.take(event));
+  }
+
+  if (decoders.length === 0) return null;
+  return (event) => decoders.reduce((decoded, decode) => decode(decoded), event);
+};
+
+/**
+ * Reports signals that drifted from what the stream sent to the server, which
+ * answers with a resync, and fires DRIFT_EVENT on the Retryer's element.
+ *
+ * @param {Object} params
+ * @param {URL} params.url - Where the server takes drift reports
+ * @param {{conn: number, id: number, expected: string, actual: string}} params.report
+ * @param {Retryer} params.retryer
+ */
+const reportDrift = function ({ url, report, retryer }) {
+  InterceptorLogger.warn(
+    `[Interceptor] Signals drifted from the stream's at event ${report.id}, reporting to ${url}`,
+    report
+  );
+  retryer.element.dispatchEvent(new CustomEvent(DRIFT_EVENT, { detail: report }));
+
+  originalFetch(url, {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify(report),
+    keepalive: true,
+  }).catch((e) =>
+    InterceptorLogger.error("[Interceptor] Failed to report drift:", e)
+  );
+};
+
+/**
+ * The serializer each Retryer's streams ask for, negotiated through its
+ * capabilitiesURL
+ *
+ * @type {WeakMap<Retryer, Promise<string|null>>}
+ */
+const Serializers = new WeakMap();
+
+/**
+ * Fetches the capabilities of the Retryer's server, once, and resolves to the
+ * first of its serializers the client decodes, or null for JSON. A failed
+ * fetch is retried on the next request.
+ *
+ * @param {Retryer} retryer
+ * @returns {Promise<string|null>}
+ */
+const negotiateSerializer = function (retryer) {
+  let serializer = Serializers.get(retryer);
+  if (!serializer) {
+    serializer = originalFetch(retryer.options.capabilitiesURL, {
+      headers: { Accept: "application/json" },
+    })
+      .then((response) => {
+        if (!response.ok) throw new Error(`${response.status} ${response.statusText}`);
+        return response.json();
+      })
+      .then(
+        ({ serializers = [] }) =>
+          serializers.find((name) => Object.hasOwn(SignalDecoders, name)) ?? null
+      )
+      .catch((e) => {
+        InterceptorLogger.error("[Interceptor] Failed to fetch capabilities:", e);
+        Serializers.delete(retryer);
+        return null;
+      });
+    Serializers.set(retryer, serializer);
+  }
+  return serializer;
+};
+
+/**
+ * Returns fetch arguments with a request header set.
+ *
+ * @param {Object} params
+ * @param {string | URL | Request} params.resource
+ * @param {RequestInit} [params.init]
+ * @param {string} name
+ * @param {string} value
+ * @returns {{ resource: string | URL | Request, init: RequestInit }}
+ */
+const withRequestHeader = function ({ resource, init }, name, value) {
+  // init's headers, if any, replace a Request's
+  if (init?.headers || !(resource instanceof Request)) {
+    const headers = new Headers(init?.headers);
+    headers.set(name, value);
+    return { resource, init: { ...init, headers } };
+  }
+  const headers = new Headers(resource.headers);
+  headers.set(name, value);
+  return { resource: new Request(resource, { headers }), init };
+};
+
 /**
  * Creates a TransformStream to process the response body stream.
  * Applies the dataInterceptor if configured, then enqueues chunks to the stream.
+ * For SSE responses, events are decoded (see eventDecoder), and the events of
+ * a patch group are held back until the group is complete (see TxBuffer).
  *
  * @param {Object} params
  * @param {string} params.url
@@ -42,6 +187,10 @@ export function ToggleInterceptorLogging(enabled) {
  * @returns {TransformStream} A TransformStream that processes chunks with optional data modification
  */
 const fetchStreamTransformer = function ({ url, response, retryer }) {
+  const groups = new ContentType(response.headers.get("content-type")).isSSE
+    ? new TxBuffer(eventDecoder({ url, response, retryer }))
+    : null;
+
   return new TransformStream({
     async transform(chunk, controller) {
       retryer?.trackSSE(RETRYER_BYPASS_KEY);
@@ -53,6 +202,12 @@ const fetchStreamTransformer = function ({ url, response, retryer }) {
             retryer.options.dataInterceptor({ url, response, chunk }) ?? chunk;
         }
 
+        // hold back unfinished patch groups
+        if (groups) {
+          chunk = groups.push(chunk);
+          if (!chunk) return;
+        }
+
         // return data to stream
         controller.enqueue(chunk);
       } catch (e) {
@@ -63,6 +218,18 @@ const fetchStreamTransformer = function ({ url, response, retryer }) {
         controller.error(e);
       }
     },
+
+    flush(controller) {
+      if (!groups) return;
+
+      const { rest, dropped } = groups.end();
+      if (dropped) {
+        InterceptorLogger.warn(
+          `[Interceptor] Dropped an unfinished patch group from ${url}`
+        );
+      }
+      if (rest) controller.enqueue(rest);
+    },
   });
 };
 
@@ -93,6 +260,25 @@ window.fetch = async function (resource, init) {
     retryer
   );
 
+  if (retryer.options.capabilitiesURL) {
+    const serializer = await negotiateSerializer(retryer);
+    if (serializer) {
+      ({ resource, init } = withRequestHeader(
+        { resource, init },
+        SERIALIZER_HEADER,
+        serializer
+      ));
+    }
+  }
+
+  if (retryer.options.deltaEncoding) {
+    ({ resource, init } = withRequestHeader(
+      { resource, init },
+      DELTA_HEADER,
+      DELTA_FORMAT
+    ));
+  }
+
   if (retryer.options.requestInterceptor) {
     ({ resource, init } = retryer.options.requestInterceptor({
       resource,
@@ -61,6 +61,8 @@ export function SimpleBackoffCalculator({
  * @param {Function|null} [options.requestInterceptor=null] - Function to modify fetch requests before they execute. Takes ({ resource, init }) and returns { resource, init }. Resource can be string, URL, or Request object. Init is the optional RequestInit. Default is null (no modification).
  * @param {Function|null} [options.responseInterceptor=null] - Function to modify Response object before it's returned to Datastar. Takes ({ url, response }) and returns modified Response. Useful for modifying headers, status, etc. Default is null (no modification).
  * @param {Function|null} [options.dataInterceptor=null] - Function to modify streaming response data chunks. Takes ({ url, response, chunk }) and returns modified chunk. Chunk is a Uint8Array containing binary data. Called for each chunk of the response body. Default is null (no modification).
+ * @param {string} [options.capabilitiesURL=""] - URL of a resilientsse Capabilities endpoint. If set, it is fetched before the first request, and requests ask for the first binary signal serializer it lists that the client decodes ("cbor" or "msgpack"). Default is empty (JSON signals).
+ * @param {boolean} [options.deltaEncoding=false] - Whether requests ask resilientsse servers for delta-encoded element patches, diffs against the elements the connection was sent before. Default is false (whole patches).
  */
 export class Retryer {
   #logger;
@@ -93,6 +95,8 @@ export class Retryer {
       requestInterceptor: null, // function ({ resource, init }) => ({ resource, init })
       responseInterceptor: null, // function ({ url, response }) => response
       dataInterceptor: null, // function ({ url, response, chunk }) => chunk
+      capabilitiesURL: "",
+      deltaEncoding: false,
     };
 
     this.element = element;
@@ -0,0 +1,282 @@
+/**
+ * SSE field carrying the signals of a signal patch encoded by the stream's
+ * serializer, in base64, in place of its `data: signals` lines. Without data
+ * lines the event never reaches Datastar undecoded.
+ *
+ * @constant {string}
+ */
+export const SIGNALS_FIELD = "resilient-signals";
+
+/**
+ * Header carrying the serializer a client asks for on the request, and the
+ * one the server chose on the response.
+ *
+ * @constant {string}
+ */
+export const SERIALIZER_HEADER = "X-Resilient-Serializer";
+
+/**
+ * The binary signal encodings the client decodes, by the name servers
+ * negotiate them by.
+ *
+ * @type {Object<string, (bytes: Uint8Array) => any>}
+ */
+export const SignalDecoders = {
+  cbor: DecodeCBOR,
+  msgpack: DecodeMessagePack,
+};
+
+// matches a SIGNALS_FIELD line, capturing its value
+const signalsFieldLine = new RegExp(`^${SIGNALS_FIELD}: ?(.*)$`, "gm");
+
+/**
+ * Returns the function rewriting the events of a stream serialized by name
+ * into the JSON signal patches Datastar expects. It throws, failing the
+ * stream, on signals it can't decode.
+ *
+ * @example
+ * const decode = SignalsDecoder("cbor");
+ * event = decode(event); // "resilient-signals: oWFuAQ==" -> 'data: signals {"n":1}'
+ *
+ * @param {string} name - The serializer the server chose
+ * @returns {(event: string) => string}
+ */
+export function SignalsDecoder(name) {
+  const decode = SignalDecoders[name];
+  return (event) => {
+    if (!event.includes(SIGNALS_FIELD)) return event;
+    return event.replace(signalsFieldLine, (_, value) => {
+      if (!decode) throw new Error(`Unknown serializer ${name}`);
+      const bytes = Uint8Array.from(atob(value), (c) => c.charCodeAt(0));
+      return `data: signals ${JSON.stringify(decode(bytes))}`;
+    });
+  };
+}
+
+/**
+ * Decodes a CBOR (RFC 8949) value into its JSON equivalent. Indefinite
+ * lengths, byte strings and non-string map keys aren't supported; tags are
+ * skipped.
+ *
+ * @param {Uint8Array} bytes - The encoded value
+ * @returns {any} The value
+ */
+export function DecodeCBOR(bytes) {
+  const r = new Reader(bytes);
+  const value = cborItem(r);
+  r.end();
+  return value;
+}
+
+/**
+ * Decodes a MessagePack value into its JSON equivalent. Binary and extension
+ * types and non-string map keys aren't supported.
+ *
+ * @param {Uint8Array} bytes - The encoded value
+ * @returns {any} The value
+ */
+export function DecodeMessagePack(bytes) {
+  const r = new Reader(bytes);
+  const value = msgpackItem(r);
+  r.end();
+  return value;
+}
+
+function cborItem(r) {
+  const head = r.u8();
+  const major = head >> 5;
+  const info = head & 0x1f;
+
+  if (major === 7) {
+    switch (info) {
+      case 20:
+        return false;
+      case 21:
+        return true;
+      case 22:
+      case 23:
+        return null;
+      case 25:
+        return float16(r.u16());
+      case 26:
+        return r.f32();
+      case 27:
+        return r.f64();
+    }
+    throw new Error(`cbor: unsupported simple value ${info}`);
+  }
+
+  let n = info;
+  if (info === 24) n = r.u8();
+  else if (info === 25) n = r.u16();
+  else if (info === 26) n = r.u32();
+  else if (info === 27) n = r.u64();
+  else if (info > 27) throw new Error("cbor: indefinite lengths aren't supported");
+
+  switch (major) {
+    case 0:
+      return n;
+    case 1:
+      return -1 - n;
+    case 3:
+      return r.text(n);
+    case 4:
+      return array(n, () => cborItem(r));
+    case 5:
+      return object(n, () => cborItem(r));
+    case 6:
+      return cborItem(r);
+  }
+  throw new Error("cbor: byte strings aren't supported");
+}
+
+function msgpackItem(r) {
+  const b = r.u8();
+  if (b <= 0x7f) return b;
+  if (b >= 0xe0) return b - 0x100;
+  if ((b & 0xe0) === 0xa0) return r.text(b & 0x1f);
+  if ((b & 0xf0) === 0x90) return array(b & 0x0f, () => msgpackItem(r));
+  if ((b & 0xf0) === 0x80) return object(b & 0x0f, () => msgpackItem(r));
+
+  switch (b) {
+    case 0xc0:
+      return null;
+    case 0xc2:
+      return false;
+    case 0xc3:
+      return true;
+    case 0xca:
+      return r.f32();
+    case 0xcb:
+      return r.f64();
+    case 0xcc:
+      return r.u8();
+    case 0xcd:
+      return r.u16();
+    case 0xce:
+      return r.u32();
+    case 0xcf:
+      return r.u64();
+    case 0xd0:
+      return r.i8();
+    case 0xd1:
+      return r.i16();
+    case 0xd2:
+      return r.i32();
+    case 0xd3:
+      return r.i64();
+    case 0xd9:
+      return r.text(r.u8());
+    case 0xda:
+      return r.text(r.u16());
+    case 0xdb:
+      return r.text(r.u32());
+    case 0xdc:
+      return array(r.u16(), () => msgpackItem(r));
+    case 0xdd:
+      return array(r.u32(), () => msgpackItem(r));
+    case 0xde:
+      return object(r.u16(), () => msgpackItem(r));
+    case 0xdf:
+      return object(r.u32(), () => msgpackItem(r));
+  }
+  throw new Error(`msgpack: unsupported type 0x${b.toString(16)}`);
+}
+
+function array(n, item) {
+  const values = [];
+  for (let i = 0; i < n; i++) values.push(item());
+  return values;
+}
+
+function object(n, item) {
+  const values = {};
+  for (let i = 0; i < n; i++) {
+    const key = item();
+    if (typeof key !== "string") throw new Error("only string keys are supported");
+    // defined rather than assigned, so "__proto__" is a key like any other
+    Object.defineProperty(values, key, {
+      value: item(),
+      enumerable: true,
+      writable: true,
+      configurable: true,
+    });
+  }
+  return values;
+}
+
+function float16(h) {
+  const sign = h & 0x8000 ? -1 : 1;
+  const exp = (h >> 10) & 0x1f;
+  const frac = h & 0x3ff;
+  if (exp === 0) return sign * 2 ** -14 * (frac / 1024);
+  if (exp === 31) return frac ? NaN : sign * Infinity;
+  return sign * 2 ** (exp - 15) * (1 + frac / 1024);
+}
+
+const utf8 = new TextDecoder("utf-8", { fatal: true });
+
+// Reader reads big-endian values off bytes
+class Reader {
+  constructor(bytes) {
+    this.bytes = bytes;
+    this.view = new DataView(bytes.buffer, bytes.byteOffset, bytes.byteLength);
+    this.pos = 0;
+  }
+
+  take(n) {
+    if (this.pos + n > this.bytes.length) throw new Error("truncated value");
+    const at = this.pos;
+    this.pos += n;
+    return at;
+  }
+
+  end() {
+    if (this.pos !== this.bytes.length) throw new Error("trailing bytes after value");
+  }
+
+  u8() {
+    return this.view.getUint8(this.take(1));
+  }
+
+  u16() {
+    return this.view.getUint16(this.take(2));
+  }
+
+  u32() {
+    return this.view.getUint32(this.take(4));
+  }
+
+  u64() {
+    return Number(this.view.getBigUint64(this.take(8)));
+  }
+
+  i8() {
+    return this.view.getInt8(this.take(1));
+  }
+
+  i16() {
+    return this.view.getInt16(this.take(2));
+  }
+
+  i32() {
+    return this.view.getInt32(this.take(4));
+  }
+
+  i64() {
+    return Number(this.view.getBigInt64(this.take(8)));
+  }
+
+  f32() {
+    return this.view.getFloat32(this.take(4));
+  }
+
+  f64() {
+    return this.view.getFloat64(this.take(8));
+  }
+
+  text(n) {
+    const at = this.take(n);
+    return utf8.decode(this.bytes.subarray(at, at + n));
+  }
+}
@@ -46,6 +46,54 @@ export const CONNECTED_EVENT = "connected";
  */
 export const DISCONNECTED_EVENT = "disconnected";
 
+/**
+ * Event name fired when the signals a stream patched no longer match the
+ * checksum its resilientsse server sent. The event's detail is the drift
+ * report sent to the server: { conn, id, expected, actual }.
+ *
+ * @constant {string}
+ */
+export const DRIFT_EVENT = "drift";
+
+/**
+ * Hashes bytes with the 32-bit FNV-1a hash, as resilientsse servers do for
+ * checksums, returning it in hex.
+ *
+ * @param {Uint8Array} bytes - The bytes to hash
+ * @returns {string} The hash, 8 hex digits
+ */
+export function Fnv1a(bytes) {
+  let hash = 0x811c9dc5;
+  for (const byte of bytes) {
+    hash = Math.imul(hash ^ byte, 0x01000193);
+  }
+  return (hash >>> 0).toString(16).padStart(8, "0");
+}
+
+/**
+ * Splits an SSE event into its fields, in order, the way SSE parsers do:
+ * a field's value starts after the colon and one optional space, and
+ * comments are skipped.
+ *
+ * @param {string} event - The event text
+ * @returns {Array<[string, string]>} The event's [name, value] pairs
+ */
+export function EventFields(event) {
+  const fields = [];
+  for (const line of event.split(/\r?\n/)) {
+    if (line === "" || line.startsWith(":")) continue;
+    const colon = line.indexOf(":");
+    if (colon < 0) {
+      fields.push([line, ""]);
+      continue;
+    }
+    let value = line.slice(colon + 1);
+    if (value.startsWith(" ")) value = value.slice(1);
+    fields.push([line.slice(0, colon), value]);
+  }
+  return fields;
+}
+
 export class Logger {
   constructor(enabled = false) {
     this.enabled = enabled;
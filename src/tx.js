@@ -0,0 +1,117 @@
+/**
+ * SSE field a resilientsse server adds to every event of a patch group but
+ * the last, carrying the ID of the group's last event.
+ * SSE parsers ignore unknown fields, so Datastar never sees it.
+ *
+ * @constant {string}
+ */
+export const TX_FIELD = "resilient-tx";
+
+// matches the TX_FIELD line of an event
+const txFieldLine = new RegExp(`(^|[\\r\\n])${TX_FIELD}:`);
+
+// matches the blank line ending an event
+const eventEnd = /\r?\n\r?\n/g;
+
+/**
+ * Holds back the events of an SSE stream that belong to an unfinished patch
+ * group, and passes a group on only once its last event has arrived, so
+ * Datastar applies the whole group in one go. A group cut off by the end of
+ * the stream is never passed on: the server replays it whole when the client
+ * reconnects with the ID of the event before it.
+ *
+ * Events are passed on as received; incomplete events are held until the
+ * blank line ending them arrives, which Datastar waits for anyway.
+ *
+ * With decode, every complete event is passed through it first, and what it
+ * returns is passed on in its place: this is where the events a resilientsse
+ * server extends with fields of its own are decoded. decode may throw to fail
+ * the stream.
+ *
+ * @example
+ * const groups = new TxBuffer();
+ * const out = groups.push(chunk); // Uint8Array to pass on, or null
+ *
+ * @param {((event: string) => string)|null} [decode=null] - Decodes a complete event
+ */
+export class TxBuffer {
+  constructor(decode = null) {
+    this.decode = decode;
+    this.decoder = new TextDecoder();
+    this.encoder = new TextEncoder();
+    // text of the event being received
+    this.partial = "";
+    // complete events of the unfinished group
+    this.held = "";
+  }
+
+  /**
+   * Takes the next chunk of the stream and returns what may be passed on.
+   *
+   * @param {Uint8Array} chunk - The chunk received
+   * @returns {Uint8Array|null} The bytes to pass on, or null if none
+   */
+  push(chunk) {
+    const text = this.partial + this.decoder.decode(chunk, { stream: true });
+
+    // nothing held back, to hold or to decode: pass the chunk on untouched
+    if (
+      !this.decode &&
+      this.held === "" &&
+      this.partial === "" &&
+      !text.includes(TX_FIELD) &&
+      /\n\r?\n$/.test(text)
+    ) {
+      return chunk;
+    }
+
+    let out = "";
+    let start = 0;
+    eventEnd.lastIndex = 0;
+    for (let m; (m = eventEnd.exec(text)); ) {
+      const end = m.index + m[0].length;
+      out += this.take(text.slice(start, end));
+      start = end;
+    }
+    this.partial = text.slice(start);
+
+    return out === "" ? null : this.encoder.encode(out);
+  }
+
+  /**
+   * Takes a complete event, returning the text to pass on.
+   *
+   * @private
+   * @param {string} event - The event, including the blank line ending it
+   * @returns {string} The text to pass on
+   */
+  take(event) {
+    if (this.decode) event = this.decode(event);
+    if (txFieldLine.test(event)) {
+      this.held += event;
+      return "";
+    }
+    // the group's last event; servers write a group in one piece, so any
+    // other event also ends whatever was held
+    const out = this.held + event;
+    this.held = "";
+    return out;
+  }
+
+  /**
+   * Ends the stream, returning the incomplete event it ended with, if any.
+   * An unfinished group is dropped.
+   *
+   * @returns {{ rest: Uint8Array|null, dropped: boolean }}
+   */
+  end() {
+    const rest = this.partial + this.decoder.decode();
+    const dropped = this.held !== "";
+    this.partial = "";
+    this.held = "";
+    return {
+      rest: rest === "" ? null : this.encoder.encode(rest),
+      dropped,
+    };
+  }
+}
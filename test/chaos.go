@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// chaosTypes are the classes of traffic the chaos knobs can single out
+var chaosTypes = map[string]bool{"signals": true, "elements": true, "heartbeats": true}
+
+// chaosWriter degrades selected classes of SSE frames on their way to the
+// client while everything else flows normally: matching frames are dropped
+// with probability drop, or else held back for delay. Delayed frames are
+// written in order, but later frames of other classes overtake them, as they
+// would behind a proxy that buffers one kind of traffic.
+//
+// Frames are classified by their first event, so a patch group counts as its
+// first event's class. Frames the knobs can't select, such as retry
+// directives, always pass through.
+type chaosWriter struct {
+	http.ResponseWriter
+	rc    *http.ResponseController
+	r     *http.Request
+	name  string
+	opts  scenarioOpts
+	types map[string]bool
+
+	// mu serializes writes to the underlying ResponseWriter
+	mu      sync.Mutex
+	delayed chan delayedFrame
+	wg      sync.WaitGroup
+}
+
+type delayedFrame struct {
+	due   time.Time
+	frame []byte
+}
+
+// chaosWriterFor wraps w if opts select any chaos, returning w unchanged
+// otherwise. The returned wait must be called before the handler returns.
+// It sits below the stream's compressor, so parseScenarioOpts refuses chaos
+// with compression: frameType could not tell compressed frames apart.
+func chaosWriterFor(w http.ResponseWriter, r *http.Request, name string, opts scenarioOpts) (_ http.ResponseWriter, wait func()) {
+	if opts.Chaos == "" || (opts.ChaosDelay == 0 && opts.ChaosDrop == 0) {
+		return w, func() {}
+	}
+
+	c := &chaosWriter{
+		ResponseWriter: w,
+		rc:             http.NewResponseController(w),
+		r:              r,
+		name:           name,
+		opts:           opts,
+		types:          map[string]bool{},
+	}
+	for _, t := range splitList(opts.Chaos) {
+		c.types[t] = true
+	}
+	if opts.ChaosDelay > 0 {
+		c.delayed = make(chan delayedFrame, 1024)
+		c.wg.Go(c.writeDelayed)
+	}
+	return c, c.wait
+}
+
+// frameType classifies a frame as one of chaosTypes, or "" if it is none
+func frameType(frame []byte) string {
+	switch {
+	case bytes.HasPrefix(frame, []byte(": heartbeat")):
+		return "heartbeats"
+	case bytes.HasPrefix(frame, []byte("event: datastar-patch-signals")):
+		return "signals"
+	case bytes.HasPrefix(frame, []byte("event: datastar-patch-elements")):
+		return "elements"
+	}
+	return ""
+}
+
+func (c *chaosWriter) Write(p []byte) (int, error) {
+	t := frameType(p)
+	if !c.types[t] {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.ResponseWriter.Write(p)
+	}
+
+	if c.opts.ChaosDrop > 0 && c.opts.rand().Float64() < c.opts.ChaosDrop {
+		slog.Info("chaos: dropping frame", "scenario", c.name, "frame", t)
+		return len(p), nil
+	}
+	if c.delayed != nil {
+		select {
+		case c.delayed <- delayedFrame{due: time.Now().Add(c.opts.ChaosDelay), frame: bytes.Clone(p)}:
+			return len(p), nil
+		default:
+			// queue full: deliver late rather than block the stream
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ResponseWriter.Write(p)
+}
+
+// FlushError lets http.ResponseController flush through the chaos writer
+func (c *chaosWriter) FlushError() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rc.Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *chaosWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// writeDelayed writes held-back frames once they are due, until wait is called
+func (c *chaosWriter) writeDelayed() {
+	for f := range c.delayed {
+		select {
+		case <-c.r.Context().Done():
+			continue // client gone: discard
+		case <-time.After(time.Until(f.due)):
+		}
+
+		c.mu.Lock()
+		_, err := c.ResponseWriter.Write(f.frame)
+		if err == nil {
+			err = c.rc.Flush()
+		}
+		c.mu.Unlock()
+		if err != nil {
+			slog.Warn("chaos: delayed write failed", "scenario", c.name, "err", err)
+		}
+	}
+}
+
+// wait delivers (or discards, if the client is gone) every held-back frame
+func (c *chaosWriter) wait() {
+	if c.delayed != nil {
+		close(c.delayed)
+		c.wg.Wait()
+	}
+}
@@ -0,0 +1,145 @@
+// Command resilientctl works with resilientsse data: replay exports, the
+// stores they come from, and simulated load.
+//
+//	resilientctl store dump <export>            print a replay export as JSON lines
+//	resilientctl store load <jsonl> <export>    build a replay export from JSON lines
+//	resilientctl store export <store> <export>  export a replay store
+//	resilientctl store import <export> <store>  import an export into a replay store
+//	resilientctl simulate [flags]               simulate many subscribers in memory
+//
+// Each JSON line is one event:
+//
+//	{"key":"session /api/stable","capacity":100,"id":1,"frame":"event: ...\n\n"}
+//
+// dump and load are inverses, so an export can be dumped, edited or generated
+// as text, and loaded back, e.g. to seed a test environment with a
+// production-shaped backlog.
+//
+// export and import move events between an export file and a live store:
+// a running test server (http://localhost:8080, through its
+// /api/replay/export and /api/replay/import endpoints, whatever store it
+// runs with), Redis (redis://localhost:6379/0, the redisreplay package's
+// stores under its default prefix) or a bbolt file (bolt:replay.db, a
+// boltreplay log, which must not be open in another process). Importing
+// adds to each key only the events newer than its newest, so a store can be
+// migrated to another, or seeded from a loaded export:
+//
+//	resilientctl store export bolt:replay.db replay.export
+//	resilientctl store import replay.export redis://localhost:6379/0
+//
+// simulate connects -subscribers in-memory clients (see the memtransport
+// package) to a hub topic, publishes -events to it while -churn of the
+// subscribers reconnect between events, and checks that every subscriber
+// received every event exactly once, through session catch-up and replay.
+// It fails if any did not. Without sockets, 100k subscribers fit in one
+// process:
+//
+//	resilientctl simulate -subscribers 100000 -events 50 -churn 0.01
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"resilient-test/resilientsse"
+)
+
+// storeEvent is one line of the JSON lines form of an export
+type storeEvent struct {
+	Key      string `json:"key"`
+	Capacity int    `json:"capacity"`
+	ID       uint64 `json:"id"`
+	Frame    string `json:"frame"`
+}
+
+func main() {
+	args := os.Args[1:]
+	var err error
+	switch {
+	case len(args) == 3 && args[0] == "store" && args[1] == "dump":
+		err = storeDump(args[2])
+	case len(args) == 4 && args[0] == "store" && args[1] == "load":
+		err = storeLoad(args[2], args[3])
+	case len(args) == 4 && args[0] == "store" && args[1] == "export":
+		err = storeExport(args[2], args[3])
+	case len(args) == 4 && args[0] == "store" && args[1] == "import":
+		err = storeImport(args[2], args[3])
+	case len(args) >= 1 && args[0] == "simulate":
+		err = simulate(args[1:])
+	default:
+		fmt.Fprintln(os.Stderr, "usage:")
+		fmt.Fprintln(os.Stderr, "  resilientctl store dump <export>")
+		fmt.Fprintln(os.Stderr, "  resilientctl store load <jsonl> <export>")
+		fmt.Fprintln(os.Stderr, "  resilientctl store export <http://...|redis://...|bolt:path> <export>")
+		fmt.Fprintln(os.Stderr, "  resilientctl store import <export> <http://...|redis://...|bolt:path>")
+		fmt.Fprintln(os.Stderr, "  resilientctl simulate [-subscribers n] [-events n] [-interval d] [-churn f] [-replay n] [-seed n]")
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "resilientctl:", err)
+		os.Exit(1)
+	}
+}
+
+// storeDump prints every event of the export at path as a JSON line
+func storeDump(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buffers := resilientsse.NewReplayBuffers(1)
+	if err := buffers.Import(f); err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	enc := json.NewEncoder(out)
+	for _, key := range buffers.Keys() {
+		b := buffers.Get(key)
+		b.Range(func(id uint64, frame []byte) bool {
+			err = enc.Encode(storeEvent{Key: key, Capacity: b.Cap(), ID: id, Frame: string(frame)})
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// storeLoad writes the events in the JSON lines file src as an export to dst
+func storeLoad(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	buffers := resilientsse.NewReplayBuffers(1)
+	dec := json.NewDecoder(in)
+	for line := 1; dec.More(); line++ {
+		var e storeEvent
+		if err := dec.Decode(&e); err != nil {
+			return fmt.Errorf("%s: event %d: %w", src, line, err)
+		}
+		b := buffers.GetWithSize(e.Key, e.Capacity)
+		if e.ID <= b.LastID() {
+			return fmt.Errorf("%s: event %d: id %d does not increase within key %q", src, line, e.ID, e.Key)
+		}
+		b.Add(e.ID, []byte(e.Frame))
+	}
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := buffers.Export(out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
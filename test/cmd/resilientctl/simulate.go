@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"resilient-test/resilientsse"
+	"resilient-test/resilientsse/memtransport"
+)
+
+// clientHeader names the simulated client a request comes from, keying its
+// replay buffer
+const clientHeader = "X-Sim-Client"
+
+// simTopic is the hub topic the simulation publishes to
+const simTopic = "sim"
+
+// simClient is one simulated subscriber, across its reconnects
+type simClient struct {
+	id int
+
+	mu   sync.Mutex
+	conn *memtransport.Conn
+	seen []uint8 // how many times each event was received, by number
+}
+
+// received records the event numbered in e's signals, if any
+func (c *simClient) received(e memtransport.Event) {
+	for _, line := range e.Data {
+		rest, ok := strings.CutPrefix(line, "signals ")
+		if !ok {
+			continue
+		}
+		var signals struct {
+			N int `json:"n"`
+		}
+		if json.Unmarshal([]byte(rest), &signals) == nil && signals.N > 0 {
+			c.mu.Lock()
+			c.seen[signals.N-1]++
+			c.mu.Unlock()
+		}
+	}
+}
+
+// simulate runs the simulate command: subscribers connected over
+// memtransport to a hub topic with per-client replay and sessions, events
+// published to the topic while a share of the subscribers keeps
+// reconnecting, and a check that every subscriber received every event
+// exactly once
+func simulate(args []string) error {
+	fs := flag.NewFlagSet("simulate", flag.ContinueOnError)
+	subscribers := fs.Int("subscribers", 10000, "concurrent subscribers")
+	events := fs.Int("events", 100, "events published")
+	interval := fs.Duration("interval", time.Millisecond, "time between events")
+	churn := fs.Float64("churn", 0.05, "share of subscribers reconnecting between two events")
+	replay := fs.Int("replay", 64, "replay buffer size per subscriber")
+	seed := fs.Uint64("seed", 0, "seed for picking reconnecting subscribers (0 = random)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *subscribers < 1 || *events < 1 {
+		return fmt.Errorf("subscribers and events must be positive")
+	}
+	rng := rand.New(rand.NewPCG(*seed, *seed))
+	if *seed == 0 {
+		rng = rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+	}
+
+	hub := resilientsse.NewHub()
+	buffers := resilientsse.NewReplayBuffers(*replay)
+	sessions := resilientsse.NewMemorySessionStore()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream := resilientsse.New(w, r,
+			resilientsse.WithHub(hub),
+			resilientsse.WithSessions(sessions),
+			resilientsse.WithReplay(buffers.Get(r.Header.Get(clientHeader))))
+		defer stream.Close(nil)
+		if stream.IsClosed() {
+			return
+		}
+		if err := hub.Subscribe(stream, simTopic); err != nil {
+			return
+		}
+		<-stream.Context().Done()
+	})
+
+	start := time.Now()
+	clients := make([]*simClient, *subscribers)
+	var wg sync.WaitGroup
+	for i := range clients {
+		c := &simClient{id: i, seen: make([]uint8, *events)}
+		clients[i] = c
+		wg.Go(func() {
+			c.conn = memtransport.Open(handler, "/sim", memtransport.Options{
+				Header:  http.Header{clientHeader: {strconv.Itoa(c.id)}},
+				OnEvent: c.received,
+			})
+		})
+	}
+	wg.Wait()
+	settle(hub, *subscribers)
+	connected := time.Since(start)
+
+	var reconnects atomic.Int64
+	start = time.Now()
+	for n := 1; n <= *events; n++ {
+		hub.PublishSignals(simTopic, map[string]int{"n": n})
+
+		var churned sync.WaitGroup
+		for range int(*churn * float64(*subscribers)) {
+			c := clients[rng.IntN(len(clients))]
+			churned.Go(func() {
+				c.mu.Lock()
+				conn := c.conn
+				c.conn = nil
+				c.mu.Unlock()
+				if conn == nil {
+					return // picked twice this round
+				}
+
+				next := conn.Reconnect()
+				c.mu.Lock()
+				c.conn = next
+				c.mu.Unlock()
+				reconnects.Add(1)
+			})
+		}
+		churned.Wait()
+		time.Sleep(*interval)
+	}
+	settle(hub, *subscribers)
+	published := time.Since(start)
+
+	var missing, duplicates, incomplete int
+	for _, c := range clients {
+		c.mu.Lock()
+		clientOK := true
+		for _, times := range c.seen {
+			switch {
+			case times == 0:
+				missing++
+				clientOK = false
+			case times > 1:
+				duplicates += int(times) - 1
+				clientOK = false
+			}
+		}
+		c.mu.Unlock()
+		if !clientOK {
+			incomplete++
+		}
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	fmt.Printf("subscribers      %d (connected in %s)\n", *subscribers, connected.Round(time.Millisecond))
+	fmt.Printf("events           %d (published in %s, %.0f deliveries/s)\n", *events, published.Round(time.Millisecond),
+		float64(*subscribers**events)/published.Seconds())
+	fmt.Printf("reconnects       %d\n", reconnects.Load())
+	fmt.Printf("missing          %d\n", missing)
+	fmt.Printf("duplicates       %d\n", duplicates)
+	fmt.Printf("incomplete       %d subscribers\n", incomplete)
+	fmt.Printf("goroutines       %d\n", runtime.NumGoroutine())
+	fmt.Printf("heap in use      %d MiB\n", mem.HeapInuse>>20)
+
+	for _, c := range clients {
+		c.conn.Close()
+	}
+	if missing > 0 || duplicates > 0 {
+		return fmt.Errorf("%d subscribers did not receive every event exactly once", incomplete)
+	}
+	return nil
+}
+
+// settle waits until n streams of hub are subscribed to the topic, and done
+// being caught up on it
+func settle(hub *resilientsse.Hub, n int) {
+	for {
+		subscribed := 0
+		for _, s := range hub.Streams() {
+			if len(hub.Topics(s)) > 0 {
+				subscribed++
+			}
+		}
+		if subscribed >= n {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// Subscribe holds the topic while catching up, so publishing an event
+	// that sends nothing waits for the last catch-up to finish
+	hub.Publish(simTopic, func(*resilientsse.ResilientSSE) error { return nil })
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+
+	"resilient-test/resilientsse"
+	"resilient-test/resilientsse/boltreplay"
+	"resilient-test/resilientsse/redisreplay"
+)
+
+// replayStoreSet is a set of replay stores by key that can be exported and
+// imported
+type replayStoreSet interface {
+	resilientsse.ReplayExporter
+	resilientsse.ReplayImporter
+}
+
+// openStores opens the replay stores named by target:
+//
+//	redis://host:port/db  the stores of a redisreplay.Stores, default prefix
+//	bolt:path             the stores of a boltreplay.Log file
+//
+// and returns a func closing them
+func openStores(target string) (replayStoreSet, func() error, error) {
+	switch {
+	case strings.HasPrefix(target, "redis://"), strings.HasPrefix(target, "rediss://"):
+		opts, err := redis.ParseURL(target)
+		if err != nil {
+			return nil, nil, err
+		}
+		client := redis.NewClient(opts)
+		return redisreplay.NewStores(client, redisreplay.Config{}), client.Close, nil
+	case strings.HasPrefix(target, "bolt:"):
+		l, err := boltreplay.Open(strings.TrimPrefix(target, "bolt:"), boltreplay.Config{CompactInterval: -1})
+		if err != nil {
+			return nil, nil, err
+		}
+		return l, l.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unknown store %q: want http://, redis:// or bolt:", target)
+}
+
+// isServer reports whether target is a running test server's address
+func isServer(target string) bool {
+	return strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://")
+}
+
+// storeExport writes the replay store src, or the one a running test server
+// at src uses, as an export to dst
+func storeExport(src, dst string) error {
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := exportFrom(src, out); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func exportFrom(src string, w io.Writer) error {
+	if isServer(src) {
+		resp, err := http.Get(strings.TrimSuffix(src, "/") + "/api/replay/export")
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", src, resp.Status)
+		}
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+
+	stores, closeStores, err := openStores(src)
+	if err != nil {
+		return err
+	}
+	defer closeStores()
+	return resilientsse.ExportReplay(w, stores)
+}
+
+// storeImport loads the export at src into the replay store dst, or the one
+// a running test server at dst uses
+func storeImport(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	if isServer(dst) {
+		resp, err := http.Post(strings.TrimSuffix(dst, "/")+"/api/replay/import", "application/octet-stream", in)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+			return fmt.Errorf("%s: %s: %s", dst, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return nil
+	}
+
+	stores, closeStores, err := openStores(dst)
+	if err != nil {
+		return err
+	}
+	if err := resilientsse.ImportReplay(in, stores); err != nil {
+		closeStores()
+		return err
+	}
+	return closeStores()
+}
@@ -0,0 +1,14 @@
+//go:build !minimal
+
+package main
+
+// The encodings the compress knob offers. Builds with -tags minimal leave out
+// zstd, along with its dependency (see compression_minimal.go).
+
+import (
+	"resilient-test/resilientsse"
+	"resilient-test/resilientsse/zstdsse"
+)
+
+// compressEncodings are the encodings the compress knob accepts
+var compressEncodings = []resilientsse.Encoding{resilientsse.Gzip, zstdsse.Zstd}
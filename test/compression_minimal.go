@@ -0,0 +1,9 @@
+//go:build minimal
+
+package main
+
+import "resilient-test/resilientsse"
+
+// compressEncodings are the encodings the compress knob accepts: minimal
+// builds don't link zstd
+var compressEncodings = []resilientsse.Encoding{resilientsse.Gzip}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var configFile = flag.String("config", "", "JSON file of scenario default overrides, reloaded on SIGHUP or when it changes (see config.go)")
+
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// liveConfig holds the scenario defaults currently in effect. The config file
+// maps scenario names (or "*" for every scenario) to knobs in query-parameter
+// form, applied on top of the registry defaults:
+//
+//	{
+//	  "*":      {"heartbeat": "5s"},
+//	  "stable": {"interval": "1s", "replay": "200"}
+//	}
+//
+// A reload never drops connections. Open streams pick up the new defaults for
+// any knob their request did not set, where that is safe mid-stream (see
+// streamEvents); connect-time knobs such as delay or failRate only affect new
+// connections.
+type liveConfig struct {
+	mu      sync.RWMutex
+	byPath  map[string]scenarioOpts // by scenario path
+	changed chan struct{}           // closed and replaced on every reload
+}
+
+var config = &liveConfig{changed: make(chan struct{})}
+
+// defaults returns the current defaults for the scenario served at path
+func (c *liveConfig) defaults(path string) scenarioOpts {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.byPath[path]
+}
+
+// reloaded returns a channel closed on the next reload
+func (c *liveConfig) reloaded() <-chan struct{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.changed
+}
+
+// load rebuilds every scenario's defaults from the registry plus the
+// overrides in file (none if file is ""). Nothing changes if file is invalid.
+func (c *liveConfig) load(file string) error {
+	overrides := map[string]map[string]string{}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &overrides); err != nil {
+			return fmt.Errorf("parsing %s: %w", file, err)
+		}
+	}
+
+	known := map[string]bool{"*": true}
+	for _, s := range scenarios {
+		known[s.Name] = true
+	}
+	for name := range overrides {
+		if !known[name] {
+			return fmt.Errorf("%s: unknown scenario %q", file, name)
+		}
+	}
+
+	defaults := map[string]scenarioOpts{}
+	for _, s := range scenarios {
+		q := url.Values{}
+		for k, v := range overrides["*"] {
+			q.Set(k, v)
+		}
+		for k, v := range overrides[s.Name] {
+			q.Set(k, v)
+		}
+		opts, err := parseOptValues(q, s.Defaults)
+		if err != nil {
+			return fmt.Errorf("%s: scenario %q: %w", file, s.Name, err)
+		}
+		defaults[s.Path] = opts
+	}
+
+	c.mu.Lock()
+	c.byPath = defaults
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mu.Unlock()
+	return nil
+}
+
+// watchConfig reloads file on SIGHUP and whenever its modification time or
+// size changes. A file that fails to load is logged and the previous config
+// stays in effect.
+func watchConfig(file string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var lastMod time.Time
+	var lastSize int64
+	if fi, err := os.Stat(file); err == nil {
+		lastMod, lastSize = fi.ModTime(), fi.Size()
+	}
+
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("⚙️  SIGHUP received, reloading %s\n", file)
+		case <-ticker.C:
+			fi, err := os.Stat(file)
+			if err != nil || (fi.ModTime().Equal(lastMod) && fi.Size() == lastSize) {
+				continue
+			}
+			lastMod, lastSize = fi.ModTime(), fi.Size()
+			log.Printf("⚙️  %s changed, reloading\n", file)
+		}
+
+		if err := config.load(file); err != nil {
+			log.Printf("⚠️  Config reload failed, keeping previous config: %v\n", err)
+			continue
+		}
+		if err := renderScenarioPages(); err != nil {
+			log.Printf("⚠️  Re-rendering scenario pages failed: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"resilient-test/resilientsse"
+)
+
+const sessionCookie = "resilient-session"
+
+// connKey identifies the streams one client session holds to one endpoint
+type connKey struct {
+	Session string
+	Path    string
+}
+
+// connStatsTTL is how long the counts of a key without streams are kept for
+// the assertion API, and connSweepInterval how often they are checked
+const (
+	connStatsTTL      = 10 * time.Minute
+	connSweepInterval = time.Minute
+)
+
+// connTracker counts live streams per session and endpoint, flagging a
+// session that holds more than one stream to the same endpoint at a time.
+// A key's counts are dropped connStatsTTL after its last stream closes.
+type connTracker struct {
+	mu        sync.Mutex
+	conns     map[connKey]*connCounts
+	lastSweep time.Time
+}
+
+// connCounts are the streams of one connKey
+type connCounts struct {
+	active     int
+	peak       int
+	duplicates int
+	// closed is when active last dropped to zero
+	closed time.Time
+}
+
+var tracker = &connTracker{conns: map[connKey]*connCounts{}, lastSweep: time.Now()}
+
+// open records a new stream and returns how many streams the key now holds
+func (t *connTracker) open(key connKey) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now := time.Now(); now.Sub(t.lastSweep) >= connSweepInterval {
+		t.sweep(now)
+	}
+	c := t.conns[key]
+	if c == nil {
+		c = &connCounts{}
+		t.conns[key] = c
+	}
+	c.active++
+	c.peak = max(c.peak, c.active)
+	if c.active > 1 {
+		c.duplicates++
+	}
+	return c.active
+}
+
+// close records the end of a stream opened with open
+func (t *connTracker) close(key connKey) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if c := t.conns[key]; c != nil {
+		if c.active--; c.active == 0 {
+			c.closed = time.Now()
+		}
+	}
+}
+
+// sweep drops the keys whose last stream closed over connStatsTTL ago
+func (t *connTracker) sweep(now time.Time) {
+	for key, c := range t.conns {
+		if c.active == 0 && now.Sub(c.closed) > connStatsTTL {
+			delete(t.conns, key)
+		}
+	}
+	t.lastSweep = now
+}
+
+// connStats is one row of the assertion API response
+type connStats struct {
+	Session    string `json:"session"`
+	Path       string `json:"path"`
+	Active     int    `json:"active"`
+	Peak       int    `json:"peak"`
+	Duplicates int    `json:"duplicates"`
+}
+
+// serveAssertions reports per-session stream counts as JSON, so tests can
+// assert a client never held duplicate streams. ?session=current restricts the
+// report to the caller's own session, ?session=<id> to any other.
+func (t *connTracker) serveAssertions(w http.ResponseWriter, r *http.Request) {
+	session := r.URL.Query().Get("session")
+	if session == "current" {
+		session = sessionID(w, r)
+	}
+
+	t.mu.Lock()
+	stats := []connStats{}
+	for key, c := range t.conns {
+		if session != "" && key.Session != session {
+			continue
+		}
+		stats = append(stats, connStats{
+			Session:    key.Session,
+			Path:       key.Path,
+			Active:     c.active,
+			Peak:       c.peak,
+			Duplicates: c.duplicates,
+		})
+	}
+	t.mu.Unlock()
+
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Session != stats[j].Session {
+			return stats[i].Session < stats[j].Session
+		}
+		return stats[i].Path < stats[j].Path
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]any{"connections": stats})
+}
+
+// sessionID returns the client's session from its cookie, issuing a new one
+// if missing. It must run before the response headers are flushed.
+func sessionID(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(sessionCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: id, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	// make the new session visible to anything else reading this request
+	r.AddCookie(&http.Cookie{Name: sessionCookie, Value: id})
+	return id
+}
+
+// sessionKey keys limits by the request's harness session, which
+// trackConnection has made sure it has
+func sessionKey(r *http.Request) string {
+	if c, err := r.Cookie(sessionCookie); err == nil {
+		return c.Value
+	}
+	return resilientsse.KeyBySession(r)
+}
+
+// trackConnection registers the request's stream with tracker until done is called
+func trackConnection(w http.ResponseWriter, r *http.Request, name string) (done func()) {
+	key := connKey{Session: sessionID(w, r), Path: r.URL.Path}
+	if n := tracker.open(key); n > 1 {
+		slog.Warn("duplicate connection", "scenario", name, "session", key.Session, "streams", n)
+	}
+	return func() { tracker.close(key) }
+}
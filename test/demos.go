@@ -0,0 +1,257 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+
+	"resilient-test/resilientsse"
+)
+
+// The demos are small multi-user apps built on resilientsse.Hub, exercising
+// fan-out, presence, replay and reconnection under user-driven traffic. Their
+// pages live in demos/; open one in several tabs.
+//
+// Each room orders its broadcasts with its mutex, and a client that connects
+// or reconnects is sent a snapshot of the room under the same mutex once it
+// is registered with the room's hub, so it never misses or duplicates an
+// update. Streams queue their events (backpressure close), so broadcasting
+// under the mutex never blocks on a slow client; one that falls too far
+// behind is closed, and replay plus the snapshot catch it up when it comes
+// back.
+
+// demoStreamOpts are the knobs demo streams are opened with
+var demoStreamOpts = scenarioOpts{Heartbeat: 5 * time.Second, Replay: 100, Backpressure: "close"}
+
+// chatHistory is how many messages the chat keeps, and shows
+const chatHistory = 50
+
+// maxChatMessage caps the length of a chat message, in bytes
+const maxChatMessage = 500
+
+// demoSignals are the signals the demo pages send with every request
+type demoSignals struct {
+	Name    string `json:"name"`
+	Message string `json:"message"`
+}
+
+// demoRoom is what the demos have in common: a hub of the room's streams and
+// the names of the people in it
+type demoRoom struct {
+	name string
+	hub  *resilientsse.Hub
+
+	// mu guards the room's state and orders its broadcasts
+	mu     sync.Mutex
+	people map[uint64]string // by stream ID
+}
+
+func newDemoRoom(name string) *demoRoom {
+	return &demoRoom{name: name, hub: resilientsse.NewHub(), people: map[uint64]string{}}
+}
+
+// join opens a stream for the request, registered with the room's hub (and
+// the test server's), and sends it the room's state with snapshot once it is
+// in. The caller must call leave when the stream ends.
+func (d *demoRoom) join(w http.ResponseWriter, r *http.Request, snapshot func(s *resilientsse.ResilientSSE)) *resilientsse.ResilientSSE {
+	var signals demoSignals
+	if err := datastar.ReadSignals(r, &signals); err != nil {
+		slog.Warn("ignoring unreadable signals", "demo", d.name, "err", err)
+	}
+
+	streamOpts := demoStreamOpts
+	streamOpts.name = d.name
+	opts := append(streamOpts.streamOptions(w, r), resilientsse.WithHub(d.hub))
+	stream := resilientsse.New(w, r, opts...)
+	if stream.IsClosed() {
+		return stream
+	}
+
+	id := stream.ConnInfo().ID
+	name := strings.TrimSpace(signals.Name)
+	if name == "" {
+		name = fmt.Sprintf("guest-%d", id)
+		stream.MarshalAndPatchSignals(map[string]string{"name": name})
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.people[id] = name
+	snapshot(stream)
+	d.broadcastPresence()
+	return stream
+}
+
+// leave closes the stream and tells everyone else it's gone
+func (d *demoRoom) leave(stream *resilientsse.ResilientSSE) {
+	stream.Close(nil)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.people[stream.ConnInfo().ID]; !ok {
+		return
+	}
+	delete(d.people, stream.ConnInfo().ID)
+	d.broadcastPresence()
+}
+
+// broadcastPresence sends everyone the list of people in the room, counting
+// each name once however many tabs it has open. d.mu must be held.
+func (d *demoRoom) broadcastPresence() {
+	names := []string{}
+	for _, name := range d.people {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	d.hub.BroadcastSignals(map[string]any{"online": len(names), "people": strings.Join(names, ", ")})
+}
+
+// chatMessage is one message in the chat
+type chatMessage struct {
+	ID   int
+	From string
+	Text string
+	At   time.Time
+}
+
+// html renders the message as the element the chat page shows
+func (m chatMessage) html() string {
+	return fmt.Sprintf(`<div id="msg-%d" class="chat-message"><span class="chat-time">%s</span> <b>%s</b> %s</div>`,
+		m.ID, m.At.Format("15:04:05"), html.EscapeString(m.From), html.EscapeString(m.Text))
+}
+
+// chatRoom is the live chat demo. New messages are appended to every page,
+// and the oldest removed, in one patch group.
+type chatRoom struct {
+	*demoRoom
+	messages []chatMessage // guarded by mu
+	nextID   int
+}
+
+var chat = &chatRoom{demoRoom: newDemoRoom("chat")}
+
+// serveStream streams the chat to one client until it goes away
+func (c *chatRoom) serveStream(w http.ResponseWriter, r *http.Request) {
+	stream := c.join(w, r, func(s *resilientsse.ResilientSSE) {
+		var b strings.Builder
+		b.WriteString(`<div id="chat-messages">`)
+		for _, m := range c.messages {
+			b.WriteString(m.html())
+		}
+		b.WriteString(`</div>`)
+		s.PatchElements(b.String())
+	})
+	defer c.leave(stream)
+
+	<-stream.Context().Done()
+}
+
+// serveSend posts the message in the request's signals and clears the
+// sender's input
+func (c *chatRoom) serveSend(w http.ResponseWriter, r *http.Request) {
+	var signals demoSignals
+	if err := datastar.ReadSignals(r, &signals); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	text := strings.TrimSpace(signals.Message)
+	if text == "" || len(text) > maxChatMessage {
+		http.Error(w, fmt.Sprintf("message must be 1-%d bytes", maxChatMessage), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	c.nextID++
+	m := chatMessage{ID: c.nextID, From: cmp.Or(strings.TrimSpace(signals.Name), "anonymous"), Text: text, At: time.Now()}
+	c.messages = append(c.messages, m)
+	var expired int
+	if len(c.messages) > chatHistory {
+		expired = c.messages[0].ID
+		c.messages = c.messages[1:]
+	}
+	sent := c.hub.Broadcast(func(s *resilientsse.ResilientSSE) error {
+		tx := s.Tx()
+		tx.PatchElements(m.html(), datastar.WithSelectorID("chat-messages"), datastar.WithModeAppend())
+		if expired > 0 {
+			tx.RemoveElementByID("msg-" + strconv.Itoa(expired))
+		}
+		return tx.Commit()
+	})
+	c.mu.Unlock()
+	slog.Info("chat message", "from", m.From, "text", m.Text, "sent", sent)
+
+	datastar.NewSSE(w, r).MarshalAndPatchSignals(map[string]string{"message": ""})
+}
+
+// counterBoard is the collaborative counter demo: one shared counter anyone
+// can change, with a small dashboard of who is watching and who touched it
+// last
+type counterBoard struct {
+	*demoRoom
+	value  int // guarded by mu
+	clicks int
+	lastBy string
+}
+
+var counter = &counterBoard{demoRoom: newDemoRoom("counter")}
+
+// signals returns the board's state as signals. c.mu must be held.
+func (c *counterBoard) signals() map[string]any {
+	return map[string]any{"counter": c.value, "clicks": c.clicks, "lastBy": c.lastBy}
+}
+
+// serveStream streams the board to one client until it goes away
+func (c *counterBoard) serveStream(w http.ResponseWriter, r *http.Request) {
+	stream := c.join(w, r, func(s *resilientsse.ResilientSSE) {
+		s.MarshalAndPatchSignals(c.signals())
+	})
+	defer c.leave(stream)
+
+	<-stream.Context().Done()
+}
+
+// serveAdd adds ?delta= (1 by default) to the counter
+func (c *counterBoard) serveAdd(w http.ResponseWriter, r *http.Request) {
+	delta := 1
+	if v := r.URL.Query().Get("delta"); v != "" {
+		var err error
+		if delta, err = strconv.Atoi(v); err != nil {
+			http.Error(w, fmt.Sprintf("invalid delta %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+	var signals demoSignals
+	if err := datastar.ReadSignals(r, &signals); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	c.mu.Lock()
+	c.value += delta
+	c.clicks++
+	c.lastBy = cmp.Or(strings.TrimSpace(signals.Name), "anonymous")
+	c.hub.BroadcastSignals(c.signals())
+	c.mu.Unlock()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerDemos mounts the demo pages and their endpoints
+func registerDemos(mux *http.ServeMux) {
+	mux.Handle("/demos/", http.StripPrefix("/demos/", http.FileServer(http.Dir("demos"))))
+	mux.HandleFunc("GET /api/demos/chat", chat.serveStream)
+	mux.HandleFunc("POST /api/demos/chat/send", chat.serveSend)
+	mux.HandleFunc("GET /api/demos/counter", counter.serveStream)
+	mux.HandleFunc("POST /api/demos/counter/add", counter.serveAdd)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// familyListener is an extra listener used by the address-family scenario.
+// A blackholed listener never completes a TCP handshake (see
+// blackholeListen), so a client that picks that family gets no answer at
+// all, as with an unreachable address, and must fail over to the other.
+type familyListener struct {
+	network   string
+	addr      string
+	blackhole bool
+}
+
+// familyListeners serve the full test server on:
+//   - [::1]:8081 only, for IPv6-only behavior
+//   - localhost:8082 with IPv4 blackholed, so only IPv6 answers
+//   - localhost:8083 with IPv6 blackholed, so only IPv4 answers
+var familyListeners = []familyListener{
+	{network: "tcp6", addr: "[::1]:8081"},
+	{network: "tcp6", addr: "[::1]:8082"},
+	{network: "tcp4", addr: "127.0.0.1:8082", blackhole: true},
+	{network: "tcp4", addr: "127.0.0.1:8083"},
+	{network: "tcp6", addr: "[::1]:8083", blackhole: true},
+}
+
+// familiesStarted is set once startFamilyListeners has run
+var familiesStarted atomic.Bool
+
+// startFamilyListeners starts every familyListener in the background. A
+// listener that cannot bind (e.g. no IPv6 on this host) is logged and skipped.
+func startFamilyListeners(handler http.Handler) {
+	for _, fl := range familyListeners {
+		if fl.blackhole {
+			if err := blackholeListen(fl.network, fl.addr); err != nil {
+				log.Printf("⚠️  Skipping %s blackhole on %s: %v\n", fl.network, fl.addr, err)
+				continue
+			}
+			log.Printf("🕳️  Blackholing %s on %s\n", fl.network, fl.addr)
+			continue
+		}
+
+		ln, err := net.Listen(fl.network, fl.addr)
+		if err != nil {
+			log.Printf("⚠️  Skipping %s listener on %s: %v\n", fl.network, fl.addr, err)
+			continue
+		}
+		log.Printf("🌐 Serving %s on http://%s\n", fl.network, fl.addr)
+		go func() {
+			if err := http.Serve(ln, handler); err != nil {
+				log.Printf("%s listener on %s stopped: %v\n", fl.network, fl.addr, err)
+			}
+		}()
+	}
+	familiesStarted.Store(true)
+}
+
+// familyFallbackDelay is how long probeFamilies gives the preferred family
+// before racing the other, as happy-eyeballs clients do (RFC 8305 suggests
+// 250ms, Go's dialer uses 300ms)
+const familyFallbackDelay = 300 * time.Millisecond
+
+// familyProbe is how a dual-stack listener answered a happy-eyeballs dial
+type familyProbe struct {
+	// Family is the one that answered, IPv6 or IPv4, Addr its address and
+	// Status the HTTP status of a request over the connection
+	Family string `json:"family,omitempty"`
+	Addr   string `json:"addr,omitempty"`
+	Status int    `json:"status,omitempty"`
+	// Ms is how long until the connection was established
+	Ms    int64  `json:"ms"`
+	Error string `json:"error,omitempty"`
+}
+
+// probeFamily dials port over IPv6 and, familyFallbackDelay later, over
+// IPv4, keeps whichever connects first and sends it a request, as a
+// happy-eyeballs client resolving localhost to both would. Against a
+// listener with one family blackholed it must fail over to the other.
+func probeFamily(ctx context.Context, port string) familyProbe {
+	type dialed struct {
+		family string
+		conn   net.Conn
+		err    error
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialed, 2)
+	dial := func(family, network, addr string, delay time.Duration) {
+		select {
+		case <-ctx.Done():
+			results <- dialed{family: family, err: ctx.Err()}
+			return
+		case <-time.After(delay):
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, network, addr)
+		results <- dialed{family, conn, err}
+	}
+
+	start := time.Now()
+	go dial("IPv6", "tcp6", "[::1]:"+port, 0)
+	go dial("IPv4", "tcp4", "127.0.0.1:"+port, familyFallbackDelay)
+
+	var winner dialed
+	var errs []string
+	for range 2 {
+		d := <-results
+		if d.err != nil {
+			errs = append(errs, d.family+": "+d.err.Error())
+			continue
+		}
+		if winner.conn != nil {
+			d.conn.Close()
+			continue
+		}
+		winner = d
+		cancel()
+	}
+	probe := familyProbe{Ms: time.Since(start).Milliseconds()}
+	if winner.conn == nil {
+		probe.Error = strings.Join(errs, "; ")
+		return probe
+	}
+	defer winner.conn.Close()
+	probe.Family, probe.Addr = winner.family, winner.conn.RemoteAddr().String()
+
+	winner.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:"+port+"/api/metrics", nil)
+	req.Close = true
+	if err := req.Write(winner.conn); err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(winner.conn), req)
+	if err != nil {
+		probe.Error = err.Error()
+		return probe
+	}
+	resp.Body.Close()
+	probe.Status = resp.StatusCode
+	return probe
+}
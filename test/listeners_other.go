@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "errors"
+
+// blackholeListen is unsupported off unix: it needs a listening socket with
+// a backlog it can fill
+func blackholeListen(network, addr string) error {
+	return errors.New("blackholing needs a unix system")
+}
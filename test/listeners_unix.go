@@ -0,0 +1,66 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// blackholeListen binds addr and listens on it with the smallest backlog,
+// never accepting, then fills the accept queue with connections of its own.
+// The kernel drops the SYNs of every further client, so their connects go
+// unanswered and time out, as with an unreachable address, instead of
+// completing the handshake and stalling at the HTTP level. The socket is
+// kept until the process exits.
+func blackholeListen(network, addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return err
+	}
+	domain, sa := syscall.AF_INET, syscall.Sockaddr(nil)
+	if ip4 := tcpAddr.IP.To4(); ip4 != nil && network != "tcp6" {
+		sa4 := &syscall.SockaddrInet4{Port: tcpAddr.Port}
+		copy(sa4.Addr[:], ip4)
+		sa = sa4
+	} else {
+		domain = syscall.AF_INET6
+		sa6 := &syscall.SockaddrInet6{Port: tcpAddr.Port}
+		copy(sa6.Addr[:], tcpAddr.IP.To16())
+		sa = sa6
+	}
+
+	fd, err := syscall.Socket(domain, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		return err
+	}
+	if domain == syscall.AF_INET6 {
+		// leave the IPv4 side of the port to the family that answers
+		syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 1)
+	}
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+
+	// a handful of connections fills even a backlog the kernel rounded up;
+	// once one goes unanswered, the queue is full
+	for range 8 {
+		conn, err := net.DialTimeout(network, addr, 200*time.Millisecond)
+		if err != nil {
+			return nil
+		}
+		blackholePlugs = append(blackholePlugs, conn)
+	}
+	return fmt.Errorf("accept queue of %s never filled up", addr)
+}
+
+// blackholePlugs are the connections filling the blackholes' accept queues
+var blackholePlugs []net.Conn
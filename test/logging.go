@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"resilient-test/resilientsse"
+)
+
+var (
+	logFormat = flag.String("log-format", "", "log as text or json key=value records on stderr (default: plain log lines)")
+	logLevel  = flag.String("log-level", "info", "least severe level logged: debug, info, warn or error")
+)
+
+// setupLogging makes slog's default logger, which the scenario streams log
+// through (see scenarioOpts.logger), honour -log-format and -log-level. The
+// log package's output, such as the startup banner, goes through the same
+// handler, at info level.
+func setupLogging() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		return fmt.Errorf("-log-level: %w", err)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "":
+		slog.SetLogLoggerLevel(level)
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, handlerOpts)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts)))
+	default:
+		return fmt.Errorf("-log-format: want text or json, got %q", *logFormat)
+	}
+	return nil
+}
+
+// logger returns the logger of the scenario being served
+func (o scenarioOpts) logger() *slog.Logger {
+	return slog.With("scenario", o.name)
+}
+
+// logSendError logs why a stream's send failed: a client going away or the
+// server closing the stream is routine, a client that stopped reading or an
+// event that couldn't be rendered is worth a look
+func logSendError(logger *slog.Logger, err error) {
+	switch {
+	case errors.Is(err, resilientsse.ErrClientGone):
+		logger.Debug("client gone", "err", err)
+	case errors.Is(err, resilientsse.ErrStreamClosed):
+		logger.Debug("stream closed", "err", err)
+	case errors.Is(err, resilientsse.ErrWriteTimeout):
+		logger.Warn("client stopped reading", "err", err)
+	default:
+		logger.Warn("send failed", "err", err)
+	}
+}
@@ -1,20 +1,57 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
-	"math/rand"
+	"log/slog"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/starfederation/datastar-go/datastar"
+
+	"resilient-test/resilientsse"
 )
 
 const (
 	port = ":8080"
+
+	// drainTimeout bounds a graceful shutdown; drainRetry is the reconnect
+	// delay suggested to clients of drained streams
+	drainTimeout = 10 * time.Second
+	drainRetry   = 2 * time.Second
 )
 
+var families = flag.Bool("families", false, "also serve on IPv6-only and dual-stack addresses with one family blackholed (see listeners.go)")
+
 func main() {
+	flag.Parse()
+	if err := setupLogging(); err != nil {
+		log.Fatal(err)
+	}
+	openConnectionGuard()
+	openReplayBuffers()
+	closeReplayStores := openReplayStores()
+	defer closeReplayStores()
+	closeTracing := openTracing()
+	defer closeTracing()
+
 	mux := http.NewServeMux()
 
 	// Serve static files (HTML, CSS) from current directory
@@ -27,18 +64,102 @@ func main() {
 	// Serve test files from ./tests directory
 	mux.Handle("/tests/", http.StripPrefix("/tests/", http.FileServer(http.Dir("tests"))))
 
-	// Test endpoints - various resilience scenarios
-	mux.HandleFunc("/api/stable", stableSSE)
-	mux.HandleFunc("/api/random-failures", randomFailuresSSE)
-	mux.HandleFunc("/api/delayed-start", delayedStartSSE)
-	mux.HandleFunc("/api/inactivity-test", inactivityTestSSE)
+	// Test endpoints - various resilience scenarios (see scenarios.go)
+	for _, s := range scenarios {
+		mux.HandleFunc(s.Path, s.serve)
+	}
+
+	// Warm-up probe callbacks (see the probe knob in opts.go)
+	mux.Handle("/api/probe", prober)
+
+	// Push an event to every connected client, or to one (see serveBroadcast)
+	mux.HandleFunc("POST /api/broadcast", serveBroadcast)
+	mux.HandleFunc("POST /api/publish", servePublish)
+	go publishClock()
+
+	// Multi-user demo apps (see demos.go)
+	registerDemos(mux)
+
+	// Every endpoint again behind an SSE-aware reverse proxy, /proxy/api/stable
+	// and so on, and a proxy whose upstream is down (see proxyTo)
+	mux.Handle("/proxy/", proxyTo("/proxy", "http://localhost"+port))
+	mux.Handle("/proxy-down/", proxyTo("/proxy-down", "http://127.0.0.1:1"))
+
+	// Assertion API for scenario pages and scripted tests
+	mux.HandleFunc("/api/assertions/connections", tracker.serveAssertions)
+	mux.HandleFunc("/api/dead-letters", serveDeadLetters)
+	mux.Handle("/api/metrics", metrics)
+
+	// Bookmarks for clients going offline (see bookmarks)
+	mux.Handle("/api/bookmark", bookmarks)
+
+	// Acknowledgements pruning replay (see acks)
+	mux.Handle("/api/ack", acks)
+
+	// Drift reports of streams with the checksum knob (see driftMonitor)
+	mux.Handle("POST /api/drift", driftMonitor)
+
+	// Serializers the client can ask streams for (see capabilities)
+	mux.Handle("GET /api/capabilities", capabilities)
+
+	// Replay store export and import (see serveReplayExport)
+	mux.HandleFunc("GET /api/replay/export", serveReplayExport)
+	mux.HandleFunc("POST /api/replay/import", serveReplayImport)
+
+	// Scenario defaults, optionally overridden by -config
+	if err := config.load(*configFile); err != nil {
+		log.Fatal(err)
+	}
+	if *configFile != "" {
+		go watchConfig(*configFile)
+	}
+
+	// Generated per-scenario test pages
+	if err := renderScenarioPages(); err != nil {
+		log.Fatal(err)
+	}
+	mux.HandleFunc("/scenarios/", serveScenarioPage)
+
+	if *families {
+		startFamilyListeners(mux)
+	}
 
 	log.Printf("🚀 Test server starting on http://localhost%s\n", port)
 	log.Printf("📝 Testing resilient library with datastar-go\n")
 	log.Printf("📂 Serving source files from ../src/\n")
-	if err := http.ListenAndServe(port, mux); err != nil {
-		log.Fatal(err)
+	log.Printf("💬 Demos at http://localhost%s/demos/chat.html and /demos/counter.html\n", port)
+
+	srv := &http.Server{Addr: port, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	shutdown(srv)
+}
+
+// shutdown stops accepting connections and drains open streams, telling their
+// clients to reconnect after drainRetry, giving up after drainTimeout
+func shutdown(srv *http.Server) {
+	log.Printf("🛑 Draining %d streams before shutdown\n", drainer.Len())
+
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- srv.Shutdown(ctx) }()
+
+	if err := drainer.Drain(ctx, drainRetry); err != nil {
+		log.Printf("⚠️  %d streams still open after %s\n", drainer.Len(), drainTimeout)
+	}
+	if err := <-shutdownErr; err != nil {
+		log.Printf("⚠️  Shutdown: %v\n", err)
 	}
+	log.Printf("👋 Test server stopped\n")
 }
 
 // serveIndex serves the main HTML test page
@@ -56,144 +177,1117 @@ func serveCSS(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "styles.css")
 }
 
-// stableSSE - reliable connection that never fails
-func stableSSE(w http.ResponseWriter, r *http.Request) {
-	sse := datastar.NewSSE(w, r)
-	count := 0
-	logs := []string{}
+// serveBroadcast patches a broadcast signal, {"broadcast": message}, on every
+// live scenario stream, or with ?conn=<id> (as logged on connect) on just
+// that one, and reports how many streams it reached:
+//
+//	curl -X POST 'localhost:8080/api/broadcast?message=hello'
+func serveBroadcast(w http.ResponseWriter, r *http.Request) {
+	signals := map[string]string{"broadcast": r.URL.Query().Get("message")}
+
+	var sent int
+	if conn := r.URL.Query().Get("conn"); conn != "" {
+		id, err := strconv.ParseUint(conn, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid conn %q", conn), http.StatusBadRequest)
+			return
+		}
+		ok, err := hub.Send(id, func(s *resilientsse.ResilientSSE) error {
+			return s.MarshalAndPatchSignals(signals)
+		})
+		if !ok {
+			http.Error(w, fmt.Sprintf("no stream %d", id), http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			sent = 1
+		}
+	} else {
+		sent, _ = hub.BroadcastSignals(signals)
+	}
+	slog.Info("broadcast", "message", signals["broadcast"], "sent", sent, "streams", hub.Len())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent})
+}
+
+// serveReplayExport writes the replay store the server runs with, in memory,
+// Redis or bbolt, in the export format of resilientsse/export.go:
+//
+//	curl -o replay.export localhost:8080/api/replay/export
+func serveReplayExport(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	if err := resilientsse.ExportReplay(&buf, replayStores()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(buf.Bytes())
+}
+
+// serveReplayImport loads an export into the replay store the server runs
+// with, adding to each key the events newer than its newest:
+//
+//	curl --data-binary @replay.export localhost:8080/api/replay/import
+func serveReplayImport(w http.ResponseWriter, r *http.Request) {
+	err := resilientsse.ImportReplay(r.Body, replayStores())
+	if errors.Is(err, resilientsse.ErrExportFormat) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// servePublish publishes ?message= to the hub topic ?topic= and reports how
+// many subscribers it reached
+func servePublish(w http.ResponseWriter, r *http.Request) {
+	name, message := r.URL.Query().Get("topic"), r.URL.Query().Get("message")
+	if name == "" {
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+	sent := publish(name, message)
+	slog.Info("published", "topic", name, "message", message, "sent", sent)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent})
+}
+
+// deadLetterView is a dead letter as listed by /api/dead-letters
+type deadLetterView struct {
+	Conn       uint64 `json:"conn"`
+	Session    string `json:"session,omitempty"`
+	Path       string `json:"path"`
+	ID         uint64 `json:"id"`
+	Reason     string `json:"reason"`
+	Error      string `json:"error,omitempty"`
+	Replayable bool   `json:"replayable"`
+	At         string `json:"at"`
+	Frames     string `json:"frames"`
+}
+
+// serveDeadLetters lists the events streams failed to deliver, oldest first,
+// with ?session= limiting them to one resilient session
+func serveDeadLetters(w http.ResponseWriter, r *http.Request) {
+	session := r.URL.Query().Get("session")
+	letters := []deadLetterView{}
+	for _, l := range deadLetters.List() {
+		if session != "" && l.Conn.SessionID != session {
+			continue
+		}
+		v := deadLetterView{
+			Conn:       l.Conn.ID,
+			Session:    l.Conn.SessionID,
+			Path:       l.Conn.Path,
+			ID:         l.ID,
+			Reason:     l.Reason.String(),
+			Replayable: l.Replayable,
+			At:         l.At.Format(time.RFC3339Nano),
+			Frames:     string(l.Frames),
+		}
+		if l.Err != nil {
+			v.Error = l.Err.Error()
+		}
+		letters = append(letters, v)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	json.NewEncoder(w).Encode(map[string]any{"letters": letters, "evicted": deadLetters.Evicted()})
+}
+
+// topicCounts numbers the messages published to each topic
+var (
+	topicCountsMu sync.Mutex
+	topicCounts   = map[string]int{}
+)
+
+// topicMessage is a message published to a hub topic, the data subscriber
+// filters and transforms work on
+type topicMessage struct {
+	Topic string
+	N     int
+	Text  string
+}
+
+// publish publishes message to a hub topic, rendered as the topics signal
+// {"topics": {topic: {"n": count, "last": message}}}
+func publish(name, message string) int {
+	topicCountsMu.Lock()
+	topicCounts[name]++
+	m := topicMessage{Topic: name, N: topicCounts[name], Text: message}
+	topicCountsMu.Unlock()
+
+	return hub.PublishData(name, m, func(s *resilientsse.ResilientSSE, data any) error {
+		m := data.(topicMessage)
+		return s.MarshalAndPatchSignals(map[string]any{"topics": map[string]any{m.Topic: map[string]any{"n": m.N, "last": m.Text}}})
+	})
+}
+
+// publishClock publishes the time to the clock topic every second
+func publishClock() {
+	for t := range time.Tick(time.Second) {
+		publish("clock", t.Format("15:04:05"))
+	}
+}
+
+// proxyTo forwards requests under prefix to upstream with the prefix removed,
+// through resilientsse.NewProxy
+func proxyTo(prefix, upstream string) http.Handler {
+	target, err := url.Parse(upstream)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return http.StripPrefix(prefix, resilientsse.NewProxy(target, resilientsse.ProxyConfig{}))
+}
+
+// sessions keeps the count/logs of session-enabled scenarios across reconnects,
+// forgetting sessions unused for an hour
+var sessions = resilientsse.NewMemorySessionStoreWithLimits(resilientsse.SessionLimits{
+	MaxAge:      time.Hour,
+	MaxSessions: 100_000,
+})
+
+// bookmarks is the /api/bookmark endpoint, bookmarking the caller's replay
+// of the scenario endpoint ?stream= for clients going offline. Its secret is
+// drawn at startup, so bookmarks don't outlive the server.
+var bookmarks = resilientsse.NewBookmarks(resilientsse.BookmarkConfig{
+	Secret: []byte(rand.Text()),
+	Key:    bookmarkKey,
+	Store:  scenarioReplayStore,
+})
 
-	sse.PatchElementf(`<div id="stable-feed">Connection established at %s</div>`, time.Now().Format("15:04:05"))
+// bookmarkKey keys /api/bookmark and /api/ack requests by the caller's session
+// cookie and the scenario endpoint ?stream=, as the replay knob keys its store
+func bookmarkKey(r *http.Request) (string, error) {
+	c, err := r.Cookie(sessionCookie)
+	if err != nil || c.Value == "" {
+		return "", errors.New("no session cookie")
+	}
+	stream := r.URL.Query().Get("stream")
+	if stream == "" {
+		return "", errors.New("missing stream")
+	}
+	return replayKey(c.Value, stream), nil
+}
+
+// deliveries remembers the rows the exactly-once scenario sent each session
+var deliveries = resilientsse.NewDeliveries(resilientsse.DeliveryConfig{Metrics: metrics})
+
+// acks is the /api/ack endpoint, pruning the caller's replay of the scenario
+// endpoint ?stream= up to the event it acknowledges, and telling deliveries
+var acks = resilientsse.NewAcks(resilientsse.AckConfig{
+	Key:        bookmarkKey,
+	Store:      scenarioReplayStore,
+	Metrics:    metrics,
+	Deliveries: deliveries,
+})
+
+// stableSSE - reliable connection that never fails, resuming its count after
+// a reconnect
+func stableSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, append(opts.streamOptions(w, r), resilientsse.WithSessions(sessions))...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	if sse.SessionResumed() {
+		sse.PatchElementf(`<div id="stable-feed">Session resumed at %s</div>`, time.Now().Format("15:04:05"))
+		if err := sse.Redeliver(deadLetters.Take(sse.SessionID())...); err != nil {
+			sse.Logger().Warn("redelivering dead letters", "err", err)
+		}
+	} else {
+		sse.PatchElementf(`<div id="stable-feed">Connection established at %s</div>`, time.Now().Format("15:04:05"))
+	}
+
+	streamEvents(sse, opts)
+}
+
+// randomFailuresSSE - random failures on connect and mid-stream
+func randomFailuresSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	// Random failure on connection
+	if opts.rand().Float64() < opts.FailRate {
+		opts.logger().Info("simulating connection failure")
+		http.Error(w, "Random failure", http.StatusServiceUnavailable)
+		return
+	}
+
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	streamEvents(sse, opts)
+}
+
+// delayedStartSSE - delays connection by opts.Delay
+func delayedStartSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	opts.logger().Info("delaying connection", "delay", opts.Delay)
+	time.Sleep(opts.Delay)
+
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	streamEvents(sse, opts)
+}
 
-	ticker := time.NewTicker(500 * time.Millisecond)
+// inactivityTestSSE - stops sending after opts.StallAfter events
+func inactivityTestSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	streamEvents(sse, opts)
+}
+
+// handlerPanicSSE - panics after opts.Count events, as a handler with a bug
+// would. Recover tells the client and closes the stream; mode=before-stream
+// panics before opening it, leaving the scenario's own recovery to answer.
+func handlerPanicSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	if opts.Mode == "before-stream" {
+		panic("simulated handler bug before streaming")
+	}
+
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	streamEvents(sse, opts)
+	if !sse.IsClosed() {
+		panic(fmt.Sprintf("simulated handler bug after %d events", opts.Count))
+	}
+}
+
+// numericSeriesSSE - patches a series of sensor readings, in millidegrees,
+// every tick, in the serializer the client negotiated, if any
+func numericSeriesSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	serializer := "json"
+	if ser := sse.Serializer(); ser != nil {
+		serializer = ser.Name()
+	}
+	sse.Logger().Info("negotiated serializer", "serializer", serializer)
+
+	series := make([]int, 64)
+	for i := range series {
+		series[i] = 20000
+	}
+	ticker := time.NewTicker(opts.Interval)
 	defer ticker.Stop()
 
-	for {
+	for count := 1; ; count++ {
 		select {
-		case <-r.Context().Done():
-			log.Println("[stable] Client disconnected")
+		case <-sse.Context().Done():
+			sse.Logger().Debug("client disconnected", "serializer", serializer, "events", count-1)
 			return
 		case <-ticker.C:
-			count++
-			logMsg := fmt.Sprintf("[%s] Event #%d", time.Now().Format("15:04:05"), count)
-			logs = append(logs, logMsg)
+			for i := range series {
+				series[i] += int((opts.rand().Float64() - 0.5) * 1000)
+			}
+			if err := sse.MarshalAndPatchSignals(map[string]any{"count": count, "series": series}); err != nil {
+				logSendError(sse.Logger(), err)
+				return
+			}
+			if opts.Count > 0 && count >= opts.Count {
+				sse.Logger().Info("closing stream", "serializer", serializer, "events", count)
+				return
+			}
+		}
+	}
+}
 
-			sse.MarshalAndPatchSignals(map[string]any{
-				"count": count,
-				"logs":  logs,
-			})
+// tickerSymbols are the rows of the ticker scenario's table
+var tickerSymbols = []string{
+	"AAPL", "AMZN", "ASML", "AVGO", "COST", "CSCO", "GOOG", "INTC", "META", "MSFT",
+	"NFLX", "NVDA", "ORCL", "PEP", "QCOM", "SAP", "SHOP", "TSLA", "TXN", "UBER",
+}
+
+// tickerSSE - re-renders a table of prices every interval, a few of them
+// changed, for delta encoding to send as diffs
+func tickerSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	sse.Logger().Info("negotiated delta encoding", "delta", sse.DeltaEncoding())
+
+	prices := make([]float64, len(tickerSymbols))
+	for i := range prices {
+		prices[i] = 50 + opts.rand().Float64()*450
+	}
+	ticker := time.NewTicker(opts.Interval)
+	defer ticker.Stop()
+
+	for count := 1; ; count++ {
+		select {
+		case <-sse.Context().Done():
+			sse.Logger().Debug("client disconnected", "events", count-1)
+			return
+		case <-ticker.C:
+			var b strings.Builder
+			fmt.Fprintf(&b, "<div id=\"scenario-view\">\n<table class=\"ticker\">\n<caption>Update %d</caption>\n", count)
+			for i, symbol := range tickerSymbols {
+				change := 0.0
+				if opts.rand().Float64() < 0.2 {
+					change = (opts.rand().Float64() - 0.5) * prices[i] / 50
+					prices[i] += change
+				}
+				class := "flat"
+				if change > 0 {
+					class = "up"
+				} else if change < 0 {
+					class = "down"
+				}
+				fmt.Fprintf(&b, "  <tr class=\"%s\"><th>%s</th><td>%.2f</td><td>%+.2f</td></tr>\n", class, symbol, prices[i], change)
+			}
+			b.WriteString("</table>\n</div>")
+			if err := sse.PatchElements(b.String()); err != nil {
+				logSendError(sse.Logger(), err)
+				return
+			}
+			if opts.Count > 0 && count >= opts.Count {
+				sse.Logger().Info("closing stream", "events", count)
+				return
+			}
 		}
 	}
 }
 
-// randomFailuresSSE - random failures on connect and mid-stream
-func randomFailuresSSE(w http.ResponseWriter, r *http.Request) {
-	// Random failure on connection
-	if rand.Float32() < 0.50 {
-		log.Println("[random-failures] Simulating connection failure")
-		http.Error(w, "Random failure", http.StatusServiceUnavailable)
+// zombieProber's path is never mounted, so its probes can't be answered
+var zombieProber = resilientsse.NewProber("/api/probe-unreachable")
+
+// warmupProbeSSE - requires a warm-up probe before streaming. mode=zombie
+// sends a probe the client can't answer, so every connection times out.
+func warmupProbeSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	streamOpts := opts.streamOptions(w, r)
+	if opts.Mode == "zombie" {
+		streamOpts = append(streamOpts, resilientsse.WithWarmupProbe(zombieProber, opts.Probe))
+	}
+
+	sse := resilientsse.New(w, r, streamOpts...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	if sse.IsClosed() {
+		sse.Logger().Info("dropping connection", "err", sse.Err())
 		return
 	}
+	streamEvents(sse, opts)
+}
 
-	sse := datastar.NewSSE(w, r)
-	count := 0
-	logs := []string{}
+// topicsSSE - subscribes to the hub topics listed by the topics knob. The
+// stream has a session, so a client that reconnects is caught up on what its
+// topics published in between. The match and redact knobs filter and
+// transform the messages for this subscriber only.
+func topicsSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, append(opts.streamOptions(w, r), resilientsse.WithSessions(sessions))...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	if sse.IsClosed() {
+		return
+	}
+
+	var subOpts []resilientsse.SubscribeOption
+	if opts.Match != "" {
+		subOpts = append(subOpts, resilientsse.WithFilter(func(_ *resilientsse.ResilientSSE, e resilientsse.TopicEvent) bool {
+			return strings.Contains(e.Data.(topicMessage).Text, opts.Match)
+		}))
+	}
+	if words := splitList(opts.Redact); len(words) > 0 {
+		subOpts = append(subOpts, resilientsse.WithTransform(func(_ *resilientsse.ResilientSSE, e resilientsse.TopicEvent) any {
+			m := e.Data.(topicMessage)
+			for _, word := range words {
+				m.Text = strings.ReplaceAll(m.Text, word, strings.Repeat("█", utf8.RuneCountInString(word)))
+			}
+			return m
+		}))
+	}
+
+	for _, name := range splitList(opts.Topics) {
+		if err := hub.Subscribe(sse, name, subOpts...); err != nil {
+			sse.Logger().Warn("subscribing", "topic", name, "err", err)
+			return
+		}
+	}
+	sse.Logger().Info("subscribed", "topics", opts.Topics, "session_resumed", sse.SessionResumed())
+
+	<-sse.Context().Done()
+}
+
+// flakyUpstreamSSE - streams a quote from an upstream that fails with
+// probability failRate, through a resilientsse.Source: failures re-send the
+// last good quote flagged stale and back off before retrying
+func flakyUpstreamSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	price := 100.0
+	src := &resilientsse.Source{
+		Signal:   "quote",
+		Interval: opts.Interval,
+		Retry:    resilientsse.ReconnectPolicy{Min: opts.Interval, Max: 8 * opts.Interval, Factor: 2, Jitter: resilientsse.DefaultRetryJitter},
+		Fetch: func(ctx context.Context) (any, error) {
+			if opts.rand().Float64() < opts.FailRate {
+				sse.Logger().Info("upstream fetch failed")
+				return nil, errors.New("upstream unavailable")
+			}
+			price += opts.rand().Float64() - 0.5
+			return math.Round(price*100) / 100, nil
+		},
+	}
+	src.Run(sse)
+}
+
+// envelopeSSE - negotiates the envelope version with each client and patches
+// its count both as count and under that version's key (v1 or v2), so a page
+// can run old and new clients against the same endpoint and tell which
+// envelope each got
+func envelopeSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, append(opts.streamOptions(w, r), resilientsse.WithEnvelope(resilientsse.EnvelopeV2))...)
+	defer sse.Close(nil)
+	defer sse.Recover()
 
-	ticker := time.NewTicker(250 * time.Millisecond)
+	key := fmt.Sprintf("v%d", sse.Envelope())
+	sse.Logger().Info("negotiated envelope", "envelope", key)
+
+	ticker := time.NewTicker(opts.Interval)
 	defer ticker.Stop()
 
-	for {
+	for count := 1; ; count++ {
 		select {
-		case <-r.Context().Done():
-			log.Println("[random-failures] Client disconnected")
+		case <-sse.Context().Done():
+			sse.Logger().Debug("client disconnected", "envelope", key, "events", count-1)
 			return
 		case <-ticker.C:
-			count++
-			logMsg := fmt.Sprintf("[%s] Event #%d", time.Now().Format("15:04:05"), count)
-			logs = append(logs, logMsg)
+			sse.MarshalAndPatchSignals(map[string]any{"count": count, key: map[string]int{"count": count}})
+			if opts.Count > 0 && count >= opts.Count {
+				sse.Logger().Info("closing stream", "envelope", key, "events", count)
+				return
+			}
+		}
+	}
+}
+
+// middlewareSSE - plainFeed, which knows nothing of resilientsse, behind
+// resilientsse.Middleware with the stream knobs: its events get IDs,
+// heartbeats and replay without it changing
+func middlewareSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	resilientsse.Middleware(opts.streamOptions(w, r)...)(plainFeed(opts)).ServeHTTP(w, r)
+}
 
-			if count > 4 {
-				log.Println("[random-failures] Simulating mid-stream failure")
-				http.Error(w, "Random mid-stream failure", http.StatusServiceUnavailable)
+// plainFeed is a datastar handler as an app would write it before adopting
+// resilientsse, counting the events of each connection until it has sent
+// opts.Count
+func plainFeed(opts scenarioOpts) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sse := datastar.NewSSE(w, r)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+
+		for count := 1; ; count++ {
+			select {
+			case <-r.Context().Done():
 				return
+			case <-ticker.C:
+				line := fmt.Sprintf("[%s] Event #%d", time.Now().Format("15:04:05"), count)
+				sse.MarshalAndPatchSignals(map[string]any{"count": count, "logs": map[string]string{strconv.Itoa(count): line}})
+				if opts.Count > 0 && count >= opts.Count {
+					return
+				}
 			}
+		}
+	})
+}
 
-			sse.MarshalAndPatchSignals(map[string]any{
-				"count": count,
-				"logs":  logs,
-			})
-			/*
-				// Randomly disconnect mid-stream
-				if rand.Float32() < 0.15 {
-					failures++
-					log.Println("[random-failures] Simulating silent mid-stream failure")
+// stormEvery is how often /api/reconnect-storm drops all its streams at once
+const stormEvery = 5 * time.Second
+
+// errDeploy ends the streams of a simulated deploy
+var errDeploy = errors.New("simulated deploy")
+
+// stormLimiter lets each harness session reconnect to /api/reconnect-storm
+// about once a second, and all of them together five times a second
+var stormLimiter = resilientsse.NewReconnectLimiter(resilientsse.ReconnectLimitConfig{
+	Rate:        1,
+	Burst:       3,
+	GlobalRate:  5,
+	GlobalBurst: 10,
+	Key:         sessionKey,
+	Metrics:     metrics,
+})
+
+// reconnectStormSSE - every stream is dropped at the same moment, every
+// stormEvery, as in a deploy, and stormLimiter spreads the clients coming back
+// with 429s and jittered Retry-Afters
+func reconnectStormSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	if !stormLimiter.Allow(w, r) {
+		opts.logger().Info("refusing reconnect", "retry_after", w.Header().Get("Retry-After"))
+		return
+	}
+
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	deploy := time.AfterFunc(time.Until(time.Now().Truncate(stormEvery).Add(stormEvery)), func() {
+		sse.Close(errDeploy)
+	})
+	defer deploy.Stop()
+
+	streamEvents(sse, opts)
+}
+
+// concurrentJobs is how many async jobs concurrentWritersSSE runs
+const concurrentJobs = 4
+
+// concurrentWritersSSE - streamEvents ticks on the handler's goroutine while
+// concurrentJobs async jobs push their progress onto the same stream from
+// goroutines of their own, with no lock around the stream: it serializes
+// their writes itself
+func concurrentWritersSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	rng := opts.rand()
+	var jobs sync.WaitGroup
+	defer jobs.Wait()
+	for job := range concurrentJobs {
+		jobs.Go(func() {
+			for step := 1; ; step++ {
+				select {
+				case <-sse.Context().Done():
+					return
+				case <-time.After(opts.Interval/2 + time.Duration(rng.Float64()*float64(opts.Interval))):
+				}
+				err := sse.MarshalAndPatchSignals(map[string]any{
+					"jobs": map[string]string{strconv.Itoa(job): fmt.Sprintf("step %d", step)},
+				})
+				if err != nil {
 					return
 				}
-			*/
+			}
+		})
+	}
+
+	streamEvents(sse, opts)
+}
+
+const (
+	// priorityProgressPerTick is how many progress patches priorityLanesSSE
+	// sends per interval, and priorityMilestoneEvery how many progress
+	// patches it sends per milestone
+	priorityProgressPerTick = 10
+	priorityMilestoneEvery  = 20
+)
+
+// priorityLanesSSE - progress patches on a best-effort lane and numbered
+// milestones on a critical one, on top of streamEvents' ticks, so a client
+// that can't keep up loses progress updates first and never a milestone
+func priorityLanesSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	progress := sse.Lane(resilientsse.PriorityBestEffort)
+	milestones := sse.Lane(resilientsse.PriorityCritical)
+	var lanes sync.WaitGroup
+	defer lanes.Wait()
+	lanes.Go(func() {
+		ticker := time.NewTicker(max(opts.Interval/priorityProgressPerTick, time.Millisecond))
+		defer ticker.Stop()
+		for n := 1; ; n++ {
+			select {
+			case <-sse.Context().Done():
+				return
+			case <-ticker.C:
+			}
+			if err := progress.MarshalAndPatchSignals(map[string]any{"progress": n}); err != nil {
+				return
+			}
+			if n%priorityMilestoneEvery != 0 {
+				continue
+			}
+			err := milestones.MarshalAndPatchSignals(map[string]any{
+				"milestones": map[string]string{strconv.Itoa(n / priorityMilestoneEvery): time.Now().Format("15:04:05.000")},
+			})
+			if err != nil {
+				return
+			}
+		}
+	})
+
+	streamEvents(sse, opts)
+}
+
+// exactlyOnceSSE - appends a row to the #rows list every interval as an
+// exactly-once event. Every connection walks the rows from the first, as an
+// app rebuilding its view on reconnect would, so without exactly-once a
+// client would get the rows it has appended again; instead they are skipped,
+// and only the rows it doesn't have are sent. The stream is keyed by session,
+// as the ack endpoint's are, so reloading the page starts the rows over only
+// once nothing has been acknowledged.
+func exactlyOnceSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	key := replayKey(sessionID(w, r), r.URL.Path)
+	sse := resilientsse.New(w, r, append(opts.streamOptions(w, r), resilientsse.WithExactlyOnce(deliveries, key))...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	for n := 1; opts.Count == 0 || n <= opts.Count; n++ {
+		row := "row-" + strconv.Itoa(n)
+		if !sse.Delivered(row) {
+			select {
+			case <-sse.Context().Done():
+				return
+			case <-time.After(opts.Interval):
+			}
+		}
+		// rows the client has are skipped by the stream itself
+		err := sse.Once(row).PatchElements(
+			fmt.Sprintf(`<li id="%s">Row %d, sent %s</li>`, row, n, time.Now().Format("15:04:05.000")),
+			datastar.WithSelector("#rows"), datastar.WithModeAppend(),
+		)
+		if err != nil {
+			logSendError(sse.Logger(), err)
+			return
+		}
+	}
+	<-sse.Context().Done()
+}
+
+// addressFamiliesSSE - probes the dual-stack -families listeners every
+// interval the way a happy-eyeballs client would (see probeFamily) and
+// patches how each answered into the families signal, on top of
+// streamEvents' ticks: localhost:8082 must answer over IPv6, and
+// localhost:8083, whose IPv6 side is blackholed, over IPv4 after failing
+// over
+func addressFamiliesSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+
+	var probes sync.WaitGroup
+	defer probes.Wait()
+	probes.Go(func() {
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			families := map[string]any{"enabled": familiesStarted.Load()}
+			if familiesStarted.Load() {
+				for _, port := range []string{"8082", "8083"} {
+					probe := probeFamily(sse.Context(), port)
+					sse.Logger().Info("probed address families", "port", port, "family", probe.Family, "ms", probe.Ms, "err", probe.Error)
+					families[port] = probe
+				}
+			}
+			if err := sse.MarshalAndPatchSignals(map[string]any{"families": families}); err != nil {
+				return
+			}
+			select {
+			case <-sse.Context().Done():
+				return
+			case <-ticker.C:
+			}
 		}
+	})
+
+	streamEvents(sse, opts)
+}
+
+// maxLogs caps the logs signal, which would otherwise grow without bound on
+// session-enabled streams
+const maxLogs = 100
+
+// streamState is what streamEvents saves in the stream's session, if it has one
+type streamState struct {
+	Count int      `json:"count"`
+	Logs  []string `json:"logs"`
+}
+
+// logSignals keys the logs by event number, so each tick patches just the new
+// line (and removes the one that fell off the end) instead of the whole slice
+func (st streamState) logSignals() map[string]any {
+	first := st.Count - len(st.Logs) + 1
+	logs := make(map[string]any, len(st.Logs)+1)
+	for i, line := range st.Logs {
+		logs[strconv.Itoa(first+i)] = line
 	}
+	if first > 1 {
+		logs[strconv.Itoa(first-1)] = nil
+	}
+	return logs
 }
 
-// delayedStartSSE - delays connection by 3 seconds
-func delayedStartSSE(w http.ResponseWriter, r *http.Request) {
-	log.Println("[delayed-start] Starting delayed connection...")
-	time.Sleep(3 * time.Second)
+// errMidStreamFailure ends a stream that reached the failAfter knob
+var errMidStreamFailure = errors.New("simulated mid-stream failure")
 
-	sse := datastar.NewSSE(w, r)
+// streamEvents sends count/logs signal changes every opts.Interval until the
+// client disconnects or one of the stop conditions in opts is reached. Streams
+// with a session continue the count and logs of its previous connections; the
+// stop conditions always count this connection's events. On a config reload
+// the stream switches to the new defaults for every knob its request did not
+// set.
+func streamEvents(sse *resilientsse.ResilientSSE, opts scenarioOpts) {
+	logger := sse.Logger()
 	count := 0
-	logs := []string{}
+	state := streamState{Logs: []string{}}
+	if err := sse.LoadSession(&state); err != nil {
+		logger.Warn("starting from zero, session state unreadable", "err", err)
+	}
+	payload := strings.Repeat("x", opts.PayloadSize)
+	reloaded := config.reloaded()
 
-	ticker := time.NewTicker(250 * time.Millisecond)
+	ticker := time.NewTicker(opts.Interval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-r.Context().Done():
-			log.Println("[delayed-start] Client disconnected")
+		case <-sse.Context().Done():
+			logger.Debug("client disconnected", "events", count)
 			return
+		case <-reloaded:
+			reloaded = config.reloaded()
+			r := sse.Request()
+			newOpts, err := parseScenarioOpts(r, config.defaults(r.URL.Path))
+			if err != nil {
+				logger.Warn("keeping previous options", "err", err)
+				continue
+			}
+			newOpts.name, opts = opts.name, newOpts
+			payload = strings.Repeat("x", opts.PayloadSize)
+			ticker.Reset(opts.Interval)
+			sse.SetHeartbeat(opts.Heartbeat)
+			logger.Info("applied reloaded config")
 		case <-ticker.C:
 			count++
-			logMsg := fmt.Sprintf("[%s] Event #%d", time.Now().Format("15:04:05"), count)
-			logs = append(logs, logMsg)
+			state.Count++
+			logMsg := fmt.Sprintf("[%s] Event #%d", time.Now().Format("15:04:05"), state.Count)
+			state.Logs = append(state.Logs, logMsg)
+			if len(state.Logs) > maxLogs {
+				state.Logs = state.Logs[len(state.Logs)-maxLogs:]
+			}
 
-			sse.MarshalAndPatchSignals(map[string]any{
-				"count": count,
-				"logs":  logs,
-			})
+			if opts.FailAfter > 0 && count > opts.FailAfter {
+				logger.Info("simulating mid-stream failure", "events", count-1)
+				sse.Backoff()
+				sse.Close(errMidStreamFailure)
+				return
+			}
+
+			signals := map[string]any{
+				"count": state.Count,
+				"logs":  state.logSignals(),
+			}
+			if opts.PayloadSize > 0 {
+				signals["payload"] = payload
+			}
+			if err := sse.MarshalAndPatchSignalChanges(signals); err != nil {
+				logSendError(logger, err)
+				return
+			}
+			if err := sse.SaveSession(state); err != nil {
+				logger.Warn("saving session", "err", err)
+			}
+
+			if opts.Count > 0 && count >= opts.Count {
+				logger.Info("closing stream", "events", count)
+				return
+			}
+
+			if opts.StallAfter > 0 && count >= opts.StallAfter {
+				logger.Info("stopping events, simulating inactivity", "events", count)
+				// Just hang the connection without sending data
+				<-sse.Context().Done()
+				return
+			}
 		}
 	}
 }
 
-// inactivityTestSSE - stops sending after 3 events
-func inactivityTestSSE(w http.ResponseWriter, r *http.Request) {
-	sse := datastar.NewSSE(w, r)
-	count := 0
-	logs := []string{}
+// duplicateConnectionsSSE - short-lived streams forcing rapid reconnects, so a
+// client racing itself into two open streams shows up in the assertion API
+func duplicateConnectionsSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	streamEvents(sse, opts)
+}
 
-	ticker := time.NewTicker(250 * time.Millisecond)
+// badFramingSSE - misframed SSE responses, selected with ?mode=
+//
+//   - content-length: declares a bogus Content-Length, so the stream is cut
+//     off mid-event once the declared length is reached
+//   - connection-close: sends Connection: close and drops the socket without
+//     terminating the chunked body
+//   - no-chunked: disables chunked transfer, streaming a close-delimited body
+//     with neither Transfer-Encoding nor Content-Length
+//
+// With strict=true every mode sets its headers on the ResponseWriter instead,
+// and the stream refuses to start with a 500.
+func badFramingSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	switch opts.Mode {
+	case "content-length":
+		opts.logger().Info("declaring bogus Content-Length")
+		w.Header().Set("Content-Length", "100")
+	case "connection-close", "no-chunked":
+		if !opts.Strict {
+			badFramingRaw(w, r, opts)
+			return
+		}
+		// the framing badFramingRaw writes, where the stream can see it
+		if opts.Mode == "connection-close" {
+			w.Header().Set("Connection", "close")
+		} else {
+			w.Header().Set("Transfer-Encoding", "identity")
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown mode %q", opts.Mode), http.StatusBadRequest)
+		return
+	}
+
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	if err := sse.Err(); err != nil {
+		opts.logger().Info("stream refused", "err", err)
+		return
+	}
+	streamEvents(sse, opts)
+}
+
+// badFramingRaw hijacks the connection to write framing net/http would refuse to produce
+func badFramingRaw(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	conn, buf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	chunked := opts.Mode == "connection-close"
+	logger := opts.logger().With("mode", opts.Mode, "remote", r.RemoteAddr)
+	logger.Info("writing raw response")
+
+	buf.WriteString("HTTP/1.1 200 OK\r\n")
+	buf.WriteString("Content-Type: text/event-stream\r\n")
+	buf.WriteString("Cache-Control: no-cache\r\n")
+	if chunked {
+		buf.WriteString("Transfer-Encoding: chunked\r\n")
+		buf.WriteString("Connection: close\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	ticker := time.NewTicker(opts.Interval)
 	defer ticker.Stop()
 
-	for {
+	for count := 1; ; count++ {
+		frame := fmt.Sprintf("event: %s\ndata: signals {\"count\":%d}\n\n", datastar.EventTypePatchSignals, count)
+		if chunked {
+			frame = fmt.Sprintf("%x\r\n%s\r\n", len(frame), frame)
+		}
+		buf.WriteString(frame)
+		if err := buf.Flush(); err != nil {
+			logger.Debug("client disconnected", "events", count)
+			return
+		}
+
+		// a chunked body is never terminated: the socket is just dropped
+		if chunked && count >= max(opts.Count, 1) {
+			logger.Info("dropping connection mid-body", "events", count)
+			return
+		}
+
 		select {
 		case <-r.Context().Done():
-			log.Println("[inactivity-test] Client disconnected")
+			logger.Debug("client disconnected", "events", count)
 			return
 		case <-ticker.C:
-			count++
-			logMsg := fmt.Sprintf("[%s] Event #%d", time.Now().Format("15:04:05"), count)
-			logs = append(logs, logMsg)
+		}
+	}
+}
 
-			sse.MarshalAndPatchSignals(map[string]any{
-				"count": count,
-				"logs":  logs,
-			})
+// headerFlipVariants are the header sets /api/header-flip cycles through, one
+// per connection
+var headerFlipVariants = []string{"normal", "content-type", "content-encoding", "cors", "cookie"}
 
-			// Stop after 3 events to trigger inactivity timeout
-			if count >= 3 {
-				log.Println("[inactivity-test] Stopping events (simulating inactivity)")
-				// Just hang the connection without sending data
-				<-r.Context().Done()
-				return
+// headerFlipCookie must be presented on connections in the cookie variant
+const headerFlipCookie = "header-flip-token"
+
+var (
+	headerFlipMu sync.Mutex
+	// headerFlipConns is the index of each session's next variant in mode
+	// cycle; a session back at the first variant has no entry
+	headerFlipConns = map[string]int{}
+)
+
+// setHeaderFlipNext makes i, wrapped around, the index of the session's next
+// variant. headerFlipMu must be held.
+func setHeaderFlipNext(session string, i int) {
+	if i %= len(headerFlipVariants); i == 0 {
+		delete(headerFlipConns, session)
+	} else {
+		headerFlipConns[session] = i
+	}
+}
+
+// headerFlipSSE - changes critical response headers between reconnects, so a
+// client that caches what it learned from the first connection gets caught
+// out. mode=cycle moves each session to the next variant on every connection;
+// any variant name pins it:
+//
+//   - normal: a well-formed stream
+//   - content-type: SSE frames served as text/plain
+//   - content-encoding: declares gzip without compressing the body
+//   - cors: only allows a foreign origin (visible from the -families listeners)
+//   - cookie: rejects the connection with 401 and a Set-Cookie until the
+//     cookie is presented, then streams and clears it again
+func headerFlipSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	variant := opts.Mode
+	if variant == "cycle" {
+		key := sessionID(w, r)
+		headerFlipMu.Lock()
+		i := headerFlipConns[key]
+		variant = headerFlipVariants[i]
+		setHeaderFlipNext(key, i+1)
+		headerFlipMu.Unlock()
+	}
+	opts.logger().Info("serving headers", "variant", variant)
+
+	switch variant {
+	case "normal":
+	case "content-type":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "event: %s\ndata: signals {\"count\":1}\n\n", datastar.EventTypePatchSignals)
+		return
+	case "content-encoding":
+		w.Header().Set("Content-Encoding", "gzip")
+	case "cors":
+		w.Header().Set("Access-Control-Allow-Origin", "https://example.invalid")
+		w.Header().Set("Vary", "Origin")
+	case "cookie":
+		if _, err := r.Cookie(headerFlipCookie); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: headerFlipCookie, Value: "1", Path: "/"})
+			http.Error(w, "cookie required", http.StatusUnauthorized)
+			if opts.Mode == "cycle" {
+				// stay on this variant until the cookie comes back
+				headerFlipMu.Lock()
+				setHeaderFlipNext(sessionID(w, r), slices.Index(headerFlipVariants, variant))
+				headerFlipMu.Unlock()
 			}
+			return
 		}
+		http.SetCookie(w, &http.Cookie{Name: headerFlipCookie, Path: "/", MaxAge: -1})
+	default:
+		http.Error(w, fmt.Sprintf("unknown mode %q", opts.Mode), http.StatusBadRequest)
+		return
 	}
+
+	sse := resilientsse.New(w, r, opts.streamOptions(w, r)...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	streamEvents(sse, opts)
+}
+
+// sessionRotationCookie is the credential cookie session-rotation replaces on
+// every connection
+const sessionRotationCookie = "session-rotation-token"
+
+// rotationCredentials are what a session-rotation session must present on
+// its next connection. Retired sessions were rotated away from, so nothing
+// resumes them; they are forgotten after retiredSessionTTL.
+type rotationCredentials struct {
+	Token   string
+	CSRF    string
+	Retired time.Time
+}
+
+// retiredSessionTTL is how long a retired session keeps being rejected, well
+// beyond any reconnect still presenting it
+const retiredSessionTTL = 10 * time.Minute
+
+var (
+	rotationMu sync.Mutex
+	// rotatedCredentials is keyed by resilient session ID
+	rotatedCredentials = map[string]rotationCredentials{}
+	rotationSwept      = time.Now()
+)
+
+// sweepRetiredSessions forgets the sessions retired over retiredSessionTTL
+// ago, at most once a minute. rotationMu must be held.
+func sweepRetiredSessions(now time.Time) {
+	if now.Sub(rotationSwept) < time.Minute {
+		return
+	}
+	for session, creds := range rotatedCredentials {
+		if !creds.Retired.IsZero() && now.Sub(creds.Retired) > retiredSessionTTL {
+			delete(rotatedCredentials, session)
+		}
+	}
+	rotationSwept = now
+}
+
+// sessionRotationSSE - rotates a session's credentials on every connection,
+// as apps do after re-authentication: a new token cookie, a new csrf signal
+// and, through RotateSession, a new session ID that takes the session's
+// count, replay and topics along. A reconnect presenting anything but the
+// latest credentials is rejected with 403 and its session ended, so the
+// count starting over shows a client that didn't pick them up, and the count
+// carrying on shows the stream kept its place.
+func sessionRotationSSE(w http.ResponseWriter, r *http.Request, opts scenarioOpts) {
+	var presented struct {
+		Session string `json:"resilientSession"`
+		CSRF    string `json:"csrf"`
+	}
+	datastar.ReadSignals(r, &presented)
+	session := cmp.Or(r.Header.Get(resilientsse.SessionHeader), presented.Session)
+	var token string
+	if c, err := r.Cookie(sessionRotationCookie); err == nil {
+		token = c.Value
+	}
+
+	rotationMu.Lock()
+	sweepRetiredSessions(time.Now())
+	want, known := rotatedCredentials[session]
+	stale := known && (!want.Retired.IsZero() || token != want.Token || presented.CSRF != want.CSRF)
+	if stale {
+		delete(rotatedCredentials, session)
+	}
+	rotationMu.Unlock()
+	if stale {
+		opts.logger().Info("rejecting stale credentials", "session", session)
+		sessions.Delete(session)
+		http.SetCookie(w, &http.Cookie{Name: sessionRotationCookie, Path: "/", MaxAge: -1})
+		http.Error(w, "stale credentials", http.StatusForbidden)
+		return
+	}
+
+	creds := rotationCredentials{Token: rand.Text(), CSRF: rand.Text()}
+	http.SetCookie(w, &http.Cookie{Name: sessionRotationCookie, Value: creds.Token, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+
+	sse := resilientsse.New(w, r, append(opts.streamOptions(w, r), resilientsse.WithSessions(sessions))...)
+	defer sse.Close(nil)
+	defer sse.Recover()
+	if sse.IsClosed() {
+		return
+	}
+
+	if sse.SessionResumed() {
+		if _, err := sse.RotateSession(); err != nil {
+			sse.Logger().Warn("rotating session", "err", err)
+			return
+		}
+		sse.Logger().Info("rotated session", "from", session, "last_event_id", sse.LastEventID(), "replayed", sse.Replayed())
+	}
+	rotationMu.Lock()
+	if sse.SessionID() != session {
+		rotatedCredentials[session] = rotationCredentials{Retired: time.Now()}
+	}
+	rotatedCredentials[sse.SessionID()] = creds
+	rotationMu.Unlock()
+	sse.MarshalAndPatchSignals(map[string]string{"csrf": creds.CSRF})
+
+	streamEvents(sse, opts)
 }
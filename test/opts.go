@@ -0,0 +1,617 @@
+package main
+
+import (
+	"cmp"
+	"flag"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"resilient-test/resilientsse"
+)
+
+// scenarioOpts are the knobs shared by every scenario endpoint. Each scenario
+// declares its own defaults, and any of them can be overridden per request
+// through query parameters of the same name, e.g.
+//
+//	/api/random-failures?interval=100ms&failAfter=10&failRate=0.2&seed=42
+type scenarioOpts struct {
+	// Interval between events
+	Interval time.Duration
+	// Count closes the stream after this many events (0 = never)
+	Count int
+	// FailAfter fails the stream mid-way after this many events (0 = never)
+	FailAfter int
+	// StallAfter stops sending, keeping the connection open, after this many events (0 = never)
+	StallAfter int
+	// PayloadSize adds a padding signal of this many bytes to every event
+	PayloadSize int
+	// Seed makes a request's random decisions reproducible (0 = unseeded)
+	Seed int64
+	// FailRate is the probability of rejecting a connection before streaming
+	FailRate float64
+	// Delay before the stream is established
+	Delay time.Duration
+	// Mode selects a variant for scenarios that have several
+	Mode string
+	// Heartbeat sends a keepalive comment after this much idle time (0 = off)
+	Heartbeat time.Duration
+	// Replay keeps this many events per session for Last-Event-ID replay (0 = off)
+	Replay int
+	// Compact sends a client more than this many events behind, or behind what Replay keeps, a
+	// snapshot instead of a replay (0 = off)
+	Compact int
+	// Retry sends a retry directive backing off from this delay (0 = off)
+	Retry time.Duration
+	// Idle closes the stream after this long without events, telling the client to come back
+	// after Retry, or at once without one (0 = off)
+	Idle time.Duration
+	// WriteTimeout ends the stream when a write to the client takes longer than this (0 = off)
+	WriteTimeout time.Duration
+	// Coalesce batches signal patches into one event sent this often (0 = off)
+	Coalesce time.Duration
+	// ResumeAuth is what every resume with a Last-Event-ID is allowed: allow, refresh or reject
+	// ("" = not checked)
+	ResumeAuth string
+	// Probe requires a warm-up probe answered within this long before streaming (0 = off)
+	Probe time.Duration
+	// Chaos lists the frame classes ChaosDelay and ChaosDrop apply to (see chaos.go)
+	Chaos string
+	// ChaosDelay holds back frames of the Chaos classes for this long
+	ChaosDelay time.Duration
+	// ChaosDrop is the probability of dropping a frame of the Chaos classes
+	ChaosDrop float64
+	// Backpressure is the slow-client policy: drop-oldest, coalesce or close ("" = off)
+	Backpressure string
+	// MaxQueue is how many unsent events make a client slow under Backpressure (0 = 64)
+	MaxQueue int
+	// Topics lists the hub topics to subscribe to, for scenarios that publish
+	Topics string
+	// Match only delivers topic messages containing this text (per-subscriber filter)
+	Match string
+	// Redact lists words blanked out of topic messages (per-subscriber transform)
+	Redact string
+	// Compress lists the encodings offered for the stream, preferred first: gzip, zstd (not in minimal builds) ("" = off)
+	Compress string
+	// Strict refuses to start streams on misframed responses (see resilientsse.WithStrictFraming)
+	Strict bool
+	// Checksum sends a checksum of the stream's signals this often, for the client to report drift (0 = off)
+	Checksum time.Duration
+	// Serializers lists the binary signal encodings offered for the stream, preferred first: cbor, msgpack ("" = JSON only)
+	Serializers string
+	// Delta delta-encodes element patches against this many of the last ones sent, for clients that ask (0 = off)
+	Delta int
+
+	// name is the scenario being served, set by scenario.serve for logging
+	name string
+	// rng is the request's random source, seeded from Seed by parseScenarioOpts
+	rng *lockedRand
+}
+
+// scenarioParam is a single knob as shown on the generated scenario pages
+type scenarioParam struct {
+	Name  string
+	Value string
+}
+
+// Params lists the knobs with their values, in query-parameter form
+func (o scenarioOpts) Params() []scenarioParam {
+	params := []scenarioParam{
+		{"interval", o.Interval.String()},
+		{"count", strconv.Itoa(o.Count)},
+		{"failAfter", strconv.Itoa(o.FailAfter)},
+		{"stallAfter", strconv.Itoa(o.StallAfter)},
+		{"payloadSize", strconv.Itoa(o.PayloadSize)},
+		{"seed", strconv.FormatInt(o.Seed, 10)},
+		{"failRate", strconv.FormatFloat(o.FailRate, 'g', -1, 64)},
+		{"delay", o.Delay.String()},
+		{"heartbeat", o.Heartbeat.String()},
+		{"replay", strconv.Itoa(o.Replay)},
+		{"compact", strconv.Itoa(o.Compact)},
+		{"retry", o.Retry.String()},
+		{"idle", o.Idle.String()},
+		{"writeTimeout", o.WriteTimeout.String()},
+		{"coalesce", o.Coalesce.String()},
+		{"probe", o.Probe.String()},
+		{"checksum", o.Checksum.String()},
+		{"delta", strconv.Itoa(o.Delta)},
+	}
+	if o.Mode != "" {
+		params = append(params, scenarioParam{"mode", o.Mode})
+	}
+	if o.Topics != "" {
+		params = append(params, scenarioParam{"topics", o.Topics})
+	}
+	if o.Match != "" {
+		params = append(params, scenarioParam{"match", o.Match})
+	}
+	if o.Redact != "" {
+		params = append(params, scenarioParam{"redact", o.Redact})
+	}
+	if o.ResumeAuth != "" {
+		params = append(params, scenarioParam{"resumeAuth", o.ResumeAuth})
+	}
+	if o.Strict {
+		params = append(params, scenarioParam{"strict", "true"})
+	}
+	params = append(params,
+		scenarioParam{"compress", o.Compress},
+		scenarioParam{"serializers", o.Serializers},
+		scenarioParam{"backpressure", o.Backpressure},
+		scenarioParam{"maxQueue", strconv.Itoa(o.MaxQueue)},
+		scenarioParam{"chaos", o.Chaos},
+		scenarioParam{"chaosDelay", o.ChaosDelay.String()},
+		scenarioParam{"chaosDrop", strconv.FormatFloat(o.ChaosDrop, 'g', -1, 64)},
+	)
+	return params
+}
+
+var (
+	replayMaxBytes = flag.Int64("replay-max-bytes", 0, "cap the frames each replay buffer keeps at this many bytes, evicting the oldest (0 = no cap)")
+	replayMaxAge   = flag.Duration("replay-max-age", 0, "evict replay events older than this (0 = kept until pushed out; -replay-log defaults to 1h)")
+)
+
+// replayBuffers holds the Last-Event-ID replay buffers, one per session and
+// endpoint, within the -replay-max-* limits (see openReplayBuffers)
+var replayBuffers *resilientsse.ReplayBuffers
+
+// replayStoreSet is a set of replay stores by key that can be exported and
+// imported, whichever kind the server runs with (see replayStores)
+type replayStoreSet interface {
+	resilientsse.ReplayExporter
+	resilientsse.ReplayImporter
+}
+
+// openReplayBuffers sets up replayBuffers from the flags
+func openReplayBuffers() {
+	replayBuffers = resilientsse.NewReplayBuffersWithLimits(resilientsse.ReplayLimits{
+		Size:     100,
+		MaxBytes: *replayMaxBytes,
+		MaxAge:   *replayMaxAge,
+		Metrics:  metrics,
+	})
+}
+
+// replayKey keys the replay of a session's stream of an endpoint
+func replayKey(session, path string) string {
+	return session + " " + path
+}
+
+// maxCompactingStores caps compactingStores: the key comes from the client's
+// session cookie, so the least recently used store is dropped to make room
+const maxCompactingStores = 1000
+
+// compactingStores holds the stores of the compact knob by replay key. A
+// key's store is made around its replay store on first use, and keeps the
+// compact value it was made with.
+var (
+	compactingMu     sync.Mutex
+	compactingStores = map[string]*compactingEntry{}
+)
+
+// compactingEntry is a store of compactingStores, and when it was last used
+type compactingEntry struct {
+	store *resilientsse.CompactingStore
+	used  time.Time
+}
+
+// compactingStore returns the compacting store for key, wrapping store
+func compactingStore(key string, store resilientsse.ReplayStore, maxReplay int) *resilientsse.CompactingStore {
+	compactingMu.Lock()
+	defer compactingMu.Unlock()
+
+	e, ok := compactingStores[key]
+	if !ok {
+		if len(compactingStores) >= maxCompactingStores {
+			evictCompactingStore()
+		}
+		e = &compactingEntry{store: resilientsse.NewCompactingStore(store, resilientsse.CompactionConfig{MaxReplay: maxReplay})}
+		compactingStores[key] = e
+	}
+	e.used = time.Now()
+	return e.store
+}
+
+// evictCompactingStore drops the least recently used compacting store; its
+// stream falls back to its replay store. compactingMu must be held.
+func evictCompactingStore() {
+	var oldest string
+	for key, e := range compactingStores {
+		if oldest == "" || e.used.Before(compactingStores[oldest].used) {
+			oldest = key
+		}
+	}
+	delete(compactingStores, oldest)
+}
+
+// scenarioReplayStore returns the store the scenario stream with key replays
+// from: its compacting store if it has one
+func scenarioReplayStore(key string) resilientsse.ReplayStore {
+	compactingMu.Lock()
+	defer compactingMu.Unlock()
+
+	if e, ok := compactingStores[key]; ok {
+		e.used = time.Now()
+		return e.store
+	}
+	return replayStore(key)
+}
+
+// prober answers warm-up probes, mounted at its path in main
+var prober = resilientsse.NewProber("/api/probe")
+
+// backpressurePolicies maps the backpressure knob to resilientsse policies
+var backpressurePolicies = map[string]resilientsse.BackpressurePolicy{
+	"drop-oldest": resilientsse.DropOldest,
+	"coalesce":    resilientsse.CoalesceSignals,
+	"close":       resilientsse.CloseSlow,
+}
+
+// resumeDecisions maps the resumeAuth knob to resilientsse resume decisions
+var resumeDecisions = map[string]resilientsse.ResumeDecision{
+	"allow":   resilientsse.ResumeAllow,
+	"refresh": resilientsse.ResumeRefresh,
+	"reject":  resilientsse.ResumeReject,
+}
+
+// defaultMaxQueue is used by the backpressure knob when maxQueue is 0
+const defaultMaxQueue = 64
+
+// maxRetry caps the delay of the retry knob's backoff
+const maxRetry = 30 * time.Second
+
+// drainer tracks every scenario stream for graceful shutdown (see shutdown in main.go)
+var drainer = resilientsse.NewDrainer()
+
+// hub registers every scenario stream, for /api/broadcast
+var hub = resilientsse.NewHub()
+
+// debugConfig lets any client of the test server put its stream in debug
+// mode (?resilientDebug=1), logging the stream's frames
+var debugConfig = resilientsse.DebugConfig{
+	Allow: func(*http.Request) bool { return true },
+	Tap: func(c resilientsse.ConnInfo, frame []byte) {
+		slog.Info("debug frame", "conn", c.ID, "frame", string(frame))
+	},
+}
+
+// metrics counts every scenario stream's lifecycle, served at /api/metrics
+var metrics = resilientsse.NewMetrics()
+
+var (
+	maxStreams           = flag.Int("max-streams", 0, "refuse scenario streams beyond this many open at once with 503 (0 = no cap)")
+	maxStreamsPerSession = flag.Int("max-streams-per-session", 0, "refuse scenario streams beyond this many open at once per harness session with 503 (0 = no cap)")
+)
+
+// connGuard caps the scenario streams open at once, if -max-streams or
+// -max-streams-per-session ask it to (see openConnectionGuard)
+var connGuard *resilientsse.ConnectionGuard
+
+// openConnectionGuard sets up connGuard from the flags
+func openConnectionGuard() {
+	if *maxStreams > 0 || *maxStreamsPerSession > 0 {
+		connGuard = resilientsse.NewConnectionGuard(resilientsse.ConnectionGuardConfig{
+			Max:       *maxStreams,
+			MaxPerKey: *maxStreamsPerSession,
+			Key:       sessionKey,
+			Metrics:   metrics,
+		})
+	}
+}
+
+// driftMonitor takes the drift reports of streams with the checksum knob,
+// POSTed to /api/drift
+var driftMonitor = resilientsse.NewDriftMonitor(resilientsse.DriftConfig{ReportURL: "/api/drift"})
+
+// capabilities lists every serializer the serializers knob accepts, served at
+// /api/capabilities for the client to pick from
+var capabilities = resilientsse.Capabilities{
+	Serializers: []resilientsse.Serializer{resilientsse.CBOR, resilientsse.MessagePack},
+}
+
+// deadLetters keeps the events streams failed to deliver, listed at
+// /api/dead-letters and redelivered to resuming stable sessions
+var deadLetters = resilientsse.NewDeadLetters(1000)
+
+// streamOptions translates the knobs that configure the resilientsse stream itself
+func (o scenarioOpts) streamOptions(w http.ResponseWriter, r *http.Request) []resilientsse.Option {
+	opts := []resilientsse.Option{
+		resilientsse.WithLogger(o.logger()),
+		resilientsse.WithDrainer(drainer),
+		resilientsse.WithHub(hub),
+		resilientsse.WithDebug(debugConfig),
+		resilientsse.WithDeadLetters(deadLetters.Add),
+		resilientsse.WithMetrics(metrics),
+	}
+	opts = append(opts, traceStream(r)...)
+	if connGuard != nil {
+		opts = append(opts, resilientsse.WithConnectionGuard(connGuard))
+	}
+	if o.Strict {
+		opts = append(opts, resilientsse.WithStrictFraming())
+	}
+	if o.Checksum > 0 {
+		opts = append(opts, resilientsse.WithDriftMonitor(driftMonitor, o.Checksum))
+	}
+	if o.WriteTimeout > 0 {
+		opts = append(opts, resilientsse.WithWriteTimeout(o.WriteTimeout))
+	}
+	if o.Coalesce > 0 {
+		opts = append(opts, resilientsse.WithPatchCoalescing(o.Coalesce))
+	}
+	if o.Heartbeat > 0 {
+		opts = append(opts, resilientsse.WithHeartbeat(o.Heartbeat))
+	}
+	if encodings := splitList(o.Compress); len(encodings) > 0 {
+		var offered []resilientsse.Encoding
+		for _, name := range encodings {
+			offered = append(offered, resilientsse.Encoding(name))
+		}
+		opts = append(opts, resilientsse.WithCompression(offered...))
+	}
+	if names := splitList(o.Serializers); len(names) > 0 {
+		var offered []resilientsse.Serializer
+		for _, name := range names {
+			offered = append(offered, capabilitySerializer(name))
+		}
+		opts = append(opts, resilientsse.WithSerializers(offered...))
+	}
+	if o.Delta > 0 {
+		opts = append(opts, resilientsse.WithDeltaEncoding(o.Delta))
+	}
+	if o.Replay > 0 {
+		key := replayKey(sessionID(w, r), r.URL.Path)
+		store := sizedReplayStore(key, o.Replay)
+		if o.Compact > 0 {
+			store = compactingStore(key, store, o.Compact)
+		}
+		opts = append(opts, resilientsse.WithReplayStore(store))
+		if bm, ok, err := bookmarks.FromRequest(r); err != nil {
+			o.logger().Warn("ignoring bookmark", "err", err)
+		} else if ok && bm.Key == key {
+			opts = append(opts, resilientsse.WithBookmark(bm))
+		}
+	}
+	if o.Retry > 0 {
+		opts = append(opts, resilientsse.WithReconnectPolicy(resilientsse.ReconnectPolicy{
+			Min:    o.Retry,
+			Max:    maxRetry,
+			Factor: 2,
+			Jitter: resilientsse.DefaultRetryJitter,
+		}))
+	}
+	if o.Idle > 0 {
+		opts = append(opts, resilientsse.WithIdleTimeout(o.Idle, o.Retry))
+	}
+	if policy, ok := backpressurePolicies[o.Backpressure]; ok {
+		opts = append(opts, resilientsse.WithBackpressure(resilientsse.Backpressure{
+			MaxQueue: cmp.Or(o.MaxQueue, defaultMaxQueue),
+			Policy:   policy,
+		}))
+	}
+	if decision, ok := resumeDecisions[o.ResumeAuth]; ok {
+		logger := o.logger()
+		opts = append(opts, resilientsse.WithResumeAuthorizer(func(r *http.Request, lastEventID string) resilientsse.ResumeDecision {
+			logger.Info("authorizing resume", "lastEventID", lastEventID, "decision", o.ResumeAuth)
+			return decision
+		}))
+	}
+	if o.Probe > 0 {
+		opts = append(opts, resilientsse.WithWarmupProbe(prober, o.Probe))
+	}
+	return opts
+}
+
+// parseScenarioOpts overrides defaults with any knobs present in the request query
+func parseScenarioOpts(r *http.Request, defaults scenarioOpts) (scenarioOpts, error) {
+	opts, err := parseOptValues(r.URL.Query(), defaults)
+	if err == nil && opts.Seed != 0 {
+		opts.rng = &lockedRand{r: rand.New(rand.NewSource(opts.Seed))}
+	}
+	return opts, err
+}
+
+// parseOptValues overrides defaults with any knobs present in q
+func parseOptValues(q url.Values, defaults scenarioOpts) (scenarioOpts, error) {
+	opts := defaults
+
+	durations := map[string]*time.Duration{
+		"interval":     &opts.Interval,
+		"delay":        &opts.Delay,
+		"heartbeat":    &opts.Heartbeat,
+		"retry":        &opts.Retry,
+		"idle":         &opts.Idle,
+		"writeTimeout": &opts.WriteTimeout,
+		"coalesce":     &opts.Coalesce,
+		"probe":        &opts.Probe,
+		"chaosDelay":   &opts.ChaosDelay,
+		"checksum":     &opts.Checksum,
+	}
+	for name, dst := range durations {
+		if v := q.Get(name); v != "" {
+			d, err := parseDuration(v)
+			if err != nil || d < 0 {
+				return opts, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = d
+		}
+	}
+
+	ints := map[string]*int{
+		"count":       &opts.Count,
+		"failAfter":   &opts.FailAfter,
+		"stallAfter":  &opts.StallAfter,
+		"payloadSize": &opts.PayloadSize,
+		"replay":      &opts.Replay,
+		"compact":     &opts.Compact,
+		"maxQueue":    &opts.MaxQueue,
+		"delta":       &opts.Delta,
+	}
+	for name, dst := range ints {
+		if v := q.Get(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = n
+		}
+	}
+
+	if v := q.Get("seed"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid seed %q", v)
+		}
+		opts.Seed = n
+	}
+
+	probabilities := map[string]*float64{
+		"failRate":  &opts.FailRate,
+		"chaosDrop": &opts.ChaosDrop,
+	}
+	for name, dst := range probabilities {
+		if v := q.Get(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || f > 1 {
+				return opts, fmt.Errorf("invalid %s %q", name, v)
+			}
+			*dst = f
+		}
+	}
+
+	if q.Has("backpressure") {
+		opts.Backpressure = q.Get("backpressure")
+		if _, ok := backpressurePolicies[opts.Backpressure]; !ok && opts.Backpressure != "" {
+			return opts, fmt.Errorf("invalid backpressure %q", opts.Backpressure)
+		}
+	}
+
+	if q.Has("resumeAuth") {
+		opts.ResumeAuth = q.Get("resumeAuth")
+		if _, ok := resumeDecisions[opts.ResumeAuth]; !ok && opts.ResumeAuth != "" {
+			return opts, fmt.Errorf("invalid resumeAuth %q", opts.ResumeAuth)
+		}
+	}
+
+	if q.Has("chaos") {
+		opts.Chaos = q.Get("chaos")
+		for _, t := range splitList(opts.Chaos) {
+			if !chaosTypes[t] {
+				return opts, fmt.Errorf("invalid chaos type %q", t)
+			}
+		}
+	}
+
+	if v := q.Get("mode"); v != "" {
+		opts.Mode = v
+	}
+	if v := q.Get("strict"); v != "" {
+		strict, err := strconv.ParseBool(v)
+		if err != nil {
+			return opts, fmt.Errorf("invalid strict %q", v)
+		}
+		opts.Strict = strict
+	}
+
+	if v := q.Get("topics"); v != "" {
+		opts.Topics = v
+	}
+	if v := q.Get("match"); v != "" {
+		opts.Match = v
+	}
+	if v := q.Get("redact"); v != "" {
+		opts.Redact = v
+	}
+	if v := q.Get("compress"); v != "" {
+		for _, name := range splitList(v) {
+			if !slices.Contains(compressEncodings, resilientsse.Encoding(name)) {
+				return opts, fmt.Errorf("invalid compress %q", v)
+			}
+		}
+		opts.Compress = v
+	}
+	// an empty serializers overrides a scenario's, for comparing with JSON
+	if q.Has("serializers") {
+		v := q.Get("serializers")
+		for _, name := range splitList(v) {
+			if capabilitySerializer(name) == nil {
+				return opts, fmt.Errorf("invalid serializers %q", v)
+			}
+		}
+		opts.Serializers = v
+	}
+
+	if opts.Interval <= 0 {
+		return opts, fmt.Errorf("interval must be positive")
+	}
+	// the chaos writer wraps the stream's compressor, so it could only drop or
+	// hold back compressed bytes, corrupting everything after them
+	if opts.Compress != "" && opts.Chaos != "" && (opts.ChaosDelay > 0 || opts.ChaosDrop > 0) {
+		return opts, fmt.Errorf("chaos can't be combined with compress")
+	}
+
+	return opts, nil
+}
+
+// capabilitySerializer returns the serializer of capabilities named name, or
+// nil
+func capabilitySerializer(name string) resilientsse.Serializer {
+	for _, ser := range capabilities.Serializers {
+		if ser.Name() == name {
+			return ser
+		}
+	}
+	return nil
+}
+
+// splitList splits a comma-separated knob, ignoring blanks
+func splitList(v string) []string {
+	var items []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseDuration accepts Go durations ("250ms", "2s") or plain milliseconds ("250")
+func parseDuration(v string) (time.Duration, error) {
+	if ms, err := strconv.Atoi(v); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// rand returns the random source for this request. A request with a non-zero
+// seed draws the same sequence as every other request with that seed, so its
+// run is reproducible; the source lives and dies with the request.
+func (o scenarioOpts) rand() *lockedRand {
+	if o.rng == nil {
+		return &lockedRand{}
+	}
+	return o.rng
+}
+
+// lockedRand is a concurrency-safe random source; the zero value uses the
+// global math/rand source
+type lockedRand struct {
+	mu sync.Mutex
+	r  *rand.Rand
+}
+
+func (lr *lockedRand) Float64() float64 {
+	if lr.r == nil {
+		return rand.Float64()
+	}
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+	return lr.r.Float64()
+}
@@ -0,0 +1,111 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// ReplayPruner is implemented by replay stores that can drop events a client
+// has acknowledged, ahead of their own retention limits. [ReplayBuffer]'s
+// store and those of the boltreplay and redisreplay packages implement it.
+type ReplayPruner interface {
+	// Prune drops the stored events up to and including id, returning how
+	// many it dropped. The most recent event is always kept, since the
+	// stream's IDs continue after it.
+	Prune(id uint64) (int, error)
+}
+
+// AckConfig configures [Acks]
+type AckConfig struct {
+	// Key returns the key of the stream a request is for. It decides which
+	// stream a client may prune, so it must come from something the client
+	// can't forge, such as its session.
+	Key func(r *http.Request) (string, error)
+	// Store returns the replay store of the stream with key. Stores that
+	// don't implement [ReplayPruner] keep to their own retention limits.
+	Store func(key string) ReplayStore
+	// Metrics, if set, counts the events pruned
+	Metrics *Metrics
+	// Deliveries, if set, is told of every acknowledgement, for the streams
+	// opened [WithExactlyOnce] with it
+	Deliveries *Deliveries
+}
+
+// Acks lets a client acknowledge the events it has processed, so its stream's
+// replay store keeps only what the client could still ask for rather than a
+// fixed window. Mounted as the ack endpoint, it serves POST ?lastEventId=N
+// (or a Last-Event-ID header), pruning the caller's stream up to event N and
+// answering {"lastEventId": N, "pruned": ...}:
+//
+//	acks := resilientsse.NewAcks(resilientsse.AckConfig{...})
+//	mux.Handle("/sse/ack", acks)
+//
+// A client resuming from before an acknowledged event is reported a
+// [ResilientSSE.ReplayGap], so the stream's key should be one client's: if
+// two tabs share it, one acknowledging ahead of the other costs the other a
+// snapshot on its next reconnect.
+//
+// An Acks is safe for concurrent use.
+type Acks struct {
+	c AckConfig
+}
+
+// NewAcks creates an ack endpoint
+func NewAcks(c AckConfig) *Acks {
+	return &Acks{c: c}
+}
+
+// Ack prunes the replay store of the stream with key up to event id,
+// returning how many events were dropped
+func (a *Acks) Ack(key string, id uint64) (int, error) {
+	if a.c.Deliveries != nil {
+		a.c.Deliveries.Ack(key, id)
+	}
+	pruner, ok := a.c.Store(key).(ReplayPruner)
+	if !ok {
+		return 0, nil
+	}
+	pruned, err := pruner.Prune(id)
+	if err != nil {
+		return 0, fmt.Errorf("resilientsse: pruning %q: %w", key, err)
+	}
+	if a.c.Metrics != nil {
+		a.c.Metrics.pruned.Add(int64(pruned))
+	}
+	return pruned, nil
+}
+
+// ServeHTTP prunes the caller's stream up to the event it acknowledges (POST)
+func (a *Acks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := a.c.Key(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lastID := r.Header.Get(LastEventIDHeader)
+	if lastID == "" {
+		lastID = r.URL.Query().Get(LastEventIDParam)
+	}
+	id, err := strconv.ParseUint(lastID, 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid last event ID", http.StatusBadRequest)
+		return
+	}
+	pruned, err := a.Ack(key, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{"lastEventId": id, "pruned": pruned})
+}
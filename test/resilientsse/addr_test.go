@@ -0,0 +1,70 @@
+package resilientsse
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serveOn serves h on a loopback listener of network (tcp4 or tcp6),
+// skipping the test if the family isn't available, and returns its URL
+func serveOn(t *testing.T, network string, h http.Handler) string {
+	t.Helper()
+	addr := map[string]string{"tcp4": "127.0.0.1:0", "tcp6": "[::1]:0"}[network]
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("no %s loopback: %v", network, err)
+	}
+	srv := httptest.NewUnstartedServer(h)
+	srv.Listener.Close()
+	srv.Listener = l
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// A client failing over from one address family to the other resumes where
+// it left off, and each connection is told apart by its own address
+func TestStreamAcrossAddressFamilies(t *testing.T) {
+	buf := NewReplayBuffer(16)
+	var (
+		mu      sync.Mutex
+		remotes []string
+		keys    []string
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := New(w, r, WithReplay(buf))
+		defer s.Close(nil)
+		mu.Lock()
+		remotes = append(remotes, s.ConnInfo().RemoteAddr)
+		keys = append(keys, KeyBySession(r))
+		mu.Unlock()
+		s.PatchSignals([]byte(`{"n":1}`))
+		s.PatchSignals([]byte(`{"n":2}`))
+	})
+	v6 := serveOn(t, "tcp6", h)
+	v4 := serveOn(t, "tcp4", h)
+
+	_, body := getProxied(t, v6+"/feed", nil)
+	if ids := eventIDs(body); !slices.Equal(ids, []uint64{1, 2}) {
+		t.Fatalf("over IPv6 got events %v, want 1 and 2:\n%s", ids, body)
+	}
+	// the client saw event 1 before the IPv6 path went away
+	_, body = getProxied(t, v4+"/feed", resumeHeader(1))
+	if ids := eventIDs(body); !slices.Equal(ids, []uint64{2, 3, 4}) {
+		t.Errorf("resuming over IPv4 got events %v, want 2 replayed then 3 and 4:\n%s", ids, body)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(remotes) != 2 || !strings.HasPrefix(remotes[0], "[::1]:") || !strings.HasPrefix(remotes[1], "127.0.0.1:") {
+		t.Errorf("remote addresses = %q, want the IPv6 then the IPv4 client", remotes)
+	}
+	if !slices.Equal(keys, []string{"ip ::1", "ip 127.0.0.1"}) {
+		t.Errorf("keys = %q, want each client keyed by its bare IP", keys)
+	}
+}
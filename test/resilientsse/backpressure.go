@@ -0,0 +1,383 @@
+package resilientsse
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrSlowClient is the cause reported by [ResilientSSE.Err] when the stream
+// was closed by the [CloseSlow] backpressure policy
+var ErrSlowClient = errors.New("resilientsse: client too slow")
+
+// BackpressurePolicy is what a stream does about a client that can't keep up
+type BackpressurePolicy int
+
+const (
+	// DropOldest discards the oldest unsent events. The client sees a gap in
+	// event IDs, which a reconnect with Last-Event-ID can fill from replay.
+	DropOldest BackpressurePolicy = iota
+	// CoalesceSignals merges runs of unsent signal patches into one, as JSON
+	// merge patches, so the client still converges on the latest signals. If
+	// that isn't enough, the oldest events are dropped.
+	CoalesceSignals
+	// CloseSlow ends the stream with [ErrSlowClient]. The client resumes from
+	// the last event it actually received, so with [WithReplay] it catches up
+	// on reconnect.
+	CloseSlow
+)
+
+// Backpressure configures slow-client detection. A client is slow when more
+// than MaxQueue events are waiting to be written to it, or the oldest has
+// waited longer than MaxLag; a zero limit is not checked.
+type Backpressure struct {
+	MaxQueue int
+	MaxLag   time.Duration
+	Policy   BackpressurePolicy
+}
+
+// closeFlushTimeout bounds how long Close waits for queued events to reach a
+// client before giving up on it
+const closeFlushTimeout = 2 * time.Second
+
+// WithBackpressure decouples the stream from its client: events are queued
+// and written by a background goroutine, so sending never blocks on a stalled
+// reader, and b's policy is applied once the client falls behind. Errors from
+// writing a queued event end the stream rather than being returned by the
+// send. Events sent on a [Lane] are dropped according to its [Priority].
+func WithBackpressure(b Backpressure) Option {
+	return func(o *options) {
+		o.backpressure = &b
+	}
+}
+
+// Dropped returns how many events backpressure has discarded or merged away
+func (s *ResilientSSE) Dropped() int {
+	if s.queue == nil {
+		return 0
+	}
+	s.queue.mu.Lock()
+	defer s.queue.mu.Unlock()
+	return s.queue.dropped
+}
+
+// sendQueue holds the events waiting to be written to a slow client
+type sendQueue struct {
+	mu       sync.Mutex
+	items    []queuedFrames
+	inflight bool
+	dropped  int
+
+	wake      chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	exited    chan struct{}
+}
+
+// queuedFrames is one event group waiting to be written
+type queuedFrames struct {
+	frames   []byte
+	at       time.Time
+	priority Priority
+
+	// signals and id are set for a lone signal patch that can be coalesced
+	signals map[string]any
+	id      string
+
+	// seq and event are set for an event group, for dead-lettering it: its
+	// ID and v1 frames, and whether it is recorded for replay
+	seq        uint64
+	event      []byte
+	replayable bool
+}
+
+// startQueue routes all further writes through a send queue
+func (s *ResilientSSE) startQueue() {
+	s.queue = &sendQueue{
+		wake:    make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		exited:  make(chan struct{}),
+	}
+	s.wg.Go(s.writeQueue)
+}
+
+// send writes frames to the client, or queues them if the stream has a send
+// queue. It is called with s.mu held.
+func (s *ResilientSSE) send(frames ...[]byte) error {
+	return s.sendEvent(0, PriorityNormal, nil, frames...)
+}
+
+// sendEvent is send for the frames of event group seq, whose v1 frames are
+// event, so that they are dead-lettered if backpressure drops them or the
+// stream ends with them queued, and queued at priority. It is called with
+// s.mu held.
+func (s *ResilientSSE) sendEvent(seq uint64, priority Priority, event []byte, frames ...[]byte) error {
+	if s.queue == nil {
+		if err := s.w.writeFrames(frames...); err != nil {
+			return s.failWrite(err)
+		}
+		return nil
+	}
+
+	item := queuedFrames{frames: bytes.Join(frames, nil), at: time.Now(), priority: priority}
+	if event != nil {
+		item.seq, item.event, item.replayable = seq, event, s.opts.replay != nil
+	}
+	if s.opts.backpressure.Policy == CoalesceSignals && priority != PriorityCritical {
+		// the v1 frames: the stream's serializer may have encoded the signals
+		item.signals, item.id = parseSignalsFrame(event)
+	}
+
+	q := s.queue
+	q.mu.Lock()
+	q.items = append(q.items, item)
+	err := s.applyBackpressure()
+	if err != nil {
+		// the stream is closing: the caller is told the group wasn't sent
+		q.items = q.items[:len(q.items)-1]
+	}
+	q.mu.Unlock()
+
+	if err != nil {
+		s.cancel(err)
+		// unblock a write stuck on the stalled client
+		s.w.abort()
+		return s.streamErr()
+	}
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pending reports whether anything is queued or being written
+func (q *sendQueue) pending() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items) > 0 || q.inflight
+}
+
+// slow reports whether the queue is over its limits. q.mu must be held.
+func (q *sendQueue) slow(b *Backpressure) bool {
+	if b.MaxQueue > 0 && len(q.items) > b.MaxQueue {
+		return true
+	}
+	return b.MaxLag > 0 && len(q.items) > 0 && time.Since(q.items[0].at) > b.MaxLag
+}
+
+// applyBackpressure enforces the policy on an over-limit queue, returning
+// ErrSlowClient if the stream must close. q.mu must be held.
+func (s *ResilientSSE) applyBackpressure() error {
+	q, b := s.queue, s.opts.backpressure
+	if !q.slow(b) {
+		return nil
+	}
+
+	if b.Policy == CoalesceSignals {
+		q.coalesce(func(frames []byte) []byte { return s.wrapEnvelope(frames, false, nil) })
+	}
+	s.dropQueued(PriorityBestEffort)
+	if !q.slow(b) {
+		return nil
+	}
+	if b.Policy == CloseSlow {
+		return ErrSlowClient
+	}
+	s.dropQueued(PriorityNormal)
+	if q.slow(b) {
+		// only critical events are left, and they are never dropped
+		return ErrSlowClient
+	}
+	return nil
+}
+
+// dropQueued drops the oldest queued events of priority while the queue is
+// over its limits. q.mu must be held.
+func (s *ResilientSSE) dropQueued(priority Priority) {
+	q, b := s.queue, s.opts.backpressure
+	for q.slow(b) {
+		i := slices.IndexFunc(q.items, func(item queuedFrames) bool { return item.priority == priority })
+		if i < 0 {
+			return
+		}
+		item := q.items[i]
+		q.items = slices.Delete(q.items, i, i+1)
+		q.dropped++
+		if item.event != nil {
+			s.deadLetter(DeadDropped, nil, item.seq, item.event, item.replayable)
+		}
+	}
+}
+
+// coalesce merges adjacent coalescable signal patches, putting merged frames
+// back in the stream's envelope with wrap. q.mu must be held.
+func (q *sendQueue) coalesce(wrap func(frames []byte) []byte) {
+	merged := q.items[:0]
+	for _, item := range q.items {
+		if n := len(merged); n > 0 && item.signals != nil && merged[n-1].signals != nil && item.priority == merged[n-1].priority {
+			if patch, ok := mergePatch(merged[n-1].signals, item.signals); ok {
+				item.signals = patch
+				item.event = signalsFrame(item.id, patch)
+				item.frames = wrap(item.event)
+				merged[n-1] = item
+				q.dropped++
+				continue
+			}
+		}
+		merged = append(merged, item)
+	}
+	q.items = merged
+}
+
+// writeQueue writes queued events until the stream is closed and the queue
+// drained, or a write fails
+func (s *ResilientSSE) writeQueue() {
+	q := s.queue
+	defer close(q.exited)
+
+	for {
+		q.mu.Lock()
+		if len(q.items) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.wake:
+				continue
+			case <-q.closing:
+				if !q.pending() {
+					return
+				}
+				continue
+			}
+		}
+		item := q.items[0]
+		q.items = q.items[1:]
+		q.inflight = true
+		q.mu.Unlock()
+
+		err := s.w.writeFrames(item.frames)
+
+		q.mu.Lock()
+		q.inflight = false
+		q.mu.Unlock()
+
+		if err != nil {
+			if s.ctx.Err() == nil {
+				s.failWrite(err)
+			}
+			s.abandonQueue(item, err)
+			return
+		}
+	}
+}
+
+// abandonQueue dead-letters failed, the group whose write failed, and every
+// group still queued after it
+func (s *ResilientSSE) abandonQueue(failed queuedFrames, err error) {
+	q := s.queue
+	q.mu.Lock()
+	items := q.items
+	q.items = nil
+	q.mu.Unlock()
+
+	if failed.event != nil {
+		s.deadLetter(DeadWriteFailed, err, failed.seq, failed.event, failed.replayable)
+	}
+	for _, item := range items {
+		if item.event != nil {
+			s.deadLetter(DeadAbandoned, s.Err(), item.seq, item.event, item.replayable)
+		}
+	}
+}
+
+// finishQueue lets the queue drain into a healthy client, and aborts the
+// write in progress if the client doesn't take it in time
+func (s *ResilientSSE) finishQueue() {
+	q := s.queue
+	q.closeOnce.Do(func() { close(q.closing) })
+
+	select {
+	case <-q.exited:
+	case <-time.After(closeFlushTimeout):
+		s.w.abort()
+	}
+}
+
+// parseSignalsFrame returns the signals and ID of a frame holding exactly one
+// plain signal patch, or nil if the frame is anything else
+func parseSignalsFrame(frame []byte) (signals map[string]any, id string) {
+	body, ok := bytes.CutSuffix(frame, []byte("\n\n"))
+	if !ok || bytes.Contains(body, []byte("\n\n")) {
+		return nil, ""
+	}
+
+	var data []string
+	for i, line := range bytes.Split(body, []byte("\n")) {
+		switch {
+		case i == 0:
+			if string(line) != "event: datastar-patch-signals" {
+				return nil, ""
+			}
+		case bytes.HasPrefix(line, []byte("id: ")):
+			id = string(line[len("id: "):])
+		case bytes.HasPrefix(line, []byte("data: signals ")):
+			data = append(data, string(line[len("data: signals "):]))
+		case bytes.HasPrefix(line, []byte(EnvelopeField+": ")):
+			// envelope metadata, rewritten when the frame is
+		case len(line) == 0:
+		default:
+			// onlyIfMissing and anything else we can't merge safely
+			return nil, ""
+		}
+	}
+
+	if err := json.Unmarshal([]byte(strings.Join(data, "\n")), &signals); err != nil {
+		return nil, ""
+	}
+	return signals, id
+}
+
+// signalsFrame renders a signal patch event
+func signalsFrame(id string, signals map[string]any) []byte {
+	data, _ := json.Marshal(signals)
+	var b bytes.Buffer
+	b.WriteString("event: datastar-patch-signals\n")
+	if id != "" {
+		b.WriteString("id: " + id + "\n")
+	}
+	b.WriteString("data: signals ")
+	b.Write(data)
+	b.WriteString("\n\n")
+	return b.Bytes()
+}
+
+// mergePatch composes two JSON merge patches into one with the same effect
+// as applying a then b. ok is false where that can't be expressed, namely b
+// merging an object into a key a sets to a non-object.
+func mergePatch(a, b map[string]any) (patch map[string]any, ok bool) {
+	patch = make(map[string]any, len(a)+len(b))
+	for k, v := range a {
+		patch[k] = v
+	}
+	for k, bv := range b {
+		bObj, bIsObj := bv.(map[string]any)
+		av, inA := patch[k]
+		if !bIsObj || !inA {
+			patch[k] = bv
+			continue
+		}
+		aObj, aIsObj := av.(map[string]any)
+		if !aIsObj {
+			return nil, false
+		}
+		if patch[k], ok = mergePatch(aObj, bObj); !ok {
+			return nil, false
+		}
+	}
+	return patch, true
+}
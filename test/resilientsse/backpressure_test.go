@@ -0,0 +1,142 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// stalledStream opens a stream with backpressure b whose client has stopped
+// reading while event 1 is written to it
+func stalledStream(t *testing.T, b Backpressure) (*ResilientSSE, *testWriter) {
+	t.Helper()
+	w := newTestWriter()
+	s := newStream(w, nil, WithBackpressure(b))
+	w.stallWrites()
+	patchRow(t, s, 1)
+	w.waitStalled(t)
+	return s, w
+}
+
+// finish lets the client catch up, closes the stream and returns the IDs of
+// the events the client received
+func finish(s *ResilientSSE, w *testWriter) []uint64 {
+	w.resume()
+	s.Close(nil)
+	return eventIDs(w.String())
+}
+
+func TestBackpressureDropOldest(t *testing.T) {
+	s, w := stalledStream(t, Backpressure{MaxQueue: 2, Policy: DropOldest})
+	for n := 2; n <= 5; n++ {
+		patchRow(t, s, n)
+	}
+
+	if got := s.Dropped(); got != 2 {
+		t.Errorf("Dropped() = %d, want 2", got)
+	}
+	if got, want := finish(s, w), []uint64{1, 4, 5}; !slices.Equal(got, want) {
+		t.Errorf("client received events %v, want %v", got, want)
+	}
+}
+
+func TestBackpressureCloseSlow(t *testing.T) {
+	s, w := stalledStream(t, Backpressure{MaxQueue: 2, Policy: CloseSlow})
+	patchRow(t, s, 2)
+	patchRow(t, s, 3)
+
+	if err := s.PatchElementf(`<li id="row-4">row</li>`); !errors.Is(err, ErrStreamClosed) {
+		t.Errorf("sending to a slow client = %v, want ErrStreamClosed", err)
+	}
+	if err := s.Err(); !errors.Is(err, ErrSlowClient) {
+		t.Errorf("Err() = %v, want ErrSlowClient", err)
+	}
+	if got := finish(s, w); slices.Contains(got, 4) {
+		t.Errorf("client received events %v, want no event 4", got)
+	}
+}
+
+func TestBackpressureLanes(t *testing.T) {
+	s, w := stalledStream(t, Backpressure{MaxQueue: 2, Policy: CloseSlow})
+	bestEffort := s.Lane(PriorityBestEffort)
+	patchRow(t, s, 2)
+	patchRow(t, bestEffort, 3)
+	// best-effort events go first, even under CloseSlow
+	patchRow(t, s, 4)
+	if err := s.Err(); err != nil {
+		t.Fatalf("Err() after dropping a best-effort event = %v, want nil", err)
+	}
+	if got := s.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d, want 1", got)
+	}
+
+	// with no best-effort event left to drop, the policy applies
+	s.PatchElementf(`<li id="row-5">row</li>`)
+	if err := s.Err(); !errors.Is(err, ErrSlowClient) {
+		t.Errorf("Err() = %v, want ErrSlowClient", err)
+	}
+	if got, want := finish(s, w), []uint64{1, 2, 4}; !slices.Equal(got, want) {
+		t.Errorf("client received events %v, want %v", got, want)
+	}
+}
+
+func TestBackpressureCriticalLane(t *testing.T) {
+	s, w := stalledStream(t, Backpressure{MaxQueue: 1, Policy: DropOldest})
+	critical := s.Lane(PriorityCritical)
+	patchRow(t, critical, 2)
+	// the normal event is dropped rather than the critical one before it
+	patchRow(t, s, 3)
+	if err := s.Err(); err != nil {
+		t.Fatalf("Err() after dropping a normal event = %v, want nil", err)
+	}
+
+	// critical events are never dropped: a queue of them closes the stream
+	critical.PatchElementf(`<li id="row-4">row</li>`)
+	if err := s.Err(); !errors.Is(err, ErrSlowClient) {
+		t.Errorf("Err() = %v, want ErrSlowClient", err)
+	}
+	if got, want := finish(s, w), []uint64{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("client received events %v, want %v", got, want)
+	}
+}
+
+func TestBackpressureCoalesceSignals(t *testing.T) {
+	s, w := stalledStream(t, Backpressure{MaxQueue: 1, Policy: CoalesceSignals})
+	s.MarshalAndPatchSignals(map[string]any{"a": 1, "nested": map[string]any{"x": 1}})
+	s.MarshalAndPatchSignals(map[string]any{"b": 2, "nested": map[string]any{"y": 2}})
+
+	if got := s.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d, want 1", got)
+	}
+	ids := finish(s, w)
+	stream := w.String()
+	// the merged patch takes the ID of the newest it replaces
+	if want := []uint64{1, 3}; !slices.Equal(ids, want) {
+		t.Errorf("client received events %v, want %v", ids, want)
+	}
+	want := map[string]any{"a": 1.0, "b": 2.0, "nested": map[string]any{"x": 1.0, "y": 2.0}}
+	if got := signalPatches(t, stream); len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Errorf("signal patches received = %v, want one of %v", got, want)
+	}
+}
+
+// signalPatches returns the signal patches in a stream, in order
+func signalPatches(t *testing.T, stream string) []map[string]any {
+	t.Helper()
+	var patches []map[string]any
+	for line := range strings.Lines(stream) {
+		data, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "data: signals ")
+		if !ok {
+			continue
+		}
+		var patch map[string]any
+		if err := json.Unmarshal([]byte(data), &patch); err != nil {
+			t.Fatalf("invalid signal patch %q: %v", data, err)
+		}
+		patches = append(patches, patch)
+	}
+	return patches
+}
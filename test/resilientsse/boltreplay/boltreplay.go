@@ -0,0 +1,538 @@
+// Package boltreplay keeps resilientsse replay events in an embedded bbolt
+// database file, so replay survives a restart of the process:
+//
+//	events, err := boltreplay.Open("replay.db", boltreplay.Config{
+//		MaxEvents: 1000,
+//		MaxAge:    24 * time.Hour,
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer events.Close()
+//
+//	// in the stream handler
+//	stream := resilientsse.New(w, r,
+//		resilientsse.WithSessions(sessions),
+//		resilientsse.WithReplayStore(events.Get(sessionID)))
+//
+// Each key has a bucket of events, keyed by big-endian event ID and holding
+// the time the event was added (unix ms, big-endian) followed by its frame.
+// The bucket's sequence is the total size of its frames, for MaxBytes.
+// Alongside, a keys bucket holds the ID of each key's newest event and how
+// many events it keeps, so a key whose events have all expired still tells a
+// client that missed them apart from one that is up to date.
+//
+// A Log is a [resilientsse.ReplayExporter] and [resilientsse.ReplayImporter],
+// so its events can be moved to or from other stores with
+// [resilientsse.ExportReplay] and [resilientsse.ImportReplay].
+//
+// Retention by count and size is applied as events are added; events older
+// than MaxAge are never replayed, and are deleted, along with keys left
+// empty, by [Log.Compact], which also rewrites the file when most of it is
+// free pages, since bbolt never shrinks a file by itself.
+package boltreplay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"resilient-test/resilientsse"
+)
+
+// DefaultCompactInterval is how often a [Log] without a CompactInterval is
+// compacted
+const DefaultCompactInterval = 10 * time.Minute
+
+// eventsBucket is the top-level bucket holding a bucket per key
+var eventsBucket = []byte("events")
+
+// keysBucket is the top-level bucket holding, per key, the ID of its newest
+// event and how many events it keeps, both big-endian
+var keysBucket = []byte("keys")
+
+// compactTxSize bounds the transactions the file is rewritten in
+const compactTxSize = 1 << 20
+
+// Config sets the retention of a [Log]. Zero limits are no limit.
+type Config struct {
+	// MaxEvents is how many of its most recent events each key keeps,
+	// unless set per key with [Log.GetWithSize]. Events are counted by ID,
+	// so after an ID jump a key may keep fewer.
+	MaxEvents int
+	// MaxBytes caps the total frame size of each key; the oldest events are
+	// dropped to fit, though never a key's newest event
+	MaxBytes int64
+	// MaxAge is how long an event is kept for replay
+	MaxAge time.Duration
+	// CompactInterval is how often [Log.Compact] runs in the background;
+	// zero means DefaultCompactInterval and a negative value never
+	CompactInterval time.Duration
+	// ErrorLog receives background compaction errors. Nil means the log
+	// package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// Log is a database file of replay events, handing out the [Store] of each
+// key, such as a session ID, the way [resilientsse.ReplayBuffers] does in
+// memory. A Log is safe for concurrent use.
+type Log struct {
+	path string
+	c    Config
+
+	// mu is held exclusively while the file is rewritten
+	mu sync.RWMutex
+	db *bolt.DB
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+var (
+	_ resilientsse.ReplayExporter = (*Log)(nil)
+	_ resilientsse.ReplayImporter = (*Log)(nil)
+)
+
+// Open opens the log in the file at path, creating it if needed, and starts
+// compacting it every CompactInterval. A file can only be open in one Log at
+// a time, even across processes.
+func Open(path string, c Config) (*Log, error) {
+	db, err := openDB(path)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(eventsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(keysBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("boltreplay: initializing %s: %w", path, err)
+	}
+
+	l := &Log{path: path, c: c, db: db, stop: make(chan struct{})}
+	interval := c.CompactInterval
+	if interval == 0 {
+		interval = DefaultCompactInterval
+	}
+	if interval > 0 {
+		l.wg.Go(func() { l.compactEvery(interval) })
+	}
+	return l, nil
+}
+
+func openDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("boltreplay: opening %s: %w", path, err)
+	}
+	return db, nil
+}
+
+// Close stops background compaction and closes the file
+func (l *Log) Close() error {
+	close(l.stop)
+	l.wg.Wait()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.db.Close()
+}
+
+// Get returns the store for key, keeping the configured MaxEvents
+func (l *Log) Get(key string) *Store {
+	return l.GetWithSize(key, l.c.MaxEvents)
+}
+
+// GetWithSize returns the store for key, keeping its size most recent
+// events as they are added through the returned store
+func (l *Log) GetWithSize(key string, size int) *Store {
+	return &Store{log: l, key: []byte(key), maxEvents: uint64(max(size, 0))}
+}
+
+// Delete drops the events kept for key, and the record of its newest event
+func (l *Log) Delete(key string) error {
+	return l.updateTx(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(keysBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		err := tx.Bucket(eventsBucket).DeleteBucket([]byte(key))
+		if err == bolt.ErrBucketNotFound {
+			return nil
+		}
+		return err
+	})
+}
+
+// ExportKeys returns the keys holding events, sorted
+func (l *Log) ExportKeys() ([]string, error) {
+	var keys []string
+	err := l.view(func(events *bolt.Bucket) error {
+		return events.ForEachBucket(func(key []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("boltreplay: listing keys: %w", err)
+	}
+	return keys, nil
+}
+
+// ExportEvents calls fn for each event kept for key that is not older than
+// MaxAge, oldest first, in one read transaction. A key without a size keeps
+// as many events as it has.
+func (l *Log) ExportEvents(key string, fn func(id uint64, frame []byte) error) (int, error) {
+	cutoff := l.cutoff()
+	n := 0
+	var size uint64
+	err := l.viewTx(func(tx *bolt.Tx) error {
+		_, size = keyInfo(tx, []byte(key))
+		b := tx.Bucket(eventsBucket).Bucket([]byte(key))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if eventTime(v) < cutoff {
+				return nil
+			}
+			n++
+			return fn(binary.BigEndian.Uint64(k), v[8:])
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("boltreplay: exporting %q: %w", key, err)
+	}
+	if size > 0 {
+		return int(size), nil
+	}
+	return n, nil
+}
+
+// ImportStore returns the store for key, keeping size events
+func (l *Log) ImportStore(key string, size int) resilientsse.ReplayStore {
+	return l.GetWithSize(key, size)
+}
+
+// Compact deletes the events older than MaxAge and the keys left without
+// events, remembering their newest event, then rewrites the file if at least half of it is free pages.
+// Streams wait for the rewrite.
+func (l *Log) Compact() error {
+	if err := l.expire(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	info, err := os.Stat(l.path)
+	if err != nil {
+		return fmt.Errorf("boltreplay: compacting %s: %w", l.path, err)
+	}
+	if int64(l.db.Stats().FreeAlloc) < info.Size()/2 {
+		return nil
+	}
+
+	tmp := l.path + ".compact"
+	os.Remove(tmp)
+	dst, err := openDB(tmp)
+	if err != nil {
+		return err
+	}
+	if err := bolt.Compact(dst, l.db, compactTxSize); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("boltreplay: compacting %s: %w", l.path, err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("boltreplay: compacting %s: %w", l.path, err)
+	}
+
+	if err := l.db.Close(); err != nil {
+		return fmt.Errorf("boltreplay: compacting %s: %w", l.path, err)
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		err = fmt.Errorf("boltreplay: compacting %s: %w", l.path, err)
+	}
+	// reopen whichever file is now at path, so the log keeps working if the
+	// rename failed
+	db, openErr := openDB(l.path)
+	if openErr != nil {
+		return openErr
+	}
+	l.db = db
+	return err
+}
+
+// compactEvery runs Compact every interval until the log is closed
+func (l *Log) compactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			if err := l.Compact(); err != nil {
+				l.logf("%v", err)
+			}
+		}
+	}
+}
+
+func (l *Log) logf(format string, args ...any) {
+	if l.c.ErrorLog != nil {
+		l.c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// expire deletes the events older than MaxAge, and the keys left empty; the
+// keys bucket still holds their newest event
+func (l *Log) expire() error {
+	cutoff := l.cutoff()
+	return l.update(func(events *bolt.Bucket) error {
+		var empty [][]byte
+		err := events.ForEachBucket(func(key []byte) error {
+			c := events.Bucket(key).Cursor()
+			for k, v := c.First(); k != nil; k, v = c.First() {
+				if eventTime(v) >= cutoff {
+					break
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+			if k, _ := c.First(); k == nil {
+				empty = append(empty, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range empty {
+			if err := events.DeleteBucket(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// cutoff is the unix ms time events must be added at or after to be
+// replayed
+func (l *Log) cutoff() int64 {
+	if l.c.MaxAge <= 0 {
+		return 0
+	}
+	return time.Now().Add(-l.c.MaxAge).UnixMilli()
+}
+
+func (l *Log) view(fn func(events *bolt.Bucket) error) error {
+	return l.viewTx(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(eventsBucket))
+	})
+}
+
+func (l *Log) update(fn func(events *bolt.Bucket) error) error {
+	return l.updateTx(func(tx *bolt.Tx) error {
+		return fn(tx.Bucket(eventsBucket))
+	})
+}
+
+func (l *Log) viewTx(fn func(tx *bolt.Tx) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.db.View(fn)
+}
+
+func (l *Log) updateTx(fn func(tx *bolt.Tx) error) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.db.Update(fn)
+}
+
+// Store is a [resilientsse.ReplayStore] kept in one key of a [Log]
+type Store struct {
+	log       *Log
+	key       []byte
+	maxEvents uint64
+}
+
+var (
+	_ resilientsse.ReplayStore  = (*Store)(nil)
+	_ resilientsse.ReplayPruner = (*Store)(nil)
+)
+
+// Append adds the event, then drops the oldest events beyond the retention
+// limits in the same transaction
+func (s *Store) Append(id uint64, frame []byte) error {
+	err := s.log.updateTx(func(tx *bolt.Tx) error {
+		info := binary.BigEndian.AppendUint64(eventKey(id), s.maxEvents)
+		if err := tx.Bucket(keysBucket).Put(s.key, info); err != nil {
+			return err
+		}
+		b, err := tx.Bucket(eventsBucket).CreateBucketIfNotExists(s.key)
+		if err != nil {
+			return err
+		}
+		v := make([]byte, 8+len(frame))
+		binary.BigEndian.PutUint64(v, uint64(time.Now().UnixMilli()))
+		copy(v[8:], frame)
+		if err := b.Put(eventKey(id), v); err != nil {
+			return err
+		}
+
+		size := b.Sequence() + uint64(len(frame))
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			oldest := binary.BigEndian.Uint64(k)
+			tooMany := s.maxEvents > 0 && oldest+s.maxEvents <= id
+			tooBig := s.log.c.MaxBytes > 0 && size > uint64(s.log.c.MaxBytes)
+			if oldest == id || !tooMany && !tooBig {
+				break
+			}
+			size -= uint64(len(v) - 8)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return b.SetSequence(size)
+	})
+	if err != nil {
+		return fmt.Errorf("boltreplay: adding event %d to %q: %w", id, s.key, err)
+	}
+	return nil
+}
+
+// Prune deletes the key's events up to and including id, keeping at least its
+// newest
+func (s *Store) Prune(id uint64) (int, error) {
+	pruned := 0
+	err := s.log.update(func(events *bolt.Bucket) error {
+		b := events.Bucket(s.key)
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		k, _ := c.Last()
+		if k == nil {
+			return nil
+		}
+		newest := binary.BigEndian.Uint64(k)
+
+		size := b.Sequence()
+		for k, v := c.First(); k != nil; k, v = c.First() {
+			if oldest := binary.BigEndian.Uint64(k); oldest == newest || oldest > id {
+				break
+			}
+			size -= uint64(len(v) - 8)
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			pruned++
+		}
+		return b.SetSequence(size)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("boltreplay: pruning %q: %w", s.key, err)
+	}
+	return pruned, nil
+}
+
+// Since returns the frames of the events after id that are not older than
+// MaxAge, oldest first
+func (s *Store) Since(id uint64) (frames [][]byte, complete bool, err error) {
+	cutoff := s.log.cutoff()
+	err = s.log.viewTx(func(tx *bolt.Tx) error {
+		var c *bolt.Cursor
+		var k, v []byte
+		if b := tx.Bucket(eventsBucket).Bucket(s.key); b != nil {
+			c = b.Cursor()
+			k, v = c.First()
+			for k != nil && eventTime(v) < cutoff {
+				k, v = c.Next()
+			}
+		}
+		if k == nil {
+			// everything has expired, or been compacted away: only a client
+			// that saw the last event missed nothing
+			complete = id >= lastID(tx, s.key)
+			return nil
+		}
+		complete = id+1 >= binary.BigEndian.Uint64(k)
+
+		if before := eventKey(id + 1); string(k) < string(before) {
+			k, v = c.Seek(before)
+		}
+		for ; k != nil; k, v = c.Next() {
+			frames = append(frames, append([]byte(nil), v[8:]...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("boltreplay: reading %q: %w", s.key, err)
+	}
+	return frames, complete, nil
+}
+
+// LastID returns the ID of the newest event added for the key, expired or
+// not, or 0 if there is none
+func (s *Store) LastID() (uint64, error) {
+	var id uint64
+	err := s.log.viewTx(func(tx *bolt.Tx) error {
+		id = lastID(tx, s.key)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("boltreplay: reading %q: %w", s.key, err)
+	}
+	return id, nil
+}
+
+// keyInfo returns the ID of the newest event added for key and how many
+// events it keeps, from the keys bucket
+func keyInfo(tx *bolt.Tx, key []byte) (last, size uint64) {
+	v := tx.Bucket(keysBucket).Get(key)
+	if len(v) < 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(v), binary.BigEndian.Uint64(v[8:])
+}
+
+// lastID returns the ID of the newest event added for key, falling back to
+// its bucket for files written before the keys bucket
+func lastID(tx *bolt.Tx, key []byte) uint64 {
+	last, _ := keyInfo(tx, key)
+	if b := tx.Bucket(eventsBucket).Bucket(key); b != nil {
+		if k, _ := b.Cursor().Last(); k != nil {
+			last = max(last, binary.BigEndian.Uint64(k))
+		}
+	}
+	return last
+}
+
+// eventKey is the bucket key of event id, ordered as the IDs are
+func eventKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// eventTime is when the event stored as v was added, in unix ms
+func eventTime(v []byte) int64 {
+	return int64(binary.BigEndian.Uint64(v))
+}
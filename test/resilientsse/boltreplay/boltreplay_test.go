@@ -0,0 +1,129 @@
+package boltreplay
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openLog(t *testing.T, path string, c Config) *Log {
+	t.Helper()
+	c.CompactInterval = -1
+	l, err := Open(path, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+func appendEvents(t *testing.T, s *Store, from, to uint64) {
+	t.Helper()
+	for id := from; id <= to; id++ {
+		if err := s.Append(id, fmt.Appendf(nil, "event %d\n\n", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func since(t *testing.T, s *Store, id uint64) ([]string, bool) {
+	t.Helper()
+	frames, complete, err := s.Since(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range frames {
+		got = append(got, string(f))
+	}
+	return got, complete
+}
+
+func TestSince(t *testing.T) {
+	l := openLog(t, filepath.Join(t.TempDir(), "replay.db"), Config{})
+	s := l.GetWithSize("session", 3)
+	appendEvents(t, s, 1, 5)
+
+	got, complete := since(t, s, 3)
+	if want := []string{"event 4\n\n", "event 5\n\n"}; !slices.Equal(got, want) || !complete {
+		t.Errorf("Since(3) = %q, %v, want %q, true", got, complete, want)
+	}
+	if got, complete := since(t, s, 1); len(got) != 3 || complete {
+		t.Errorf("Since(1) = %q, %v, want the 3 kept events, incomplete", got, complete)
+	}
+	if got, complete := since(t, s, 5); len(got) != 0 || !complete {
+		t.Errorf("Since(5) = %q, %v, want nothing, complete", got, complete)
+	}
+}
+
+func TestSurvivesReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "replay.db")
+	l, err := Open(path, Config{CompactInterval: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvents(t, l.Get("session"), 1, 3)
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l = openLog(t, path, Config{})
+	if got, complete := since(t, l.Get("session"), 1); len(got) != 2 || !complete {
+		t.Errorf("Since(1) after reopening = %q, %v, want 2 events, complete", got, complete)
+	}
+}
+
+// Compaction deletes a key whose events have all expired; a client that
+// missed some of them must still be told its replay is incomplete
+func TestSinceAfterCompact(t *testing.T) {
+	l := openLog(t, filepath.Join(t.TempDir(), "replay.db"), Config{MaxAge: 10 * time.Millisecond})
+	s := l.Get("session")
+	appendEvents(t, s, 1, 3)
+
+	time.Sleep(30 * time.Millisecond)
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if keys, _ := l.ExportKeys(); len(keys) != 0 {
+		t.Fatalf("keys after compacting = %q, want none", keys)
+	}
+
+	if got, complete := since(t, s, 1); len(got) != 0 || complete {
+		t.Errorf("Since(1) = %q, %v, want nothing, incomplete", got, complete)
+	}
+	if got, complete := since(t, s, 3); len(got) != 0 || !complete {
+		t.Errorf("Since(3) = %q, %v, want nothing, complete", got, complete)
+	}
+	if id, err := s.LastID(); err != nil || id != 3 {
+		t.Errorf("LastID() = %d, %v, want 3", id, err)
+	}
+
+	if err := l.Delete("session"); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := s.LastID(); err != nil || id != 0 {
+		t.Errorf("LastID() after Delete = %d, %v, want 0", id, err)
+	}
+}
+
+func TestExportEventsSize(t *testing.T) {
+	l := openLog(t, filepath.Join(t.TempDir(), "replay.db"), Config{MaxEvents: 100})
+	appendEvents(t, l.GetWithSize("small", 5), 1, 2)
+	appendEvents(t, l.GetWithSize("unbounded", 0), 1, 2)
+
+	for key, want := range map[string]int{"small": 5, "unbounded": 2} {
+		var ids []uint64
+		size, err := l.ExportEvents(key, func(id uint64, frame []byte) error {
+			ids = append(ids, id)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size != want || !slices.Equal(ids, []uint64{1, 2}) {
+			t.Errorf("ExportEvents(%q) = %v, size %d, want [1 2], size %d", key, ids, size, want)
+		}
+	}
+}
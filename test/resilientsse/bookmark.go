@@ -0,0 +1,270 @@
+package resilientsse
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// BookmarkHeader carries a bookmark on bookmark checks and on the stream
+	// request resuming from it
+	BookmarkHeader = "X-Resilient-Bookmark"
+
+	// BookmarkParam is accepted in place of BookmarkHeader, for clients that
+	// cannot set request headers
+	BookmarkParam = "resilientBookmark"
+
+	// ResumeSignal is the signal a stream resumed from a bookmark patches
+	// with how it resumed:
+	//
+	//	{"resilientResume": {"mode": "replay", "from": 41, "replayed": 12}}
+	//
+	// mode "snapshot" means the events the client missed could not all be
+	// replayed, and the app sends it a fresh snapshot instead.
+	ResumeSignal = "resilientResume"
+)
+
+// DefaultBookmarkMaxAge is how long bookmarks are accepted without a MaxAge
+const DefaultBookmarkMaxAge = 24 * time.Hour
+
+var (
+	// ErrBookmarkInvalid is returned for a bookmark that is malformed or was
+	// not signed with the secret
+	ErrBookmarkInvalid = errors.New("resilientsse: invalid bookmark")
+	// ErrBookmarkExpired is returned for a bookmark older than MaxAge
+	ErrBookmarkExpired = errors.New("resilientsse: bookmark expired")
+)
+
+// Bookmark is a client's place in a stream, kept while it is offline: the
+// key of the stream (whatever its replay store is kept under, such as a
+// session ID) and the ID of the last event the client received
+type Bookmark struct {
+	Key     string    `json:"k"`
+	EventID uint64    `json:"id"`
+	Issued  time.Time `json:"-"`
+}
+
+// BookmarkConfig configures [Bookmarks]
+type BookmarkConfig struct {
+	// Secret signs bookmarks. It must be the same on every instance, and
+	// across restarts, for bookmarks to outlive the process that issued them.
+	Secret []byte
+	// MaxAge is how long a bookmark is accepted; zero means
+	// DefaultBookmarkMaxAge
+	MaxAge time.Duration
+	// Key returns the key of the stream a request is for. It decides which
+	// stream a client may bookmark, so it must come from something the client
+	// can't forge, such as its session.
+	Key func(r *http.Request) (string, error)
+	// Store returns the replay store of the stream with key
+	Store func(key string) ReplayStore
+}
+
+// Bookmarks lets a client that goes offline for longer than a reconnect,
+// typically through a service worker, come back to a stream where it left
+// it. Mounted as the bookmark endpoint, it serves:
+//
+//   - POST ?lastEventId=N (or a Last-Event-ID header): a signed bookmark for
+//     event N of the caller's stream, {"bookmark": "...", "lastEventId": N}
+//   - GET with the bookmark in [BookmarkHeader] or [BookmarkParam]: how far
+//     the stream has moved on, {"lastEventId": ..., "behind": ..., "resume":
+//     "replay"|"snapshot"}, with an ETag so a service worker polling with
+//     If-None-Match gets 304 Not Modified until there is something new. An
+//     expired bookmark gets 410 Gone, and an invalid one 400.
+//
+// The stream request presents the bookmark the same way, and the handler
+// resumes from it with [WithBookmark]:
+//
+//	bookmarks := resilientsse.NewBookmarks(resilientsse.BookmarkConfig{...})
+//	mux.Handle("/sse/bookmark", bookmarks)
+//	...
+//	opts := []resilientsse.Option{resilientsse.WithReplayStore(store)}
+//	if bm, ok, err := bookmarks.FromRequest(r); ok && err == nil && bm.Key == key {
+//		opts = append(opts, resilientsse.WithBookmark(bm))
+//	}
+//	stream := resilientsse.New(w, r, opts...)
+//
+// A Bookmarks is safe for concurrent use.
+type Bookmarks struct {
+	c BookmarkConfig
+}
+
+// NewBookmarks creates a bookmark endpoint
+func NewBookmarks(c BookmarkConfig) *Bookmarks {
+	if c.MaxAge <= 0 {
+		c.MaxAge = DefaultBookmarkMaxAge
+	}
+	return &Bookmarks{c: c}
+}
+
+// Issue returns a signed bookmark for event id of the stream with key
+func (b *Bookmarks) Issue(key string, id uint64) string {
+	payload, _ := json.Marshal(struct {
+		Bookmark
+		Issued int64 `json:"t"`
+	}{Bookmark{Key: key, EventID: id}, time.Now().Unix()})
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(b.sign(payload))
+}
+
+// Parse checks a bookmark's signature and age and returns it
+func (b *Bookmarks) Parse(token string) (Bookmark, error) {
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return Bookmark{}, ErrBookmarkInvalid
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Bookmark{}, ErrBookmarkInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, b.sign(payload)) {
+		return Bookmark{}, ErrBookmarkInvalid
+	}
+
+	var bm struct {
+		Bookmark
+		Issued int64 `json:"t"`
+	}
+	if err := json.Unmarshal(payload, &bm); err != nil {
+		return Bookmark{}, ErrBookmarkInvalid
+	}
+	bm.Bookmark.Issued = time.Unix(bm.Issued, 0)
+	if time.Since(bm.Bookmark.Issued) > b.c.MaxAge {
+		return Bookmark{}, ErrBookmarkExpired
+	}
+	return bm.Bookmark, nil
+}
+
+// FromRequest returns the bookmark r presents, with ok false if it presents
+// none
+func (b *Bookmarks) FromRequest(r *http.Request) (bm Bookmark, ok bool, err error) {
+	token := r.Header.Get(BookmarkHeader)
+	if token == "" {
+		token = r.URL.Query().Get(BookmarkParam)
+	}
+	if token == "" {
+		return Bookmark{}, false, nil
+	}
+	bm, err = b.Parse(token)
+	return bm, true, err
+}
+
+func (b *Bookmarks) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, b.c.Secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// ServeHTTP issues bookmarks (POST) and reports how far a bookmarked stream
+// has moved on (GET)
+func (b *Bookmarks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := b.c.Key(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		b.issue(w, r, key)
+	case http.MethodGet, http.MethodHead:
+		b.check(w, r, key)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// issue serves a bookmark for the caller's stream
+func (b *Bookmarks) issue(w http.ResponseWriter, r *http.Request, key string) {
+	lastID := r.Header.Get(LastEventIDHeader)
+	if lastID == "" {
+		lastID = r.URL.Query().Get(LastEventIDParam)
+	}
+	id, err := strconv.ParseUint(lastID, 10, 64)
+	if err != nil {
+		http.Error(w, "missing or invalid last event ID", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]any{"bookmark": b.Issue(key, id), "lastEventId": id})
+}
+
+// check serves how far the bookmarked stream has moved on, revalidated by
+// ETag
+func (b *Bookmarks) check(w http.ResponseWriter, r *http.Request, key string) {
+	bm, ok, err := b.FromRequest(r)
+	switch {
+	case !ok:
+		http.Error(w, "missing bookmark", http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrBookmarkExpired):
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case bm.Key != key:
+		http.Error(w, "bookmark is for another stream", http.StatusForbidden)
+		return
+	}
+
+	store := b.c.Store(key)
+	last, err := store.LastID()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading stream: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	etag := fmt.Sprintf(`"%d-%d"`, bm.EventID, last)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Vary", BookmarkHeader)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	frames, complete, err := store.Since(bm.EventID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading stream: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	resume := "replay"
+	if !complete {
+		resume = "snapshot"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"lastEventId": last, "behind": len(frames), "resume": resume})
+}
+
+// WithBookmark resumes the stream from bm, as if the client had sent its
+// event ID as Last-Event-ID (one it does send takes precedence). Once any
+// replay is done, the stream patches [ResumeSignal] with how it resumed.
+func WithBookmark(bm Bookmark) Option {
+	return func(o *options) {
+		o.bookmark = &bm
+	}
+}
+
+// patchResume tells a client resumed from a bookmark how it was resumed
+func (s *ResilientSSE) patchResume() {
+	mode := "replay"
+	if s.opts.replay == nil || s.replayGap {
+		mode = "snapshot"
+	}
+	s.MarshalAndPatchSignals(map[string]any{ResumeSignal: map[string]any{
+		"mode":     mode,
+		"from":     s.opts.bookmark.EventID,
+		"replayed": s.replayed,
+	}})
+}
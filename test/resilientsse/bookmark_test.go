@@ -0,0 +1,114 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newBookmarks creates a bookmark endpoint for the stream "feed", whose
+// events are kept in buf
+func newBookmarks(buf *ReplayBuffer, maxAge time.Duration) *Bookmarks {
+	return NewBookmarks(BookmarkConfig{
+		Secret: []byte("secret"),
+		MaxAge: maxAge,
+		Key:    func(r *http.Request) (string, error) { return "feed", nil },
+		Store:  func(string) ReplayStore { return buf.Store() },
+	})
+}
+
+// serveBookmark sends a request to b, presenting bookmark if set
+func serveBookmark(b *Bookmarks, method, target, bookmark, etag string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if bookmark != "" {
+		r.Header.Set(BookmarkHeader, bookmark)
+	}
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, r)
+	return w
+}
+
+// A client bookmarks its place, goes offline while the stream moves on, and
+// resumes from the bookmark with exactly the events it missed
+func TestBookmarkRoundTrip(t *testing.T) {
+	buf := NewReplayBuffer(16)
+	addEvents(buf, 1, 2, 3)
+	b := newBookmarks(buf, 0)
+
+	w := serveBookmark(b, http.MethodPost, "/bookmark?lastEventId=3", "", "")
+	var issued struct {
+		Bookmark    string
+		LastEventID uint64 `json:"lastEventId"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&issued); err != nil || w.Code != http.StatusOK || issued.LastEventID != 3 {
+		t.Fatalf("issuing got %d %+v, %v", w.Code, issued, err)
+	}
+
+	addEvents(buf, 4, 5)
+	w = serveBookmark(b, http.MethodGet, "/bookmark", issued.Bookmark, "")
+	if got := strings.TrimSpace(w.Body.String()); got != `{"behind":2,"lastEventId":5,"resume":"replay"}` {
+		t.Errorf("check = %d %s", w.Code, got)
+	}
+	if w := serveBookmark(b, http.MethodGet, "/bookmark", issued.Bookmark, w.Header().Get("ETag")); w.Code != http.StatusNotModified {
+		t.Errorf("check with an unchanged ETag got %d, want 304", w.Code)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+	r.Header.Set(BookmarkHeader, issued.Bookmark)
+	bm, ok, err := b.FromRequest(r)
+	if !ok || err != nil || bm.Key != "feed" || bm.EventID != 3 {
+		t.Fatalf("FromRequest() = %+v, %v, %v", bm, ok, err)
+	}
+	out := newTestWriter()
+	s := New(out, r, WithReplay(buf), WithBookmark(bm))
+	s.Close(nil)
+
+	got := out.String()
+	if ids := eventIDs(got); len(ids) != 3 || ids[0] != 4 || ids[1] != 5 {
+		t.Errorf("resumed stream has events %v, want 4 and 5 replayed, then the resume patch:\n%s", ids, got)
+	}
+	if !strings.Contains(got, `{"resilientResume":{"from":3,"mode":"replay","replayed":2}}`) {
+		t.Errorf("resumed stream is missing its resume patch:\n%s", got)
+	}
+}
+
+func TestBookmarkSnapshot(t *testing.T) {
+	buf := NewReplayBuffer(2)
+	addEvents(buf, 1, 2, 3, 4, 5)
+	b := newBookmarks(buf, 0)
+
+	w := serveBookmark(b, http.MethodGet, "/bookmark", b.Issue("feed", 1), "")
+	if !strings.Contains(w.Body.String(), `"resume":"snapshot"`) {
+		t.Errorf("check of a bookmark behind the buffer = %s, want a snapshot", w.Body.String())
+	}
+}
+
+func TestBookmarkRejected(t *testing.T) {
+	b := newBookmarks(NewReplayBuffer(16), 0)
+	token := b.Issue("feed", 3)
+
+	tampered := newBookmarks(NewReplayBuffer(16), 0)
+	tampered.c.Secret = []byte("other")
+	if _, err := tampered.Parse(token); !errors.Is(err, ErrBookmarkInvalid) {
+		t.Errorf("Parse with another secret = %v, want ErrBookmarkInvalid", err)
+	}
+	if w := serveBookmark(b, http.MethodGet, "/bookmark", token+"x", ""); w.Code != http.StatusBadRequest {
+		t.Errorf("check of a forged bookmark got %d, want 400", w.Code)
+	}
+	if w := serveBookmark(b, http.MethodGet, "/bookmark", b.Issue("other", 3), ""); w.Code != http.StatusForbidden {
+		t.Errorf("check of another stream's bookmark got %d, want 403", w.Code)
+	}
+
+	expired := newBookmarks(NewReplayBuffer(16), time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if w := serveBookmark(expired, http.MethodGet, "/bookmark", token, ""); w.Code != http.StatusGone {
+		t.Errorf("check of an expired bookmark got %d, want 410", w.Code)
+	}
+}
@@ -0,0 +1,100 @@
+package resilientsse
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+)
+
+// CBOR encodes signals as CBOR (RFC 8949), named "cbor". Integers and floats
+// take their smallest exact encoding; object keys are sorted.
+var CBOR Serializer = cborSerializer{}
+
+type cborSerializer struct{}
+
+func (cborSerializer) Name() string { return "cbor" }
+
+func (cborSerializer) Marshal(v any) ([]byte, error) {
+	return appendCBOR(nil, v)
+}
+
+// CBOR major types
+const (
+	cborUint   = 0 << 5
+	cborNegInt = 1 << 5
+	cborText   = 3 << 5
+	cborArray  = 4 << 5
+	cborMap    = 5 << 5
+)
+
+// appendCBOR appends the CBOR encoding of v to b
+func appendCBOR(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xf6), nil
+	case bool:
+		if v {
+			return append(b, 0xf5), nil
+		}
+		return append(b, 0xf4), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i < 0 {
+				return appendCBORHead(b, cborNegInt, uint64(^i)), nil
+			}
+			return appendCBORHead(b, cborUint, uint64(i)), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("resilientsse: invalid number %q", v)
+		}
+		if float64(float32(f)) == f {
+			return binary.BigEndian.AppendUint32(append(b, 0xfa), math.Float32bits(float32(f))), nil
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xfb), math.Float64bits(f)), nil
+	case string:
+		b = appendCBORHead(b, cborText, uint64(len(v)))
+		return append(b, v...), nil
+	case []any:
+		b = appendCBORHead(b, cborArray, uint64(len(v)))
+		for _, e := range v {
+			var err error
+			if b, err = appendCBOR(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		b = appendCBORHead(b, cborMap, uint64(len(v)))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			b = appendCBORHead(b, cborText, uint64(len(k)))
+			b = append(b, k...)
+			var err error
+			if b, err = appendCBOR(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("resilientsse: cbor can't encode %T", v)
+}
+
+// appendCBORHead appends the head of a data item of the major type with
+// argument n, in its shortest form
+func appendCBORHead(b []byte, major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return append(b, major|byte(n))
+	case n <= math.MaxUint8:
+		return append(b, major|24, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, major|25), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, major|26), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, major|27), n)
+	}
+}
@@ -0,0 +1,102 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// WithPatchCoalescing batches signal patches: instead of being sent at once,
+// each is merged into a pending patch, as a JSON merge patch, and the pending
+// patch is sent as one event every interval. A producer patching every few
+// milliseconds then costs the client one event per interval, carrying only
+// the latest value of each key.
+//
+// Only plain patches of a JSON object are batched; patches with options,
+// such as [ResilientSSE.MarshalAndPatchSignalsIfMissing], are sent at once.
+// Order is kept: the pending patch is sent before any other event, before a
+// retry directive and when the stream is closed. A patch that can't be
+// merged into the pending one, e.g. an object replacing a value, sends the
+// pending one first. Batched patches return nil, and a failure to send them
+// ends the stream.
+func WithPatchCoalescing(interval time.Duration) Option {
+	return func(o *options) {
+		o.coalesce = interval
+	}
+}
+
+// coalesceSignals merges a signal patch into the pending one, reporting false
+// if it is not a JSON object
+func (s *ResilientSSE) coalesceSignals(signalsContents []byte) (bool, error) {
+	var patch map[string]any
+	if err := json.Unmarshal(signalsContents, &patch); err != nil || patch == nil {
+		return false, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ctx.Err(); err != nil {
+		return true, s.streamErr()
+	}
+	if s.coalesced != nil {
+		if merged, ok := mergePatch(s.coalesced, patch); ok {
+			s.coalesced = merged
+			return true, nil
+		}
+		if err := s.flushCoalesced(); err != nil {
+			return true, err
+		}
+	}
+	s.coalesced = patch
+	return true, nil
+}
+
+// flushCoalesced sends the pending signal patch, if there is one. s.mu must
+// be held and the stream live.
+func (s *ResilientSSE) flushCoalesced() error {
+	if s.coalesced == nil {
+		return nil
+	}
+	data, err := json.Marshal(s.coalesced)
+	s.coalesced = nil
+	if err != nil {
+		return s.renderFailed(err)
+	}
+	return s.emitGroupLocked([]sendFunc{func(id string) error {
+		return s.sse.PatchSignals(data, datastar.WithPatchSignalsEventID(id))
+	}}, PriorityNormal)
+}
+
+// startCoalescing starts sending the pending signal patch every interval,
+// unless the stream has already ended
+func (s *ResilientSSE) startCoalescing() {
+	s.bgMu.Lock()
+	defer s.bgMu.Unlock()
+
+	if s.ctx.Err() == nil {
+		s.wg.Go(s.flushCoalescedEvery)
+	}
+}
+
+// flushCoalescedEvery runs until the stream ends, sending the pending signal
+// patch every interval
+func (s *ResilientSSE) flushCoalescedEvery() {
+	ticker := time.NewTicker(s.opts.coalesce)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if s.ctx.Err() == nil {
+			s.flushCoalesced()
+		}
+		s.mu.Unlock()
+	}
+}
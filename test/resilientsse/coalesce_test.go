@@ -0,0 +1,72 @@
+package resilientsse
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPatchCoalescing(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithPatchCoalescing(time.Hour))
+	s.MarshalAndPatchSignals(map[string]any{"a": 1, "nested": map[string]any{"x": 1}})
+	s.MarshalAndPatchSignals(map[string]any{"a": 2, "nested": map[string]any{"y": nil}})
+	// an element patch sends the pending signal patch first
+	patchRow(t, s, 1)
+	// an object replacing a value can't be merged: the pending patch goes first
+	s.MarshalAndPatchSignals(map[string]any{"b": 1})
+	s.MarshalAndPatchSignals(map[string]any{"b": map[string]any{"c": 1}})
+	s.Close(nil)
+
+	want := []map[string]any{
+		{"a": 2.0, "nested": map[string]any{"x": 1.0, "y": nil}},
+		{"b": 1.0},
+		{"b": map[string]any{"c": 1.0}},
+	}
+	if got := signalPatches(t, w.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("signal patches received = %v, want %v", got, want)
+	}
+	if got, want := eventIDs(w.String()), []uint64{1, 2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("client received events %v, want %v", got, want)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		a, b, want map[string]any
+		ok         bool
+	}{
+		{
+			a:    map[string]any{"a": 1, "b": 1},
+			b:    map[string]any{"b": 2, "c": 3},
+			want: map[string]any{"a": 1, "b": 2, "c": 3},
+			ok:   true,
+		},
+		{
+			a:    map[string]any{"o": map[string]any{"x": 1}},
+			b:    map[string]any{"o": map[string]any{"y": nil}},
+			want: map[string]any{"o": map[string]any{"x": 1, "y": nil}},
+			ok:   true,
+		},
+		{
+			// a value replaced by an object is set, not merged
+			a:    map[string]any{"o": map[string]any{"x": 1}},
+			b:    map[string]any{"o": 1},
+			want: map[string]any{"o": 1},
+			ok:   true,
+		},
+		{
+			// applying b's object to a's value would drop b's nil members
+			a:  map[string]any{"o": 1},
+			b:  map[string]any{"o": map[string]any{"x": 1}},
+			ok: false,
+		},
+	}
+	for _, tt := range tests {
+		got, ok := mergePatch(tt.a, tt.b)
+		if ok != tt.ok || ok && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("mergePatch(%v, %v) = %v, %v; want %v, %v", tt.a, tt.b, got, ok, tt.want, tt.ok)
+		}
+	}
+}
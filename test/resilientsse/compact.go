@@ -0,0 +1,318 @@
+package resilientsse
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMaxAppends is how many patches adding to an element a
+// [CompactingStore] keeps without a MaxAppends
+const DefaultMaxAppends = 1000
+
+// CompactionConfig configures a [CompactingStore]
+type CompactionConfig struct {
+	// MaxReplay is the most events replayed one by one: a client further
+	// behind is sent the snapshot instead. Zero means only clients the
+	// store can't replay in full are.
+	MaxReplay int
+	// MaxAppends caps the element patches kept that add to an element
+	// rather than replace it (modes append, prepend, before and after),
+	// dropping the oldest; zero means DefaultMaxAppends. A client further
+	// behind than that misses the oldest of the additions it didn't get.
+	MaxAppends int
+}
+
+// CompactingStore is a [ReplayStore] that also keeps the state its events
+// have built up on the client: every signal patch merged into one, and the
+// latest element patch of each target, without the ones a later patch
+// replaced. A client that resumes from further back than the wrapped store
+// can replay, or more than MaxReplay events back, is sent that snapshot
+// instead of a partial or long replay, and the stream goes on from there
+// with live events, as with a complete replay.
+//
+// The snapshot is made of the events appended through the CompactingStore,
+// so it must see a stream's events from the first: it is only used if the
+// wrapped store was empty when the first was appended, and is up to date
+// with the store's newest event. It is kept in memory, for one process;
+// behind a load balancer, a client resuming on another instance falls back
+// to the wrapped store.
+//
+// Element patches are kept by target: the selector, or else the IDs of the
+// patched elements. One that replaces a target (modes outer, replace and
+// remove) drops the earlier patches of that target, and one that replaces
+// its children (inner) the earlier ones of those. Patches that add to a
+// target (append, prepend, before and after) are only sent to a client that
+// resumes from before them: applied twice, they would add the same elements
+// again, while a replacing patch can be applied any number of times. Scripts
+// and events other than signal and element patches are not kept, since they
+// only mean something when they happen.
+//
+// A CompactingStore is safe for concurrent use.
+type CompactingStore struct {
+	store ReplayStore
+	c     CompactionConfig
+
+	mu sync.Mutex
+	// started is set by the first Append, and valid if the store was empty
+	// before it and has recorded every event since
+	started bool
+	valid   bool
+	lastID  uint64
+	signals map[string]any
+	// elements are the element patches kept, oldest first
+	elements []compactElement
+	appends  int
+}
+
+// compactElement is one element patch kept in a snapshot, from event id
+type compactElement struct {
+	id     uint64
+	target string
+	mode   string
+	frame  []byte
+}
+
+var _ ReplayPruner = (*CompactingStore)(nil)
+
+// NewCompactingStore wraps store, snapshotting the events appended from now on
+func NewCompactingStore(store ReplayStore, c CompactionConfig) *CompactingStore {
+	if c.MaxAppends <= 0 {
+		c.MaxAppends = DefaultMaxAppends
+	}
+	return &CompactingStore{store: store, c: c, signals: map[string]any{}}
+}
+
+// Append records the event in the wrapped store and in the snapshot
+func (cs *CompactingStore) Append(id uint64, frame []byte) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if !cs.started {
+		last, err := cs.store.LastID()
+		cs.started = true
+		cs.valid = err == nil && last == 0
+	}
+	if err := cs.store.Append(id, frame); err != nil {
+		// the snapshot can't say whether the client got the event
+		cs.valid = false
+		return err
+	}
+	cs.lastID = id
+	for block := range bytes.SplitSeq(frame, []byte("\n\n")) {
+		if block = bytes.TrimLeft(block, "\n"); len(block) > 0 {
+			cs.record(id, block)
+		}
+	}
+	return nil
+}
+
+// Since returns the wrapped store's events after id, or the snapshot if those
+// don't cover everything after id or are more than MaxReplay
+func (cs *CompactingStore) Since(id uint64) (frames [][]byte, complete bool, err error) {
+	frames, complete, err = cs.store.Since(id)
+	if err == nil && complete && (cs.c.MaxReplay == 0 || len(frames) <= cs.c.MaxReplay) {
+		return frames, true, nil
+	}
+
+	last, lastErr := cs.store.LastID()
+	if lastErr != nil {
+		return frames, complete, err
+	}
+	if snapshot, at := cs.snapshot(id); snapshot != nil && at == last {
+		return snapshot, true, nil
+	}
+	return frames, complete, err
+}
+
+// LastID returns the wrapped store's
+func (cs *CompactingStore) LastID() (uint64, error) {
+	return cs.store.LastID()
+}
+
+// Prune prunes the wrapped store, if it is a [ReplayPruner]. The snapshot
+// is unaffected: it holds the state, not the events.
+func (cs *CompactingStore) Prune(id uint64) (int, error) {
+	if pruner, ok := cs.store.(ReplayPruner); ok {
+		return pruner.Prune(id)
+	}
+	return 0, nil
+}
+
+// Snapshot returns the events that bring a client with nothing up to date,
+// the last carrying the ID of the newest event appended, or nil if there is
+// no valid snapshot
+func (cs *CompactingStore) Snapshot() [][]byte {
+	frames, _ := cs.snapshot(0)
+	return frames
+}
+
+// snapshot returns the snapshot for a client that has the events up to
+// after, leaving out the additive patches it has, and the ID of the newest
+// event it covers
+func (cs *CompactingStore) snapshot(after uint64) ([][]byte, uint64) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if !cs.valid || cs.lastID == 0 {
+		return nil, 0
+	}
+	var frames [][]byte
+	if len(cs.signals) > 0 {
+		frames = append(frames, signalsFrame("", cs.signals))
+	}
+	for _, e := range cs.elements {
+		if e.adds() && e.id <= after {
+			continue
+		}
+		frames = append(frames, e.frame)
+	}
+	if len(frames) == 0 {
+		// nothing kept is still a state; the client's ID must move on
+		frames = append(frames, signalsFrame("", map[string]any{}))
+	}
+	last := len(frames) - 1
+	frames[last] = withEventIDLine(frames[last], strconv.FormatUint(cs.lastID, 10))
+	return frames, cs.lastID
+}
+
+// record adds one event of event id, without its blank line, to the
+// snapshot. cs.mu must be held.
+func (cs *CompactingStore) record(id uint64, block []byte) {
+	var event, selector, mode string
+	var signals, elements []string
+	onlyIfMissing := false
+	kept := make([]byte, 0, len(block)+2)
+	for line := range bytes.Lines(block) {
+		field, value, _ := strings.Cut(strings.TrimSuffix(string(line), "\n"), ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "id":
+			continue
+		case "event":
+			event = value
+		case "data":
+			key, v, _ := strings.Cut(value, " ")
+			switch key {
+			case "signals":
+				signals = append(signals, v)
+			case "onlyIfMissing":
+				onlyIfMissing = v == "true"
+			case "elements":
+				elements = append(elements, v)
+			case "selector":
+				selector = v
+			case "mode":
+				mode = v
+			}
+		}
+		kept = append(kept, line...)
+	}
+	kept = append(bytes.TrimRight(kept, "\n"), "\n\n"...)
+
+	switch event {
+	case "datastar-patch-signals":
+		var patch map[string]any
+		if err := json.Unmarshal([]byte(strings.Join(signals, "\n")), &patch); err == nil {
+			composeSignals(cs.signals, patch, onlyIfMissing)
+		}
+	case "datastar-patch-elements":
+		cs.recordElements(id, selector, cmp.Or(mode, "outer"), strings.Join(elements, "\n"), kept)
+	}
+}
+
+// recordElements keeps an element patch, dropping those it replaces. cs.mu
+// must be held.
+func (cs *CompactingStore) recordElements(id uint64, selector, mode, elements string, frame []byte) {
+	if strings.HasPrefix(strings.TrimSpace(elements), "<script") {
+		return
+	}
+	target := selector
+	if target == "" {
+		target = elementIDs(elements)
+	}
+	if target == "" {
+		// nothing to tell which patches it replaces, or is replaced by
+		mode = "append"
+	}
+
+	switch mode {
+	case "outer", "replace", "remove":
+		cs.drop(func(e compactElement) bool { return e.target == target })
+	case "inner":
+		cs.drop(func(e compactElement) bool {
+			return e.target == target && (e.mode == "inner" || e.mode == "append" || e.mode == "prepend")
+		})
+	default:
+		cs.appends++
+		if cs.appends > cs.c.MaxAppends {
+			oldest := slices.IndexFunc(cs.elements, compactElement.adds)
+			cs.elements = slices.Delete(cs.elements, oldest, oldest+1)
+			cs.appends--
+		}
+	}
+	cs.elements = append(cs.elements, compactElement{id: id, target: target, mode: mode, frame: frame})
+}
+
+// drop removes the kept element patches matching fn. cs.mu must be held.
+func (cs *CompactingStore) drop(fn func(e compactElement) bool) {
+	cs.elements = slices.DeleteFunc(cs.elements, func(e compactElement) bool {
+		if !fn(e) {
+			return false
+		}
+		if e.adds() {
+			cs.appends--
+		}
+		return true
+	})
+}
+
+// adds reports whether the patch adds to its target rather than replaces it
+func (e compactElement) adds() bool {
+	switch e.mode {
+	case "outer", "replace", "remove", "inner":
+		return false
+	}
+	return true
+}
+
+// elementIDPattern finds the id attributes of elements
+var elementIDPattern = regexp.MustCompile(`<[a-zA-Z][^>]*?\sid=["']([^"']+)["']`)
+
+// elementIDs returns the IDs of the elements in a patch as a selector, or ""
+// if none has one
+func elementIDs(elements string) string {
+	var ids []string
+	for _, m := range elementIDPattern.FindAllStringSubmatch(elements, -1) {
+		ids = append(ids, "#"+m[1])
+	}
+	return strings.Join(ids, ",")
+}
+
+// composeSignals applies patch to state as a patch itself, so that state
+// stays a single patch with the effect of all of them: nil values are kept,
+// as they remove the key from a client that still has it
+func composeSignals(state, patch map[string]any, onlyIfMissing bool) {
+	for k, v := range patch {
+		old, had := state[k]
+		obj, isObj := v.(map[string]any)
+		oldObj, oldIsObj := old.(map[string]any)
+		switch {
+		case isObj && oldIsObj:
+			composeSignals(oldObj, obj, onlyIfMissing)
+		case onlyIfMissing && had && old != nil:
+		case isObj && had && old != nil:
+			// the object replaces a value, so its nil members mean nothing
+			state[k] = withoutNils(obj)
+		case isObj:
+			state[k] = copySignals(obj)
+		default:
+			state[k] = v
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package resilientsse
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func signalsEvent(id uint64, signals string) []byte {
+	return fmt.Appendf(nil, "event: datastar-patch-signals\nid: %d\ndata: signals %s\n\n", id, signals)
+}
+
+func elementsEvent(id uint64, selector, mode, elements string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "event: datastar-patch-elements\nid: %d\n", id)
+	if selector != "" {
+		fmt.Fprintf(&b, "data: selector %s\n", selector)
+	}
+	if mode != "" {
+		fmt.Fprintf(&b, "data: mode %s\n", mode)
+	}
+	fmt.Fprintf(&b, "data: elements %s\n\n", elements)
+	return []byte(b.String())
+}
+
+// compactingStore returns a CompactingStore over an empty buffer, with the
+// events appended
+func compactingStore(t *testing.T, c CompactionConfig, events ...[]byte) *CompactingStore {
+	t.Helper()
+	cs := NewCompactingStore(NewReplayBuffer(100).Store(), c)
+	for i, e := range events {
+		if err := cs.Append(uint64(i+1), e); err != nil {
+			t.Fatalf("Append(%d): %v", i+1, err)
+		}
+	}
+	return cs
+}
+
+// feedEvents are a stream's events: signal patches, a status element
+// replaced, and rows appended to a list
+var feedEvents = [][]byte{
+	signalsEvent(1, `{"a":1,"o":{"x":1}}`),
+	elementsEvent(2, "", "", `<div id="status">old</div>`),
+	elementsEvent(3, "#list", "append", `<li id="r1">1</li>`),
+	elementsEvent(4, "", "", `<div id="status">new</div>`),
+	signalsEvent(5, `{"o":{"y":2}}`),
+	elementsEvent(6, "#list", "append", `<li id="r2">2</li>`),
+}
+
+// snapshotText joins frames, checking that only the last has an ID and that
+// it is lastID
+func snapshotText(t *testing.T, frames [][]byte, lastID uint64) string {
+	t.Helper()
+	text := string(joinFrames(frames))
+	if got := eventIDs(text); len(got) != 1 || got[0] != lastID {
+		t.Errorf("snapshot event IDs = %v, want just %d on the last event", got, lastID)
+	}
+	return text
+}
+
+func joinFrames(frames [][]byte) []byte {
+	var out []byte
+	for _, f := range frames {
+		out = append(out, f...)
+	}
+	return out
+}
+
+func TestCompactingStoreSnapshot(t *testing.T) {
+	cs := compactingStore(t, CompactionConfig{}, feedEvents...)
+	snapshot := cs.Snapshot()
+	text := snapshotText(t, snapshot, 6)
+
+	want := []struct {
+		text string
+		kept bool
+	}{
+		{`data: signals {"a":1,"o":{"x":1,"y":2}}`, true},
+		{`<div id="status">new</div>`, true},
+		{`<li id="r1">1</li>`, true},
+		{`<li id="r2">2</li>`, true},
+		// replaced by the newer patch of #status
+		{`<div id="status">old</div>`, false},
+	}
+	for _, w := range want {
+		if strings.Contains(text, w.text) != w.kept {
+			t.Errorf("snapshot contains %s: %v, want %v\n%s", w.text, !w.kept, w.kept, text)
+		}
+	}
+	if len(snapshot) != 4 {
+		t.Errorf("snapshot has %d events, want 4 (signals, r1, status, r2)", len(snapshot))
+	}
+}
+
+func TestCompactingStoreSinceSendsSnapshot(t *testing.T) {
+	cs := compactingStore(t, CompactionConfig{MaxReplay: 1}, feedEvents...)
+
+	// one event behind: replayed as is
+	frames, complete, err := cs.Since(5)
+	if err != nil || !complete || !equalFrames(frames, [][]byte{feedEvents[5]}) {
+		t.Errorf("Since(5) = %q, %v, %v; want event 6, complete", frames, complete, err)
+	}
+
+	// further behind than MaxReplay: the snapshot, without the rows the
+	// client appended already
+	frames, complete, err = cs.Since(4)
+	if err != nil || !complete {
+		t.Fatalf("Since(4) = complete %v, %v; want complete", complete, err)
+	}
+	text := snapshotText(t, frames, 6)
+	if strings.Contains(text, `id="r1"`) {
+		t.Errorf("Since(4) sends row r1 again, which the client appended at event 3\n%s", text)
+	}
+	if !strings.Contains(text, `id="r2"`) || !strings.Contains(text, `<div id="status">new</div>`) {
+		t.Errorf("Since(4) is missing row r2 or the status\n%s", text)
+	}
+}
+
+func TestCompactingStoreInnerDropsAppends(t *testing.T) {
+	cs := compactingStore(t, CompactionConfig{},
+		elementsEvent(1, "#list", "append", `<li id="r1">1</li>`),
+		elementsEvent(2, "#list", "inner", `<li id="r0">0</li>`),
+		elementsEvent(3, "#list", "append", `<li id="r2">2</li>`),
+	)
+	text := snapshotText(t, cs.Snapshot(), 3)
+	if strings.Contains(text, `id="r1"`) {
+		t.Errorf("snapshot keeps a row the inner patch replaced\n%s", text)
+	}
+	if !strings.Contains(text, `id="r0"`) || !strings.Contains(text, `id="r2"`) {
+		t.Errorf("snapshot is missing the inner patch or the row after it\n%s", text)
+	}
+}
+
+func TestCompactingStoreMaxAppends(t *testing.T) {
+	cs := compactingStore(t, CompactionConfig{MaxAppends: 2},
+		elementsEvent(1, "#list", "append", `<li id="r1">1</li>`),
+		elementsEvent(2, "#list", "append", `<li id="r2">2</li>`),
+		elementsEvent(3, "#list", "append", `<li id="r3">3</li>`),
+	)
+	text := snapshotText(t, cs.Snapshot(), 3)
+	if strings.Contains(text, `id="r1"`) || !strings.Contains(text, `id="r3"`) {
+		t.Errorf("snapshot with MaxAppends 2 should keep the two newest rows\n%s", text)
+	}
+}
+
+func TestCompactingStoreNeedsEveryEvent(t *testing.T) {
+	buf := NewReplayBuffer(2)
+	buf.Add(1, signalsEvent(1, `{"a":1}`))
+	// the store had events before the CompactingStore saw any
+	cs := NewCompactingStore(buf.Store(), CompactionConfig{})
+	for id := uint64(2); id <= 4; id++ {
+		cs.Append(id, signalsEvent(id, `{"b":1}`))
+	}
+
+	if snapshot := cs.Snapshot(); snapshot != nil {
+		t.Errorf("Snapshot() = %q, want nil", snapshot)
+	}
+	if _, complete, _ := cs.Since(1); complete {
+		t.Error("Since(1) past the buffer is complete, want a gap")
+	}
+}
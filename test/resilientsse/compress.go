@@ -0,0 +1,179 @@
+package resilientsse
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Encoding is a content coding a stream can be compressed with
+type Encoding string
+
+// Gzip is the encoding [WithCompression] supports out of the box; others are
+// added with [RegisterEncoding], e.g. zstd by the zstdsse package
+const Gzip Encoding = "gzip"
+
+// Compressor is a streaming compressor, such as a [gzip.Writer]
+type Compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// encoders holds the compressor constructors of the registered encodings
+var (
+	encodersMu sync.RWMutex
+	encoders   = map[Encoding]func(w io.Writer) (Compressor, error){
+		Gzip: func(w io.Writer) (Compressor, error) { return gzip.NewWriter(w), nil },
+	}
+)
+
+// RegisterEncoding makes e available to [WithCompression], compressing
+// streams with the writers newCompressor returns. Packages adding an
+// encoding call it from init, so the core doesn't link their dependencies.
+func RegisterEncoding(e Encoding, newCompressor func(w io.Writer) (Compressor, error)) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+
+	encoders[e] = newCompressor
+}
+
+// encoder returns the compressor constructor of e, or nil if e isn't
+// registered
+func encoder(e Encoding) func(w io.Writer) (Compressor, error) {
+	encodersMu.RLock()
+	defer encodersMu.RUnlock()
+
+	return encoders[e]
+}
+
+// WithCompression compresses the stream with the first of encodings the
+// client accepts (Accept-Encoding), or with gzip if none are given:
+//
+//	resilientsse.WithCompression(zstdsse.Zstd, resilientsse.Gzip)
+//
+// Encodings that aren't registered are skipped.
+//
+// The compressor is flushed with every write, so each event, heartbeat and
+// replayed batch still reaches the client at once, but keeps its window
+// across events, so the markup element patches repeat compresses very well.
+// A client accepting none of the encodings gets the stream uncompressed.
+//
+// Each compressed stream holds a compressor of a few hundred KB. Use
+// WithCompression rather than datastar-go's compression options, which would
+// compress the frames the stream records for replay.
+func WithCompression(encodings ...Encoding) Option {
+	if len(encodings) == 0 {
+		encodings = []Encoding{Gzip}
+	}
+	return func(o *options) {
+		o.compression = encodings
+	}
+}
+
+// Encoding returns the encoding the stream is compressed with, "" if none
+func (s *ResilientSSE) Encoding() Encoding {
+	if s.compressor == nil {
+		return ""
+	}
+	return s.compressor.encoding
+}
+
+// compressWriter compresses everything written to the client's
+// ResponseWriter
+type compressWriter struct {
+	http.ResponseWriter
+	rc       *http.ResponseController
+	encoding Encoding
+	enc      Compressor
+	closed   bool
+}
+
+// compress returns w compressed with the encoding negotiated for r, and sets
+// the response headers for it. It returns w as is if r accepts none of the
+// stream's encodings.
+func (s *ResilientSSE) compress(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	w.Header().Add("Vary", "Accept-Encoding")
+	encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), s.opts.compression)
+	if encoding == "" {
+		return w
+	}
+
+	enc, err := encoder(encoding)(w)
+	if err != nil {
+		return w
+	}
+	cw := &compressWriter{ResponseWriter: w, rc: http.NewResponseController(w), encoding: encoding, enc: enc}
+	w.Header().Set("Content-Encoding", string(encoding))
+	w.Header().Del("Content-Length")
+	s.compressor = cw
+	return cw
+}
+
+// Write compresses p into the response
+func (w *compressWriter) Write(p []byte) (int, error) {
+	return w.enc.Write(p)
+}
+
+// FlushError sends everything compressed so far to the client, for
+// [http.ResponseController]
+func (w *compressWriter) FlushError() error {
+	if err := w.enc.Flush(); err != nil {
+		return err
+	}
+	return w.rc.Flush()
+}
+
+// Unwrap lets [http.ResponseController] reach the client's ResponseWriter,
+// e.g. for write deadlines
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close ends the compressed stream, once
+func (w *compressWriter) close() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	if w.enc.Close() == nil {
+		w.rc.Flush()
+	}
+}
+
+// negotiateEncoding returns the first registered one of encodings that
+// acceptEncoding accepts, by name or through *, or "" if there is none
+func negotiateEncoding(acceptEncoding string, encodings []Encoding) Encoding {
+	accepted := map[string]bool{}
+	for part := range strings.SplitSeq(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		for param := range strings.SplitSeq(params, ";") {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if name != "" {
+			accepted[strings.ToLower(name)] = q > 0
+		}
+	}
+
+	for _, e := range encodings {
+		if encoder(e) == nil {
+			continue
+		}
+		ok, listed := accepted[string(e)]
+		if !listed {
+			ok = accepted["*"]
+		}
+		if ok {
+			return e
+		}
+	}
+	return ""
+}
@@ -0,0 +1,110 @@
+package resilientsse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// flushWriter is a ResponseWriter recording what is written and flushed
+type flushWriter struct {
+	header  http.Header
+	buf     bytes.Buffer
+	flushes int
+}
+
+func (w *flushWriter) Header() http.Header         { return w.header }
+func (w *flushWriter) Write(p []byte) (int, error) { return w.buf.Write(p) }
+func (w *flushWriter) WriteHeader(int)             {}
+func (w *flushWriter) Flush()                      { w.flushes++ }
+
+// gunzip returns what the gzip stream in p decompresses to so far, which
+// may stop mid-stream
+func gunzip(t *testing.T, p []byte) string {
+	t.Helper()
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	RegisterEncoding("test", func(w io.Writer) (Compressor, error) { return gzip.NewWriter(w), nil })
+	both := []Encoding{"test", Gzip}
+	for _, c := range []struct {
+		accept    string
+		encodings []Encoding
+		want      Encoding
+	}{
+		{"gzip, deflate, br", both, Gzip},
+		{"test, gzip", both, "test"},
+		{"gzip, test", both, "test"},
+		{"test;q=0, gzip", both, Gzip},
+		{"GZIP", both, Gzip},
+		{"*", both, "test"},
+		{"*, test;q=0", both, Gzip},
+		{"deflate", both, ""},
+		{"", both, ""},
+		{"unknown, gzip", []Encoding{"unknown", Gzip}, Gzip},
+	} {
+		if got := negotiateEncoding(c.accept, c.encodings); got != c.want {
+			t.Errorf("negotiateEncoding(%q, %q) = %q, want %q", c.accept, c.encodings, got, c.want)
+		}
+	}
+}
+
+// Each event must reach the client as soon as it is sent, decompressible
+// without waiting for the rest of the stream
+func TestCompressionFlushesEachEvent(t *testing.T) {
+	w := &flushWriter{header: http.Header{}}
+	header := http.Header{}
+	header.Set("Accept-Encoding", "gzip")
+	s := newStream(w, header, WithCompression())
+
+	if s.Encoding() != Gzip || w.header.Get("Content-Encoding") != "gzip" || w.header.Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("stream encoding %q, headers %v, want gzip", s.Encoding(), w.header)
+	}
+	for i := range 3 {
+		flushes := w.flushes
+		if err := s.PatchSignals(fmt.Appendf(nil, `{"n":%d}`, i)); err != nil {
+			t.Fatal(err)
+		}
+		if w.flushes == flushes {
+			t.Errorf("event %d wasn't flushed", i)
+		}
+		if got, want := gunzip(t, w.buf.Bytes()), fmt.Sprintf(`{"n":%d}`, i); !strings.Contains(got, want) {
+			t.Errorf("after event %d the client can read %q, missing %s", i, got, want)
+		}
+	}
+	s.Close(nil)
+
+	got := gunzip(t, w.buf.Bytes())
+	if ids := eventIDs(got); len(ids) != 3 || ids[2] != 3 {
+		t.Errorf("decompressed stream has events %v, want 3 ending with 3:\n%s", ids, got)
+	}
+}
+
+func TestCompressionNotAccepted(t *testing.T) {
+	w := &flushWriter{header: http.Header{}}
+	header := http.Header{}
+	header.Set("Accept-Encoding", "identity")
+	s := newStream(w, header, WithCompression())
+	s.PatchSignals([]byte(`{"n":1}`))
+	s.Close(nil)
+
+	if s.Encoding() != "" || w.header.Get("Content-Encoding") != "" {
+		t.Errorf("stream encoding %q, Content-Encoding %q, want none", s.Encoding(), w.header.Get("Content-Encoding"))
+	}
+	if !strings.Contains(w.buf.String(), `{"n":1}`) {
+		t.Errorf("uncompressed stream = %q", w.buf.String())
+	}
+}
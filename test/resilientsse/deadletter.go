@@ -0,0 +1,209 @@
+package resilientsse
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// DeadLetterReason tells why an event ended up as a [DeadLetter]
+type DeadLetterReason int
+
+const (
+	// DeadRenderFailed means the event could not be rendered, e.g. signals
+	// that don't marshal to JSON. It never got an ID or frames.
+	DeadRenderFailed DeadLetterReason = iota
+	// DeadWriteFailed means writing the event to the client failed
+	DeadWriteFailed
+	// DeadDropped means backpressure discarded the event, unsent, to keep up
+	// with a slow client
+	DeadDropped
+	// DeadAbandoned means the event was still queued when the stream ended
+	DeadAbandoned
+)
+
+func (r DeadLetterReason) String() string {
+	switch r {
+	case DeadWriteFailed:
+		return "write failed"
+	case DeadDropped:
+		return "dropped"
+	case DeadAbandoned:
+		return "abandoned"
+	default:
+		return "render failed"
+	}
+}
+
+// DeadLetter is an event a stream could not deliver, with what it takes to
+// find out why and to deliver it again
+type DeadLetter struct {
+	Conn   ConnInfo
+	Reason DeadLetterReason
+	// Err is what lost the event: the rendering or write error, or the
+	// stream's error for an abandoned event. It is nil for dropped events.
+	Err error
+	// ID is the event ID the event was sent under, 0 if it never got one
+	ID uint64
+	// Frames is the event group as rendered for the wire, in envelope v1,
+	// nil if it failed to render
+	Frames []byte
+	// Replayable reports that the event was recorded for replay, so a client
+	// resuming from before it is sent it anyway
+	Replayable bool
+	At         time.Time
+}
+
+// WithDeadLetters hands every event the stream fails to deliver to handler,
+// rather than losing it silently. It can be given several times; handlers
+// run in the order they were registered.
+//
+// Handlers run while the stream is locked, so they must return quickly and
+// must not use the stream; a [DeadLetters] store's Add is a suitable one.
+func WithDeadLetters(handler func(DeadLetter)) Option {
+	return func(o *options) {
+		o.deadLetters = append(o.deadLetters, handler)
+	}
+}
+
+// deadLetter hands an undelivered event to the stream's dead-letter handlers
+func (s *ResilientSSE) deadLetter(reason DeadLetterReason, err error, id uint64, frames []byte, replayable bool) {
+	if len(s.opts.deadLetters) == 0 && s.opts.logger == nil {
+		return
+	}
+	l := DeadLetter{
+		Conn:       s.ConnInfo(),
+		Reason:     reason,
+		Err:        err,
+		ID:         id,
+		Frames:     frames,
+		Replayable: replayable,
+		At:         time.Now(),
+	}
+	s.logDeadLetter(l)
+	for _, handler := range s.opts.deadLetters {
+		handler(l)
+	}
+}
+
+// renderFailed dead-letters an event that could not be rendered, returning
+// err
+func (s *ResilientSSE) renderFailed(err error) error {
+	s.deadLetter(DeadRenderFailed, err, 0, nil, false)
+	return err
+}
+
+// Redeliver sends the frames of letters again, each as a new event group
+// with the next event ID, e.g. the letters of a session taken from a
+// [DeadLetters] store when its client resumes. Letters without frames, and
+// replayable ones, which a resuming client is replayed anyway, are skipped.
+func (s *ResilientSSE) Redeliver(letters ...DeadLetter) error {
+	for _, l := range letters {
+		if l.Frames == nil || l.Replayable {
+			continue
+		}
+		err := s.emit(func(id string) error {
+			_, err := s.w.Write(withEventID(l.Frames, id))
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// withEventID returns frames with the value of every id field replaced by
+// id. Only the last event of a group carries one.
+func withEventID(frames []byte, id string) []byte {
+	var b bytes.Buffer
+	b.Grow(len(frames))
+	for line := range bytes.Lines(frames) {
+		if bytes.HasPrefix(line, []byte("id: ")) {
+			line = []byte("id: " + id + "\n")
+		}
+		b.Write(line)
+	}
+	return b.Bytes()
+}
+
+// DeadLetters keeps the most recent dead letters in memory, for inspecting
+// them and redelivering them to the sessions they were meant for. Its Add
+// method is a handler for [WithDeadLetters]:
+//
+//	dead := resilientsse.NewDeadLetters(1000)
+//	stream := resilientsse.New(w, r,
+//		resilientsse.WithSessions(sessions),
+//		resilientsse.WithDeadLetters(dead.Add))
+//	if stream.SessionResumed() {
+//		stream.Redeliver(dead.Take(stream.SessionID())...)
+//	}
+//
+// A DeadLetters is safe for concurrent use.
+type DeadLetters struct {
+	mu      sync.Mutex
+	letters []DeadLetter
+	size    int
+	evicted int
+}
+
+// NewDeadLetters creates a store that keeps the last size letters
+func NewDeadLetters(size int) *DeadLetters {
+	return &DeadLetters{size: max(size, 1)}
+}
+
+// Add keeps l, evicting the oldest letter when full
+func (d *DeadLetters) Add(l DeadLetter) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.letters) == d.size {
+		d.letters = d.letters[1:]
+		d.evicted++
+	}
+	d.letters = append(d.letters, l)
+}
+
+// List returns the letters kept, oldest first
+func (d *DeadLetters) List() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]DeadLetter(nil), d.letters...)
+}
+
+// Take removes and returns the letters of a session, oldest first
+func (d *DeadLetters) Take(sessionID string) []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var taken []DeadLetter
+	kept := d.letters[:0]
+	for _, l := range d.letters {
+		if l.Conn.SessionID == sessionID {
+			taken = append(taken, l)
+		} else {
+			kept = append(kept, l)
+		}
+	}
+	clear(d.letters[len(kept):])
+	d.letters = kept
+	return taken
+}
+
+// Len returns the number of letters kept
+func (d *DeadLetters) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.letters)
+}
+
+// Evicted returns how many letters have been evicted to make room, and so
+// are lost for good
+func (d *DeadLetters) Evicted() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.evicted
+}
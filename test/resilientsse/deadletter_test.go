@@ -0,0 +1,78 @@
+package resilientsse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDeadLetterWriteFailed(t *testing.T) {
+	dead := NewDeadLetters(10)
+	w := newTestWriter()
+	s := newStream(w, nil, WithSessions(NewMemorySessionStore()), WithDeadLetters(dead.Add))
+	defer s.Close(nil)
+
+	if err := s.PatchSignals([]byte(`{"n":1}`)); err != nil {
+		t.Fatal(err)
+	}
+	w.failWrites()
+	if err := s.PatchSignals([]byte(`{"n":2}`)); err == nil {
+		t.Fatal("send to a client that went away succeeded")
+	}
+
+	letters := dead.Take(s.SessionID())
+	if len(letters) != 1 {
+		t.Fatalf("dead letters of the session = %+v, want 1", letters)
+	}
+	l := letters[0]
+	if l.Reason != DeadWriteFailed || !errors.Is(l.Err, errClientGone) {
+		t.Errorf("letter reason %v, err %v, want write failed with %v", l.Reason, l.Err, errClientGone)
+	}
+	// event 1 patched the new session's ID
+	if l.ID != 3 || !strings.Contains(string(l.Frames), `{"n":2}`) || !strings.Contains(string(l.Frames), "id: 3\n") {
+		t.Errorf("letter ID %d, frames %q, want event 3", l.ID, l.Frames)
+	}
+	if dead.Len() != 0 {
+		t.Errorf("Take left %d letters", dead.Len())
+	}
+}
+
+func TestDeadLetterRenderFailed(t *testing.T) {
+	dead := NewDeadLetters(10)
+	s := newStream(newTestWriter(), nil, WithDeadLetters(dead.Add))
+	defer s.Close(nil)
+
+	if err := s.MarshalAndPatchSignals(func() {}); err == nil {
+		t.Fatal("patching signals that don't marshal succeeded")
+	}
+	letters := dead.List()
+	if len(letters) != 1 || letters[0].Reason != DeadRenderFailed || letters[0].Err == nil || letters[0].Frames != nil {
+		t.Errorf("dead letters = %+v, want one render failure without frames", letters)
+	}
+}
+
+func TestRedeliver(t *testing.T) {
+	l := DeadLetter{ID: 2, Frames: []byte("event: datastar-patch-signals\nid: 2\ndata: signals {\"n\":2}\n\n")}
+	w := newTestWriter()
+	s := newStream(w, resumeHeader(5))
+	defer s.Close(nil)
+
+	replayable := l
+	replayable.Replayable = true
+	if err := s.Redeliver(l, replayable, DeadLetter{}); err != nil {
+		t.Fatal(err)
+	}
+	if got := w.String(); !strings.Contains(got, "id: 6\ndata: signals {\"n\":2}\n") || strings.Count(got, "signals {") != 1 {
+		t.Errorf("redelivered stream = %q, want the letter once, as event 6", got)
+	}
+}
+
+func TestDeadLettersEvict(t *testing.T) {
+	dead := NewDeadLetters(2)
+	for id := range uint64(3) {
+		dead.Add(DeadLetter{ID: id})
+	}
+	if letters := dead.List(); len(letters) != 2 || letters[0].ID != 1 || dead.Evicted() != 1 {
+		t.Errorf("kept %+v, evicted %d, want the last 2, 1 evicted", letters, dead.Evicted())
+	}
+}
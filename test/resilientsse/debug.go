@@ -0,0 +1,73 @@
+package resilientsse
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	// DebugHeader asks for debug mode on the client's own stream when set to "1"
+	DebugHeader = "X-Resilient-Debug"
+
+	// DebugParam is accepted in place of DebugHeader, for clients that cannot
+	// set request headers
+	DebugParam = "resilientDebug"
+)
+
+// DebugConfig controls per-connection debug mode. A client asks for it with
+// [DebugHeader] or [DebugParam]; if Allow permits, its stream (and only its
+// stream) adds debug metadata to the envelope of every event group, e.g.
+//
+//	resilient: {"v":2,"ts":1760000000000,"debug":{"events":2,"bytes":311,"renderUs":18,"idleMs":1200}}
+//
+// and passes every frame it writes to Tap. The metadata counts the group's
+// events and v1 bytes, the time spent rendering it and the time since the
+// stream's previous write. A debug stream gets the [EnvelopeField] even when
+// it negotiated [EnvelopeV1]; SSE parsers ignore it, so debug mode doesn't
+// change what the page sees, only what an envelope decoder or dev tools show.
+type DebugConfig struct {
+	// Allow decides whether the request may use debug mode. Nil allows nobody.
+	Allow func(r *http.Request) bool
+	// Tap, if set, receives every frame written to a debug stream. It runs
+	// while the stream is writing, so it must be quick and must not keep frame.
+	Tap func(info ConnInfo, frame []byte)
+}
+
+// WithDebug lets clients turn on debug mode for their stream, as permitted by c
+func WithDebug(c DebugConfig) Option {
+	return func(o *options) {
+		o.debug = &c
+	}
+}
+
+// Debug reports whether the stream is in debug mode
+func (s *ResilientSSE) Debug() bool {
+	return s.debug
+}
+
+// debugRequested reports whether r asks for, and is allowed, debug mode
+func debugRequested(r *http.Request, c *DebugConfig) bool {
+	if c == nil || c.Allow == nil {
+		return false
+	}
+	asked := r.Header.Get(DebugHeader) == "1" || r.URL.Query().Get(DebugParam) == "1"
+	return asked && c.Allow(r)
+}
+
+// groupDebug is the debug metadata of an event group, added to its envelope
+// on a debug stream
+type groupDebug struct {
+	events       int
+	render, idle time.Duration
+}
+
+// tap passes frames to the debug tap, if the stream has one
+func (s *ResilientSSE) tap(frames ...[]byte) {
+	if !s.debug || s.opts.debug.Tap == nil {
+		return
+	}
+	info := s.ConnInfo()
+	for _, frame := range frames {
+		s.opts.debug.Tap(info, frame)
+	}
+}
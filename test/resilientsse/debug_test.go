@@ -0,0 +1,65 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// envelopes returns the envelope metadata of the events in a stream, in order
+func envelopes(t *testing.T, stream string) []map[string]any {
+	t.Helper()
+	var out []map[string]any
+	for line := range strings.Lines(stream) {
+		data, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), EnvelopeField+": ")
+		if !ok {
+			continue
+		}
+		var meta map[string]any
+		if err := json.Unmarshal([]byte(data), &meta); err != nil {
+			t.Fatalf("invalid envelope %q: %v", data, err)
+		}
+		out = append(out, meta)
+	}
+	return out
+}
+
+func TestDebugEnvelope(t *testing.T) {
+	var tapped []string
+	debug := WithDebug(DebugConfig{
+		Allow: func(*http.Request) bool { return true },
+		Tap:   func(_ ConnInfo, frame []byte) { tapped = append(tapped, string(frame)) },
+	})
+	header := http.Header{}
+	header.Set(DebugHeader, "1")
+
+	w := newTestWriter()
+	s := newStream(w, header, debug)
+	patchRow(t, s, 1)
+	s.Close(nil)
+
+	metas := envelopes(t, w.String())
+	if len(metas) != 1 {
+		t.Fatalf("debug stream has %d envelopes, want 1\n%s", len(metas), w.String())
+	}
+	d, ok := metas[0]["debug"].(map[string]any)
+	if !ok || d["events"] != 1.0 || d["bytes"].(float64) <= 0 {
+		t.Errorf("envelope debug metadata = %v, want 1 event of some bytes", metas[0]["debug"])
+	}
+	if strings.Contains(w.String(), ": debug") {
+		t.Errorf("debug stream still writes a debug comment\n%s", w.String())
+	}
+	if len(tapped) != 1 || !strings.Contains(tapped[0], EnvelopeField+": ") {
+		t.Errorf("tapped frames = %q, want the enveloped event", tapped)
+	}
+
+	// without asking for it, the stream stays plain v1
+	w = newTestWriter()
+	s = newStream(w, nil, debug)
+	patchRow(t, s, 1)
+	s.Close(nil)
+	if metas := envelopes(t, w.String()); len(metas) != 0 {
+		t.Errorf("stream not in debug mode has envelopes %v, want none", metas)
+	}
+}
@@ -0,0 +1,245 @@
+package resilientsse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+const (
+	// DeltaHeader carries the delta format a client decodes on the request,
+	// and the one the server chose on the response. The only format is "1".
+	DeltaHeader = "X-Resilient-Delta"
+
+	// DeltaParam is accepted in place of DeltaHeader on the request, for
+	// clients that cannot set request headers
+	DeltaParam = "resilientDelta"
+
+	// DictField marks an element patch sent whole whose elements the client
+	// keeps in the dictionary slot it names:
+	//
+	//	event: datastar-patch-elements
+	//	id: 41
+	//	data: elements <li id="item-41">the quick brown fox</li>
+	//	resilient-dict: 3
+	DictField = "resilient-dict"
+
+	// DeltaField carries the elements of an element patch as a binary diff
+	// against a dictionary slot, in place of its elements data lines: the
+	// slot, the 32-bit FNV-1a hash, in hex, of the elements it rebuilds, and
+	// the diff in base64. The diff is a sequence of operations, each a uvarint
+	// holding a length n shifted left by one and the kind in the low bit: an
+	// insert (0) is followed by the n bytes to insert, a copy (1) by the
+	// uvarint offset of the n bytes to copy from the slot. After the patch
+	// above, copying 14 bytes, inserting "2" and copying 26:
+	//
+	//	event: datastar-patch-elements
+	//	id: 42
+	//	resilient-delta: 3 72288045 HQACMjUP
+	//
+	// The rebuilt elements replace the slot's. Without data lines the event is
+	// never dispatched, so only a client that asked for deltas sees it.
+	DeltaField = "resilient-delta"
+
+	// deltaFormat is the format of DictField and DeltaField
+	deltaFormat = "1"
+)
+
+// WithDeltaEncoding lets clients negotiate delta-encoded element patches. A
+// client asks with [DeltaHeader] or [DeltaParam] set to "1", and gets it back
+// in the DeltaHeader response header.
+//
+// The stream then keeps the elements of the last element patches it sent,
+// up to slots of them (8 if slots isn't positive), and sends each element
+// patch as a [DeltaField] diff against the one it shares the most with,
+// where that is smaller; otherwise it is sent whole, with a [DictField]
+// naming the slot it takes. Streams re-rendering the same fragment, a feed
+// or a table, send little more than what changed.
+//
+// The dictionary lives as long as the connection: a client reconnecting
+// starts a fresh one, as does the stream replaying to it. A client that
+// rebuilds elements whose hash doesn't match fails the stream, to reconnect.
+func WithDeltaEncoding(slots int) Option {
+	return func(o *options) {
+		if slots <= 0 {
+			slots = 8
+		}
+		o.deltaSlots = slots
+	}
+}
+
+// DeltaEncoding reports whether the stream negotiated delta encoding
+func (s *ResilientSSE) DeltaEncoding() bool {
+	return s.w.delta != nil
+}
+
+// negotiateDelta reports whether r asks for delta encoding
+func negotiateDelta(r *http.Request) bool {
+	asked := r.Header.Get(DeltaHeader)
+	if asked == "" {
+		asked = r.URL.Query().Get(DeltaParam)
+	}
+	return asked == deltaFormat
+}
+
+// elementsDataLine starts the data lines of an element patch's elements
+var elementsDataLine = []byte("data: " + datastar.ElementsDatalineLiteral)
+
+// deltaDict is the dictionary of the element patches a connection was sent.
+// Its writer's writes are serialized, and so are its uses.
+type deltaDict struct {
+	slots [][]byte
+	// next is the slot the next patch sent whole takes
+	next int
+}
+
+func newDeltaDict(slots int) *deltaDict {
+	return &deltaDict{slots: make([][]byte, slots)}
+}
+
+// encode returns frames with their element patches delta-encoded
+func (d *deltaDict) encode(frames []byte) []byte {
+	if !bytes.Contains(frames, elementsDataLine) {
+		return frames
+	}
+	out := make([]byte, 0, len(frames))
+	for rest := frames; len(rest) > 0; {
+		end := bytes.Index(rest, []byte("\n\n"))
+		if end < 0 {
+			out = append(out, rest...)
+			break
+		}
+		// events end with one or more blank lines
+		next := len(rest) - len(bytes.TrimLeft(rest[end:], "\n"))
+		out = d.encodeEvent(out, rest[:end+1])
+		out = append(out, rest[end+1:next]...)
+		rest = rest[next:]
+	}
+	return out
+}
+
+// encodeEvent appends event to out, as a diff if it is an element patch and
+// the diff is the smaller, and records its elements
+func (d *deltaDict) encodeEvent(out, event []byte) []byte {
+	if !bytes.HasPrefix(event, []byte("event: "+datastar.EventTypePatchElements+"\n")) {
+		return append(out, event...)
+	}
+
+	var elements [][]byte
+	size := 0
+	for line := range bytes.Lines(event) {
+		if e, ok := bytes.CutPrefix(line, elementsDataLine); ok {
+			elements = append(elements, bytes.TrimSuffix(e, []byte("\n")))
+			size += len(line)
+		}
+	}
+	if elements == nil {
+		return append(out, event...)
+	}
+	payload := bytes.Join(elements, []byte("\n"))
+
+	slot, diff := d.closest(payload)
+	if slot >= 0 {
+		field := len(DeltaField) + len(": ") + len(strconv.Itoa(slot)) + len(" 00000000 ") + base64.StdEncoding.EncodedLen(len(diff)) + len("\n")
+		if field < size {
+			d.slots[slot] = payload
+			return appendDelta(out, event, slot, payload, diff)
+		}
+	}
+
+	// sent whole, taking the next slot
+	slot = d.next
+	d.next = (d.next + 1) % len(d.slots)
+	d.slots[slot] = payload
+	out = append(out, event...)
+	out = append(out, DictField+": "...)
+	out = strconv.AppendInt(out, int64(slot), 10)
+	return append(out, '\n')
+}
+
+// closest returns the slot payload has the smallest diff against, and the
+// diff, or -1 if the dictionary is empty
+func (d *deltaDict) closest(payload []byte) (slot int, diff []byte) {
+	slot = -1
+	for i, base := range d.slots {
+		if base == nil {
+			continue
+		}
+		if dd := appendDiff(nil, base, payload); slot < 0 || len(dd) < len(diff) {
+			slot, diff = i, dd
+		}
+	}
+	return slot, diff
+}
+
+// minCopy is the shortest run of bytes a diff copies from its base rather
+// than inserts
+const minCopy = 8
+
+// appendDiff appends to b the diff, as DeltaField describes it, rebuilding
+// payload from base. Runs of minCopy bytes or more found in base are copied.
+func appendDiff(b, base, payload []byte) []byte {
+	// the first offset of every minCopy bytes of base
+	index := make(map[uint64]int, len(base))
+	for i := len(base) - minCopy; i >= 0; i-- {
+		index[binary.LittleEndian.Uint64(base[i:])] = i
+	}
+
+	inserted := 0
+	for i := 0; i+minCopy <= len(payload); {
+		at, ok := index[binary.LittleEndian.Uint64(payload[i:])]
+		if !ok {
+			i++
+			continue
+		}
+		n := minCopy
+		for at+n < len(base) && i+n < len(payload) && base[at+n] == payload[i+n] {
+			n++
+		}
+		if inserted < i {
+			b = binary.AppendUvarint(b, uint64(i-inserted)<<1)
+			b = append(b, payload[inserted:i]...)
+		}
+		b = binary.AppendUvarint(b, uint64(n)<<1|1)
+		b = binary.AppendUvarint(b, uint64(at))
+		i += n
+		inserted = i
+	}
+	if inserted < len(payload) {
+		b = binary.AppendUvarint(b, uint64(len(payload)-inserted)<<1)
+		b = append(b, payload[inserted:]...)
+	}
+	return b
+}
+
+// appendDelta appends event to out with a DeltaField in place of its
+// elements lines
+func appendDelta(out, event []byte, slot int, payload, diff []byte) []byte {
+	h := fnv.New32a()
+	h.Write(payload)
+
+	written := false
+	for line := range bytes.Lines(event) {
+		if !bytes.HasPrefix(line, elementsDataLine) {
+			out = append(out, line...)
+			continue
+		}
+		if !written {
+			out = append(out, DeltaField+": "...)
+			out = strconv.AppendInt(out, int64(slot), 10)
+			out = append(out, ' ')
+			out = fmt.Appendf(out, "%08x", h.Sum32())
+			out = append(out, ' ')
+			out = base64.StdEncoding.AppendEncode(out, diff)
+			out = append(out, '\n')
+			written = true
+		}
+	}
+	return out
+}
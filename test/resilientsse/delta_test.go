@@ -0,0 +1,173 @@
+package resilientsse
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDeltaNegotiation(t *testing.T) {
+	tests := []struct {
+		header, param string
+		want          bool
+	}{
+		{"1", "", true},
+		{"", "1", true},
+		{"2", "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/feed?"+DeltaParam+"="+tt.param, nil)
+		if tt.header != "" {
+			r.Header.Set(DeltaHeader, tt.header)
+		}
+		w := newTestWriter()
+		s := New(w, r, WithDeltaEncoding(0))
+		s.Close(nil)
+
+		if s.DeltaEncoding() != tt.want || (w.header.Get(DeltaHeader) == "1") != tt.want {
+			t.Errorf("asked %q/%q: got %v, header %q, want %v", tt.header, tt.param, s.DeltaEncoding(), w.header.Get(DeltaHeader), tt.want)
+		}
+	}
+}
+
+// feed renders a list of n items ending at last
+func feed(last, n int) string {
+	var b strings.Builder
+	b.WriteString("<ul id=\"feed\">\n")
+	for i := last - n + 1; i <= last; i++ {
+		fmt.Fprintf(&b, "  <li>item %d: the quick brown fox jumps over the lazy dog</li>\n", i)
+	}
+	b.WriteString("</ul>")
+	return b.String()
+}
+
+// Element patches re-rendering a fragment go out as diffs a client with the
+// dictionary rebuilds, and unrelated ones whole
+func TestDeltaEncoding(t *testing.T) {
+	buf := NewReplayBuffer(8)
+	w := newTestWriter()
+	s := newStream(w, http.Header{DeltaHeader: {"1"}}, WithDeltaEncoding(2), WithReplay(buf))
+	var sent []string
+	for _, elements := range []string{feed(10, 10), feed(11, 10), feed(12, 10), `<p id="a">a</p>`, `<p id="b">b</p>`, feed(13, 10)} {
+		if err := s.PatchElements(elements); err != nil {
+			t.Fatal(err)
+		}
+		sent = append(sent, elements)
+	}
+	s.Close(nil)
+
+	got := w.String()
+	if n := strings.Count(got, DeltaField+": "); n != 2 {
+		t.Errorf("stream carries %d deltas, want 2:\n%s", n, got)
+	}
+	if n := strings.Count(got, DictField+": "); n != 4 {
+		t.Errorf("stream carries %d whole patches, want 4:\n%s", n, got)
+	}
+	if len(got) >= len(replayedTo(t, buf, resumeHeader(0))) {
+		t.Errorf("deltas didn't shrink the stream:\n%s", got)
+	}
+
+	rebuilt := rebuildElements(t, got, 2)
+	if strings.Join(rebuilt, "\n--\n") != strings.Join(sent, "\n--\n") {
+		t.Errorf("client rebuilt\n%s\nwant\n%s", strings.Join(rebuilt, "\n--\n"), strings.Join(sent, "\n--\n"))
+	}
+
+	// a reconnecting client starts a fresh dictionary, as does the replay
+	header := resumeHeader(0)
+	header.Set(DeltaHeader, "1")
+	replayed := replayedTo(t, buf, header)
+	if !strings.HasPrefix(replayed, "event: datastar-patch-elements\nid: 1\n") || !strings.Contains(replayed, "</ul>\n"+DictField+": 0\n") {
+		t.Errorf("reconnecting client was replayed:\n%s", replayed)
+	}
+	if rebuilt := rebuildElements(t, replayed, 2); strings.Join(rebuilt, "\n--\n") != strings.Join(sent, "\n--\n") {
+		t.Errorf("reconnecting client rebuilt\n%s", strings.Join(rebuilt, "\n--\n"))
+	}
+}
+
+// replayedTo returns what a client with header is sent from buf
+func replayedTo(t *testing.T, buf *ReplayBuffer, header http.Header) string {
+	t.Helper()
+	w := newTestWriter()
+	newStream(w, header, WithDeltaEncoding(2), WithReplay(buf)).Close(nil)
+	return w.String()
+}
+
+// rebuildElements decodes stream as a client with a dictionary of slots
+// does, returning the elements of each element patch
+func rebuildElements(t *testing.T, stream string, slots int) []string {
+	t.Helper()
+	dict := make([][]byte, slots)
+	var rebuilt []string
+	for event := range strings.SplitSeq(strings.TrimSpace(stream), "\n\n") {
+		var elements []string
+		for line := range strings.SplitSeq(event, "\n") {
+			if e, ok := strings.CutPrefix(line, "data: elements "); ok {
+				elements = append(elements, e)
+			}
+			if slot, ok := strings.CutPrefix(line, DictField+": "); ok {
+				i, _ := strconv.Atoi(slot)
+				dict[i] = []byte(strings.Join(elements, "\n"))
+			}
+			if field, ok := strings.CutPrefix(line, DeltaField+": "); ok {
+				var i int
+				var sum, encoded string
+				fmt.Sscan(field, &i, &sum, &encoded)
+				diff, err := base64.StdEncoding.DecodeString(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				payload := applyDiff(t, dict[i], diff)
+				h := fnv.New32a()
+				h.Write(payload)
+				if fmt.Sprintf("%08x", h.Sum32()) != sum {
+					t.Fatalf("rebuilt elements don't match the hash %s:\n%s", sum, payload)
+				}
+				dict[i] = payload
+				elements = strings.Split(string(payload), "\n")
+			}
+		}
+		if elements != nil {
+			rebuilt = append(rebuilt, strings.Join(elements, "\n"))
+		}
+	}
+	return rebuilt
+}
+
+// applyDiff rebuilds the payload diff encodes against base
+func applyDiff(t *testing.T, base, diff []byte) []byte {
+	t.Helper()
+	var payload []byte
+	for len(diff) > 0 {
+		op, n := binary.Uvarint(diff)
+		diff = diff[n:]
+		if op&1 == 0 {
+			payload = append(payload, diff[:op>>1]...)
+			diff = diff[op>>1:]
+			continue
+		}
+		at, n := binary.Uvarint(diff)
+		diff = diff[n:]
+		payload = append(payload, base[at:at+op>>1]...)
+	}
+	return payload
+}
+
+// Without negotiating, element patches go out as datastar-go renders them
+func TestDeltaNotNegotiated(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithDeltaEncoding(0))
+	s.PatchElements(feed(10, 10))
+	s.PatchElements(feed(11, 10))
+	s.Close(nil)
+
+	if got := w.String(); strings.Contains(got, DeltaField) || strings.Contains(got, DictField) {
+		t.Errorf("stream without deltas:\n%s", got)
+	}
+}
@@ -0,0 +1,127 @@
+package resilientsse
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrDraining is the cause reported by [ResilientSSE.Err] for streams ended,
+// or refused, by [Drainer.Drain]
+var ErrDraining = errors.New("resilientsse: server draining")
+
+// DrainSignal is the signal a stream ended by [Drainer.Drain] patches just
+// before it ends, telling the client when to come back, like [IdleSignal]:
+//
+//	{"resilientDrain": {"reconnect": "backoff", "retry": 1650}}
+//
+// Clients that manage reconnects themselves, such as the Resilient JS
+// Retryer, ignore the retry field sent along with it; the signal gives them
+// the same directive.
+const DrainSignal = "resilientDrain"
+
+// Drainer tracks a server's live streams so they can be wound down gracefully
+// on shutdown. Run Drain alongside [http.Server.Shutdown], which stops
+// accepting connections but does not end streams on its own:
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+//	defer cancel()
+//	go srv.Shutdown(ctx)
+//	drainer.Drain(ctx, 2*time.Second)
+//
+// A Drainer is safe for concurrent use.
+type Drainer struct {
+	mu       sync.Mutex
+	streams  map[*ResilientSSE]struct{}
+	draining bool
+	retry    time.Duration
+	empty    chan struct{} // closed once draining with no streams left
+}
+
+// NewDrainer creates a Drainer with no streams
+func NewDrainer() *Drainer {
+	return &Drainer{streams: map[*ResilientSSE]struct{}{}}
+}
+
+// WithDrainer registers the stream with d until it is closed. A stream opened
+// while d is draining is told to reconnect later and closed straight away.
+func WithDrainer(d *Drainer) Option {
+	return func(o *options) {
+		o.drainer = d
+	}
+}
+
+// Drain tells every live stream to reconnect after about retry (jittered, so
+// clients don't all come back at once), patching [DrainSignal] and sending a
+// retry field, and ends it with [ErrDraining], once
+// any event being written has been flushed. It then waits until every stream
+// has been closed, or returns ctx's error if that takes too long. New streams
+// are refused from the moment Drain is called.
+func (d *Drainer) Drain(ctx context.Context, retry time.Duration) error {
+	d.mu.Lock()
+	d.draining = true
+	d.retry = retry
+	d.empty = make(chan struct{})
+	if len(d.streams) == 0 {
+		close(d.empty)
+	}
+	streams := make([]*ResilientSSE, 0, len(d.streams))
+	for s := range d.streams {
+		streams = append(streams, s)
+	}
+	empty := d.empty
+	d.mu.Unlock()
+
+	for _, s := range streams {
+		// a stalled client can hold up its own retry write, but not the others
+		go s.drain(retry)
+	}
+
+	select {
+	case <-empty:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len returns the number of live streams
+func (d *Drainer) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return len(d.streams)
+}
+
+// add registers s, returning false and the suggested retry delay if d is
+// draining
+func (d *Drainer) add(s *ResilientSSE) (ok bool, retry time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.draining {
+		return false, d.retry
+	}
+	d.streams[s] = struct{}{}
+	return true, 0
+}
+
+// remove unregisters s
+func (d *Drainer) remove(s *ResilientSSE) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.streams[s]; !ok {
+		return
+	}
+	delete(d.streams, s)
+	if d.draining && len(d.streams) == 0 {
+		close(d.empty)
+	}
+}
+
+// drain sends the stream a jittered reconnect directive and ends it
+func (s *ResilientSSE) drain(retry time.Duration) {
+	s.closeWithRetry(DrainSignal, nil, retry, ErrDraining)
+}
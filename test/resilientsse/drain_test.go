@@ -0,0 +1,68 @@
+package resilientsse
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// drainedStream opens a stream with d, closed by its handler once the stream
+// ends, as a handler streaming until its context is done would
+func drainedStream(d *Drainer) (*ResilientSSE, *testWriter) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithDrainer(d))
+	go func() {
+		<-s.Context().Done()
+		s.Close(nil)
+	}()
+	return s, w
+}
+
+func TestDrainOnShutdown(t *testing.T) {
+	d := NewDrainer()
+	a, aw := drainedStream(d)
+	b, bw := drainedStream(d)
+	if d.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", d.Len())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := d.Drain(ctx, 2*time.Second); err != nil {
+		t.Fatalf("Drain() = %v", err)
+	}
+	if d.Len() != 0 {
+		t.Errorf("Len() after draining = %d, want 0", d.Len())
+	}
+	for i, s := range []*ResilientSSE{a, b} {
+		if !errors.Is(s.Err(), ErrDraining) {
+			t.Errorf("stream %d ended with %v, want ErrDraining", i, s.Err())
+		}
+	}
+	for i, w := range []*testWriter{aw, bw} {
+		if got := w.String(); !strings.Contains(got, `"`+DrainSignal+`":`) || !strings.Contains(got, "\nretry: ") {
+			t.Errorf("stream %d wasn't told to reconnect later:\n%s", i, got)
+		}
+	}
+
+	// streams opened once draining has started are turned away at once
+	late, lw := drainedStream(d)
+	if !late.IsClosed() || !errors.Is(late.Err(), ErrDraining) || !strings.Contains(lw.String(), DrainSignal) {
+		t.Errorf("stream opened while draining closed %v with %v:\n%s", late.IsClosed(), late.Err(), lw.String())
+	}
+}
+
+// Drain gives up on streams whose handlers don't return in time
+func TestDrainTimeout(t *testing.T) {
+	d := NewDrainer()
+	s := newStream(newTestWriter(), nil, WithDrainer(d))
+	defer s.Close(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := d.Drain(ctx, time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Drain() = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,246 @@
+package resilientsse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// ChecksumField carries a checksum of the signals a stream's
+	// [SignalStore] says its client has, in a block of its own:
+	//
+	//	resilient-checksum: {"conn":7,"id":42,"keys":["count","logs"],"sum":"9f3a01bc"}
+	//
+	// The block has no data, so SSE parsers never dispatch it. sum is the
+	// 32-bit FNV-1a hash, in hex, of the JSON encoding of the store's state,
+	// with object keys sorted and no HTML escaping; keys are its top-level
+	// keys, and id is the last event sent before it. The resilient client
+	// hashes the same keys of the signals the stream patched, and reports a
+	// mismatch to the URL in [DriftHeader].
+	ChecksumField = "resilient-checksum"
+
+	// DriftHeader carries the URL drift is reported to, on the responses of
+	// streams with [WithDriftMonitor]
+	DriftHeader = "X-Resilient-Drift"
+)
+
+// DriftConfig configures a [DriftMonitor]
+type DriftConfig struct {
+	// ReportURL is where clients report drift: the path the DriftMonitor is
+	// served at
+	ReportURL string
+	// OnDrift, if set, is called with every report for a live stream
+	OnDrift func(DriftReport)
+}
+
+// DriftReport is a client's report that its signals don't match a checksum
+type DriftReport struct {
+	// Conn is the [ConnInfo.ID] of the stream
+	Conn uint64 `json:"conn"`
+	// EventID is the last event sent before the checksum
+	EventID uint64 `json:"id"`
+	// Expected is the checksum the stream sent, Actual the client's
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// DriftMonitor checks that clients' signals match what their streams sent
+// them. Every stream opened with [WithDriftMonitor] sends a [ChecksumField]
+// block every interval; a client whose own checksum differs, e.g. because it
+// missed a patch to backpressure or a proxy, reports it by POSTing a
+// [DriftReport] as JSON to the DriftMonitor, which schedules a resync: the
+// stream patches the store's keys away and back with the whole state, in one
+// group. Mount it at the ReportURL:
+//
+//	drift := resilientsse.NewDriftMonitor(resilientsse.DriftConfig{ReportURL: "/drift"})
+//	mux.Handle("POST /drift", drift)
+//	...
+//	stream := resilientsse.New(w, r, resilientsse.WithDriftMonitor(drift, 10*time.Second))
+//
+// The checksum covers only the signals the stream diffs with
+// [ResilientSSE.MarshalAndPatchSignalChanges]; elements and signals the
+// client changes itself aren't checked.
+type DriftMonitor struct {
+	c DriftConfig
+
+	mu      sync.Mutex
+	streams map[uint64]*ResilientSSE
+}
+
+// NewDriftMonitor creates a DriftMonitor
+func NewDriftMonitor(c DriftConfig) *DriftMonitor {
+	return &DriftMonitor{c: c, streams: map[uint64]*ResilientSSE{}}
+}
+
+// WithDriftMonitor sends a checksum of the stream's signals every interval,
+// and takes its drift reports through m
+func WithDriftMonitor(m *DriftMonitor, interval time.Duration) Option {
+	return func(o *options) {
+		o.drift = m
+		o.driftInterval = interval
+	}
+}
+
+// ServeHTTP takes a DriftReport and schedules a resync of its stream,
+// answering 202, or 404 once the stream has ended
+func (m *DriftMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var report DriftReport
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&report); err != nil {
+		http.Error(w, "invalid drift report", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	s := m.streams[report.Conn]
+	m.mu.Unlock()
+	if s == nil {
+		http.Error(w, "no such stream", http.StatusNotFound)
+		return
+	}
+
+	s.Logger().Warn("signal drift", slog.Uint64("event_id", report.EventID),
+		slog.String("expected", report.Expected), slog.String("actual", report.Actual))
+	if m.c.OnDrift != nil {
+		m.c.OnDrift(report)
+	}
+	select {
+	case s.resyncWake <- struct{}{}:
+	default: // a resync is already scheduled
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// add registers s
+func (m *DriftMonitor) add(s *ResilientSSE) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.streams[s.connID] = s
+}
+
+// remove unregisters s
+func (m *DriftMonitor) remove(s *ResilientSSE) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.streams, s.connID)
+}
+
+// startDriftWatch registers the stream with its DriftMonitor and starts
+// sending checksums, unless the stream has already ended
+func (s *ResilientSSE) startDriftWatch() {
+	s.bgMu.Lock()
+	defer s.bgMu.Unlock()
+
+	if s.ctx.Err() == nil {
+		s.opts.drift.add(s)
+		s.wg.Go(s.driftWatch)
+	}
+}
+
+// driftWatch runs until the stream ends, sending a checksum every interval
+// and a resync whenever one is scheduled
+func (s *ResilientSSE) driftWatch() {
+	ticker := time.NewTicker(s.opts.driftInterval)
+	defer ticker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.resyncWake:
+			err = s.resyncSignals()
+		case <-ticker.C:
+			err = s.sendChecksum()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// sendChecksum sends a ChecksumField block for the stream's signal store
+func (s *ResilientSSE) sendChecksum() error {
+	// the store and what was sent must agree: no diff may be on its way
+	s.changesMu.Lock()
+	defer s.changesMu.Unlock()
+
+	state := s.signals.Get()
+	sum, err := signalsChecksum(state)
+	if err != nil {
+		return s.renderFailed(err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx.Err() != nil {
+		return s.streamErr()
+	}
+	if err := s.flushCoalesced(); err != nil {
+		return err
+	}
+	keys := slices.Sorted(maps.Keys(state))
+	if keys == nil {
+		keys = []string{} // the client iterates them
+	}
+	block, err := json.Marshal(map[string]any{"conn": s.connID, "id": s.seq, "keys": keys, "sum": sum})
+	if err != nil {
+		return s.renderFailed(err)
+	}
+	err = s.send([]byte(ChecksumField + ": " + string(block) + "\n\n"))
+	s.lastWrite = time.Now()
+	return err
+}
+
+// resyncSignals patches every key of the stream's signal store away and back
+// with its whole state, in one group, so the client ends up with exactly
+// what the store has
+func (s *ResilientSSE) resyncSignals() error {
+	s.changesMu.Lock()
+	defer s.changesMu.Unlock()
+
+	state := s.signals.Get()
+	if len(state) == 0 {
+		return nil
+	}
+	cleared := make(map[string]any, len(state))
+	for k := range state {
+		cleared[k] = nil
+	}
+	tx := s.Tx()
+	if err := tx.MarshalAndPatchSignals(cleared); err != nil {
+		return err
+	}
+	if err := tx.MarshalAndPatchSignals(state); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// signalsChecksum is the ChecksumField sum of state
+func signalsChecksum(state map[string]any) (string, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(state); err != nil {
+		return "", fmt.Errorf("failed to marshal signals: %w", err)
+	}
+	h := fnv.New32a()
+	h.Write(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
+	return fmt.Sprintf("%08x", h.Sum32()), nil
+}
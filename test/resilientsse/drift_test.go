@@ -0,0 +1,95 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checksums returns the ChecksumField blocks written to w
+func checksums(w *testWriter) []map[string]any {
+	var blocks []map[string]any
+	for line := range strings.Lines(w.String()) {
+		if v, ok := strings.CutPrefix(line, ChecksumField+": "); ok {
+			var block map[string]any
+			json.Unmarshal([]byte(v), &block)
+			blocks = append(blocks, block)
+		}
+	}
+	return blocks
+}
+
+// The checksum is the FNV-1a hash of the store's state as the client would
+// encode it: keys sorted, markup left alone
+func TestDriftChecksum(t *testing.T) {
+	m := NewDriftMonitor(DriftConfig{})
+	w := newTestWriter()
+	s := newStream(w, nil, WithDriftMonitor(m, 10*time.Millisecond))
+	defer s.Close(nil)
+
+	if err := s.MarshalAndPatchSignalChanges(map[string]any{"name": "<b>", "count": 1}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "a checksum", func() bool { return len(checksums(w)) > 0 })
+
+	h := fnv.New32a()
+	h.Write([]byte(`{"count":1,"name":"<b>"}`))
+	block := checksums(w)[0]
+	if want := fmt.Sprintf("%08x", h.Sum32()); block["sum"] != want {
+		t.Errorf("sum = %v, want %s", block["sum"], want)
+	}
+	if block["id"] != 1.0 || block["conn"] != float64(s.ConnInfo().ID) || fmt.Sprint(block["keys"]) != "[count name]" {
+		t.Errorf("checksum block = %v, want event 1 of this connection with keys count and name", block)
+	}
+}
+
+// A stream that hasn't diffed any signals checks an empty store
+func TestDriftChecksumEmpty(t *testing.T) {
+	m := NewDriftMonitor(DriftConfig{})
+	w := newTestWriter()
+	s := newStream(w, nil, WithDriftMonitor(m, 10*time.Millisecond))
+	defer s.Close(nil)
+
+	waitFor(t, "a checksum", func() bool { return len(checksums(w)) > 0 })
+	h := fnv.New32a()
+	h.Write([]byte(`{}`))
+	block := checksums(w)[0]
+	if keys, ok := block["keys"].([]any); !ok || len(keys) != 0 || block["sum"] != fmt.Sprintf("%08x", h.Sum32()) {
+		t.Errorf("checksum block = %v, want no keys and the sum of {}", block)
+	}
+}
+
+// A drift report has the stream clear the store's keys and patch them back
+// whole, in one group
+func TestDriftResync(t *testing.T) {
+	m := NewDriftMonitor(DriftConfig{})
+	w := newTestWriter()
+	s := newStream(w, nil, WithDriftMonitor(m, time.Hour))
+	defer s.Close(nil)
+	s.MarshalAndPatchSignalChanges(map[string]any{"count": 1})
+
+	report := func(conn uint64) int {
+		rec := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"conn":%d,"id":1,"expected":"a","actual":"b"}`, conn)
+		m.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/drift", strings.NewReader(body)))
+		return rec.Code
+	}
+	if code := report(s.ConnInfo().ID); code != http.StatusAccepted {
+		t.Fatalf("report answered %d, want 202", code)
+	}
+	waitFor(t, "the resync", func() bool { return strings.Contains(w.String(), `{"count":null}`) })
+	got := w.String()
+	resync := got[strings.Index(got, `{"count":null}`):]
+	if !strings.Contains(resync, `{"count":1}`) || !strings.Contains(resync, TxField) {
+		t.Errorf("resync isn't the cleared and full state in one group:\n%s", got)
+	}
+
+	if code := report(s.ConnInfo().ID + 1000); code != http.StatusNotFound {
+		t.Errorf("report for an unknown stream answered %d, want 404", code)
+	}
+}
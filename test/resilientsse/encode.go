@@ -0,0 +1,110 @@
+package resilientsse
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// framePool recycles the buffers events are rendered into, so a stream
+// sending thousands of events a second doesn't allocate one for each
+var framePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, 1024)
+		return &b
+	},
+}
+
+// maxPooledFrame is the largest buffer put back in framePool; the memory of
+// an unusually large event is left to the GC rather than pinned in the pool
+const maxPooledFrame = 64 << 10
+
+// heartbeatFrame is the comment written by heartbeats
+var heartbeatFrame = []byte(": heartbeat\n\n")
+
+// plainEvent is a signal or element patch without options. The stream
+// encodes these, the bulk of most streams, itself, straight into a pooled
+// buffer; datastar-go's encoder allocates for every event.
+type plainEvent struct {
+	eventType datastar.EventType
+	signals   []byte
+	elements  string
+	priority  Priority
+}
+
+// appendPlainEvent appends e, under id if any, to buf, byte for byte as
+// datastar-go renders it, extra blank line included
+func appendPlainEvent(buf []byte, e plainEvent, id []byte) []byte {
+	buf = append(buf, "event: "...)
+	buf = append(buf, e.eventType...)
+	buf = append(buf, '\n')
+	if len(id) > 0 {
+		buf = append(buf, "id: "...)
+		buf = append(buf, id...)
+		buf = append(buf, '\n')
+	}
+	switch e.eventType {
+	case datastar.EventTypePatchSignals:
+		buf = appendDataLines(buf, datastar.SignalsDatalineLiteral, e.signals)
+	case datastar.EventTypePatchElements:
+		if e.elements != "" {
+			buf = appendDataLinesString(buf, datastar.ElementsDatalineLiteral, e.elements)
+		}
+	}
+	return append(buf, "\n\n"...)
+}
+
+// appendDataLines appends a data field for each line of data, starting with
+// prefix
+func appendDataLines(buf []byte, prefix string, data []byte) []byte {
+	for {
+		line, rest, more := bytes.Cut(data, []byte("\n"))
+		buf = append(buf, "data: "...)
+		buf = append(buf, prefix...)
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+		if !more {
+			return buf
+		}
+		data = rest
+	}
+}
+
+// appendDataLinesString is appendDataLines for data held in a string
+func appendDataLinesString(buf []byte, prefix, data string) []byte {
+	for {
+		line, rest, more := strings.Cut(data, "\n")
+		buf = append(buf, "data: "...)
+		buf = append(buf, prefix...)
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+		if !more {
+			return buf
+		}
+		data = rest
+	}
+}
+
+// emitPlain is emit for a patch without options, encoded by the stream
+func (s *ResilientSSE) emitPlain(e plainEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ctx.Err(); err != nil {
+		return s.streamErr()
+	}
+	if err := s.flushCoalesced(); err != nil {
+		return err
+	}
+
+	s.seq++
+	var id [20]byte
+	start := time.Now()
+	s.w.hold()
+	s.w.held = appendPlainEvent(s.w.held, e, strconv.AppendUint(id[:0], s.seq, 10))
+	return s.sendGroup(1, s.w.release(), start, e.priority)
+}
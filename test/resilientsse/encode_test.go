@@ -0,0 +1,104 @@
+package resilientsse
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// appendPlainEvent must render exactly what datastar-go's encoder does, or
+// clients would see the stream change with the options a patch is sent with
+func TestAppendPlainEventMatchesDatastar(t *testing.T) {
+	cases := []struct {
+		name string
+		e    plainEvent
+		id   string
+	}{
+		{"signals", plainEvent{eventType: datastar.EventTypePatchSignals, signals: []byte(`{"n":1}`)}, "7"},
+		{"signals without id", plainEvent{eventType: datastar.EventTypePatchSignals, signals: []byte(`{"n":1}`)}, ""},
+		{"multiline signals", plainEvent{eventType: datastar.EventTypePatchSignals, signals: []byte("{\n  \"n\": 1\n}")}, "8"},
+		{"elements", plainEvent{eventType: datastar.EventTypePatchElements, elements: `<div id="a">a</div>`}, "9"},
+		{"multiline elements", plainEvent{eventType: datastar.EventTypePatchElements, elements: "<ul id=\"l\">\n<li>1</li>\n</ul>"}, "10"},
+		{"no elements", plainEvent{eventType: datastar.EventTypePatchElements}, "11"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			sse := datastar.NewSSE(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			start := rec.Body.Len()
+			var err error
+			if c.e.eventType == datastar.EventTypePatchSignals {
+				err = sse.PatchSignals(c.e.signals, datastar.WithPatchSignalsEventID(c.id))
+			} else {
+				err = sse.PatchElements(c.e.elements, datastar.WithPatchElementsEventID(c.id))
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := rec.Body.String()[start:]
+			if got := string(appendPlainEvent(nil, c.e, []byte(c.id))); got != want {
+				t.Errorf("appendPlainEvent() = %q, datastar-go writes %q", got, want)
+			}
+		})
+	}
+}
+
+// discardWriter is a ResponseWriter that throws everything away, so only
+// the stream's own work is measured
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+func (w *discardWriter) Flush()                      {}
+
+// benchPayload is the bytes of data in each benchmarked event
+const benchPayload = 64
+
+// benchSend measures sending events with send on a stream whose client
+// discards them, opened with header and opts
+func benchSend(b *testing.B, header http.Header, send func(s *ResilientSSE) error, opts ...Option) {
+	r := httptest.NewRequest(http.MethodGet, "/bench", nil)
+	if header != nil {
+		r.Header = header
+	}
+	s := New(&discardWriter{header: http.Header{}}, r, opts...)
+	defer s.Close(nil)
+
+	b.ReportAllocs()
+	for b.Loop() {
+		if err := send(s); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+var (
+	benchSignals  = fmt.Appendf(nil, `{"payload":%q}`, strings.Repeat("x", benchPayload))
+	benchElements = `<div id="payload">` + strings.Repeat("x", benchPayload) + `</div>`
+)
+
+func patchBenchSignals(s *ResilientSSE) error { return s.PatchSignals(benchSignals) }
+
+func BenchmarkPatchSignals(b *testing.B) {
+	benchSend(b, nil, patchBenchSignals)
+}
+
+func BenchmarkPatchElements(b *testing.B) {
+	benchSend(b, nil, func(s *ResilientSSE) error { return s.PatchElements(benchElements) })
+}
+
+func BenchmarkPatchSignalsReplay(b *testing.B) {
+	benchSend(b, nil, patchBenchSignals, WithReplay(NewReplayBuffer(1024)))
+}
+
+func BenchmarkPatchSignalsEnvelopeV2(b *testing.B) {
+	benchSend(b, http.Header{EnvelopeHeader: {"2"}}, patchBenchSignals, WithEnvelope(EnvelopeV2))
+}
@@ -0,0 +1,113 @@
+package resilientsse
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// EnvelopeHeader carries the envelope version a client understands on the
+	// request, and the version the server chose on the response
+	EnvelopeHeader = "X-Resilient-Envelope"
+
+	// EnvelopeParam is accepted in place of EnvelopeHeader on the request, for
+	// clients that cannot set request headers
+	EnvelopeParam = "resilientEnvelope"
+
+	// EnvelopeField is the SSE field holding EnvelopeV2 metadata
+	EnvelopeField = "resilient"
+)
+
+// Envelope is a version of the framing events are sent in
+type Envelope int
+
+const (
+	// EnvelopeV1 is plain datastar events. It is what every client gets unless
+	// it asks for more.
+	EnvelopeV1 Envelope = 1
+	// EnvelopeV2 adds an EnvelopeField line to the last event of each group
+	// with JSON metadata: the envelope version, the time the group was sent
+	// in Unix milliseconds and, for events resent from replay, "replay":true:
+	//
+	//	event: datastar-patch-signals
+	//	id: 42
+	//	data: signals {"count":42}
+	//	resilient: {"v":2,"ts":1760000000000}
+	//
+	// SSE parsers, datastar's included, ignore fields they don't know, so a v2
+	// event is also a valid v1 event; a client that asks for v2 without
+	// understanding it loses nothing.
+	EnvelopeV2 Envelope = 2
+)
+
+// WithEnvelope lets clients negotiate an envelope version up to max. A
+// client asks for a version with [EnvelopeHeader] or [EnvelopeParam] and gets
+// the lower of that and max; a client that doesn't ask, or asks for something
+// unparseable, gets [EnvelopeV1]. The chosen version is sent back in the
+// EnvelopeHeader response header.
+//
+// Without WithEnvelope every stream is v1 and the response carries no header.
+func WithEnvelope(max Envelope) Option {
+	return func(o *options) {
+		o.envelope = max
+	}
+}
+
+// Envelope returns the envelope version negotiated for the stream
+func (s *ResilientSSE) Envelope() Envelope {
+	return s.envelope
+}
+
+// negotiateEnvelope picks the envelope version for r, up to max
+func negotiateEnvelope(r *http.Request, max Envelope) Envelope {
+	asked := r.Header.Get(EnvelopeHeader)
+	if asked == "" {
+		asked = r.URL.Query().Get(EnvelopeParam)
+	}
+	v, err := strconv.Atoi(asked)
+	if err != nil || Envelope(v) < EnvelopeV1 {
+		return EnvelopeV1
+	}
+	return min(Envelope(v), max)
+}
+
+// wrapEnvelope returns frames, an event group rendered as v1, in the stream's
+// envelope and serializer, with debug's metadata if it isn't nil. Replay
+// buffers hold v1 frames, so they can be replayed to clients of any version.
+func (s *ResilientSSE) wrapEnvelope(frames []byte, replayed bool, debug *groupDebug) []byte {
+	if s.serializer != nil {
+		frames = serializeSignals(frames, s.serializer)
+	}
+	if s.envelope < EnvelopeV2 && debug == nil {
+		return frames
+	}
+	// the field goes inside the last event, before the blank line ending it
+	body := bytes.TrimRight(frames, "\n")
+	if len(body) == len(frames) {
+		return frames
+	}
+
+	wrapped := make([]byte, 0, len(frames)+len(EnvelopeField)+128)
+	wrapped = append(wrapped, body...)
+	wrapped = append(wrapped, "\n"+EnvelopeField+`: {"v":`...)
+	wrapped = strconv.AppendInt(wrapped, int64(s.envelope), 10)
+	wrapped = append(wrapped, `,"ts":`...)
+	wrapped = strconv.AppendInt(wrapped, time.Now().UnixMilli(), 10)
+	if replayed {
+		wrapped = append(wrapped, `,"replay":true`...)
+	}
+	if debug != nil {
+		wrapped = append(wrapped, `,"debug":{"events":`...)
+		wrapped = strconv.AppendInt(wrapped, int64(debug.events), 10)
+		wrapped = append(wrapped, `,"bytes":`...)
+		wrapped = strconv.AppendInt(wrapped, int64(len(frames)), 10)
+		wrapped = append(wrapped, `,"renderUs":`...)
+		wrapped = strconv.AppendInt(wrapped, debug.render.Microseconds(), 10)
+		wrapped = append(wrapped, `,"idleMs":`...)
+		wrapped = strconv.AppendInt(wrapped, debug.idle.Milliseconds(), 10)
+		wrapped = append(wrapped, '}')
+	}
+	return append(wrapped, "}\n\n"...)
+}
@@ -0,0 +1,282 @@
+package resilientsse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Replay stores are exported in a simple binary format, so their contents can
+// be moved between stores or used to seed test environments (see
+// [ExportReplay] and [ImportReplay]):
+//
+//	magic    "RSSEREPL"
+//	version  1 byte (currently 1)
+//	sections until EOF, one per buffer:
+//	    key       uvarint length + bytes ("" for a lone ReplayBuffer)
+//	    capacity  uvarint
+//	    count     uvarint
+//	    events    count times, oldest first:
+//	        id     uvarint
+//	        frame  uvarint length + bytes (the exact SSE frame sent)
+const (
+	exportMagic   = "RSSEREPL"
+	exportVersion = 1
+
+	// maxExportFrame and maxExportCapacity guard Import against corrupt input
+	// claiming huge frames or buffers
+	maxExportFrame    = 64 << 20
+	maxExportCapacity = 1 << 20
+)
+
+// ErrExportFormat is returned by [ImportReplay] and the Import methods when the
+// input is not a valid export
+var ErrExportFormat = errors.New("resilientsse: invalid replay export")
+
+// Range calls fn for each buffered event, oldest first, until fn returns false
+func (b *ReplayBuffer) Range(fn func(id uint64, frame []byte) bool) {
+	b.mu.Lock()
+	events := make([]replayEvent, b.n)
+	for i := range b.n {
+		events[i] = b.events[(b.start+i)%len(b.events)]
+	}
+	b.mu.Unlock()
+
+	for _, e := range events {
+		if !fn(e.id, e.frame) {
+			return
+		}
+	}
+}
+
+// Export writes the buffer's events to w in the export format
+func (b *ReplayBuffer) Export(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	writeExportHeader(bw)
+	var events []replayEvent
+	b.Range(func(id uint64, frame []byte) bool {
+		events = append(events, replayEvent{id: id, frame: frame})
+		return true
+	})
+	writeExportSection(bw, "", b.Cap(), events)
+	return bw.Flush()
+}
+
+// Import adds the events of an export written by [ReplayBuffer.Export] that
+// are newer than the buffer's newest event
+func (b *ReplayBuffer) Import(r io.Reader) error {
+	br := bufio.NewReader(r)
+	if err := readExportHeader(br); err != nil {
+		return err
+	}
+	return readExportSections(br, func(string, int) ReplayStore { return b.Store() })
+}
+
+// ReplayExporter is implemented by sets of replay stores kept by key whose
+// contents [ExportReplay] can write. [ReplayBuffers] and the stores of the
+// boltreplay and redisreplay packages implement it.
+type ReplayExporter interface {
+	// ExportKeys returns the keys holding events, sorted
+	ExportKeys() ([]string, error)
+	// ExportEvents calls fn for each event kept for key, oldest first,
+	// stopping at the first error fn returns, and returns how many events
+	// the key keeps. frame is only valid until fn returns.
+	ExportEvents(key string, fn func(id uint64, frame []byte) error) (size int, err error)
+}
+
+// ReplayImporter is implemented by sets of replay stores kept by key that
+// [ImportReplay] can load an export into. [ReplayBuffers] and the stores of
+// the boltreplay and redisreplay packages implement it.
+type ReplayImporter interface {
+	// ImportStore returns the store for key, keeping size events if it is
+	// created
+	ImportStore(key string, size int) ReplayStore
+}
+
+// ExportReplay writes every key of src to w in the export format, one section
+// per key, e.g. to move a running server's replay to another kind of store
+func ExportReplay(w io.Writer, src ReplayExporter) error {
+	keys, err := src.ExportKeys()
+	if err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	writeExportHeader(bw)
+	for _, key := range keys {
+		var events []replayEvent
+		size, err := src.ExportEvents(key, func(id uint64, frame []byte) error {
+			events = append(events, replayEvent{id: id, frame: append([]byte(nil), frame...)})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		writeExportSection(bw, key, size, events)
+	}
+	return bw.Flush()
+}
+
+// ImportReplay loads an export into dst, adding to each key's store the
+// events newer than its newest
+func ImportReplay(r io.Reader, dst ReplayImporter) error {
+	br := bufio.NewReader(r)
+	if err := readExportHeader(br); err != nil {
+		return err
+	}
+	return readExportSections(br, dst.ImportStore)
+}
+
+// Keys returns the keys of all buffers, sorted
+func (bs *ReplayBuffers) Keys() []string {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	keys := make([]string, 0, len(bs.buffers))
+	for k := range bs.buffers {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ExportKeys returns the keys of all buffers, sorted
+func (bs *ReplayBuffers) ExportKeys() ([]string, error) {
+	return bs.Keys(), nil
+}
+
+// ExportEvents calls fn for each event of the buffer for key, if there is one
+func (bs *ReplayBuffers) ExportEvents(key string, fn func(id uint64, frame []byte) error) (int, error) {
+	bs.mu.Lock()
+	b, ok := bs.buffers[key]
+	bs.mu.Unlock()
+	if !ok {
+		return 0, nil
+	}
+	return b.Cap(), b.exportEvents(fn)
+}
+
+// ImportStore returns the buffer for key as a store, creating it with size
+func (bs *ReplayBuffers) ImportStore(key string, size int) ReplayStore {
+	return bs.GetWithSize(key, size).Store()
+}
+
+// Export writes every buffer to w in the export format, one section per key
+func (bs *ReplayBuffers) Export(w io.Writer) error {
+	return ExportReplay(w, bs)
+}
+
+// Import loads an export into the buffers, creating missing ones with the
+// exported capacity and adding events newer than an existing buffer's newest
+func (bs *ReplayBuffers) Import(r io.Reader) error {
+	return ImportReplay(r, bs)
+}
+
+// exportEvents calls fn for each buffered event, oldest first, until fn
+// returns an error
+func (b *ReplayBuffer) exportEvents(fn func(id uint64, frame []byte) error) error {
+	var err error
+	b.Range(func(id uint64, frame []byte) bool {
+		err = fn(id, frame)
+		return err == nil
+	})
+	return err
+}
+
+func writeExportHeader(w *bufio.Writer) {
+	w.WriteString(exportMagic)
+	w.WriteByte(exportVersion)
+}
+
+func writeExportSection(w *bufio.Writer, key string, size int, events []replayEvent) {
+	writeUvarint(w, uint64(len(key)))
+	w.WriteString(key)
+	writeUvarint(w, uint64(max(size, 0)))
+	writeUvarint(w, uint64(len(events)))
+	for _, e := range events {
+		writeUvarint(w, e.id)
+		writeUvarint(w, uint64(len(e.frame)))
+		w.Write(e.frame)
+	}
+}
+
+func writeUvarint(w *bufio.Writer, v uint64) {
+	w.Write(binary.AppendUvarint(nil, v))
+}
+
+func readExportHeader(r *bufio.Reader) error {
+	header := make([]byte, len(exportMagic)+1)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(exportMagic)]) != exportMagic {
+		return ErrExportFormat
+	}
+	if v := header[len(exportMagic)]; v != exportVersion {
+		return fmt.Errorf("%w: unsupported version %d", ErrExportFormat, v)
+	}
+	return nil
+}
+
+// readExportSections reads sections until EOF, adding each one's events
+// newer than the newest of the store returned by store
+func readExportSections(r *bufio.Reader, store func(key string, size int) ReplayStore) error {
+	for {
+		keyLen, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return nil
+		}
+		key, err := readExportBytes(r, keyLen, err)
+		if err != nil {
+			return err
+		}
+
+		size, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrExportFormat, err)
+		}
+		count, err := binary.ReadUvarint(r)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrExportFormat, err)
+		}
+
+		s := store(string(key), int(min(size, maxExportCapacity)))
+		last, err := s.LastID()
+		if err != nil {
+			return err
+		}
+		for range count {
+			id, err := binary.ReadUvarint(r)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrExportFormat, err)
+			}
+			frameLen, err := binary.ReadUvarint(r)
+			frame, err := readExportBytes(r, frameLen, err)
+			if err != nil {
+				return err
+			}
+			if id > last {
+				if err := s.Append(id, frame); err != nil {
+					return err
+				}
+				last = id
+			}
+		}
+	}
+}
+
+// readExportBytes reads a length-prefixed field whose length was read with err
+func readExportBytes(r *bufio.Reader, n uint64, err error) ([]byte, error) {
+	if err == nil && n > maxExportFrame {
+		err = fmt.Errorf("field of %d bytes", n)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrExportFormat, err)
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrExportFormat, err)
+	}
+	return buf, nil
+}
@@ -0,0 +1,29 @@
+package resilientsse
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReplayBuffersExportImport(t *testing.T) {
+	src := NewReplayBuffers(10)
+	addEvents(src.Get("a"), 1, 2, 3)
+	addEvents(src.Get("b"), 7)
+	var dump bytes.Buffer
+	if err := src.Export(&dump); err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+
+	// importing into a live store keeps what it has, and adds what's newer
+	dst := NewReplayBuffers(10)
+	addEvents(dst.Get("a"), 1, 2)
+	if err := dst.Import(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if got, complete := dst.Get("a").Since(0); !equalFrames(got, frames(1, 2, 3)) || !complete {
+		t.Errorf("imported buffer a has %d frames, complete %v; want 3, complete", len(got), complete)
+	}
+	if got, complete := dst.Get("b").Since(6); !equalFrames(got, frames(7)) || !complete {
+		t.Errorf("imported buffer b has %d frames after 6, complete %v; want 1, complete", len(got), complete)
+	}
+}
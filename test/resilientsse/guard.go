@@ -0,0 +1,131 @@
+package resilientsse
+
+import (
+	"cmp"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrTooManyConnections is the cause reported by [ResilientSSE.Err] for
+// streams a [ConnectionGuard] refused
+var ErrTooManyConnections = errors.New("resilientsse: too many connections")
+
+// DefaultGuardRetry is the Retry-After of refused connections without a Retry
+// policy: 5 to 10 seconds, so refused clients don't all come back together
+var DefaultGuardRetry = ReconnectPolicy{Min: 10 * time.Second, Jitter: 0.5}
+
+// ConnectionGuardConfig configures a [ConnectionGuard]
+type ConnectionGuardConfig struct {
+	// Max caps the streams open at once; zero means no cap
+	Max int
+	// MaxPerKey caps the streams open at once for each key, e.g. each user;
+	// zero means no cap
+	MaxPerKey int
+	// Key returns the key a request's stream counts against for MaxPerKey;
+	// nil means the client's IP
+	Key func(r *http.Request) string
+	// Retry computes the Retry-After of a refused connection (attempt 0);
+	// zero means DefaultGuardRetry
+	Retry ReconnectPolicy
+	// Metrics, if set, tracks the streams open and counts refused ones
+	Metrics *Metrics
+}
+
+// ConnectionGuard caps the streams open at once, overall and per key, so a
+// burst of clients can't exhaust the server. Streams opened
+// [WithConnectionGuard] beyond a cap are refused with 503 Service Unavailable
+// and a jittered Retry-After before anything is streamed.
+//
+// A ConnectionGuard is safe for concurrent use.
+type ConnectionGuard struct {
+	c ConnectionGuardConfig
+
+	mu      sync.Mutex
+	streams map[*ResilientSSE]string
+	perKey  map[string]int
+}
+
+// NewConnectionGuard creates a guard with no streams
+func NewConnectionGuard(c ConnectionGuardConfig) *ConnectionGuard {
+	if c.Key == nil {
+		c.Key = clientIP
+	}
+	c.Retry = cmp.Or(c.Retry, DefaultGuardRetry)
+	return &ConnectionGuard{c: c, streams: map[*ResilientSSE]string{}, perKey: map[string]int{}}
+}
+
+// WithConnectionGuard counts the stream against g's caps until it is closed.
+// A stream over a cap is answered with 503 and returned closed, with
+// [ErrTooManyConnections].
+func WithConnectionGuard(g *ConnectionGuard) Option {
+	return func(o *options) {
+		o.guard = g
+	}
+}
+
+// Len returns the number of streams open
+func (g *ConnectionGuard) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return len(g.streams)
+}
+
+// Count returns the number of streams open for key
+func (g *ConnectionGuard) Count(key string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.perKey[key]
+}
+
+// add counts s against the caps, or answers w with 503 if that would exceed
+// one
+func (g *ConnectionGuard) add(s *ResilientSSE, w http.ResponseWriter, r *http.Request) error {
+	key := g.c.Key(r)
+
+	g.mu.Lock()
+	full := (g.c.Max > 0 && len(g.streams) >= g.c.Max) ||
+		(g.c.MaxPerKey > 0 && g.perKey[key] >= g.c.MaxPerKey)
+	if !full {
+		g.streams[s] = key
+		g.perKey[key]++
+	}
+	g.mu.Unlock()
+
+	if full {
+		if g.c.Metrics != nil {
+			g.c.Metrics.guardRefused.Add(1)
+		}
+		retry := max(g.c.Retry.Delay(0), time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "too many connections", http.StatusServiceUnavailable)
+		return ErrTooManyConnections
+	}
+	if g.c.Metrics != nil {
+		g.c.Metrics.guarded.Add(1)
+	}
+	return nil
+}
+
+// remove uncounts s, if it was counted
+func (g *ConnectionGuard) remove(s *ResilientSSE) {
+	g.mu.Lock()
+	key, ok := g.streams[s]
+	if ok {
+		delete(g.streams, s)
+		if g.perKey[key]--; g.perKey[key] == 0 {
+			delete(g.perKey, key)
+		}
+	}
+	g.mu.Unlock()
+
+	if ok && g.c.Metrics != nil {
+		g.c.Metrics.guarded.Add(-1)
+	}
+}
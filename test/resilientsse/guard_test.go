@@ -0,0 +1,61 @@
+package resilientsse
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// guardedStream opens a stream for session through g, recording the response
+func guardedStream(g *ConnectionGuard, session string) (*ResilientSSE, *httptest.ResponseRecorder) {
+	w := httptest.NewRecorder()
+	header := http.Header{}
+	header.Set(SessionHeader, session)
+	return newStream(w, header, WithConnectionGuard(g)), w
+}
+
+func TestConnectionGuardPerSession(t *testing.T) {
+	g := NewConnectionGuard(ConnectionGuardConfig{MaxPerKey: 1, Key: KeyBySession})
+
+	first, _ := guardedStream(g, "a")
+	defer first.Close(nil)
+	if first.IsClosed() || g.Count("session a") != 1 {
+		t.Fatalf("first stream closed %v, counted %d times", first.IsClosed(), g.Count("session a"))
+	}
+
+	dup, w := guardedStream(g, "a")
+	if !dup.IsClosed() || !errors.Is(dup.Err(), ErrTooManyConnections) {
+		t.Errorf("duplicate stream closed %v with %v, want ErrTooManyConnections", dup.IsClosed(), dup.Err())
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Errorf("duplicate stream answered %d, Retry-After %q, want 503 with a Retry-After",
+			w.Code, w.Header().Get("Retry-After"))
+	}
+	dup.Close(nil)
+	if n := g.Count("session a"); n != 1 {
+		t.Errorf("closing the refused stream left %d counted, want 1", n)
+	}
+
+	other, _ := guardedStream(g, "b")
+	defer other.Close(nil)
+	if other.IsClosed() {
+		t.Error("another session's stream was refused")
+	}
+}
+
+func TestConnectionGuardReleaseOnClose(t *testing.T) {
+	g := NewConnectionGuard(ConnectionGuardConfig{Max: 1, MaxPerKey: 1, Key: KeyBySession})
+
+	first, _ := guardedStream(g, "a")
+	first.Close(nil)
+	if g.Len() != 0 || g.Count("session a") != 0 {
+		t.Fatalf("after Close, %d streams and %d for the session are counted", g.Len(), g.Count("session a"))
+	}
+
+	second, _ := guardedStream(g, "a")
+	defer second.Close(nil)
+	if second.IsClosed() {
+		t.Errorf("reconnect after Close refused: %v", second.Err())
+	}
+}
@@ -0,0 +1,102 @@
+package resilientsse
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrHeartbeatFailed is the cause reported by [ResilientSSE.Err] when a
+// heartbeat could not be written, which usually means the client is gone
+var ErrHeartbeatFailed = errors.New("resilientsse: heartbeat write failed")
+
+// WithHeartbeat writes an SSE comment whenever the stream has been idle for
+// interval, so proxies and load balancers don't drop quiet connections. A
+// failed heartbeat write ends the stream, cancelling its context.
+//
+// Heartbeats are written beneath datastar-go, so they cannot be combined with
+// [datastar.WithCompression] passed through [WithSSEOptions].
+func WithHeartbeat(interval time.Duration) Option {
+	return func(o *options) {
+		o.heartbeat = interval
+	}
+}
+
+// SetHeartbeat changes the heartbeat interval of a live stream, starting
+// heartbeats if it had none. An interval of 0 stops them.
+func (s *ResilientSSE) SetHeartbeat(interval time.Duration) {
+	s.heartbeatInterval.Store(int64(interval))
+
+	s.bgMu.Lock()
+	defer s.bgMu.Unlock()
+
+	if s.heartbeatWake == nil {
+		if interval <= 0 || s.ctx.Err() != nil {
+			return
+		}
+		s.heartbeatWake = make(chan struct{}, 1)
+		s.wg.Go(s.heartbeat)
+		return
+	}
+
+	select {
+	case s.heartbeatWake <- struct{}{}:
+	default:
+	}
+}
+
+// heartbeat runs until the stream ends, writing a comment every time the
+// stream goes the current heartbeat interval without sending anything
+func (s *ResilientSSE) heartbeat() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		interval := time.Duration(s.heartbeatInterval.Load())
+		var tick <-chan time.Time
+		if interval > 0 {
+			s.mu.Lock()
+			idle := time.Since(s.lastWrite)
+			s.mu.Unlock()
+			timer.Reset(interval - idle)
+			tick = timer.C
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.heartbeatWake:
+			continue
+		case <-tick:
+		}
+
+		s.mu.Lock()
+		if s.ctx.Err() != nil {
+			s.mu.Unlock()
+			return
+		}
+		if time.Since(s.lastWrite) < interval || (s.queue != nil && s.queue.pending()) {
+			s.mu.Unlock()
+			continue
+		}
+
+		if s.queue != nil {
+			err := s.send(heartbeatFrame)
+			s.lastWrite = time.Now()
+			s.mu.Unlock()
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		err := s.w.writeFrames(heartbeatFrame)
+		s.lastWrite = time.Now()
+		s.mu.Unlock()
+
+		if err != nil {
+			s.failWrite(fmt.Errorf("%w: %w", ErrHeartbeatFailed, err))
+			return
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package resilientsse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// heartbeats counts the heartbeats written to w
+func heartbeats(w *testWriter) int {
+	return strings.Count(w.String(), string(heartbeatFrame))
+}
+
+// An idle stream gets a heartbeat every interval
+func TestHeartbeatCadence(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithHeartbeat(20*time.Millisecond))
+	defer s.Close(nil)
+
+	time.Sleep(110 * time.Millisecond)
+	if n := heartbeats(w); n < 3 || n > 6 {
+		t.Errorf("%d heartbeats in 110ms at 20ms, want about 5", n)
+	}
+}
+
+// Events already keep the connection busy, so they postpone heartbeats
+func TestHeartbeatPostponedByEvents(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithHeartbeat(40*time.Millisecond))
+	defer s.Close(nil)
+
+	for range 10 {
+		time.Sleep(10 * time.Millisecond)
+		if err := s.PatchSignals([]byte(`{"n":1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := heartbeats(w); n != 0 {
+		t.Errorf("%d heartbeats on a stream sending an event every 10ms", n)
+	}
+}
+
+func TestSetHeartbeat(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil)
+	defer s.Close(nil)
+
+	s.SetHeartbeat(10 * time.Millisecond)
+	waitFor(t, "a heartbeat", func() bool { return heartbeats(w) > 0 })
+
+	s.SetHeartbeat(0)
+	time.Sleep(15 * time.Millisecond) // one in flight may still land
+	n := heartbeats(w)
+	time.Sleep(50 * time.Millisecond)
+	if heartbeats(w) != n {
+		t.Errorf("heartbeats went on after SetHeartbeat(0)")
+	}
+}
+
+func TestHeartbeatWriteFailed(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithHeartbeat(10*time.Millisecond))
+	defer s.Close(nil)
+
+	w.failWrites()
+	waitDone(t, s)
+	if !errors.Is(s.Err(), ErrHeartbeatFailed) || !errors.Is(s.Err(), errClientGone) {
+		t.Errorf("stream ended with %v, want ErrHeartbeatFailed wrapping the write error", s.Err())
+	}
+}
@@ -0,0 +1,150 @@
+package resilientsse
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+)
+
+// ConnInfo describes a stream's connection to the lifecycle hooks
+type ConnInfo struct {
+	// ID is unique to the stream within the process
+	ID         uint64
+	RemoteAddr string
+	Path       string
+	// SessionID is set with [WithSessions]
+	SessionID string
+	// LastEventID is the point the client resumed from, "" on a fresh connection
+	LastEventID string
+	// Events is how many events the stream has sent so far, not counting
+	// replayed ones
+	Events uint64
+}
+
+// DropReason tells the OnDrop hook why a stream ended
+type DropReason int
+
+const (
+	// DropClosed means the server ended the stream with [ResilientSSE.Close]
+	// or a failed setup step such as the warm-up probe
+	DropClosed DropReason = iota
+	// DropClientGone means the request ended, normally because the client
+	// disconnected
+	DropClientGone
+	// DropWriteError means writing to the client failed
+	DropWriteError
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropClientGone:
+		return "client gone"
+	case DropWriteError:
+		return "write error"
+	default:
+		return "closed"
+	}
+}
+
+// Hooks are called at points in a stream's lifecycle. Any of them may be nil.
+// Hooks run on the goroutine that reached that point, so they should return
+// quickly.
+type Hooks struct {
+	// OnConnect runs when a client connects without a Last-Event-ID, once the
+	// stream is established
+	OnConnect func(info ConnInfo)
+	// OnResume runs instead of OnConnect when the client resumes with a
+	// Last-Event-ID, after any replay
+	OnResume func(info ConnInfo)
+	// OnReplay runs when a resuming client has been sent the events it
+	// missed from the replay store, before OnResume, with how many there
+	// were and whether they covered everything after its Last-Event-ID
+	OnReplay func(info ConnInfo, events int, complete bool)
+	// OnDrop runs once when [ResilientSSE.Close] is called on a stream that
+	// was established, with the reason and the cause reported by
+	// [ResilientSSE.Err]
+	OnDrop func(info ConnInfo, reason DropReason, cause error)
+}
+
+// WithHooks registers lifecycle hooks. It can be given several times; hooks
+// run in the order they were registered.
+func WithHooks(h Hooks) Option {
+	return func(o *options) {
+		o.hooks = append(o.hooks, h)
+	}
+}
+
+// connIDs numbers streams for ConnInfo.ID
+var connIDs atomic.Uint64
+
+// ConnInfo returns the stream's connection metadata
+func (s *ResilientSSE) ConnInfo() ConnInfo {
+	return ConnInfo{
+		ID:          s.connID,
+		RemoteAddr:  s.r.RemoteAddr,
+		Path:        s.r.URL.Path,
+		SessionID:   s.SessionID(),
+		LastEventID: s.lastEventID,
+		Events:      s.sent.Load(),
+	}
+}
+
+// failWrite ends the stream after a failed write to the client, with cause
+// classified as ErrWriteTimeout or ErrClientGone, and returns it classified
+func (s *ResilientSSE) failWrite(cause error) error {
+	cause = s.classifyWrite(cause)
+	s.writeFailed.Store(true)
+	s.cancel(cause)
+	return cause
+}
+
+// dropReason classifies why the (ended) stream ended
+func (s *ResilientSSE) dropReason() DropReason {
+	switch {
+	case s.writeFailed.Load():
+		return DropWriteError
+	case s.r.Context().Err() != nil && errors.Is(context.Cause(s.ctx), context.Canceled):
+		return DropClientGone
+	default:
+		return DropClosed
+	}
+}
+
+// runConnectHooks runs OnConnect or OnResume once the stream is established
+func (s *ResilientSSE) runConnectHooks() {
+	s.established = true
+	info := s.ConnInfo()
+	s.logConnect(info)
+	for _, h := range s.opts.hooks {
+		switch {
+		case s.Resumed() && h.OnResume != nil:
+			h.OnResume(info)
+		case !s.Resumed() && h.OnConnect != nil:
+			h.OnConnect(info)
+		}
+	}
+}
+
+// runReplayHooks runs OnReplay after a replay
+func (s *ResilientSSE) runReplayHooks() {
+	info := s.ConnInfo()
+	for _, h := range s.opts.hooks {
+		if h.OnReplay != nil {
+			h.OnReplay(info, s.replayed, !s.replayGap)
+		}
+	}
+}
+
+// runDropHooks runs OnDrop, once, for an established stream
+func (s *ResilientSSE) runDropHooks() {
+	if !s.established || !s.dropped.CompareAndSwap(false, true) {
+		return
+	}
+	info, reason, cause := s.ConnInfo(), s.dropReason(), s.Err()
+	s.logDrop(info, reason, cause)
+	for _, h := range s.opts.hooks {
+		if h.OnDrop != nil {
+			h.OnDrop(info, reason, cause)
+		}
+	}
+}
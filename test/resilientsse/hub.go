@@ -0,0 +1,163 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// Hub is a registry of live streams, for pushing events to every connected
+// client, to the subscribers of a topic (see [Hub.Publish]), or to one client
+// picked by its [ConnInfo.ID]:
+//
+//	hub := resilientsse.NewHub()
+//
+//	// in the stream handler
+//	stream := resilientsse.New(w, r, resilientsse.WithHub(hub))
+//	defer stream.Close(nil)
+//	<-stream.Context().Done()
+//
+//	// anywhere else
+//	hub.BroadcastSignals(map[string]any{"announcement": "deploying in 5m"})
+//
+// A Hub is safe for concurrent use.
+type Hub struct {
+	mu       sync.RWMutex
+	streams  map[uint64]*ResilientSSE
+	topicsOf map[uint64][]string // by stream ID
+
+	topicsMu    sync.Mutex
+	topics      map[string]*topic
+	topicReplay int
+	cursors     map[string]*sessionCursors // by session ID
+	cursorTTL   time.Duration
+	lastSweep   time.Time
+}
+
+// NewHub creates a Hub with no streams
+func NewHub() *Hub {
+	return &Hub{
+		streams:     map[uint64]*ResilientSSE{},
+		topicsOf:    map[uint64][]string{},
+		topics:      map[string]*topic{},
+		topicReplay: DefaultTopicReplay,
+		cursors:     map[string]*sessionCursors{},
+		cursorTTL:   DefaultCursorTTL,
+		lastSweep:   time.Now(),
+	}
+}
+
+// WithHub registers the stream with h once it is established, until it is
+// closed. It can be given several times to register with several hubs.
+func WithHub(h *Hub) Option {
+	return func(o *options) {
+		o.hubs = append(o.hubs, h)
+	}
+}
+
+// HubSend writes to one stream of a hub
+type HubSend func(s *ResilientSSE) error
+
+// Broadcast calls send on every registered stream and returns how many
+// succeeded. Streams are sent to concurrently, so a stalled client only holds
+// up Broadcast's return, not the other clients; successive broadcasts from
+// one goroutine reach each stream in order.
+func (h *Hub) Broadcast(send HubSend) int {
+	streams := h.Streams()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent := 0
+	for _, s := range streams {
+		wg.Go(func() {
+			if send(s) == nil {
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return sent
+}
+
+// BroadcastSignals patches signals on every registered stream, encoding them
+// only once, and returns how many streams were sent the patch
+func (h *Hub) BroadcastSignals(signals any, opts ...datastar.PatchSignalsOption) (int, error) {
+	b, err := json.Marshal(signals)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal signals: %w", err)
+	}
+	return h.Broadcast(func(s *ResilientSSE) error {
+		return s.PatchSignals(b, opts...)
+	}), nil
+}
+
+// BroadcastElements patches elements on every registered stream and returns
+// how many streams were sent the patch
+func (h *Hub) BroadcastElements(elements string, opts ...datastar.PatchElementOption) int {
+	return h.Broadcast(func(s *ResilientSSE) error {
+		return s.PatchElements(elements, opts...)
+	})
+}
+
+// Send calls send on the stream with the given ID, returning false if no such
+// stream is registered
+func (h *Hub) Send(id uint64, send HubSend) (ok bool, err error) {
+	s, ok := h.Get(id)
+	if !ok {
+		return false, nil
+	}
+	return true, send(s)
+}
+
+// Get returns the registered stream with the given ID
+func (h *Hub) Get(id uint64) (*ResilientSSE, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	s, ok := h.streams[id]
+	return s, ok
+}
+
+// Streams returns the registered streams, in no particular order
+func (h *Hub) Streams() []*ResilientSSE {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	streams := make([]*ResilientSSE, 0, len(h.streams))
+	for _, s := range h.streams {
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// Len returns the number of registered streams
+func (h *Hub) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return len(h.streams)
+}
+
+// add registers s
+func (h *Hub) add(s *ResilientSSE) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.streams[s.connID] = s
+}
+
+// remove unregisters s and unsubscribes it from its topics
+func (h *Hub) remove(s *ResilientSSE) {
+	h.mu.Lock()
+	delete(h.streams, s.connID)
+	topics := h.topicsOf[s.connID]
+	delete(h.topicsOf, s.connID)
+	h.mu.Unlock()
+
+	h.leaveTopics(s, topics)
+}
@@ -0,0 +1,99 @@
+package resilientsse
+
+import (
+	"errors"
+	"maps"
+	"time"
+)
+
+// ErrIdle is the cause reported by [ResilientSSE.Err] for streams closed by
+// [WithIdleTimeout]
+var ErrIdle = errors.New("resilientsse: idle timeout")
+
+// IdleSignal is the signal a stream closed by [WithIdleTimeout] patches just
+// before it ends, telling the client when to come back:
+//
+//	{"resilientIdle": {"reconnect": "backoff", "retry": 41250}}
+//
+// reconnect is "immediate" or "backoff", and retry is the delay in
+// milliseconds, also sent as the SSE retry field.
+const IdleSignal = "resilientIdle"
+
+// WithIdleTimeout closes the stream once it goes timeout without sending an
+// event; heartbeats don't count. Before closing it patches [IdleSignal] and
+// sends a retry field: a retry of 0 asks the client to reconnect immediately,
+// e.g. to be rebalanced onto another server, and a longer one to back off
+// for about that long (jittered by [DefaultRetryJitter]), e.g. to free the
+// connection of a client that has nothing to receive. The stream ends with
+// [ErrIdle], and [Hooks.OnDrop] sees [DropClosed].
+func WithIdleTimeout(timeout, retry time.Duration) Option {
+	return func(o *options) {
+		o.idleTimeout = timeout
+		o.idleRetry = retry
+	}
+}
+
+// startIdleWatch starts closing the stream once it goes idle, unless it has
+// already ended
+func (s *ResilientSSE) startIdleWatch() {
+	s.bgMu.Lock()
+	defer s.bgMu.Unlock()
+
+	if s.ctx.Err() == nil {
+		s.wg.Go(s.idleWatch)
+	}
+}
+
+// idleWatch runs until the stream ends, closing it if it goes the idle
+// timeout without an event
+func (s *ResilientSSE) idleWatch() {
+	timeout := s.opts.idleTimeout
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		s.mu.Lock()
+		idle := time.Since(s.lastEvent)
+		s.mu.Unlock()
+		if idle < timeout {
+			timer.Reset(timeout - idle)
+			continue
+		}
+
+		s.closeIdle()
+		return
+	}
+}
+
+// closeIdle tells the client when to reconnect and ends the stream
+func (s *ResilientSSE) closeIdle() {
+	s.closeWithRetry(IdleSignal, nil, s.opts.idleRetry, ErrIdle)
+}
+
+// closeWithRetry patches signal with a reconnect directive for about retry
+// (jittered by DefaultRetryJitter), alongside fields, sends the same delay as
+// the retry field for clients that only read that, and ends the stream with
+// cause
+func (s *ResilientSSE) closeWithRetry(signal string, fields map[string]any, retry time.Duration, cause error) {
+	p := ReconnectPolicy{Min: retry, Max: retry, Jitter: DefaultRetryJitter}
+	retry = p.Delay(0)
+	reconnect := "backoff"
+	if retry <= 0 {
+		reconnect = "immediate"
+	}
+
+	directive := map[string]any{
+		"reconnect": reconnect,
+		"retry":     retry.Milliseconds(),
+	}
+	maps.Copy(directive, fields)
+	s.MarshalAndPatchSignals(map[string]any{signal: directive})
+	s.SetRetry(retry)
+	s.cancel(cause)
+}
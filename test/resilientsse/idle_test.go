@@ -0,0 +1,60 @@
+package resilientsse
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitDone waits for s to end
+func waitDone(t *testing.T, s *ResilientSSE) {
+	t.Helper()
+	select {
+	case <-s.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream didn't end")
+	}
+}
+
+// An idle stream is closed, with a directive to reconnect, once it goes the
+// timeout without an event, heartbeats or not; events keep it open
+func TestIdleClose(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithIdleTimeout(60*time.Millisecond, 0), WithHeartbeat(10*time.Millisecond))
+	defer s.Close(nil)
+
+	for range 5 {
+		time.Sleep(20 * time.Millisecond)
+		if err := s.PatchSignals([]byte(`{"n":1}`)); err != nil {
+			t.Fatalf("stream sending events every 20ms closed: %v", err)
+		}
+	}
+
+	sent := time.Now()
+	waitDone(t, s)
+	if idle := time.Since(sent); idle < 60*time.Millisecond {
+		t.Errorf("stream closed %v after its last event, before the idle timeout", idle)
+	}
+	if !errors.Is(s.Err(), ErrIdle) {
+		t.Errorf("stream ended with %v, want ErrIdle", s.Err())
+	}
+	got := w.String()
+	if !strings.Contains(got, ": heartbeat") {
+		t.Errorf("no heartbeats were sent while idle:\n%s", got)
+	}
+	if !strings.Contains(got, `{"`+IdleSignal+`":{"reconnect":"immediate","retry":0}}`) || !strings.Contains(got, "\nretry: 0\n") {
+		t.Errorf("idle stream wasn't told to reconnect at once:\n%s", got)
+	}
+}
+
+func TestIdleCloseBackoff(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil, WithIdleTimeout(10*time.Millisecond, time.Minute))
+	defer s.Close(nil)
+
+	waitDone(t, s)
+	if got := w.String(); !strings.Contains(got, `{"`+IdleSignal+`":{"reconnect":"backoff","retry":`) {
+		t.Errorf("idle stream wasn't told to back off:\n%s", got)
+	}
+}
@@ -0,0 +1,53 @@
+package resilientsse
+
+// Priority is how much an event matters to a client that can't keep up, for
+// streams opened [WithBackpressure]. Without backpressure every event is
+// written in order as it is sent, whatever its priority.
+type Priority int
+
+const (
+	// PriorityNormal is the priority of events sent on the stream itself,
+	// which the [Backpressure] policy applies to
+	PriorityNormal Priority = iota
+	// PriorityCritical events are never dropped or coalesced, and reach
+	// the client in the order they were sent. If a slow client's queue is
+	// still over its limits once every other event is dropped, the stream is
+	// closed with [ErrSlowClient], so the client reconnects and, with
+	// [WithReplay], is replayed them.
+	PriorityCritical
+	// PriorityBestEffort events are coalesced (under [CoalesceSignals]) and
+	// then dropped, oldest first, before the policy touches anything else,
+	// even under [CloseSlow]
+	PriorityBestEffort
+)
+
+// Lane sends events on a stream at one [Priority]. It has the same patch
+// methods as [ResilientSSE], and its events take the stream's next event IDs
+// like any other:
+//
+//	progress := stream.Lane(resilientsse.PriorityBestEffort)
+//	progress.MarshalAndPatchSignals(map[string]any{"progress": pct})
+//	...
+//	stream.Lane(resilientsse.PriorityCritical).PatchElements(receipt)
+//
+// Patches sent through a Lane are not batched by [WithPatchCoalescing]; any
+// batched patch is sent before them.
+type Lane struct {
+	patcher
+}
+
+// Lane returns a Lane sending events on the stream at priority
+func (s *ResilientSSE) Lane(priority Priority) *Lane {
+	return &Lane{patcher{
+		ctx: s.ctx,
+		sse: s.sse,
+		emit: func(send sendFunc) error {
+			return s.emitGroup([]sendFunc{send}, priority)
+		},
+		emitPlain: func(e plainEvent) error {
+			e.priority = priority
+			return s.emitPlain(e)
+		},
+		fail: s.renderFailed,
+	}}
+}
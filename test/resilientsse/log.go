@@ -0,0 +1,90 @@
+package resilientsse
+
+import (
+	"cmp"
+	"log/slog"
+)
+
+// WithLogger makes the stream log its own lifecycle to logger: the connect,
+// or the resume with what was replayed, every dead letter, and the drop with
+// its reason and how many events were sent. Each line carries the
+// connection's attributes (see [ResilientSSE.Logger]), and whatever logger
+// already carries, such as the name of the endpoint:
+//
+//	resilientsse.WithLogger(slog.With("feed", name))
+//
+// Without it the stream logs nothing itself.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		o.logger = logger
+	}
+}
+
+// Logger returns the stream's logger (slog's default logger without
+// [WithLogger]) with the connection's attributes: conn, its ID, path, remote
+// and, with sessions, session. Handlers log through it so their lines can be
+// told apart from other streams' and matched with the stream's own.
+func (s *ResilientSSE) Logger() *slog.Logger {
+	return cmp.Or(s.opts.logger, slog.Default()).With(connAttrs(s.ConnInfo())...)
+}
+
+// connAttrs are the attributes Logger adds for a connection
+func connAttrs(info ConnInfo) []any {
+	attrs := []any{
+		slog.Uint64("conn", info.ID),
+		slog.String("path", info.Path),
+		slog.String("remote", info.RemoteAddr),
+	}
+	if info.SessionID != "" {
+		attrs = append(attrs, slog.String("session", info.SessionID))
+	}
+	return attrs
+}
+
+// logConnect logs the stream's connect or resume, once it is established
+func (s *ResilientSSE) logConnect(info ConnInfo) {
+	if s.opts.logger == nil {
+		return
+	}
+	logger := s.opts.logger.With(connAttrs(info)...)
+	if !s.Resumed() {
+		logger.Info("stream connected")
+		return
+	}
+	attrs := []any{slog.String("last_event_id", info.LastEventID)}
+	if s.opts.replay != nil {
+		attrs = append(attrs, slog.Int("replayed", s.replayed), slog.Bool("replay_gap", s.replayGap))
+	}
+	logger.Info("stream resumed", attrs...)
+}
+
+// logDrop logs the end of an established stream, as a warning if writing to
+// the client failed
+func (s *ResilientSSE) logDrop(info ConnInfo, reason DropReason, cause error) {
+	if s.opts.logger == nil {
+		return
+	}
+	level := slog.LevelInfo
+	if reason == DropWriteError {
+		level = slog.LevelWarn
+	}
+	s.opts.logger.With(connAttrs(info)...).Log(s.ctx, level, "stream dropped",
+		slog.String("reason", reason.String()),
+		slog.Any("cause", cause),
+		slog.Uint64("events", info.Events))
+}
+
+// logDeadLetter logs an event the stream could not deliver
+func (s *ResilientSSE) logDeadLetter(l DeadLetter) {
+	if s.opts.logger == nil {
+		return
+	}
+	attrs := []any{slog.String("reason", l.Reason.String())}
+	if l.ID != 0 {
+		attrs = append(attrs, slog.Uint64("event_id", l.ID))
+	}
+	if l.Err != nil {
+		attrs = append(attrs, slog.Any("err", l.Err))
+	}
+	s.opts.logger.With(connAttrs(l.Conn)...).Warn("event not delivered", attrs...)
+}
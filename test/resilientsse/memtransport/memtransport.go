@@ -0,0 +1,292 @@
+// Package memtransport serves SSE handlers to in-memory clients, without
+// sockets, so a single process can hold as many concurrent streams as it has
+// memory for, e.g. to check how a hub and its stores hold up under 100k
+// subscribers publishing, resuming and churning:
+//
+//	c := memtransport.Open(handler, "/api/feed", memtransport.Options{})
+//	defer c.Close()
+//	...
+//	c = c.Reconnect() // resumes with the last event ID received
+//
+// A [Conn] is both the client and the [http.ResponseWriter] the handler
+// writes to. It parses the stream as it is written, keeping counts and the
+// last event ID rather than the bytes, and hands each event to
+// [Options.OnEvent] if set.
+package memtransport
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteAddr is the remote address of every in-memory request
+const RemoteAddr = "memory"
+
+// ErrClientGone is returned by writes to a [Conn] the client has closed
+var ErrClientGone = errors.New("memtransport: client closed the connection")
+
+// Event is one event received by a [Conn]
+type Event struct {
+	ID   string
+	Type string
+	// Data holds the event's data lines, without the "data: " prefix
+	Data []string
+}
+
+// Options configures the client end of a [Conn]
+type Options struct {
+	// Header is added to the request, e.g. a session header
+	Header http.Header
+	// LastEventID resumes after this event; "" connects afresh
+	LastEventID string
+	// OnEvent is called with every event as it is written, on the handler's
+	// goroutine
+	OnEvent func(Event)
+}
+
+// Conn is one in-memory stream. The handler serving it runs on its own
+// goroutine from [Open] until it returns; [Conn.Close] is the client going
+// away, which cancels the request's context and fails later writes.
+type Conn struct {
+	handler http.Handler
+	target  string
+	opts    Options
+
+	header http.Header
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu         sync.Mutex
+	status     int
+	deadline   time.Time
+	partial    []byte
+	events     int
+	bytes      int64
+	lastID     string
+	lastSeq    uint64
+	duplicates int
+}
+
+// Open requests target from handler as an SSE client and returns as soon as
+// the handler is running
+func Open(handler http.Handler, target string, opts Options) *Conn {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Conn{
+		handler: handler,
+		target:  target,
+		opts:    opts,
+		header:  http.Header{},
+		ctx:     ctx,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		panic("memtransport: invalid target " + strconv.Quote(target))
+	}
+	r.RemoteAddr = RemoteAddr
+	r.RequestURI = target
+	for k, v := range opts.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Accept", "text/event-stream")
+	if opts.LastEventID != "" {
+		r.Header.Set("Last-Event-ID", opts.LastEventID)
+	}
+
+	go func() {
+		defer close(c.done)
+		handler.ServeHTTP(c, r)
+	}()
+	return c
+}
+
+// Close disconnects the client and waits for the handler to return
+func (c *Conn) Close() {
+	c.cancel()
+	<-c.done
+}
+
+// Reconnect closes c and opens it again, resuming after the last event it
+// received, with the headers given by the server's response added to the
+// request's (so a session issued in a response header is presented back)
+func (c *Conn) Reconnect() *Conn {
+	c.Close()
+
+	opts := c.opts
+	opts.Header = c.opts.Header.Clone()
+	if opts.Header == nil {
+		opts.Header = http.Header{}
+	}
+	c.mu.Lock()
+	for k, v := range c.header {
+		if strings.HasPrefix(k, "X-") {
+			opts.Header[k] = v
+		}
+	}
+	opts.LastEventID = cmp.Or(c.lastID, opts.LastEventID)
+	c.mu.Unlock()
+
+	return Open(c.handler, c.target, opts)
+}
+
+// Done is closed when the handler has returned
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Status returns the response status, 0 until the handler writes
+func (c *Conn) Status() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.status
+}
+
+// Events returns how many events the client has received
+func (c *Conn) Events() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.events
+}
+
+// Bytes returns how many bytes of the stream the client has received
+func (c *Conn) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.bytes
+}
+
+// LastEventID returns the ID of the last event received with one
+func (c *Conn) LastEventID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lastID
+}
+
+// Duplicates returns how many events arrived with a numeric ID not above
+// the previous one, i.e. that the client had already seen
+func (c *Conn) Duplicates() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.duplicates
+}
+
+// Header is the response header, for the handler
+func (c *Conn) Header() http.Header {
+	return c.header
+}
+
+// WriteHeader records the response status, for the handler
+func (c *Conn) WriteHeader(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+// Write receives part of the stream, for the handler. It fails once the
+// client has gone away or the write deadline has passed.
+func (c *Conn) Write(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, ErrClientGone
+	}
+
+	c.mu.Lock()
+	if c.status == 0 {
+		c.status = http.StatusOK
+	}
+	if !c.deadline.IsZero() && !time.Now().Before(c.deadline) {
+		c.mu.Unlock()
+		return 0, os.ErrDeadlineExceeded
+	}
+	c.bytes += int64(len(p))
+	c.partial = append(c.partial, p...)
+	var events []Event
+	for {
+		block, rest, ok := bytes.Cut(c.partial, []byte("\n\n"))
+		if !ok {
+			break
+		}
+		c.partial = rest
+		if e, ok := parseEvent(block); ok {
+			c.received(e)
+			events = append(events, e)
+		}
+	}
+	if len(c.partial) == 0 {
+		c.partial = nil
+	}
+	c.mu.Unlock()
+
+	if c.opts.OnEvent != nil {
+		for _, e := range events {
+			c.opts.OnEvent(e)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush is a no-op: everything written is received at once
+func (c *Conn) Flush() {}
+
+// SetWriteDeadline fails writes from t on, for [http.ResponseController]
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.deadline = t
+	return nil
+}
+
+// received counts e. c.mu must be held.
+func (c *Conn) received(e Event) {
+	c.events++
+	if e.ID == "" {
+		return
+	}
+	c.lastID = e.ID
+	if seq, err := strconv.ParseUint(e.ID, 10, 64); err == nil {
+		if seq <= c.lastSeq {
+			c.duplicates++
+		}
+		c.lastSeq = max(c.lastSeq, seq)
+	}
+}
+
+// parseEvent parses one block of SSE lines, reporting false for blocks that
+// are only comments or fields other than event, id and data
+func parseEvent(block []byte) (Event, bool) {
+	var e Event
+	ok := false
+	for line := range strings.Lines(string(block)) {
+		line = strings.TrimSuffix(line, "\n")
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			e.Type, ok = value, true
+		case "id":
+			e.ID, ok = value, true
+		case "data":
+			e.Data, ok = append(e.Data, value), true
+		}
+	}
+	return e, ok
+}
@@ -0,0 +1,247 @@
+package memtransport_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"resilient-test/resilientsse"
+	"resilient-test/resilientsse/memtransport"
+)
+
+// countHandler sends events numbered from one after the Last-Event-ID, echoing
+// the request's X-Client header, until the client goes away or n were sent
+func countHandler(n int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("X-Client", r.Header.Get("X-Client"))
+		from, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+		for id := from + 1; id <= from+n; id++ {
+			if _, err := fmt.Fprintf(w, "event: tick\nid: %d\ndata: n %d\n\n", id, id); err != nil {
+				return
+			}
+		}
+		<-r.Context().Done()
+	})
+}
+
+func TestConnReceivesEvents(t *testing.T) {
+	var mu sync.Mutex
+	var data []string
+	c := memtransport.Open(countHandler(3), "/feed", memtransport.Options{
+		OnEvent: func(e memtransport.Event) {
+			mu.Lock()
+			defer mu.Unlock()
+			data = append(data, e.Data...)
+		},
+	})
+	waitEvents(t, c, 3)
+	c.Close()
+
+	if got := c.LastEventID(); got != "3" {
+		t.Errorf("LastEventID() = %q, want 3", got)
+	}
+	if got := c.Status(); got != http.StatusOK {
+		t.Errorf("Status() = %d, want 200", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(data, ","); got != "n 1,n 2,n 3" {
+		t.Errorf("received data %q, want n 1,n 2,n 3", got)
+	}
+}
+
+func TestConnReconnectResumes(t *testing.T) {
+	c := memtransport.Open(countHandler(2), "/feed", memtransport.Options{
+		Header: http.Header{"X-Client": {"a"}},
+	})
+	waitEvents(t, c, 2)
+
+	c = c.Reconnect()
+	defer c.Close()
+	waitEvents(t, c, 2)
+	if got := c.LastEventID(); got != "4" {
+		t.Errorf("LastEventID() after Reconnect = %q, want 4", got)
+	}
+	if got := c.Header().Get("X-Client"); got != "a" {
+		t.Errorf("X-Client header on reconnect = %q, want a", got)
+	}
+	if got := c.Duplicates(); got != 0 {
+		t.Errorf("Duplicates() = %d, want 0", got)
+	}
+}
+
+func TestConnClosedFailsWrites(t *testing.T) {
+	written := make(chan error, 1)
+	c := memtransport.Open(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, err := w.Write([]byte("data: late\n\n"))
+		written <- err
+	}), "/feed", memtransport.Options{})
+	c.Close()
+
+	if err := <-written; !errors.Is(err, memtransport.ErrClientGone) {
+		t.Errorf("write after Close = %v, want ErrClientGone", err)
+	}
+	if got := c.Events(); got != 0 {
+		t.Errorf("Events() = %d, want 0", got)
+	}
+}
+
+// TestHubChurn connects subscribers to a hub topic over memtransport,
+// publishes to it while some reconnect between events, and checks that every
+// subscriber received every event exactly once, through session catch-up and
+// replay
+func TestHubChurn(t *testing.T) {
+	subscribers, events, churn := 10000, 20, 0.05
+	if testing.Short() {
+		subscribers = 500
+	}
+
+	hub := resilientsse.NewHub()
+	buffers := resilientsse.NewReplayBuffers(64)
+	sessions := resilientsse.NewMemorySessionStore()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stream := resilientsse.New(w, r,
+			resilientsse.WithHub(hub),
+			resilientsse.WithSessions(sessions),
+			resilientsse.WithReplay(buffers.Get(r.Header.Get("X-Sim-Client"))))
+		defer stream.Close(nil)
+		if stream.IsClosed() || hub.Subscribe(stream, "sim") != nil {
+			return
+		}
+		<-stream.Context().Done()
+	})
+
+	type client struct {
+		mu   sync.Mutex
+		conn *memtransport.Conn
+		seen []int
+	}
+	clients := make([]*client, subscribers)
+	var wg sync.WaitGroup
+	for i := range clients {
+		c := &client{seen: make([]int, events)}
+		clients[i] = c
+		wg.Go(func() {
+			conn := memtransport.Open(handler, "/sim", memtransport.Options{
+				Header:  http.Header{"X-Sim-Client": {strconv.Itoa(i)}},
+				OnEvent: func(e memtransport.Event) { countSignal(&c.mu, c.seen, e) },
+			})
+			c.mu.Lock()
+			c.conn = conn
+			c.mu.Unlock()
+		})
+	}
+	wg.Wait()
+	settle(t, hub, subscribers)
+
+	rng := rand.New(rand.NewPCG(1, 2))
+	for n := 1; n <= events; n++ {
+		hub.PublishSignals("sim", map[string]int{"n": n})
+
+		var churned sync.WaitGroup
+		picked := map[int]bool{}
+		for range int(churn * float64(subscribers)) {
+			i := rng.IntN(subscribers)
+			if picked[i] {
+				continue
+			}
+			picked[i] = true
+			c := clients[i]
+			churned.Go(func() {
+				c.mu.Lock()
+				conn := c.conn
+				c.mu.Unlock()
+				next := conn.Reconnect()
+				c.mu.Lock()
+				c.conn = next
+				c.mu.Unlock()
+			})
+		}
+		churned.Wait()
+	}
+	settle(t, hub, subscribers)
+
+	incomplete := 0
+	for i, c := range clients {
+		c.mu.Lock()
+		for n, times := range c.seen {
+			if times != 1 {
+				if incomplete < 5 {
+					t.Errorf("subscriber %d received event %d %d times", i, n+1, times)
+				}
+				incomplete++
+				break
+			}
+		}
+		conn := c.conn
+		c.mu.Unlock()
+		conn.Close()
+	}
+	if incomplete > 0 {
+		t.Errorf("%d of %d subscribers did not receive every event exactly once", incomplete, subscribers)
+	}
+}
+
+// countSignal counts the event numbered in e's signals in seen
+func countSignal(mu *sync.Mutex, seen []int, e memtransport.Event) {
+	for _, line := range e.Data {
+		rest, ok := strings.CutPrefix(line, "signals ")
+		if !ok {
+			continue
+		}
+		var signals struct {
+			N int `json:"n"`
+		}
+		if json.Unmarshal([]byte(rest), &signals) == nil && signals.N > 0 {
+			mu.Lock()
+			seen[signals.N-1]++
+			mu.Unlock()
+		}
+	}
+}
+
+// settle waits until n streams of hub are subscribed, and done being caught
+// up on the topic
+func settle(t *testing.T, hub *resilientsse.Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(30 * time.Second)
+	for {
+		subscribed := 0
+		for _, s := range hub.Streams() {
+			if len(hub.Topics(s)) > 0 {
+				subscribed++
+			}
+		}
+		if subscribed >= n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d streams subscribed", subscribed, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// publishing to a subscriber waits for its catch-up, so publishing an
+	// event that sends nothing waits for the last catch-up to finish
+	hub.Publish("sim", func(*resilientsse.ResilientSSE) error { return nil })
+}
+
+// waitEvents waits until c has received n events
+func waitEvents(t *testing.T, c *memtransport.Conn, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Events() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d events, want %d", c.Events(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,163 @@
+package resilientsse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Metrics counts what the streams opened [WithMetrics] go through. Mounted as
+// a handler, it serves the counts in the Prometheus text format:
+//
+//	metrics := resilientsse.NewMetrics()
+//	mux.Handle("/metrics", metrics)
+//	...
+//	stream := resilientsse.New(w, r, resilientsse.WithMetrics(metrics))
+//
+// A Metrics is safe for concurrent use.
+type Metrics struct {
+	open        atomic.Int64
+	connects    atomic.Int64
+	resumes     atomic.Int64
+	replayed    atomic.Int64
+	replayGaps  atomic.Int64
+	events      atomic.Int64
+	deadLetters atomic.Int64
+	limited     atomic.Int64
+	// pruned is kept by Acks, deduplicated by Deliveries
+	pruned       atomic.Int64
+	deduplicated atomic.Int64
+	// guarded and guardRefused are kept by a ConnectionGuard
+	guarded      atomic.Int64
+	guardRefused atomic.Int64
+	drops        [DropWriteError + 1]atomic.Int64
+	// evictions are kept by ReplayBuffers
+	evictions [evictedAge + 1]atomic.Int64
+}
+
+// MetricsSnapshot is the counts of a [Metrics] at one point in time
+type MetricsSnapshot struct {
+	// Open is how many streams are established and not yet dropped
+	Open        int64 `json:"open"`
+	Connects    int64 `json:"connects"`
+	Resumes     int64 `json:"resumes"`
+	Replayed    int64 `json:"replayed"`
+	ReplayGaps  int64 `json:"replayGaps"`
+	Events      int64 `json:"events"`
+	DeadLetters int64 `json:"deadLetters"`
+	// Limited counts connections a [ReconnectLimiter] refused
+	Limited int64 `json:"limited"`
+	// Pruned counts replay events dropped once clients acknowledged them
+	// through [Acks]
+	Pruned int64 `json:"pruned"`
+	// Deduplicated counts exactly-once events not sent because the client
+	// had them already, after [Deliveries]
+	Deduplicated int64 `json:"deduplicated"`
+	// Guarded is how many streams a [ConnectionGuard] is counting, and
+	// GuardRefused how many it refused
+	Guarded      int64 `json:"guarded"`
+	GuardRefused int64 `json:"guardRefused"`
+	// Drops counts dropped streams by DropReason.String()
+	Drops map[string]int64 `json:"drops"`
+	// Evictions counts events [ReplayBuffer]s evicted, by cause: "count",
+	// "bytes" or "age", after their [ReplayLimits]
+	Evictions map[string]int64 `json:"evictions"`
+}
+
+// NewMetrics creates a set of zero counts
+func NewMetrics() *Metrics {
+	return &Metrics{}
+}
+
+// WithMetrics counts the stream's connect or resume, replay, events, dead
+// letters and drop in m
+func WithMetrics(m *Metrics) Option {
+	return func(o *options) {
+		o.metrics = m
+		o.hooks = append(o.hooks, Hooks{
+			OnConnect: func(ConnInfo) {
+				m.open.Add(1)
+				m.connects.Add(1)
+			},
+			OnResume: func(ConnInfo) {
+				m.open.Add(1)
+				m.resumes.Add(1)
+			},
+			OnReplay: func(_ ConnInfo, events int, complete bool) {
+				m.replayed.Add(int64(events))
+				if !complete {
+					m.replayGaps.Add(1)
+				}
+			},
+			OnDrop: func(_ ConnInfo, reason DropReason, _ error) {
+				m.open.Add(-1)
+				m.drops[reason].Add(1)
+			},
+		})
+		o.deadLetters = append(o.deadLetters, func(DeadLetter) {
+			m.deadLetters.Add(1)
+		})
+	}
+}
+
+// Snapshot returns the current counts
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	snap := MetricsSnapshot{
+		Open:         m.open.Load(),
+		Connects:     m.connects.Load(),
+		Resumes:      m.resumes.Load(),
+		Replayed:     m.replayed.Load(),
+		ReplayGaps:   m.replayGaps.Load(),
+		Events:       m.events.Load(),
+		DeadLetters:  m.deadLetters.Load(),
+		Limited:      m.limited.Load(),
+		Pruned:       m.pruned.Load(),
+		Deduplicated: m.deduplicated.Load(),
+		Guarded:      m.guarded.Load(),
+		GuardRefused: m.guardRefused.Load(),
+		Drops:        map[string]int64{},
+		Evictions:    map[string]int64{},
+	}
+	for reason := range m.drops {
+		snap.Drops[DropReason(reason).String()] = m.drops[reason].Load()
+	}
+	for cause := range m.evictions {
+		snap.Evictions[replayEviction(cause).String()] = m.evictions[cause].Load()
+	}
+	return snap
+}
+
+// ServeHTTP serves the counts in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	snap := m.Snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name, kind, help string, value int64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("resilientsse_streams_open", "gauge", "Streams established and not yet dropped.", snap.Open)
+	metric("resilientsse_connects_total", "counter", "Streams established without a Last-Event-ID.", snap.Connects)
+	metric("resilientsse_resumes_total", "counter", "Streams established with a Last-Event-ID.", snap.Resumes)
+	metric("resilientsse_replayed_events_total", "counter", "Events replayed to resuming clients.", snap.Replayed)
+	metric("resilientsse_replay_gaps_total", "counter", "Resumes whose replay did not cover everything missed.", snap.ReplayGaps)
+	metric("resilientsse_events_total", "counter", "Events sent, not counting replayed ones.", snap.Events)
+	metric("resilientsse_dead_letters_total", "counter", "Events streams failed to deliver.", snap.DeadLetters)
+	metric("resilientsse_limited_total", "counter", "Connections refused by a reconnect limiter.", snap.Limited)
+	metric("resilientsse_pruned_events_total", "counter", "Replay events dropped once acknowledged by clients.", snap.Pruned)
+	metric("resilientsse_deduplicated_events_total", "counter", "Exactly-once events not sent because the client had them already.", snap.Deduplicated)
+	metric("resilientsse_guarded_streams", "gauge", "Streams counted by a connection guard.", snap.Guarded)
+	metric("resilientsse_guard_refused_total", "counter", "Connections refused by a connection guard.", snap.GuardRefused)
+
+	fmt.Fprint(w, "# HELP resilientsse_drops_total Streams dropped, by reason.\n# TYPE resilientsse_drops_total counter\n")
+	for reason := range m.drops {
+		label := strings.ReplaceAll(DropReason(reason).String(), " ", "_")
+		fmt.Fprintf(w, "resilientsse_drops_total{reason=%q} %d\n", label, snap.Drops[DropReason(reason).String()])
+	}
+
+	fmt.Fprint(w, "# HELP resilientsse_replay_evictions_total Events evicted from replay buffers, by cause.\n# TYPE resilientsse_replay_evictions_total counter\n")
+	for cause := range m.evictions {
+		label := replayEviction(cause).String()
+		fmt.Fprintf(w, "resilientsse_replay_evictions_total{cause=%q} %d\n", label, snap.Evictions[label])
+	}
+}
@@ -0,0 +1,220 @@
+package resilientsse
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Middleware makes the datastar handlers it wraps resilient without changing
+// their code: a handler keeps calling [datastar.NewSSE] and patching as
+// before, and its events reach the client through a [ResilientSSE] opened
+// with opts, which numbers them and adds whatever opts ask for (heartbeats,
+// replay, sessions, metrics, ...):
+//
+//	mux.Handle("/feed", resilientsse.Middleware(
+//		resilientsse.WithHeartbeat(15*time.Second),
+//		resilientsse.WithReplay(buf),
+//		resilientsse.WithMetrics(metrics),
+//	)(feedHandler))
+//
+// The stream is opened when the handler starts streaming, so a handler that
+// answers with an error status or another content type is passed through
+// untouched. The handler's request context is cancelled when the stream ends,
+// e.g. on a failed write or a drain, and [StreamFrom] reaches the stream
+// from it.
+//
+// Any event ID the handler sets is replaced by the stream's. The handler
+// must not compress its events; use [WithCompression] instead. A handler
+// that panics once streaming is recovered as by [ResilientSSE.Recover].
+func Middleware(opts ...Option) func(http.Handler) http.Handler {
+	return MiddlewareFunc(func(*http.Request) []Option { return opts })
+}
+
+// MiddlewareFunc is [Middleware] with options chosen per request, e.g. a
+// replay store keyed by the caller's session
+func MiddlewareFunc(opts func(r *http.Request) []Option) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithCancelCause(r.Context())
+			defer cancel(nil)
+
+			mw := &middlewareWriter{ResponseWriter: w, cancel: cancel}
+			r = r.WithContext(context.WithValue(ctx, middlewareKey{}, mw))
+			mw.open = func() *ResilientSSE {
+				return New(w, r, opts(r)...)
+			}
+			defer mw.close()
+			defer mw.recover()
+			next.ServeHTTP(mw, r)
+		})
+	}
+}
+
+// middlewareKey is the context key of a request's middlewareWriter
+type middlewareKey struct{}
+
+// StreamFrom returns the stream [Middleware] opened for the request whose
+// context is ctx, or nil if the handler has not started streaming
+func StreamFrom(ctx context.Context) *ResilientSSE {
+	mw, ok := ctx.Value(middlewareKey{}).(*middlewareWriter)
+	if !ok {
+		return nil
+	}
+	mw.mu.Lock()
+	defer mw.mu.Unlock()
+
+	return mw.stream
+}
+
+// middlewareWriter is the ResponseWriter a handler wrapped by Middleware
+// writes to. It opens the stream on the handler's first flush or write of an
+// event stream, then splits what the handler writes into events and sends
+// each through the stream.
+type middlewareWriter struct {
+	http.ResponseWriter
+	open   func() *ResilientSSE
+	cancel context.CancelCauseFunc
+
+	mu          sync.Mutex
+	stream      *ResilientSSE
+	passthrough bool
+	// pending is the start of an event the handler has not finished writing
+	pending []byte
+}
+
+// WriteHeader passes a status other than 200 through, leaving the response
+// to the handler
+func (m *middlewareWriter) WriteHeader(code int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stream == nil && !m.passthrough && code != http.StatusOK {
+		m.passthrough = true
+		m.ResponseWriter.WriteHeader(code)
+	}
+}
+
+// Write sends each event p completes through the stream, or passes p through
+// if the handler is not streaming events
+func (m *middlewareWriter) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.streaming() {
+		return m.ResponseWriter.Write(p)
+	}
+	if m.stream.IsClosed() {
+		return 0, m.stream.streamErr()
+	}
+
+	m.pending = append(m.pending, p...)
+	for {
+		end := bytes.Index(m.pending, []byte("\n\n"))
+		if end < 0 {
+			return len(p), nil
+		}
+		// datastar-go ends events with an extra blank line, which separates
+		// them no more than one does
+		event := m.pending[:end+2]
+		m.pending = bytes.TrimLeft(m.pending[end+2:], "\n")
+		if err := m.send(event); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+// FlushError opens the stream when the handler flushes its event-stream
+// headers, as [datastar.NewSSE] does. The stream flushes every event itself.
+func (m *middlewareWriter) FlushError() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.streaming() {
+		return http.NewResponseController(m.ResponseWriter).Flush()
+	}
+	return nil
+}
+
+// streaming opens the stream if the handler is streaming events, and reports
+// whether it is. m.mu must be held.
+func (m *middlewareWriter) streaming() bool {
+	if m.stream != nil {
+		return true
+	}
+	if m.passthrough {
+		return false
+	}
+	if ct := m.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		m.passthrough = true
+		return false
+	}
+
+	m.stream = m.open()
+	context.AfterFunc(m.stream.Context(), func() {
+		m.cancel(m.stream.Err())
+	})
+	return true
+}
+
+// send sends an event of the handler's under the stream's next event ID
+func (m *middlewareWriter) send(event []byte) error {
+	var frame []byte
+	for line := range bytes.Lines(event) {
+		if !bytes.HasPrefix(line, []byte("id:")) {
+			frame = append(frame, line...)
+		}
+	}
+	if strings.TrimSpace(string(frame)) == "" {
+		return nil
+	}
+
+	s := m.stream
+	return s.emit(func(id string) error {
+		_, err := s.w.Write(withEventIDLine(frame, id))
+		return err
+	})
+}
+
+// close ends the stream once the handler returns
+func (m *middlewareWriter) close() {
+	m.mu.Lock()
+	s := m.stream
+	m.mu.Unlock()
+	if s != nil {
+		s.Close(nil)
+	}
+}
+
+// recover recovers a panic in the handler once it is streaming, as
+// [ResilientSSE.Recover] does. A handler that panics before then is left to
+// net/http.
+func (m *middlewareWriter) recover() {
+	m.mu.Lock()
+	s := m.stream
+	m.mu.Unlock()
+	if s == nil {
+		return
+	}
+	if v := recover(); v != nil {
+		s.recovered(v)
+	}
+}
+
+// withEventIDLine returns frame with an id field carrying id, after its event
+// field
+func withEventIDLine(frame []byte, id string) []byte {
+	idLine := []byte("id: " + id + "\n")
+	at := 0
+	if bytes.HasPrefix(frame, []byte("event:")) {
+		at = bytes.IndexByte(frame, '\n') + 1
+	}
+	return append(append(append([]byte(nil), frame[:at]...), idLine...), frame[at:]...)
+}
+
+// Unwrap lets [http.ResponseController] reach the client's ResponseWriter
+func (m *middlewareWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}
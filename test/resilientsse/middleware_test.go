@@ -0,0 +1,72 @@
+package resilientsse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// feedHandler is a plain datastar handler sending two element patches with
+// IDs of its own
+func feedHandler(opened *bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sse := datastar.NewSSE(w, r)
+		*opened = StreamFrom(r.Context()) != nil
+		sse.PatchElements(`<div id="a">a</div>`, datastar.WithPatchElementsEventID("handler-1"))
+		sse.PatchElements(`<div id="b">b</div>`, datastar.WithPatchElementsEventID("handler-2"))
+	})
+}
+
+func TestMiddlewareNumbersEvents(t *testing.T) {
+	var opened bool
+	h := Middleware(WithReplay(NewReplayBuffer(10)))(feedHandler(&opened))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/feed", nil))
+
+	if !opened {
+		t.Error("StreamFrom(ctx) = nil once the handler started streaming")
+	}
+	body := rec.Body.String()
+	if got, want := eventIDs(body), []uint64{1, 2}; !slices.Equal(got, want) {
+		t.Errorf("event IDs = %v, want %v\n%s", got, want, body)
+	}
+	if strings.Contains(body, "handler-") {
+		t.Errorf("the handler's own event IDs reached the client\n%s", body)
+	}
+}
+
+func TestMiddlewareReplays(t *testing.T) {
+	var opened bool
+	h := Middleware(WithReplay(NewReplayBuffer(10)))(feedHandler(&opened))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/feed", nil))
+
+	r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+	r.Header.Set(LastEventIDHeader, "1")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+
+	// event 2 replayed ahead of the handler's, which continue after it
+	body := rec.Body.String()
+	if got, want := eventIDs(body), []uint64{2, 3, 4}; !slices.Equal(got, want) {
+		t.Errorf("event IDs = %v, want %v\n%s", got, want, body)
+	}
+	if i := strings.Index(body, `id="b"`); i < 0 || i > strings.Index(body, `id="a"`) {
+		t.Errorf("replayed event 2 is not first\n%s", body)
+	}
+}
+
+func TestMiddlewarePassesErrorsThrough(t *testing.T) {
+	h := Middleware(WithReplay(NewReplayBuffer(10)))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "no feed", http.StatusNotFound)
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/feed", nil))
+
+	if rec.Code != http.StatusNotFound || rec.Body.String() != "no feed\n" {
+		t.Errorf("response = %d %q, want the handler's 404", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,125 @@
+package resilientsse
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+)
+
+// MessagePack encodes signals as MessagePack (msgpack.org), named "msgpack".
+// Integers and floats take their smallest exact encoding; object keys are
+// sorted.
+var MessagePack Serializer = msgpackSerializer{}
+
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Name() string { return "msgpack" }
+
+func (msgpackSerializer) Marshal(v any) ([]byte, error) {
+	return appendMsgpack(nil, v)
+}
+
+// appendMsgpack appends the MessagePack encoding of v to b
+func appendMsgpack(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return appendMsgpackInt(b, i), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("resilientsse: invalid number %q", v)
+		}
+		if float64(float32(f)) == f {
+			return binary.BigEndian.AppendUint32(append(b, 0xca), math.Float32bits(float32(f))), nil
+		}
+		return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f)), nil
+	case string:
+		return appendMsgpackString(b, v), nil
+	case []any:
+		b = appendMsgpackLen(b, 0x90, 0xdc, len(v))
+		for _, e := range v {
+			var err error
+			if b, err = appendMsgpack(b, e); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		b = appendMsgpackLen(b, 0x80, 0xde, len(v))
+		for _, k := range slices.Sorted(maps.Keys(v)) {
+			b = appendMsgpackString(b, k)
+			var err error
+			if b, err = appendMsgpack(b, v[k]); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("resilientsse: msgpack can't encode %T", v)
+}
+
+// appendMsgpackString appends the MessagePack encoding of v to b
+func appendMsgpackString(b []byte, v string) []byte {
+	switch n := len(v); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, v...)
+}
+
+// appendMsgpackLen appends the header of an array or map of n elements: fix,
+// the fix format, under 16 elements, else the 16-bit format, first, or the
+// 32-bit one that follows it
+func appendMsgpackLen(b []byte, fix, first byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, first), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, first+1), uint32(n))
+	}
+}
+
+// appendMsgpackInt appends the smallest MessagePack encoding of i
+func appendMsgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0 && i <= math.MaxInt8:
+		return append(b, byte(i))
+	case i < 0 && i >= -32:
+		return append(b, byte(i))
+	case i >= 0 && i <= math.MaxUint8:
+		return append(b, 0xcc, byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(i))
+	case i >= 0:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), uint64(i))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(i))
+	case i >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(i))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(i))
+	}
+}
@@ -0,0 +1,198 @@
+// Package natsbridge carries the topics of a resilientsse.Hub over NATS
+// JetStream, so an event published on one instance of an app reaches the
+// subscribers connected to every instance:
+//
+//	nc, _ := nats.Connect(nats.DefaultURL)
+//	js, _ := jetstream.New(nc)
+//	bridge, err := natsbridge.New(ctx, hub, js, natsbridge.Config{})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer bridge.Close()
+//
+//	// on any instance, instead of hub.PublishSignals
+//	bridge.PublishSignals(ctx, "orders", map[string]any{"orders": n})
+//
+// Events are published to the subject <Prefix><topic> of a JetStream stream,
+// and every bridge, the publisher's included, relays them to its hub in the
+// stream's order with [resilientsse.Hub.PublishDataAt], numbered by their
+// stream sequence. A topic's events therefore carry the same numbers on
+// every instance, and a relayed event is only delivered once even if
+// JetStream redelivers it.
+//
+// Topic names become subject tokens, so they must not contain spaces or the
+// wildcards * and >; dots make hierarchies of subjects as usual.
+package natsbridge
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+
+	"resilient-test/resilientsse"
+)
+
+const (
+	// DefaultStream is the JetStream stream of a bridge without a Stream
+	DefaultStream = "RESILIENT_TOPICS"
+	// DefaultPrefix is the subject prefix of a bridge without a Prefix
+	DefaultPrefix = "resilient.topics."
+	// DefaultMaxAge is how long the stream keeps events without a MaxAge
+	DefaultMaxAge = time.Hour
+)
+
+// Config configures a [Bridge]
+type Config struct {
+	// Stream names the JetStream stream events go through, created or
+	// updated by [New]; "" means DefaultStream
+	Stream string
+	// Prefix is prepended to topic names to make subjects; "" means
+	// DefaultPrefix. It should end with a dot.
+	Prefix string
+	// MaxAge is how long the stream keeps events; zero means DefaultMaxAge.
+	// Bridges only relay events published after they start, so this only
+	// bounds the stream's storage.
+	MaxAge time.Duration
+	// ErrorLog receives events that could not be relayed. Nil means the log
+	// package's standard logger.
+	ErrorLog *log.Logger
+}
+
+// Bridge relays the events published through any bridge of a stream to the
+// subscribers of its hub
+type Bridge struct {
+	hub     *resilientsse.Hub
+	js      jetstream.JetStream
+	c       Config
+	consume jetstream.ConsumeContext
+}
+
+// message is an event as it travels through NATS
+type message struct {
+	Signals  json.RawMessage `json:"signals,omitempty"`
+	Elements string          `json:"elements,omitempty"`
+}
+
+// New creates or updates the stream and starts relaying the events published
+// to it from now on to hub, until [Bridge.Close]
+func New(ctx context.Context, hub *resilientsse.Hub, js jetstream.JetStream, c Config) (*Bridge, error) {
+	c.Stream = cmp.Or(c.Stream, DefaultStream)
+	c.Prefix = cmp.Or(c.Prefix, DefaultPrefix)
+	c.MaxAge = cmp.Or(max(c.MaxAge, 0), DefaultMaxAge)
+
+	stream, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     c.Stream,
+		Subjects: []string{c.Prefix + ">"},
+		MaxAge:   c.MaxAge,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("natsbridge: creating stream %s: %w", c.Stream, err)
+	}
+	consumer, err := stream.OrderedConsumer(ctx, jetstream.OrderedConsumerConfig{
+		FilterSubjects: []string{c.Prefix + ">"},
+		DeliverPolicy:  jetstream.DeliverNewPolicy,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("natsbridge: consuming stream %s: %w", c.Stream, err)
+	}
+
+	b := &Bridge{hub: hub, js: js, c: c}
+	b.consume, err = consumer.Consume(b.relay)
+	if err != nil {
+		return nil, fmt.Errorf("natsbridge: consuming stream %s: %w", c.Stream, err)
+	}
+	return b, nil
+}
+
+// Close stops relaying events to the hub
+func (b *Bridge) Close() {
+	b.consume.Stop()
+}
+
+// PublishSignals publishes a patch of signals to the topic on every
+// instance, returning once JetStream has stored it
+func (b *Bridge) PublishSignals(ctx context.Context, topic string, signals any) error {
+	raw, err := json.Marshal(signals)
+	if err != nil {
+		return fmt.Errorf("failed to marshal signals: %w", err)
+	}
+	return b.publish(ctx, topic, message{Signals: raw})
+}
+
+// PublishElements publishes a patch of elements to the topic on every
+// instance, returning once JetStream has stored it
+func (b *Bridge) PublishElements(ctx context.Context, topic, elements string) error {
+	return b.publish(ctx, topic, message{Elements: elements})
+}
+
+func (b *Bridge) publish(ctx context.Context, topic string, m message) error {
+	if topic == "" || strings.ContainsAny(topic, " *>") {
+		return fmt.Errorf("natsbridge: invalid topic %q", topic)
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if _, err := b.js.Publish(ctx, b.c.Prefix+topic, data); err != nil {
+		return fmt.Errorf("natsbridge: publishing to %s: %w", topic, err)
+	}
+	return nil
+}
+
+// relay publishes an event from the stream to the hub, numbered by its
+// stream sequence
+func (b *Bridge) relay(msg jetstream.Msg) {
+	if err := b.relayMsg(msg); err != nil {
+		b.logf("natsbridge: relaying %s: %v", msg.Subject(), err)
+	}
+}
+
+func (b *Bridge) relayMsg(msg jetstream.Msg) error {
+	meta, err := msg.Metadata()
+	if err != nil {
+		return err
+	}
+	var m message
+	if err := json.Unmarshal(msg.Data(), &m); err != nil {
+		return err
+	}
+	topic := strings.TrimPrefix(msg.Subject(), b.c.Prefix)
+	seq := meta.Sequence.Stream
+
+	switch {
+	case m.Signals != nil:
+		var signals any
+		if err := json.Unmarshal(m.Signals, &signals); err != nil {
+			return err
+		}
+		b.hub.PublishDataAt(topic, seq, signals, func(s *resilientsse.ResilientSSE, data any) error {
+			return s.MarshalAndPatchSignals(data)
+		})
+	case m.Elements != "":
+		b.hub.PublishDataAt(topic, seq, m.Elements, func(s *resilientsse.ResilientSSE, data any) error {
+			elements, ok := data.(string)
+			if !ok {
+				return errors.New("natsbridge: elements transformed into a non-string")
+			}
+			return s.PatchElements(elements)
+		})
+	default:
+		return errors.New("empty event")
+	}
+	return nil
+}
+
+func (b *Bridge) logf(format string, args ...any) {
+	if b.c.ErrorLog != nil {
+		b.c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
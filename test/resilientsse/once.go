@@ -0,0 +1,320 @@
+package resilientsse
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyField is the SSE field carrying the idempotency key of an
+// event sent with [ResilientSSE.Once]:
+//
+//	event: datastar-patch-elements
+//	id: 42
+//	data: mode append
+//	data: selector #orders
+//	data: elements <li id="order-7">Order 7</li>
+//	resilient-key: order-7
+//
+// Like [EnvelopeField], SSE parsers ignore it, so plain datastar clients are
+// unaffected; a client that remembers the keys it has applied can use it to
+// skip an event it is sent again.
+const IdempotencyKeyField = "resilient-key"
+
+const (
+	// DefaultDeliveryMaxKeys is how many idempotency keys [Deliveries] keeps
+	// per stream without a MaxKeys
+	DefaultDeliveryMaxKeys = 10000
+	// DefaultDeliveryMaxAge is how long [Deliveries] keeps the keys of a
+	// stream nobody is connected to without a MaxAge
+	DefaultDeliveryMaxAge = time.Hour
+)
+
+// DeliveryConfig configures [Deliveries]
+type DeliveryConfig struct {
+	// MaxKeys caps the idempotency keys kept per stream, forgetting the
+	// oldest; zero means DefaultDeliveryMaxKeys. A forgotten key is sent
+	// again if the app sends it again.
+	MaxKeys int
+	// MaxAge is how long the keys of a stream are kept once no client is
+	// connected to it and none acknowledges its events; zero means
+	// DefaultDeliveryMaxAge
+	MaxAge time.Duration
+	// Metrics, if set, counts the events not sent because the client had
+	// them already
+	Metrics *Metrics
+}
+
+// Deliveries remembers, per stream key, the idempotency keys of the events
+// sent with [ResilientSSE.Once] and which of them the client has applied, so
+// that streams opened [WithExactlyOnce] send each one once. Mounted with
+// [Acks] (see [AckConfig].Deliveries), it also learns what a client applied
+// from its acknowledgements, which is all it has to go on when the client
+// reconnects without a Last-Event-ID.
+//
+// Keys are kept in memory, for one process.
+//
+// A Deliveries is safe for concurrent use.
+type Deliveries struct {
+	c DeliveryConfig
+
+	mu        sync.Mutex
+	streams   map[string]*deliveryLog
+	lastSweep time.Time
+}
+
+// deliveryLog is what Deliveries knows of one stream
+type deliveryLog struct {
+	// ids maps the idempotency keys sent to the event ID each was sent as,
+	// and keys lists them oldest first
+	ids  map[string]uint64
+	keys []string
+	// acked is the highest event ID the client acknowledged, and lastID the
+	// highest one recorded, which the stream's IDs must stay above
+	acked  uint64
+	lastID uint64
+	// open counts the streams connected, used when the log was last touched
+	open int
+	used time.Time
+}
+
+// NewDeliveries creates an empty set of delivery logs
+func NewDeliveries(c DeliveryConfig) *Deliveries {
+	c.MaxKeys = cmp.Or(c.MaxKeys, DefaultDeliveryMaxKeys)
+	c.MaxAge = cmp.Or(c.MaxAge, DefaultDeliveryMaxAge)
+	return &Deliveries{c: c, streams: map[string]*deliveryLog{}, lastSweep: time.Now()}
+}
+
+// WithExactlyOnce makes the events sent on the stream with [ResilientSSE.Once]
+// exactly-once, for patches that do harm when applied twice, such as elements
+// appended to a list. key is the stream's key in d, the same one its [Acks]
+// use. It must be one client's, and one page's: a page loaded again has none
+// of what the last one applied, so the key should include an ID the page
+// makes up when it loads.
+//
+// Whether the client has an event is worked out when the stream opens:
+//   - resumed with a complete replay, it has every event sent so far, or is
+//     being replayed it
+//   - resumed with a replay gap, without replay or after [ResumeRefresh], it
+//     has the events up to its Last-Event-ID, and none after
+//   - opened without a Last-Event-ID, it has the events up to the last one it
+//     acknowledged; those after are sent again if the app sends them, marked
+//     with their [IdempotencyKeyField] for a client that dedupes
+//
+// Events the client has are not sent again, whatever the app sends.
+func WithExactlyOnce(d *Deliveries, key string) Option {
+	return func(o *options) {
+		o.deliveries = d
+		o.deliveryKey = key
+	}
+}
+
+// Once is a stream's patch methods for one exactly-once event, returned by
+// [ResilientSSE.Once]
+type Once struct {
+	patcher
+}
+
+// Once returns patch methods sending an event with the idempotency key key,
+// such as the ID of the record the patch shows:
+//
+//	stream.Once("order-" + id).PatchElements(row,
+//		datastar.WithSelector("#orders"), datastar.WithModeAppend())
+//
+// The event carries key in an [IdempotencyKeyField], and is never dropped
+// or coalesced under backpressure ([PriorityCritical]). On a stream opened
+// [WithExactlyOnce], it is only sent if the client doesn't have the event
+// with key already; otherwise the send does nothing and returns nil. Keys
+// may not contain line breaks.
+func (s *ResilientSSE) Once(key string) *Once {
+	return &Once{patcher{
+		ctx: s.ctx,
+		sse: s.sse,
+		emit: func(send sendFunc) error {
+			return s.emitOnce(key, send)
+		},
+		fail: s.renderFailed,
+	}}
+}
+
+// Delivered reports whether the client has, or is being sent, the event with
+// the idempotency key key. It is false on a stream not opened
+// [WithExactlyOnce].
+func (s *ResilientSSE) Delivered(key string) bool {
+	if s.deliveries == nil {
+		return false
+	}
+	return s.opts.deliveries.has(s.deliveries, key)
+}
+
+// emitOnce sends one event as an exactly-once event with key, unless the
+// client has it already
+func (s *ResilientSSE) emitOnce(key string, send sendFunc) error {
+	if key == "" || strings.ContainsAny(key, "\r\n") {
+		return s.renderFailed(fmt.Errorf("resilientsse: invalid idempotency key %q", key))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ctx.Err(); err != nil {
+		return s.streamErr()
+	}
+	if s.deliveries != nil && s.opts.deliveries.has(s.deliveries, key) {
+		if m := s.opts.deliveries.c.Metrics; m != nil {
+			m.deduplicated.Add(1)
+		}
+		return nil
+	}
+	if err := s.flushCoalesced(); err != nil {
+		return err
+	}
+
+	frames, start, err := s.renderGroup([]sendFunc{send})
+	if err != nil {
+		return err
+	}
+	if err := s.sendGroup(1, withIdempotencyKey(frames, key), start, PriorityCritical); err != nil {
+		// not recorded: the client may not have the event, and a replay
+		// wouldn't bring it
+		return err
+	}
+	if s.deliveries != nil {
+		s.opts.deliveries.record(s.deliveries, key, s.seq)
+	}
+	return nil
+}
+
+// withIdempotencyKey adds an IdempotencyKeyField line to the last event of
+// frames
+func withIdempotencyKey(frames []byte, key string) []byte {
+	body := bytes.TrimRight(frames, "\n")
+	return append(body, "\n"+IdempotencyKeyField+": "+key+"\n\n"...)
+}
+
+// openDelivery attaches the stream to its delivery log, forgetting the keys
+// the client doesn't have, and keeps the stream's IDs above those recorded
+func (s *ResilientSSE) openDelivery(lastID uint64, lastIDErr error) {
+	d := s.opts.deliveries
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	log := d.log(s.opts.deliveryKey)
+	log.open++
+	s.deliveryOpen = true
+	switch {
+	case s.Resumed() && lastIDErr == nil && s.opts.replay != nil && !s.replayGap && !s.refreshed:
+		// the replay brings the client up to the store's last event, and no
+		// further: an event whose write failed never made it into the store
+		if last, err := s.opts.replay.LastID(); err == nil {
+			log.forgetAfter(max(last, lastID))
+		} else {
+			log.forgetAfter(lastID)
+		}
+	case s.Resumed() && lastIDErr == nil:
+		log.forgetAfter(lastID)
+	default:
+		log.forgetAfter(log.acked)
+	}
+	s.seq = max(s.seq, log.lastID)
+	s.deliveries = log
+}
+
+// closeDelivery detaches the stream from its delivery log
+func (s *ResilientSSE) closeDelivery() {
+	d := s.opts.deliveries
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if s.deliveryOpen {
+		s.deliveryOpen = false
+		s.deliveries.open--
+		s.deliveries.used = time.Now()
+	}
+}
+
+// Ack records that the client of the stream with key has applied the events
+// up to id. [Acks] calls it for the acknowledgements it serves.
+func (d *Deliveries) Ack(key string, id uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	log := d.log(key)
+	log.acked = max(log.acked, id)
+}
+
+// Delete forgets the stream with key
+func (d *Deliveries) Delete(key string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.streams, key)
+}
+
+// log returns the log of the stream with key, creating it if needed. d.mu
+// must be held.
+func (d *Deliveries) log(key string) *deliveryLog {
+	if now := time.Now(); now.Sub(d.lastSweep) >= replaySweepInterval {
+		d.sweep(now)
+	}
+
+	log, ok := d.streams[key]
+	if !ok {
+		log = &deliveryLog{ids: map[string]uint64{}}
+		d.streams[key] = log
+	}
+	log.used = time.Now()
+	return log
+}
+
+// sweep forgets the streams unused for MaxAge. d.mu must be held.
+func (d *Deliveries) sweep(now time.Time) {
+	for key, log := range d.streams {
+		if log.open == 0 && now.Sub(log.used) > d.c.MaxAge {
+			delete(d.streams, key)
+		}
+	}
+	d.lastSweep = now
+}
+
+// has reports whether log records key
+func (d *Deliveries) has(log *deliveryLog, key string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	_, ok := log.ids[key]
+	return ok
+}
+
+// record adds key, sent as event id, to log
+func (d *Deliveries) record(log *deliveryLog, key string, id uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := log.ids[key]; !ok {
+		log.keys = append(log.keys, key)
+	}
+	log.ids[key] = id
+	log.lastID = max(log.lastID, id)
+	log.used = time.Now()
+	for len(log.keys) > d.c.MaxKeys {
+		delete(log.ids, log.keys[0])
+		log.keys = log.keys[1:]
+	}
+}
+
+// forgetAfter drops the keys sent after event id, which the client doesn't
+// have. d.mu must be held.
+func (log *deliveryLog) forgetAfter(id uint64) {
+	log.keys = slices.DeleteFunc(log.keys, func(key string) bool {
+		if log.ids[key] <= id {
+			return false
+		}
+		delete(log.ids, key)
+		return true
+	})
+}
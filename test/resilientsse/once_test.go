@@ -0,0 +1,159 @@
+package resilientsse
+
+import (
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// sendRows sends the rows n as exactly-once events keyed row-<n>
+func sendRows(t *testing.T, s *ResilientSSE, rows ...int) {
+	t.Helper()
+	for _, n := range rows {
+		key := "row-" + strconv.Itoa(n)
+		if err := s.Once(key).PatchElementf(`<li id="%s">row</li>`, key); err != nil {
+			t.Fatalf("Once(%s): %v", key, err)
+		}
+	}
+}
+
+// rowsSent returns the idempotency keys of the events in a stream
+func rowsSent(stream string) []string {
+	var keys []string
+	for line := range strings.Lines(stream) {
+		if key, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), IdempotencyKeyField+": "); ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// onceStream opens a stream on the key "page" of d, sends rows on it
+// and closes it, returning what it wrote
+func onceStream(t *testing.T, d *Deliveries, header http.Header, replay *ReplayBuffer, rows ...int) string {
+	t.Helper()
+	w := newTestWriter()
+	opts := []Option{WithExactlyOnce(d, "page")}
+	if replay != nil {
+		opts = append(opts, WithReplay(replay))
+	}
+	s := newStream(w, header, opts...)
+	sendRows(t, s, rows...)
+	s.Close(nil)
+	return w.String()
+}
+
+func TestOnceSendsEachKeyOnce(t *testing.T) {
+	metrics := NewMetrics()
+	d := NewDeliveries(DeliveryConfig{Metrics: metrics})
+	w := newTestWriter()
+	s := newStream(w, nil, WithExactlyOnce(d, "page"))
+	sendRows(t, s, 1, 2, 1)
+	if !s.Delivered("row-1") || s.Delivered("row-3") {
+		t.Errorf("Delivered(row-1), Delivered(row-3) = %v, %v; want true, false", s.Delivered("row-1"), s.Delivered("row-3"))
+	}
+	s.Close(nil)
+
+	if got, want := rowsSent(w.String()), []string{"row-1", "row-2"}; !slices.Equal(got, want) {
+		t.Errorf("rows sent = %q, want %q", got, want)
+	}
+	if got := metrics.deduplicated.Load(); got != 1 {
+		t.Errorf("deduplicated events = %d, want 1", got)
+	}
+}
+
+func TestOnceFreshConnect(t *testing.T) {
+	d := NewDeliveries(DeliveryConfig{})
+	first := onceStream(t, d, nil, nil, 1, 2, 3)
+
+	// without acknowledgements, a page connecting afresh has none of them
+	second := onceStream(t, d, nil, nil, 1, 2, 3)
+	if got, want := rowsSent(second), []string{"row-1", "row-2", "row-3"}; !slices.Equal(got, want) {
+		t.Errorf("rows sent on a fresh connect = %q, want %q", got, want)
+	}
+	// IDs stay above those the log recorded
+	if ids := eventIDs(second); ids[0] <= eventIDs(first)[2] {
+		t.Errorf("second stream's IDs %v don't continue after the first's %v", ids, eventIDs(first))
+	}
+
+	// with them, it has the rows up to the acknowledged event
+	d.Ack("page", eventIDs(second)[1])
+	third := onceStream(t, d, nil, nil, 1, 2, 3)
+	if got, want := rowsSent(third), []string{"row-3"}; !slices.Equal(got, want) {
+		t.Errorf("rows sent after acknowledging row-2 = %q, want %q", got, want)
+	}
+}
+
+func TestOnceResume(t *testing.T) {
+	d := NewDeliveries(DeliveryConfig{})
+	first := onceStream(t, d, nil, nil, 1, 2, 3)
+	ids := eventIDs(first)
+
+	// without replay, a resuming client has the rows up to its Last-Event-ID
+	resumed := onceStream(t, d, resumeHeader(ids[1]), nil, 1, 2, 3)
+	if got, want := rowsSent(resumed), []string{"row-3"}; !slices.Equal(got, want) {
+		t.Errorf("rows sent resuming after row-2 = %q, want %q", got, want)
+	}
+}
+
+func TestOnceCompleteReplay(t *testing.T) {
+	d := NewDeliveries(DeliveryConfig{})
+	replay := NewReplayBuffer(10)
+	first := onceStream(t, d, nil, replay, 1, 2, 3)
+
+	// a complete replay brings the client every row, so none is sent again
+	resumed := onceStream(t, d, resumeHeader(eventIDs(first)[0]), replay, 1, 2, 3)
+	if got, want := rowsSent(resumed), []string{"row-2", "row-3"}; !slices.Equal(got, want) {
+		t.Errorf("rows in the resumed stream = %q, want the replayed %q only", got, want)
+	}
+	if got := eventIDs(resumed); !slices.Equal(got, eventIDs(first)[1:]) {
+		t.Errorf("resumed stream's events = %v, want the replayed %v only", got, eventIDs(first)[1:])
+	}
+}
+
+func TestOnceFailedWriteResent(t *testing.T) {
+	d := NewDeliveries(DeliveryConfig{})
+	replay := NewReplayBuffer(10)
+	w := newTestWriter()
+	s := newStream(w, nil, WithExactlyOnce(d, "page"), WithReplay(replay))
+	sendRows(t, s, 1)
+	w.failWrites()
+	if err := s.Once("row-2").PatchElementf(`<li id="row-2">row</li>`); err == nil {
+		t.Fatal("Once(row-2) to a client that went away = nil, want an error")
+	}
+	s.Close(nil)
+
+	// the replay is complete but can't bring row-2, so it is sent again
+	resumed := onceStream(t, d, resumeHeader(eventIDs(w.String())[0]), replay, 1, 2)
+	if got, want := rowsSent(resumed), []string{"row-2"}; !slices.Equal(got, want) {
+		t.Errorf("rows sent after resuming = %q, want %q", got, want)
+	}
+}
+
+func TestDeliveriesMaxKeys(t *testing.T) {
+	d := NewDeliveries(DeliveryConfig{MaxKeys: 2})
+	w := newTestWriter()
+	s := newStream(w, nil, WithExactlyOnce(d, "page"))
+	defer s.Close(nil)
+	sendRows(t, s, 1, 2, 3)
+
+	// the oldest key is forgotten, so it is sent again
+	if s.Delivered("row-1") || !s.Delivered("row-3") {
+		t.Errorf("Delivered(row-1), Delivered(row-3) = %v, %v; want false, true", s.Delivered("row-1"), s.Delivered("row-3"))
+	}
+}
+
+func TestOnceInvalidKey(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil)
+	defer s.Close(nil)
+
+	if err := s.Once("a\nb").PatchElementf(`<li id="x">x</li>`); err == nil {
+		t.Error("Once with a line break in the key = nil, want an error")
+	}
+	if err := s.Once("").PatchElementf(`<li id="x">x</li>`); err == nil {
+		t.Error("Once with an empty key = nil, want an error")
+	}
+}
@@ -0,0 +1,124 @@
+// Package otelsse traces resilientsse streams with OpenTelemetry: each
+// connection gets a server span, a child of the trace context the request
+// carries, so a long-lived stream shows up in the distributed trace of
+// whatever opened it:
+//
+//	stream := resilientsse.New(w, r,
+//		otelsse.Trace(r, otelsse.Config{}),
+//		resilientsse.WithReplay(buf))
+//
+// The span has an event for each point of the stream's life: "replay" (with
+// how many events the client was sent and whether they covered everything it
+// missed), "connect" or "resume", and "disconnect" with the drop reason and
+// cause. It ends when the stream is closed, or when the request ends for a
+// stream that was never established, e.g. one whose warm-up probe timed out.
+package otelsse
+
+import (
+	"cmp"
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"resilient-test/resilientsse"
+)
+
+// ScopeName is the instrumentation scope of the spans
+const ScopeName = "resilient-test/resilientsse/otelsse"
+
+// Config configures [Trace]
+type Config struct {
+	// TracerProvider creates the spans; nil means the global provider
+	TracerProvider trace.TracerProvider
+	// Propagator extracts the request's trace context; nil means the global
+	// propagator
+	Propagator propagation.TextMapPropagator
+	// SpanName names the span of a stream; "" means "SSE <path>"
+	SpanName string
+}
+
+// Trace returns an option that traces the stream opened for r. The span is
+// started right away, so it covers the stream's setup too.
+func Trace(r *http.Request, c Config) resilientsse.Option {
+	provider := c.TracerProvider
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+	propagator := c.Propagator
+	if propagator == nil {
+		propagator = otel.GetTextMapPropagator()
+	}
+
+	ctx := propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	_, span := provider.Tracer(ScopeName).Start(ctx, cmp.Or(c.SpanName, "SSE "+r.URL.Path),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("url.path", r.URL.Path),
+			attribute.String("client.address", r.RemoteAddr),
+		))
+
+	// an established stream's span ends with OnDrop, which runs on Close;
+	// one that is never established gets no OnDrop
+	var established atomic.Bool
+	var end sync.Once
+	context.AfterFunc(r.Context(), func() {
+		if !established.Load() {
+			end.Do(func() {
+				span.SetAttributes(attribute.Bool("resilientsse.established", false))
+				span.End()
+			})
+		}
+	})
+
+	return resilientsse.WithHooks(resilientsse.Hooks{
+		OnReplay: func(info resilientsse.ConnInfo, events int, complete bool) {
+			span.AddEvent("replay", trace.WithAttributes(
+				attribute.Int("resilientsse.replay.events", events),
+				attribute.Bool("resilientsse.replay.complete", complete),
+			))
+		},
+		OnConnect: func(info resilientsse.ConnInfo) {
+			established.Store(true)
+			span.SetAttributes(connAttributes(info)...)
+			span.AddEvent("connect")
+		},
+		OnResume: func(info resilientsse.ConnInfo) {
+			established.Store(true)
+			span.SetAttributes(connAttributes(info)...)
+			span.AddEvent("resume", trace.WithAttributes(
+				attribute.String("resilientsse.last_event_id", info.LastEventID),
+			))
+		},
+		OnDrop: func(info resilientsse.ConnInfo, reason resilientsse.DropReason, cause error) {
+			end.Do(func() {
+				attrs := []attribute.KeyValue{attribute.String("resilientsse.drop.reason", reason.String())}
+				if cause != nil {
+					attrs = append(attrs, attribute.String("resilientsse.drop.cause", cause.Error()))
+				}
+				span.AddEvent("disconnect", trace.WithAttributes(attrs...))
+				span.SetAttributes(attribute.Bool("resilientsse.established", true))
+				if reason == resilientsse.DropWriteError {
+					span.SetStatus(codes.Error, cause.Error())
+				}
+				span.End()
+			})
+		},
+	})
+}
+
+// connAttributes describes an established stream
+func connAttributes(info resilientsse.ConnInfo) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{attribute.Int64("resilientsse.conn.id", int64(info.ID))}
+	if info.SessionID != "" {
+		attrs = append(attrs, attribute.String("resilientsse.session.id", info.SessionID))
+	}
+	return attrs
+}
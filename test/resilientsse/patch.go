@@ -0,0 +1,120 @@
+package resilientsse
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// sendFunc renders one event onto the stream under the given event ID. An
+// empty id sends the event without one.
+type sendFunc func(id string) error
+
+// patcher implements the datastar-go patch surface shared by [ResilientSSE]
+// and [Tx], on top of whatever emit does with each rendered event. fail is
+// told about events that could not be rendered. emitPlain, if set, takes the
+// patches without options instead of emit, and coalesce, if set, the signal
+// patches it can merge.
+type patcher struct {
+	ctx       context.Context
+	sse       *datastar.ServerSentEventGenerator
+	emit      func(send sendFunc) error
+	emitPlain func(e plainEvent) error
+	fail      func(err error) error
+	coalesce  func(signalsContents []byte) (ok bool, err error)
+}
+
+// The methods below mirror [datastar.ServerSentEventGenerator]. Each one sends
+// exactly one event, tagged with an event ID assigned by the stream; an event
+// ID passed in opts is overridden.
+
+// Send emits a raw server-sent event
+func (p patcher) Send(eventType datastar.EventType, dataLines []string, opts ...datastar.SSEEventOption) error {
+	return p.emit(func(id string) error {
+		return p.sse.Send(eventType, dataLines, append(opts, datastar.WithSSEEventId(id))...)
+	})
+}
+
+// PatchElements sends HTML elements to the client to update the DOM tree with
+func (p patcher) PatchElements(elements string, opts ...datastar.PatchElementOption) error {
+	if p.emitPlain != nil && len(opts) == 0 {
+		return p.emitPlain(plainEvent{eventType: datastar.EventTypePatchElements, elements: elements})
+	}
+	return p.emit(func(id string) error {
+		return p.sse.PatchElements(elements, append(opts, datastar.WithPatchElementsEventID(id))...)
+	})
+}
+
+// PatchElementf is a convenience wrapper around PatchElements that formats
+// the elements with [fmt.Sprintf]
+func (p patcher) PatchElementf(format string, args ...any) error {
+	return p.PatchElements(fmt.Sprintf(format, args...))
+}
+
+// PatchElementTempl renders a templ component and patches it into the DOM
+func (p patcher) PatchElementTempl(c datastar.TemplComponent, opts ...datastar.PatchElementOption) error {
+	var sb strings.Builder
+	if err := c.Render(p.ctx, &sb); err != nil {
+		return p.fail(fmt.Errorf("failed to render: %w", err))
+	}
+	return p.PatchElements(sb.String(), opts...)
+}
+
+// RemoveElement removes the elements matching selector
+func (p patcher) RemoveElement(selector string, opts ...datastar.PatchElementOption) error {
+	return p.PatchElements("", append(opts, datastar.WithSelector(selector), datastar.WithModeRemove())...)
+}
+
+// RemoveElementByID removes the element with the given id
+func (p patcher) RemoveElementByID(id string) error {
+	return p.RemoveElement("#" + id)
+}
+
+// PatchSignals sends a JSON-encoded signals patch to the client
+func (p patcher) PatchSignals(signalsContents []byte, opts ...datastar.PatchSignalsOption) error {
+	if len(opts) == 0 {
+		if p.coalesce != nil {
+			if ok, err := p.coalesce(signalsContents); ok {
+				return err
+			}
+		}
+		if p.emitPlain != nil {
+			return p.emitPlain(plainEvent{eventType: datastar.EventTypePatchSignals, signals: signalsContents})
+		}
+	}
+	return p.emit(func(id string) error {
+		return p.sse.PatchSignals(signalsContents, append(opts, datastar.WithPatchSignalsEventID(id))...)
+	})
+}
+
+// MarshalAndPatchSignals JSON-encodes signals and patches them
+func (p patcher) MarshalAndPatchSignals(signals any, opts ...datastar.PatchSignalsOption) error {
+	b, err := json.Marshal(signals)
+	if err != nil {
+		return p.fail(fmt.Errorf("failed to marshal signals: %w", err))
+	}
+	return p.PatchSignals(b, opts...)
+}
+
+// MarshalAndPatchSignalsIfMissing patches signals only where the client does
+// not already have them
+func (p patcher) MarshalAndPatchSignalsIfMissing(signals any, opts ...datastar.PatchSignalsOption) error {
+	return p.MarshalAndPatchSignals(signals, append(opts, datastar.WithOnlyIfMissing(true))...)
+}
+
+// ExecuteScript runs scriptContents on the client
+func (p patcher) ExecuteScript(scriptContents string, opts ...datastar.ExecuteScriptOption) error {
+	return p.emit(func(id string) error {
+		return p.sse.ExecuteScript(scriptContents, append(opts, datastar.WithExecuteScriptEventID(id))...)
+	})
+}
+
+// ConsoleLog logs msg to the client's console
+func (p patcher) ConsoleLog(msg string, opts ...datastar.ExecuteScriptOption) error {
+	return p.emit(func(id string) error {
+		return p.sse.ConsoleLog(msg, append(opts, datastar.WithExecuteScriptEventID(id))...)
+	})
+}
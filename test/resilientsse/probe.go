@@ -0,0 +1,136 @@
+package resilientsse
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrProbeTimeout is the cause reported by [ResilientSSE.Err] when the client
+// did not answer the warm-up probe in time
+var ErrProbeTimeout = errors.New("resilientsse: warm-up probe not answered")
+
+// Prober makes new streams prove the client is really there before they are
+// considered established. The stream sends a tiny script that calls back to
+// the Prober's path; until the callback arrives nothing else is sent, and no
+// replay happens. Connections that never call back (zombies left behind by
+// broken intermediaries, clients that don't run scripts) are closed after the
+// timeout without consuming any replay resources.
+//
+// The Prober must be mounted on its path:
+//
+//	prober := resilientsse.NewProber("/sse/probe")
+//	mux.Handle("/sse/probe", prober)
+//	...
+//	stream := resilientsse.New(w, r, resilientsse.WithWarmupProbe(prober, 5*time.Second))
+//
+// A Prober is safe for concurrent use.
+type Prober struct {
+	path string
+
+	mu      sync.Mutex
+	pending map[string]chan struct{}
+
+	established atomic.Int64
+	timedOut    atomic.Int64
+}
+
+// NewProber creates a Prober whose callbacks are served on path
+func NewProber(path string) *Prober {
+	return &Prober{path: path, pending: map[string]chan struct{}{}}
+}
+
+// WithWarmupProbe makes [New] block until the client answers p's probe, or
+// close the stream with [ErrProbeTimeout] if it hasn't within timeout
+func WithWarmupProbe(p *Prober, timeout time.Duration) Option {
+	return func(o *options) {
+		o.probe = p
+		o.probeTimeout = timeout
+	}
+}
+
+// ServeHTTP accepts probe callbacks (POST ?token=...)
+func (p *Prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	p.mu.Lock()
+	ch, ok := p.pending[token]
+	delete(p.pending, token)
+	p.mu.Unlock()
+
+	if !ok {
+		http.Error(w, "unknown or expired probe", http.StatusNotFound)
+		return
+	}
+	close(ch)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Stats returns how many streams answered the probe and how many timed out
+func (p *Prober) Stats() (established, timedOut int64) {
+	return p.established.Load(), p.timedOut.Load()
+}
+
+// register creates a pending probe
+func (p *Prober) register() (token string, answered <-chan struct{}) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	token = hex.EncodeToString(b)
+
+	ch := make(chan struct{})
+	p.mu.Lock()
+	p.pending[token] = ch
+	p.mu.Unlock()
+	return token, ch
+}
+
+// forget drops a probe that will no longer be waited on
+func (p *Prober) forget(token string) {
+	p.mu.Lock()
+	delete(p.pending, token)
+	p.mu.Unlock()
+}
+
+// probe sends the warm-up script and waits for the callback. The script is
+// not an application event, so it takes no event ID and is never replayed.
+func (s *ResilientSSE) probe() error {
+	p := s.opts.probe
+	token, answered := p.register()
+	defer p.forget(token)
+
+	script := fmt.Sprintf(`fetch(%q, {method: "POST"})`, p.path+"?token="+token)
+	s.w.hold()
+	err := s.sse.ExecuteScript(script)
+	frames := s.w.release()
+	if err != nil {
+		return err
+	}
+	if err := s.w.writeFrames(frames); err != nil {
+		return s.failWrite(err)
+	}
+
+	timer := time.NewTimer(s.opts.probeTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-answered:
+		p.established.Add(1)
+		return nil
+	case <-timer.C:
+		p.timedOut.Add(1)
+		return ErrProbeTimeout
+	case <-s.ctx.Done():
+		return context.Cause(s.ctx)
+	}
+}
@@ -0,0 +1,87 @@
+package resilientsse
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// probeToken matches the callback URL of a warm-up script
+var probeToken = regexp.MustCompile(`/probe\?token=([0-9a-f]+)`)
+
+// A client that never answers the probe is closed after the timeout, without
+// being replayed anything
+func TestProbeTimeout(t *testing.T) {
+	prober := NewProber("/probe")
+	buf := NewReplayBuffer(16)
+	addEvents(buf, 1, 2, 3)
+	w := newTestWriter()
+
+	start := time.Now()
+	s := newStream(w, resumeHeader(1), WithReplay(buf), WithWarmupProbe(prober, 20*time.Millisecond))
+	defer s.Close(nil)
+
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("New returned after %v, before the probe timed out", elapsed)
+	}
+	if !s.IsClosed() || !errors.Is(s.Err(), ErrProbeTimeout) {
+		t.Errorf("stream closed %v with %v, want ErrProbeTimeout", s.IsClosed(), s.Err())
+	}
+	if ids := eventIDs(w.String()); len(ids) != 0 {
+		t.Errorf("unprobed client was sent events %v", ids)
+	}
+	if established, timedOut := prober.Stats(); established != 0 || timedOut != 1 {
+		t.Errorf("Stats() = %d, %d, want 0 established, 1 timed out", established, timedOut)
+	}
+	if len(prober.pending) != 0 {
+		t.Errorf("%d probes still pending", len(prober.pending))
+	}
+}
+
+func TestProbeAnswered(t *testing.T) {
+	prober := NewProber("/probe")
+	buf := NewReplayBuffer(16)
+	addEvents(buf, 1, 2, 3)
+	w := newTestWriter()
+
+	opened := make(chan *ResilientSSE)
+	go func() {
+		opened <- newStream(w, resumeHeader(1), WithReplay(buf), WithWarmupProbe(prober, 5*time.Second))
+	}()
+
+	var token string
+	for deadline := time.Now().Add(5 * time.Second); token == ""; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("no warm-up script was sent")
+		}
+		if m := probeToken.FindStringSubmatch(w.String()); m != nil {
+			token = m[1]
+		}
+	}
+	if ids := eventIDs(w.String()); len(ids) != 0 {
+		t.Errorf("events %v were sent before the probe was answered", ids)
+	}
+
+	answer := httptest.NewRecorder()
+	prober.ServeHTTP(answer, httptest.NewRequest(http.MethodPost, "/probe?token="+token, nil))
+	if answer.Code != http.StatusNoContent {
+		t.Fatalf("answering the probe got %d", answer.Code)
+	}
+	s := <-opened
+	defer s.Close(nil)
+
+	if s.IsClosed() {
+		t.Fatalf("answered stream closed with %v", s.Err())
+	}
+	if ids := eventIDs(w.String()); len(ids) != 2 || ids[0] != 2 {
+		t.Errorf("replayed events %v, want 2 and 3", ids)
+	}
+	again := httptest.NewRecorder()
+	prober.ServeHTTP(again, httptest.NewRequest(http.MethodPost, "/probe?token="+token, nil))
+	if again.Code != http.StatusNotFound {
+		t.Errorf("answering the probe twice got %d, want 404", again.Code)
+	}
+}
@@ -0,0 +1,158 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultProxyRetry is the reconnect delay a proxy suggests when its upstream
+// fails without saying when to come back
+const DefaultProxyRetry = 2 * time.Second
+
+// ProxyConfig configures [NewProxy]
+type ProxyConfig struct {
+	// Retry is the reconnect delay suggested to clients when the upstream is
+	// unreachable or fails without a Retry-After. It is jittered by
+	// [DefaultRetryJitter]. Zero means DefaultProxyRetry.
+	Retry time.Duration
+	// Transport carries requests upstream. Nil means [http.DefaultTransport].
+	Transport http.RoundTripper
+	// ErrorLog receives upstream errors. Nil means the log package's standard
+	// logger.
+	ErrorLog *log.Logger
+}
+
+// NewProxy returns a reverse proxy to target that keeps streams working
+// through it:
+//
+//   - event stream responses are flushed event by event, and marked
+//     X-Accel-Buffering: no so nginx-style front proxies don't buffer them
+//   - the resume state of a reconnecting client reaches the upstream along
+//     with the rest of the request: its Last-Event-ID (copied from
+//     [LastEventIDParam] into the header if only the parameter is set, for
+//     upstreams that only read the header), session, envelope and debug
+//     headers and parameters
+//   - an unreachable upstream, or one answering 5xx or 429, becomes a retry
+//     hint: the error status with a Retry-After header, and either an SSE
+//     body with a retry: field or, for other requests, a JSON body
+//     {"error": ..., "retryAfterMs": ...}. The upstream's own Retry-After is
+//     passed on if it has one.
+//
+// A stream the upstream ends, for instance when it drains, ends the same way
+// for the client, retry directive included.
+func NewProxy(target *url.URL, c ProxyConfig) *httputil.ReverseProxy {
+	if c.Retry <= 0 {
+		c.Retry = DefaultProxyRetry
+	}
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.SetURL(target)
+			pr.SetXForwarded()
+			if pr.Out.Header.Get(LastEventIDHeader) == "" {
+				if id := pr.In.URL.Query().Get(LastEventIDParam); id != "" {
+					pr.Out.Header.Set(LastEventIDHeader, id)
+				}
+			}
+		},
+		Transport:     c.Transport,
+		FlushInterval: -1,
+		ErrorLog:      c.ErrorLog,
+		ModifyResponse: func(resp *http.Response) error {
+			if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+				return &upstreamError{status: resp.StatusCode, retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+			}
+			if isEventStream(resp.Header.Get("Content-Type")) {
+				resp.Header.Set("X-Accel-Buffering", "no")
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if r.Context().Err() != nil {
+				return // the client is gone
+			}
+			c.logf("resilientsse: proxy %s: %v", r.URL.Path, err)
+
+			status, retry := http.StatusBadGateway, time.Duration(0)
+			var upErr *upstreamError
+			if errors.As(err, &upErr) {
+				status, retry = upErr.status, upErr.retryAfter
+			}
+			if retry <= 0 {
+				p := ReconnectPolicy{Min: c.Retry, Max: c.Retry, Jitter: DefaultRetryJitter}
+				retry = p.Delay(0)
+			}
+			writeRetryHint(w, r, status, retry)
+		},
+	}
+}
+
+func (c ProxyConfig) logf(format string, args ...any) {
+	if c.ErrorLog != nil {
+		c.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// upstreamError is an upstream response the proxy turns into a retry hint
+type upstreamError struct {
+	status     int
+	retryAfter time.Duration
+}
+
+func (e *upstreamError) Error() string {
+	return fmt.Sprintf("upstream answered %d %s", e.status, http.StatusText(e.status))
+}
+
+// writeRetryHint tells the client to come back after retry, in the form its
+// request accepts
+func writeRetryHint(w http.ResponseWriter, r *http.Request, status int, retry time.Duration) {
+	h := w.Header()
+	h.Set("Retry-After", strconv.Itoa(int((retry+time.Second-1)/time.Second)))
+	h.Set("Cache-Control", "no-cache")
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		h.Set("Content-Type", "text/event-stream")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, ": upstream unavailable (%d %s)\nretry: %d\n\n", status, http.StatusText(status), retry.Milliseconds())
+		return
+	}
+
+	h.Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error":        http.StatusText(status),
+		"retryAfterMs": retry.Milliseconds(),
+	})
+}
+
+// parseRetryAfter reads a Retry-After header in either of its forms, returning
+// 0 if it is missing, malformed or in the past
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return max(time.Duration(secs)*time.Second, 0)
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
+
+// isEventStream reports whether contentType is an SSE stream
+func isEventStream(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == "text/event-stream"
+}
@@ -0,0 +1,90 @@
+package resilientsse
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// newProxied serves upstream behind a proxy, returning the proxy's URL
+func newProxied(t *testing.T, upstream http.HandlerFunc) string {
+	t.Helper()
+	up := httptest.NewServer(upstream)
+	t.Cleanup(up.Close)
+	target, _ := url.Parse(up.URL)
+	proxy := httptest.NewServer(NewProxy(target, ProxyConfig{ErrorLog: log.New(io.Discard, "", 0)}))
+	t.Cleanup(proxy.Close)
+	return proxy.URL
+}
+
+// getProxied requests target with header, returning the response and its body
+func getProxied(t *testing.T, target string, header http.Header) (*http.Response, string) {
+	t.Helper()
+	r, _ := http.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+// A client reconnecting through the proxy is replayed what it missed, whether
+// it presents its Last-Event-ID as the header or the parameter
+func TestProxyForwardsLastEventID(t *testing.T) {
+	buf := NewReplayBuffer(16)
+	addEvents(buf, 1, 2, 3, 4, 5)
+	var upstreamIDs []string
+	proxy := newProxied(t, func(w http.ResponseWriter, r *http.Request) {
+		upstreamIDs = append(upstreamIDs, r.Header.Get(LastEventIDHeader))
+		New(w, r, WithReplay(buf)).Close(nil)
+	})
+
+	for _, c := range []struct {
+		name   string
+		target string
+		header http.Header
+	}{
+		{"header", proxy + "/feed", resumeHeader(3)},
+		{"param", proxy + "/feed?" + LastEventIDParam + "=3", nil},
+	} {
+		resp, body := getProxied(t, c.target, c.header)
+		if ids := eventIDs(body); len(ids) != 2 || ids[0] != 4 || ids[1] != 5 {
+			t.Errorf("%s: client through the proxy was replayed %v, want 4 and 5:\n%s", c.name, ids, body)
+		}
+		if resp.Header.Get("X-Accel-Buffering") != "no" {
+			t.Errorf("%s: stream response isn't marked unbuffered", c.name)
+		}
+	}
+	if len(upstreamIDs) != 2 || upstreamIDs[0] != "3" || upstreamIDs[1] != "3" {
+		t.Errorf("upstream saw Last-Event-ID %q, want 3 both times", upstreamIDs)
+	}
+}
+
+func TestProxyRetryHint(t *testing.T) {
+	proxy := newProxied(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "7")
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	})
+
+	resp, body := getProxied(t, proxy+"/feed", http.Header{"Accept": {"text/event-stream"}})
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "7" {
+		t.Errorf("client got %d, Retry-After %q, want 503 with the upstream's 7", resp.StatusCode, resp.Header.Get("Retry-After"))
+	}
+	if !strings.Contains(body, "\nretry: 7000\n") {
+		t.Errorf("stream body = %q, want a retry field", body)
+	}
+
+	_, body = getProxied(t, proxy+"/api", nil)
+	if !strings.Contains(body, `"retryAfterMs":7000`) {
+		t.Errorf("JSON body = %q, want retryAfterMs", body)
+	}
+}
@@ -0,0 +1,234 @@
+package resilientsse
+
+import (
+	"cmp"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultReconnectRate is how many connections per second a key may open
+	// without a Rate
+	DefaultReconnectRate = 1.0
+	// DefaultReconnectBurst is how many connections a key may open at once
+	// without a Burst
+	DefaultReconnectBurst = 5
+)
+
+// DefaultReconnectBackoff spreads the Retry-After of refused connections over
+// a few seconds at first, and up to two minutes for a key that keeps coming
+// back too soon
+var DefaultReconnectBackoff = ReconnectPolicy{Min: 4 * time.Second, Max: 2 * time.Minute, Factor: 2, Jitter: 0.75}
+
+// reconnectSweepInterval is how often idle keys are forgotten
+const reconnectSweepInterval = time.Minute
+
+// ReconnectLimitConfig configures a [ReconnectLimiter]
+type ReconnectLimitConfig struct {
+	// Rate is how many connections per second a key may open on average;
+	// zero means DefaultReconnectRate
+	Rate float64
+	// Burst is how many connections a key may open at once; zero means
+	// DefaultReconnectBurst
+	Burst int
+	// GlobalRate caps the connections per second of all keys together, which
+	// is what a mass reconnect (every client of a restarted server coming
+	// back at once) exceeds; zero means no cap
+	GlobalRate float64
+	// GlobalBurst is how many connections all keys may open at once; zero
+	// means GlobalRate, rounded up
+	GlobalBurst int
+	// Key returns the key a request's connection counts against; nil means
+	// the client's IP. Behind a proxy, key by the client address the proxy
+	// forwards. [KeyBySession] keys clients sharing an IP separately.
+	Key func(r *http.Request) string
+	// Backoff computes the Retry-After of a refused connection, attempt
+	// being how many times in a row its key was refused, minus one; zero
+	// means DefaultReconnectBackoff. Retry-After is never sooner than the
+	// key could connect again.
+	Backoff ReconnectPolicy
+	// Metrics, if set, counts refused connections
+	Metrics *Metrics
+}
+
+// ReconnectLimiter refuses connections that come too often, from one client
+// or from all of them together, with 429 Too Many Requests and a jittered
+// Retry-After, so a reconnect storm after a deploy is spread out rather than
+// met all at once. It checks the request before the stream is opened:
+//
+//	limiter := resilientsse.NewReconnectLimiter(resilientsse.ReconnectLimitConfig{GlobalRate: 200})
+//	mux.Handle("/feed", limiter.Wrap(feedHandler))
+//
+// or, in a handler, before [New]:
+//
+//	if !limiter.Allow(w, r) {
+//		return
+//	}
+//
+// EventSource gives up on a 429; the Resilient JS Retryer and Datastar retry
+// with their own backoff.
+//
+// A ReconnectLimiter is safe for concurrent use.
+type ReconnectLimiter struct {
+	c ReconnectLimitConfig
+
+	mu        sync.Mutex
+	global    tokenBucket
+	keys      map[string]*reconnectKey
+	lastSweep time.Time
+}
+
+// reconnectKey is the connections of one key
+type reconnectKey struct {
+	tokenBucket
+	// refused counts the key's refusals since it last got through
+	refused int
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second
+type tokenBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// take takes a token if there is one, or else returns how long until there
+// is
+func (b *tokenBucket) take(rate float64, burst int, now time.Time) (ok bool, wait time.Duration) {
+	if b.at.IsZero() {
+		b.tokens = float64(burst)
+	} else {
+		b.tokens = min(b.tokens+now.Sub(b.at).Seconds()*rate, float64(burst))
+	}
+	b.at = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// refund gives back a token taken by take
+func (b *tokenBucket) refund() {
+	b.tokens++
+}
+
+// full reports whether the bucket has refilled by now
+func (b *tokenBucket) full(rate float64, burst int, now time.Time) bool {
+	return b.tokens+now.Sub(b.at).Seconds()*rate >= float64(burst)
+}
+
+// NewReconnectLimiter creates a limiter that has seen no connections
+func NewReconnectLimiter(c ReconnectLimitConfig) *ReconnectLimiter {
+	c.Rate = cmp.Or(max(c.Rate, 0), DefaultReconnectRate)
+	c.Burst = cmp.Or(max(c.Burst, 0), DefaultReconnectBurst)
+	if c.GlobalRate > 0 {
+		c.GlobalBurst = cmp.Or(max(c.GlobalBurst, 0), int(math.Ceil(c.GlobalRate)))
+	}
+	if c.Key == nil {
+		c.Key = clientIP
+	}
+	if c.Backoff == (ReconnectPolicy{}) {
+		c.Backoff = DefaultReconnectBackoff
+	}
+	return &ReconnectLimiter{c: c, keys: map[string]*reconnectKey{}, lastSweep: time.Now()}
+}
+
+// Allow counts r's connection against its key and the global limit. If
+// either is exceeded it answers r with 429 and returns false, and the
+// handler must return without opening a stream.
+func (l *ReconnectLimiter) Allow(w http.ResponseWriter, r *http.Request) bool {
+	retryAfter, ok := l.take(l.c.Key(r), time.Now())
+	if ok {
+		return true
+	}
+	if l.c.Metrics != nil {
+		l.c.Metrics.limited.Add(1)
+	}
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "too many reconnects", http.StatusTooManyRequests)
+	return false
+}
+
+// Wrap returns a handler that serves next the connections Allow lets through
+func (l *ReconnectLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l.Allow(w, r) {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// Len returns the number of keys being tracked
+func (l *ReconnectLimiter) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.keys)
+}
+
+// take takes a token for key, and a global one, returning the Retry-After if
+// it can't have both
+func (l *ReconnectLimiter) take(key string, now time.Time) (retryAfter time.Duration, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) >= reconnectSweepInterval {
+		l.sweep(now)
+	}
+
+	k := l.keys[key]
+	if k == nil {
+		k = &reconnectKey{}
+		l.keys[key] = k
+	}
+	ok, wait := k.take(l.c.Rate, l.c.Burst, now)
+	if ok && l.c.GlobalRate > 0 {
+		if ok, wait = l.global.take(l.c.GlobalRate, l.c.GlobalBurst, now); !ok {
+			k.refund()
+		}
+	}
+	if ok {
+		k.refused = 0
+		return 0, true
+	}
+
+	k.refused++
+	return max(l.c.Backoff.Delay(k.refused-1), wait, time.Second), false
+}
+
+// sweep forgets keys that have refilled, and so would be treated the same if
+// they were new. l.mu must be held.
+func (l *ReconnectLimiter) sweep(now time.Time) {
+	for key, k := range l.keys {
+		if k.full(l.c.Rate, l.c.Burst, now) {
+			delete(l.keys, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+// KeyBySession keys a connection by the session it presents
+// ([SessionHeader]), or else by its client's IP, for clients behind a shared
+// IP such as an office NAT. Clients choose the session they present, so one
+// can dodge its own limit with made-up IDs; GlobalRate still applies.
+func KeyBySession(r *http.Request) string {
+	if id := r.Header.Get(SessionHeader); id != "" {
+		return "session " + id
+	}
+	return clientIP(r)
+}
+
+// clientIP keys a connection by its client's IP
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip " + host
+}
@@ -0,0 +1,100 @@
+package resilientsse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// noJitter is a Backoff whose Retry-After is predictable
+var noJitter = ReconnectPolicy{Min: 4 * time.Second, Max: 20 * time.Second, Factor: 2}
+
+func TestReconnectLimiterRefill(t *testing.T) {
+	l := NewReconnectLimiter(ReconnectLimitConfig{Rate: 2, Burst: 3, Backoff: noJitter})
+	now := time.Now()
+
+	for i := range 3 {
+		if _, ok := l.take("a", now); !ok {
+			t.Fatalf("connection %d of a burst of 3 refused", i+1)
+		}
+	}
+	if _, ok := l.take("a", now); ok {
+		t.Fatal("connection beyond the burst allowed")
+	}
+	if _, ok := l.take("b", now); !ok {
+		t.Error("another key was refused")
+	}
+
+	// a token every 500ms
+	if _, ok := l.take("a", now.Add(400*time.Millisecond)); ok {
+		t.Error("allowed before a token was refilled")
+	}
+	if _, ok := l.take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Error("refused after a token was refilled")
+	}
+}
+
+func TestReconnectLimiterRetryAfter(t *testing.T) {
+	l := NewReconnectLimiter(ReconnectLimitConfig{Rate: 1, Burst: 1, Backoff: noJitter})
+	var hits int
+	h := l.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hits++ }))
+
+	connect := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := connect(); w.Code != http.StatusOK || hits != 1 {
+		t.Fatalf("first connection got %d, served %d times", w.Code, hits)
+	}
+	// the backoff doubles with each refusal in a row, up to its Max
+	for _, want := range []string{"4", "8", "16", "20"} {
+		w := connect()
+		if w.Code != http.StatusTooManyRequests {
+			t.Fatalf("connection over the limit got %d, want 429", w.Code)
+		}
+		if got := w.Header().Get("Retry-After"); got != want {
+			t.Errorf("Retry-After = %s, want %s", got, want)
+		}
+	}
+	if hits != 1 {
+		t.Errorf("refused connections reached the handler %d times", hits-1)
+	}
+}
+
+func TestReconnectLimiterGlobal(t *testing.T) {
+	l := NewReconnectLimiter(ReconnectLimitConfig{Rate: 10, Burst: 10, GlobalRate: 2, Backoff: noJitter})
+	now := time.Now()
+
+	l.take("a", now)
+	l.take("b", now)
+	retryAfter, ok := l.take("c", now)
+	if ok {
+		t.Fatal("connection over the global limit allowed")
+	}
+	if retryAfter < noJitter.Min {
+		t.Errorf("Retry-After = %v, want at least %v", retryAfter, noJitter.Min)
+	}
+	// the refused key's own token was given back
+	if tokens := l.keys["c"].tokens; tokens != 10 {
+		t.Errorf("refused key has %v tokens, want 10", tokens)
+	}
+}
+
+func TestReconnectLimiterSweep(t *testing.T) {
+	l := NewReconnectLimiter(ReconnectLimitConfig{Rate: 1, Burst: 2})
+	now := time.Now()
+	l.take("a", now)
+	// b empties its bucket just before the sweep, so hasn't refilled
+	l.take("b", now.Add(reconnectSweepInterval-time.Second))
+	l.take("b", now.Add(reconnectSweepInterval-time.Second))
+
+	l.take("c", now.Add(reconnectSweepInterval))
+	if _, kept := l.keys["a"]; kept || l.Len() != 2 {
+		t.Errorf("after sweeping, a kept %v and %d keys left, want a dropped and b and c left", kept, l.Len())
+	}
+}
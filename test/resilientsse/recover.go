@@ -0,0 +1,56 @@
+package resilientsse
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"time"
+)
+
+// ErrPanic is the cause reported by [ResilientSSE.Err] for streams whose
+// handler panicked, once [ResilientSSE.Recover] or [Middleware] recovered it
+var ErrPanic = errors.New("resilientsse: handler panicked")
+
+// ErrorSignal is the signal a stream patches when its handler fails, just
+// before it ends, so the page can show the failure and when it will retry:
+//
+//	{"resilientError": {"reason": "panic", "reconnect": "backoff", "retry": 740}}
+//
+// reconnect and retry are as in [IdleSignal]. The panic itself stays in the
+// server's log.
+const ErrorSignal = "resilientError"
+
+// panicRetry is about how long a client is asked to wait before reconnecting
+// to a handler that panicked
+const panicRetry = time.Second
+
+// Recover recovers a panic in the handler streaming to s: it logs the panic
+// and its stack through [ResilientSSE.Logger], patches [ErrorSignal], sends a
+// retry field and closes the stream with [ErrPanic]. The client keeps the ID
+// of the last event it got, so it resumes from there once it reconnects.
+// Defer it after opening the stream, so it runs before the deferred Close:
+//
+//	sse := resilientsse.New(w, r, opts...)
+//	defer sse.Close(nil)
+//	defer sse.Recover()
+//
+// [http.ErrAbortHandler] is panicked again, as net/http expects. [Middleware]
+// recovers the handlers it wraps itself.
+func (s *ResilientSSE) Recover() {
+	if v := recover(); v != nil {
+		s.recovered(v)
+	}
+}
+
+// recovered ends s after its handler panicked with v
+func (s *ResilientSSE) recovered(v any) {
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	s.Logger().Error("handler panicked", slog.Any("panic", v), slog.String("stack", string(debug.Stack())))
+	if !s.IsClosed() {
+		s.closeWithRetry(ErrorSignal, map[string]any{"reason": "panic"}, panicRetry, ErrPanic)
+	}
+	s.Close(ErrPanic)
+}
@@ -0,0 +1,68 @@
+package resilientsse
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// A handler that panics mid-stream tells the client, logs the stack and ends
+// the stream, leaving the client's cursor on the last event it got
+func TestRecover(t *testing.T) {
+	var log bytes.Buffer
+	w := newTestWriter()
+	s := newStream(w, nil, WithLogger(slog.New(slog.NewTextHandler(&log, nil))))
+	func() {
+		defer s.Close(nil)
+		defer s.Recover()
+		s.PatchSignals([]byte(`{"n":1}`))
+		panic("boom")
+	}()
+
+	if !errors.Is(s.Err(), ErrPanic) {
+		t.Errorf("stream ended with %v, want ErrPanic", s.Err())
+	}
+	got := w.String()
+	if !strings.Contains(got, `{"`+ErrorSignal+`":{"reason":"panic","reconnect":"backoff","retry":`) || !strings.Contains(got, "\nretry: ") {
+		t.Errorf("client wasn't told the handler failed:\n%s", got)
+	}
+	if ids := eventIDs(got); !slices.Equal(ids, []uint64{1, 2}) {
+		t.Errorf("event IDs = %v, want the patch and the error", ids)
+	}
+	if !strings.Contains(log.String(), "handler panicked") || !strings.Contains(log.String(), "panic=boom") ||
+		!strings.Contains(log.String(), "TestRecover") {
+		t.Errorf("log = %s, want the panic with its stack", log.String())
+	}
+}
+
+func TestRecoverAbortHandler(t *testing.T) {
+	s := newStream(newTestWriter(), nil, WithLogger(slog.New(slog.DiscardHandler)))
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler panicked again", v)
+		}
+	}()
+	defer s.Recover()
+	panic(http.ErrAbortHandler)
+}
+
+func TestMiddlewareRecovers(t *testing.T) {
+	h := Middleware(WithLogger(slog.New(slog.DiscardHandler)))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sse := datastar.NewSSE(w, r)
+		sse.PatchSignals([]byte(`{"n":1}`))
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/feed", nil))
+
+	if body := rec.Body.String(); !strings.Contains(body, `"`+ErrorSignal+`":`) {
+		t.Errorf("client wasn't told the handler failed:\n%s", body)
+	}
+}
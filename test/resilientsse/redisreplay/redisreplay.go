@@ -0,0 +1,300 @@
+// Package redisreplay keeps resilientsse replay events in Redis, so a client
+// whose reconnect lands on another instance of the app is still replayed what
+// it missed:
+//
+//	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+//	stores := redisreplay.NewStores(rdb, redisreplay.Config{Size: 100})
+//
+//	// in the stream handler
+//	stream := resilientsse.New(w, r,
+//		resilientsse.WithSessions(sessions),
+//		resilientsse.WithReplayStore(stores.Get(sessionID)))
+//
+// Each key is a Redis stream holding one entry per event, with the event ID
+// as the entry ID (<id>-0) and the frame in field f. Streams are trimmed to
+// about Size entries as events are added, and expire TTL after their last
+// event.
+//
+// A Stores is a [resilientsse.ReplayExporter] and
+// [resilientsse.ReplayImporter], so its events can be moved to or from other
+// stores with [resilientsse.ExportReplay] and [resilientsse.ImportReplay].
+package redisreplay
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"resilient-test/resilientsse"
+)
+
+const (
+	// DefaultPrefix is prepended to the keys of a [Stores] without a Prefix
+	DefaultPrefix = "resilientsse:replay:"
+	// DefaultSize is how many events a store keeps without a Size
+	DefaultSize = 100
+	// DefaultTTL is how long a store outlives its last event without a TTL
+	DefaultTTL = 24 * time.Hour
+	// DefaultTimeout bounds each Redis round trip without a Timeout
+	DefaultTimeout = 2 * time.Second
+)
+
+// frameField is the stream entry field holding an event's frame
+const frameField = "f"
+
+// exportBatch is how many keys or entries an export reads per round trip
+const exportBatch = 1000
+
+// Config configures the stores of a [Stores]
+type Config struct {
+	// Prefix is prepended to every key; "" means DefaultPrefix
+	Prefix string
+	// Size is how many events each store keeps, at least; trimming is
+	// approximate, so Redis may keep a few more. Zero means DefaultSize.
+	Size int
+	// TTL is how long a store is kept after its last event; zero means
+	// DefaultTTL
+	TTL time.Duration
+	// Timeout bounds each Redis round trip; zero means DefaultTimeout
+	Timeout time.Duration
+}
+
+// Stores hands out the [Store] of each key, such as a session ID, the way
+// [resilientsse.ReplayBuffers] does in memory. A Stores is safe for
+// concurrent use.
+type Stores struct {
+	client redis.UniversalClient
+	c      Config
+}
+
+var (
+	_ resilientsse.ReplayExporter = (*Stores)(nil)
+	_ resilientsse.ReplayImporter = (*Stores)(nil)
+)
+
+// NewStores creates a set of stores kept in Redis through client
+func NewStores(client redis.UniversalClient, c Config) *Stores {
+	c.Prefix = cmp.Or(c.Prefix, DefaultPrefix)
+	c.Size = cmp.Or(max(c.Size, 0), DefaultSize)
+	c.TTL = cmp.Or(max(c.TTL, 0), DefaultTTL)
+	c.Timeout = cmp.Or(max(c.Timeout, 0), DefaultTimeout)
+	return &Stores{client: client, c: c}
+}
+
+// Get returns the store for key, keeping the configured number of events
+func (st *Stores) Get(key string) *Store {
+	return st.GetWithSize(key, st.c.Size)
+}
+
+// GetWithSize returns the store for key, keeping size events. Unlike
+// [resilientsse.ReplayBuffers.GetWithSize], the size applies to what is
+// added through the returned store, whatever the key was used with before.
+func (st *Stores) GetWithSize(key string, size int) *Store {
+	return &Store{
+		client:  st.client,
+		key:     st.c.Prefix + key,
+		size:    int64(max(size, 1)),
+		ttl:     st.c.TTL,
+		timeout: st.c.Timeout,
+	}
+}
+
+// Delete drops the events kept for key
+func (st *Stores) Delete(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), st.c.Timeout)
+	defer cancel()
+
+	return st.client.Del(ctx, st.c.Prefix+key).Err()
+}
+
+// ExportKeys returns the keys with a stream under the prefix, sorted, scanning
+// exportBatch keys per round trip
+func (st *Stores) ExportKeys() ([]string, error) {
+	match := globEscaper.Replace(st.c.Prefix) + "*"
+	var keys []string
+	var cursor uint64
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), st.c.Timeout)
+		page, next, err := st.client.Scan(ctx, cursor, match, exportBatch).Result()
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("redisreplay: listing keys: %w", err)
+		}
+		for _, k := range page {
+			keys = append(keys, strings.TrimPrefix(k, st.c.Prefix))
+		}
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+	// SCAN may return a key more than once
+	slices.Sort(keys)
+	return slices.Compact(keys), nil
+}
+
+// ExportEvents calls fn for each event of the stream for key, oldest first,
+// reading exportBatch entries per round trip
+func (st *Stores) ExportEvents(key string, fn func(id uint64, frame []byte) error) (int, error) {
+	s := st.Get(key)
+	start := "-"
+	for {
+		ctx, cancel := s.context()
+		msgs, err := s.client.XRangeN(ctx, s.key, start, "+", exportBatch).Result()
+		cancel()
+		if err != nil {
+			return 0, fmt.Errorf("redisreplay: exporting %s: %w", s.key, err)
+		}
+		for _, msg := range msgs {
+			id, err := parseEntryID(msg.ID)
+			if err != nil {
+				return 0, err
+			}
+			frame, _ := msg.Values[frameField].(string)
+			if err := fn(id, []byte(frame)); err != nil {
+				return 0, err
+			}
+			start = "(" + msg.ID
+		}
+		if len(msgs) < exportBatch {
+			return st.c.Size, nil
+		}
+	}
+}
+
+// ImportStore returns the store for key, keeping size events
+func (st *Stores) ImportStore(key string, size int) resilientsse.ReplayStore {
+	return st.GetWithSize(key, size)
+}
+
+// globEscaper escapes the characters SCAN's MATCH pattern treats specially
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// Store is a [resilientsse.ReplayStore] kept in one Redis stream
+type Store struct {
+	client  redis.UniversalClient
+	key     string
+	size    int64
+	ttl     time.Duration
+	timeout time.Duration
+}
+
+var (
+	_ resilientsse.ReplayStore  = (*Store)(nil)
+	_ resilientsse.ReplayPruner = (*Store)(nil)
+)
+
+// Append adds the event to the stream, trimming it and renewing its TTL in
+// the same transaction. Redis refuses an id not above the stream's last, so
+// two instances can't both record an event under the same ID.
+func (s *Store) Append(id uint64, frame []byte) error {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	_, err := s.client.TxPipelined(ctx, func(p redis.Pipeliner) error {
+		p.XAdd(ctx, &redis.XAddArgs{
+			Stream: s.key,
+			MaxLen: s.size,
+			Approx: true,
+			ID:     entryID(id),
+			Values: []any{frameField, frame},
+		})
+		p.Expire(ctx, s.key, s.ttl)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("redisreplay: adding event %d to %s: %w", id, s.key, err)
+	}
+	return nil
+}
+
+// Since returns the frames of the events after id, oldest first, reading
+// the stream's oldest entry in the same round trip to tell whether any were
+// trimmed. Once the stream has expired, only a client that saw none of its
+// events is replayed completely.
+func (s *Store) Since(id uint64) (frames [][]byte, complete bool, err error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	var oldest, after *redis.XMessageSliceCmd
+	_, err = s.client.Pipelined(ctx, func(p redis.Pipeliner) error {
+		oldest = p.XRangeN(ctx, s.key, "-", "+", 1)
+		after = p.XRange(ctx, s.key, entryID(id+1), "+")
+		return nil
+	})
+	if err != nil {
+		return nil, false, fmt.Errorf("redisreplay: reading %s: %w", s.key, err)
+	}
+
+	if len(oldest.Val()) == 0 {
+		// the stream never existed or has expired: a client that saw any of
+		// its events may have missed the rest
+		return nil, id == 0, nil
+	}
+	first, err := parseEntryID(oldest.Val()[0].ID)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, msg := range after.Val() {
+		frame, _ := msg.Values[frameField].(string)
+		frames = append(frames, []byte(frame))
+	}
+	return frames, id+1 >= first, nil
+}
+
+// LastID returns the ID of the stream's newest event, or 0 if it has none
+func (s *Store) LastID() (uint64, error) {
+	ctx, cancel := s.context()
+	defer cancel()
+
+	msgs, err := s.client.XRevRangeN(ctx, s.key, "+", "-", 1).Result()
+	if err != nil {
+		return 0, fmt.Errorf("redisreplay: reading %s: %w", s.key, err)
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	return parseEntryID(msgs[0].ID)
+}
+
+// Prune trims the stream's events up to and including id, keeping at least
+// its newest. Events appended meanwhile, by any instance, are newer and kept.
+func (s *Store) Prune(id uint64) (int, error) {
+	last, err := s.LastID()
+	if err != nil || last == 0 {
+		return 0, err
+	}
+
+	ctx, cancel := s.context()
+	defer cancel()
+
+	n, err := s.client.XTrimMinID(ctx, s.key, entryID(min(id+1, last))).Result()
+	if err != nil {
+		return 0, fmt.Errorf("redisreplay: pruning %s: %w", s.key, err)
+	}
+	return int(n), nil
+}
+
+func (s *Store) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), s.timeout)
+}
+
+// entryID is the stream entry ID of event id
+func entryID(id uint64) string {
+	return strconv.FormatUint(id, 10) + "-0"
+}
+
+// parseEntryID returns the event ID of a stream entry ID
+func parseEntryID(v string) (uint64, error) {
+	ms, _, _ := strings.Cut(v, "-")
+	id, err := strconv.ParseUint(ms, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("redisreplay: unexpected entry ID %q", v)
+	}
+	return id, nil
+}
@@ -0,0 +1,109 @@
+package redisreplay
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func newStores(t *testing.T, c Config) (*Stores, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+	return NewStores(rdb, c), mr
+}
+
+func appendEvents(t *testing.T, s *Store, from, to uint64) {
+	t.Helper()
+	for id := from; id <= to; id++ {
+		if err := s.Append(id, fmt.Appendf(nil, "event %d\n\n", id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func since(t *testing.T, s *Store, id uint64) ([]string, bool) {
+	t.Helper()
+	frames, complete, err := s.Since(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range frames {
+		got = append(got, string(f))
+	}
+	return got, complete
+}
+
+func TestSince(t *testing.T) {
+	stores, _ := newStores(t, Config{})
+	s := stores.Get("session")
+	appendEvents(t, s, 1, 3)
+
+	got, complete := since(t, s, 1)
+	if want := []string{"event 2\n\n", "event 3\n\n"}; !slices.Equal(got, want) || !complete {
+		t.Errorf("Since(1) = %q, %v, want %q, true", got, complete, want)
+	}
+	if id, err := s.LastID(); err != nil || id != 3 {
+		t.Errorf("LastID() = %d, %v, want 3", id, err)
+	}
+	if err := s.Append(3, []byte("again\n\n")); err == nil {
+		t.Error("Append of an ID already stored succeeded")
+	}
+}
+
+func TestSinceAfterPrune(t *testing.T) {
+	stores, _ := newStores(t, Config{})
+	s := stores.Get("session")
+	appendEvents(t, s, 1, 5)
+
+	if n, err := s.Prune(3); err != nil || n != 3 {
+		t.Fatalf("Prune(3) = %d, %v, want 3", n, err)
+	}
+	if got, complete := since(t, s, 1); len(got) != 2 || complete {
+		t.Errorf("Since(1) = %q, %v, want 2 events, incomplete", got, complete)
+	}
+	if got, complete := since(t, s, 3); len(got) != 2 || !complete {
+		t.Errorf("Since(3) = %q, %v, want 2 events, complete", got, complete)
+	}
+}
+
+// Once a stream expires, a client that saw some of its events may have
+// missed the rest and must be told its replay is incomplete
+func TestSinceAfterExpiry(t *testing.T) {
+	stores, mr := newStores(t, Config{TTL: time.Minute})
+	s := stores.Get("session")
+	appendEvents(t, s, 1, 3)
+
+	mr.FastForward(2 * time.Minute)
+	if got, complete := since(t, s, 1); len(got) != 0 || complete {
+		t.Errorf("Since(1) = %q, %v, want nothing, incomplete", got, complete)
+	}
+	if got, complete := since(t, s, 0); len(got) != 0 || !complete {
+		t.Errorf("Since(0) = %q, %v, want nothing, complete", got, complete)
+	}
+}
+
+func TestExport(t *testing.T) {
+	stores, _ := newStores(t, Config{Prefix: "p:*:", Size: 10})
+	appendEvents(t, stores.Get("a"), 1, 2)
+	appendEvents(t, stores.Get("b"), 1, 1)
+
+	keys, err := stores.ExportKeys()
+	if err != nil || !slices.Equal(keys, []string{"a", "b"}) {
+		t.Fatalf("ExportKeys() = %q, %v, want [a b]", keys, err)
+	}
+	var ids []uint64
+	size, err := stores.ExportEvents("a", func(id uint64, frame []byte) error {
+		ids = append(ids, id)
+		return nil
+	})
+	if err != nil || size != 10 || !slices.Equal(ids, []uint64{1, 2}) {
+		t.Errorf("ExportEvents(a) = %v, size %d, %v, want [1 2], size 10", ids, size, err)
+	}
+}
@@ -0,0 +1,374 @@
+package resilientsse
+
+import (
+	"sync"
+	"time"
+)
+
+// ReplayBuffer is a fixed-size ring of the most recently sent events. When a
+// stream is given a buffer with [WithReplay], every event it sends is
+// recorded, and a client that reconnects with a Last-Event-ID is first sent
+// the buffered events it missed.
+//
+// The scope of a buffer is chosen by whoever holds it: one per client
+// session replays what a connection lost in flight, one per topic replays
+// everything published to that topic while the client was away. See
+// [ReplayBuffers] for keeping buffers by key.
+//
+// A ReplayBuffer is safe for concurrent use.
+type ReplayBuffer struct {
+	limits ReplayLimits
+
+	mu     sync.Mutex
+	events []replayEvent
+	start  int   // index of the oldest event
+	n      int   // number of buffered events
+	bytes  int64 // total size of the buffered frames
+	lastID uint64
+}
+
+// replayEvent is one recorded event, kept as the exact frame sent on the wire
+type replayEvent struct {
+	id    uint64
+	frame []byte
+	// at is when the event was added, if the buffer has a MaxAge
+	at time.Time
+}
+
+// ReplayLimits bounds what a [ReplayBuffer] keeps, so memory stays bounded
+// on a server with many long-lived streams. Zero limits other than Size are
+// no limit.
+type ReplayLimits struct {
+	// Size is how many of its most recent events a buffer keeps, at least 1
+	Size int
+	// MaxBytes caps the total frame size of a buffer; the oldest events are
+	// evicted to fit, though never the newest
+	MaxBytes int64
+	// MaxAge is how long an event is kept for replay. Expired events are
+	// evicted as the buffer is used, and by [ReplayBuffers] every
+	// replaySweepInterval.
+	MaxAge time.Duration
+	// Metrics, if set, counts evicted events by cause
+	Metrics *Metrics
+}
+
+// replaySweepInterval is how often ReplayBuffers evicts the expired events of
+// buffers that are not being used
+const replaySweepInterval = time.Minute
+
+// replayEviction is why an event was evicted from a ReplayBuffer
+type replayEviction int
+
+const (
+	evictedCount replayEviction = iota
+	evictedBytes
+	evictedAge
+)
+
+func (e replayEviction) String() string {
+	switch e {
+	case evictedBytes:
+		return "bytes"
+	case evictedAge:
+		return "age"
+	default:
+		return "count"
+	}
+}
+
+// NewReplayBuffer creates a buffer that keeps the last size events
+func NewReplayBuffer(size int) *ReplayBuffer {
+	return NewReplayBufferWithLimits(ReplayLimits{Size: size})
+}
+
+// NewReplayBufferWithLimits creates a buffer that keeps events within l
+func NewReplayBufferWithLimits(l ReplayLimits) *ReplayBuffer {
+	l.Size = max(l.Size, 1)
+	return &ReplayBuffer{limits: l, events: make([]replayEvent, l.Size)}
+}
+
+// Add records an event frame under id, evicting the oldest events beyond the
+// buffer's limits. IDs must be added in increasing order.
+func (b *ReplayBuffer) Add(id uint64, frame []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := replayEvent{id: id, frame: append([]byte(nil), frame...)}
+	if b.limits.MaxAge > 0 {
+		e.at = time.Now()
+		b.expire(e.at)
+	}
+	if b.n == len(b.events) {
+		b.evict(evictedCount)
+	}
+	b.events[(b.start+b.n)%len(b.events)] = e
+	b.n++
+	b.bytes += int64(len(frame))
+	b.lastID = id
+
+	for b.limits.MaxBytes > 0 && b.bytes > b.limits.MaxBytes && b.n > 1 {
+		b.evict(evictedBytes)
+	}
+}
+
+// Since returns the frames of every buffered event after id, oldest first.
+// complete is false when events after id have already been evicted, meaning
+// the returned frames do not cover everything the client missed.
+func (b *ReplayBuffer) Since(id uint64) (frames [][]byte, complete bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limits.MaxAge > 0 {
+		b.expire(time.Now())
+	}
+	if b.n == 0 {
+		// only a client that saw the last event missed nothing
+		return nil, id >= b.lastID
+	}
+
+	oldest := b.events[b.start].id
+	complete = id+1 >= oldest
+	for i := range b.n {
+		e := b.events[(b.start+i)%len(b.events)]
+		if e.id > id {
+			frames = append(frames, e.frame)
+		}
+	}
+	return frames, complete
+}
+
+// Prune drops the buffered events up to and including id, such as those a
+// client acknowledged (see [Acks]), and returns how many it dropped. The most
+// recent event is always kept.
+func (b *ReplayBuffer) Prune(id uint64) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pruned := 0
+	for b.n > 1 && b.events[b.start].id <= id {
+		b.dropOldest()
+		pruned++
+	}
+	return pruned
+}
+
+// LastID returns the ID of the most recent event, evicted or not, or 0 if
+// none was added
+func (b *ReplayBuffer) LastID() uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.lastID
+}
+
+// Len returns the number of buffered events
+func (b *ReplayBuffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.limits.MaxAge > 0 {
+		b.expire(time.Now())
+	}
+	return b.n
+}
+
+// Cap returns the maximum number of buffered events
+func (b *ReplayBuffer) Cap() int {
+	return len(b.events)
+}
+
+// Bytes returns the total size of the buffered frames
+func (b *ReplayBuffer) Bytes() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.bytes
+}
+
+// expire evicts the events older than MaxAge. b.mu must be held.
+func (b *ReplayBuffer) expire(now time.Time) {
+	for b.n > 0 && now.Sub(b.events[b.start].at) > b.limits.MaxAge {
+		b.evict(evictedAge)
+	}
+}
+
+// evict drops the oldest event, counting it under cause. b.mu must be held.
+func (b *ReplayBuffer) evict(cause replayEviction) {
+	b.dropOldest()
+	if b.limits.Metrics != nil {
+		b.limits.Metrics.evictions[cause].Add(1)
+	}
+}
+
+// dropOldest drops the oldest event. b.mu must be held.
+func (b *ReplayBuffer) dropOldest() {
+	b.bytes -= int64(len(b.events[b.start].frame))
+	b.events[b.start] = replayEvent{}
+	b.start = (b.start + 1) % len(b.events)
+	b.n--
+}
+
+// ReplayBuffers keeps one [ReplayBuffer] per key, such as a session ID or a
+// topic name, creating them on first use. Buffers are kept until deleted,
+// though with a MaxAge their expired events are evicted even while unused.
+//
+// A ReplayBuffers is safe for concurrent use.
+type ReplayBuffers struct {
+	limits ReplayLimits
+
+	mu        sync.Mutex
+	buffers   map[string]*ReplayBuffer
+	lastSweep time.Time
+}
+
+// NewReplayBuffers creates a set of buffers holding size events each, unless
+// created with [ReplayBuffers.GetWithSize]
+func NewReplayBuffers(size int) *ReplayBuffers {
+	return NewReplayBuffersWithLimits(ReplayLimits{Size: size})
+}
+
+// NewReplayBuffersWithLimits creates a set of buffers keeping events within
+// l, with l.Size overridden by [ReplayBuffers.GetWithSize]
+func NewReplayBuffersWithLimits(l ReplayLimits) *ReplayBuffers {
+	return &ReplayBuffers{limits: l, buffers: map[string]*ReplayBuffer{}, lastSweep: time.Now()}
+}
+
+// Get returns the buffer for key, creating it with the default size
+func (bs *ReplayBuffers) Get(key string) *ReplayBuffer {
+	return bs.GetWithSize(key, bs.limits.Size)
+}
+
+// GetWithSize returns the buffer for key, creating it with size if it does
+// not exist yet. An existing buffer keeps its original size.
+func (bs *ReplayBuffers) GetWithSize(key string, size int) *ReplayBuffer {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if now := time.Now(); bs.limits.MaxAge > 0 && now.Sub(bs.lastSweep) >= replaySweepInterval {
+		bs.sweep(now)
+	}
+
+	b, ok := bs.buffers[key]
+	if !ok {
+		l := bs.limits
+		l.Size = size
+		b = NewReplayBufferWithLimits(l)
+		bs.buffers[key] = b
+	}
+	return b
+}
+
+// sweep evicts the expired events of every buffer. bs.mu must be held.
+func (bs *ReplayBuffers) sweep(now time.Time) {
+	for _, b := range bs.buffers {
+		b.mu.Lock()
+		b.expire(now)
+		b.mu.Unlock()
+	}
+	bs.lastSweep = now
+}
+
+// Delete drops the buffer for key
+func (bs *ReplayBuffers) Delete(key string) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	delete(bs.buffers, key)
+}
+
+// ReplayStore keeps the events sent on a stream for replaying them to a
+// client that resumes. [ReplayBuffer] keeps them in memory; a store backed by
+// a shared database (such as the redisreplay package's) lets a client resume
+// on any instance of an app running behind a load balancer.
+//
+// Event IDs of a stream only grow, and the stream continues after
+// [ReplayStore.LastID], so a store shared by the connections of a session
+// keeps its IDs increasing whichever instance serves them.
+//
+// Implementations must be safe for concurrent use.
+type ReplayStore interface {
+	// Append records an event frame under id. frame is only valid until
+	// Append returns: the stream reuses its memory, so a store keeps a copy.
+	Append(id uint64, frame []byte) error
+	// Since returns the frames of every stored event after id, oldest first.
+	// complete is false when events after id are no longer stored.
+	Since(id uint64) (frames [][]byte, complete bool, err error)
+	// LastID returns the ID of the most recent event, or 0 if there is none
+	LastID() (uint64, error)
+}
+
+// WithReplay records every event sent on the stream in buf, and replays the
+// events a resuming client missed before anything else is sent. Event IDs
+// continue after the newest buffered event, so they never collide with events
+// sent on an earlier connection.
+func WithReplay(buf *ReplayBuffer) Option {
+	return WithReplayStore(buf.Store())
+}
+
+// WithReplayStore is [WithReplay] with any [ReplayStore]. If the store fails
+// when the stream opens, nothing is replayed and a resuming client is
+// reported a [ResilientSSE.ReplayGap]; if it fails to record an event, the
+// event is still sent and the send returns the store's error.
+func WithReplayStore(store ReplayStore) Option {
+	return func(o *options) {
+		o.replay = store
+	}
+}
+
+// Store returns b as a [ReplayStore], for APIs that take any store
+func (b *ReplayBuffer) Store() ReplayStore {
+	return bufferStore{b}
+}
+
+// bufferStore is a ReplayBuffer as a ReplayStore
+type bufferStore struct {
+	b *ReplayBuffer
+}
+
+func (bs bufferStore) Append(id uint64, frame []byte) error {
+	bs.b.Add(id, frame)
+	return nil
+}
+
+func (bs bufferStore) Since(id uint64) ([][]byte, bool, error) {
+	frames, complete := bs.b.Since(id)
+	return frames, complete, nil
+}
+
+func (bs bufferStore) LastID() (uint64, error) {
+	return bs.b.LastID(), nil
+}
+
+func (bs bufferStore) Prune(id uint64) (int, error) {
+	return bs.b.Prune(id), nil
+}
+
+// Replayed returns how many buffered events were replayed when the stream opened
+func (s *ResilientSSE) Replayed() int {
+	return s.replayed
+}
+
+// ReplayGap reports whether the client resumed from an event too old to be
+// replayed in full, in which case it should be sent a fresh snapshot
+func (s *ResilientSSE) ReplayGap() bool {
+	return s.replayGap
+}
+
+// replay writes the stored events after the client's Last-Event-ID
+func (s *ResilientSSE) replay(lastID uint64) error {
+	frames, complete, err := s.opts.replay.Since(lastID)
+	if err != nil {
+		s.replayGap = true
+		return nil
+	}
+	s.replayGap = !complete
+	s.replayed = len(frames)
+	if len(frames) == 0 {
+		return nil
+	}
+	for i, frame := range frames {
+		frames[i] = s.wrapEnvelope(frame, true, nil)
+	}
+	s.tap(frames...)
+	return s.w.writeFrames(frames...)
+}
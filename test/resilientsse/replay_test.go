@@ -0,0 +1,162 @@
+package resilientsse
+
+import (
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// frame returns the frame of a numbered test event
+func frame(id uint64) []byte {
+	return []byte("event: datastar-patch-signals\nid: " + strconv.FormatUint(id, 10) + "\ndata: signals {}\n\n")
+}
+
+// frames returns the frames of the numbered test events ids
+func frames(ids ...uint64) [][]byte {
+	var out [][]byte
+	for _, id := range ids {
+		out = append(out, frame(id))
+	}
+	return out
+}
+
+func addEvents(b *ReplayBuffer, ids ...uint64) {
+	for _, id := range ids {
+		b.Add(id, frame(id))
+	}
+}
+
+func equalFrames(a, b [][]byte) bool {
+	return slices.EqualFunc(a, b, func(x, y []byte) bool { return string(x) == string(y) })
+}
+
+func TestReplayBufferSince(t *testing.T) {
+	b := NewReplayBuffer(3)
+	addEvents(b, 1, 2, 3, 4, 5)
+
+	tests := []struct {
+		after    uint64
+		want     [][]byte
+		complete bool
+	}{
+		{after: 5, want: nil, complete: true},
+		{after: 3, want: frames(4, 5), complete: true},
+		{after: 2, want: frames(3, 4, 5), complete: true},
+		// events 1 and 2 were pushed out
+		{after: 1, want: frames(3, 4, 5), complete: false},
+		{after: 0, want: frames(3, 4, 5), complete: false},
+	}
+	for _, tt := range tests {
+		got, complete := b.Since(tt.after)
+		if !equalFrames(got, tt.want) || complete != tt.complete {
+			t.Errorf("Since(%d) = %d frames, complete %v; want %d frames, complete %v",
+				tt.after, len(got), complete, len(tt.want), tt.complete)
+		}
+	}
+	if got := b.LastID(); got != 5 {
+		t.Errorf("LastID() = %d, want 5", got)
+	}
+}
+
+func TestReplayBufferSinceEmpty(t *testing.T) {
+	b := NewReplayBuffer(3)
+	if frames, complete := b.Since(0); frames != nil || !complete {
+		t.Errorf("Since(0) on an empty buffer = %d frames, complete %v; want none, complete", len(frames), complete)
+	}
+}
+
+func TestReplayBufferFramesAreCopied(t *testing.T) {
+	b := NewReplayBuffer(3)
+	f := frame(1)
+	b.Add(1, f)
+	f[0] = 'X'
+
+	if got, _ := b.Since(0); !equalFrames(got, frames(1)) {
+		t.Errorf("Since(0) = %q, want the frame as added", got)
+	}
+}
+
+func TestReplayBufferPrune(t *testing.T) {
+	b := NewReplayBuffer(10)
+	addEvents(b, 1, 2, 3, 4)
+
+	if n := b.Prune(2); n != 2 {
+		t.Errorf("Prune(2) = %d, want 2", n)
+	}
+	if got, complete := b.Since(2); !equalFrames(got, frames(3, 4)) || !complete {
+		t.Errorf("Since(2) after Prune(2) = %d frames, complete %v; want 3 and 4, complete", len(got), complete)
+	}
+	if _, complete := b.Since(1); complete {
+		t.Error("Since(1) after Prune(2) is complete, want a gap")
+	}
+
+	// the newest event is always kept, since IDs continue after it
+	if n := b.Prune(10); n != 1 {
+		t.Errorf("Prune(10) = %d, want 1", n)
+	}
+	if got, _ := b.Since(0); !equalFrames(got, frames(4)) {
+		t.Errorf("Since(0) after Prune(10) = %d frames, want event 4", len(got))
+	}
+}
+
+func TestReplayBufferMaxBytes(t *testing.T) {
+	size := int64(len(frame(1)))
+	b := NewReplayBufferWithLimits(ReplayLimits{Size: 10, MaxBytes: 2 * size})
+	addEvents(b, 1, 2, 3)
+
+	if got, complete := b.Since(0); !equalFrames(got, frames(2, 3)) || complete {
+		t.Errorf("Since(0) = %d frames, complete %v; want 2 and 3, incomplete", len(got), complete)
+	}
+	if got := b.Bytes(); got != 2*size {
+		t.Errorf("Bytes() = %d, want %d", got, 2*size)
+	}
+}
+
+func TestReplayBufferExpire(t *testing.T) {
+	const maxAge = 50 * time.Millisecond
+	metrics := NewMetrics()
+	b := NewReplayBufferWithLimits(ReplayLimits{Size: 10, MaxAge: maxAge, Metrics: metrics})
+	addEvents(b, 1, 2)
+	time.Sleep(2 * maxAge)
+	addEvents(b, 3)
+
+	if got, complete := b.Since(0); !equalFrames(got, frames(3)) || complete {
+		t.Errorf("Since(0) = %d frames, complete %v; want event 3, incomplete", len(got), complete)
+	}
+	if got := metrics.evictions[evictedAge].Load(); got != 2 {
+		t.Errorf("evictions by age = %d, want 2", got)
+	}
+
+	time.Sleep(2 * maxAge)
+	if n := b.Len(); n != 0 {
+		t.Errorf("Len() once everything expired = %d, want 0", n)
+	}
+	// a client that saw the last event missed nothing
+	if _, complete := b.Since(3); !complete {
+		t.Error("Since(3) once everything expired is incomplete, want complete")
+	}
+	if _, complete := b.Since(2); complete {
+		t.Error("Since(2) once everything expired is complete, want a gap")
+	}
+}
+
+func TestReplayBuffersGetWithSize(t *testing.T) {
+	bs := NewReplayBuffers(5)
+	a := bs.GetWithSize("a", 2)
+	if a.Cap() != 2 {
+		t.Errorf("GetWithSize(a, 2).Cap() = %d, want 2", a.Cap())
+	}
+	// an existing buffer keeps its size
+	if got := bs.Get("a"); got != a || got.Cap() != 2 {
+		t.Errorf("Get(a) = %p with Cap %d, want %p with Cap 2", got, got.Cap(), a)
+	}
+	if got := bs.Get("b").Cap(); got != 5 {
+		t.Errorf("Get(b).Cap() = %d, want 5", got)
+	}
+
+	bs.Delete("a")
+	if got := bs.Keys(); !slices.Equal(got, []string{"b"}) {
+		t.Errorf("Keys() after Delete(a) = %q, want [b]", got)
+	}
+}
@@ -0,0 +1,556 @@
+// Package resilientsse is the server-side companion of the Resilient JS
+// library. It wraps datastar-go's [datastar.ServerSentEventGenerator] and adds
+// what a resilient client needs from the server: an ID on every event,
+// awareness of the point a reconnecting client resumes from, and a stream
+// lifecycle that ends as soon as the client is gone.
+//
+//	func feed(w http.ResponseWriter, r *http.Request) {
+//		stream := resilientsse.New(w, r, resilientsse.WithHeartbeat(15*time.Second))
+//		defer stream.Close(nil)
+//
+//		if stream.Resumed() {
+//			log.Printf("client resumed after event %s", stream.LastEventID())
+//		}
+//
+//		for {
+//			select {
+//			case <-stream.Context().Done():
+//				return
+//			case v := <-updates:
+//				stream.MarshalAndPatchSignals(v)
+//			}
+//		}
+//	}
+package resilientsse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+const (
+	// LastEventIDHeader is the standard SSE header carrying the ID of the last
+	// event a reconnecting client received
+	LastEventIDHeader = "Last-Event-ID"
+
+	// LastEventIDParam is accepted in place of LastEventIDHeader, for clients
+	// that cannot set request headers
+	LastEventIDParam = "lastEventId"
+)
+
+// ErrClosed is the cause reported by [ResilientSSE.Err] after [ResilientSSE.Close]
+var ErrClosed = errors.New("resilientsse: stream closed")
+
+// ResilientSSE is a resume-aware Server-Sent Event stream. It exposes the same
+// PatchElements/PatchSignals surface as [datastar.ServerSentEventGenerator],
+// tagging every event with a monotonically increasing ID.
+//
+// Methods are safe for concurrent use: events sent from several goroutines
+// are rendered, numbered and written one at a time, each whole.
+type ResilientSSE struct {
+	patcher
+
+	sse    *datastar.ServerSentEventGenerator
+	w      *streamWriter
+	r      *http.Request
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	opts   options
+
+	lastEventID    string
+	replayed       int
+	replayGap      bool
+	bookmarked     bool
+	refreshed      bool
+	sessionResumed bool
+
+	// sessionMu guards sessionID, which RotateSession changes
+	sessionMu sync.Mutex
+	sessionID string
+
+	connID      uint64
+	debug       bool
+	envelope    Envelope
+	serializer  Serializer
+	established bool
+	writeFailed atomic.Bool
+	dropped     atomic.Bool
+	// sent counts the event groups sent on this connection, for ConnInfo
+	sent atomic.Uint64
+
+	// wg tracks background goroutines that write to the stream. bgMu orders
+	// starting them against Close.
+	wg   sync.WaitGroup
+	bgMu sync.Mutex
+
+	heartbeatInterval atomic.Int64 // time.Duration
+	heartbeatWake     chan struct{}
+	// resyncWake schedules a resync, with WithDriftMonitor
+	resyncWake chan struct{}
+
+	// queue is set with WithBackpressure, once the stream is established
+	queue *sendQueue
+
+	// deliveries is the stream's log in its Deliveries, set with
+	// WithExactlyOnce, and deliveryOpen whether the stream is counted in it;
+	// the Deliveries' mu guards it
+	deliveries   *deliveryLog
+	deliveryOpen bool
+
+	signals *SignalStore
+	// changesMu keeps diffing against signals and sending the patch together
+	changesMu sync.Mutex
+
+	// compressor is set with WithCompression, if the client accepts one of
+	// its encodings
+	compressor *compressWriter
+
+	mu           sync.Mutex
+	seq          uint64
+	lastWrite    time.Time
+	lastEvent    time.Time
+	reconnect    *ReconnectPolicy
+	retryAttempt int
+	// coalesced is the merged signal patch waiting for the next flush
+	coalesced map[string]any
+}
+
+// Option configures a [ResilientSSE]
+type Option func(*options)
+
+type options struct {
+	sseOpts   []datastar.SSEOption
+	heartbeat time.Duration
+	replay    ReplayStore
+	seq       uint64
+
+	probe        *Prober
+	probeTimeout time.Duration
+
+	sessions  SessionStore
+	reconnect *ReconnectPolicy
+	hooks     []Hooks
+	drainer   *Drainer
+	hubs      []*Hub
+	debug     *DebugConfig
+	envelope  Envelope
+	signals   *SignalStore
+
+	compression  []Encoding
+	bookmark     *Bookmark
+	deadLetters  []func(DeadLetter)
+	logger       *slog.Logger
+	metrics      *Metrics
+	guard        *ConnectionGuard
+	writeTimeout time.Duration
+	coalesce     time.Duration
+	idleTimeout  time.Duration
+	idleRetry    time.Duration
+	resumeAuth   ResumeAuthorizer
+
+	strictFraming bool
+	drift         *DriftMonitor
+	driftInterval time.Duration
+	serializers   []Serializer
+	deltaSlots    int
+
+	backpressure *Backpressure
+
+	deliveries  *Deliveries
+	deliveryKey string
+}
+
+// WithSSEOptions passes options through to the underlying [datastar.NewSSE]
+func WithSSEOptions(opts ...datastar.SSEOption) Option {
+	return func(o *options) {
+		o.sseOpts = append(o.sseOpts, opts...)
+	}
+}
+
+// WithSeq seeds the event ID sequence, typically from persisted state, so the
+// first event sent is seq+1. A Last-Event-ID or replay buffer ahead of seq
+// takes precedence, so IDs never go backwards.
+func WithSeq(seq uint64) Option {
+	return func(o *options) {
+		o.seq = seq
+	}
+}
+
+// New upgrades w to a resilient Server-Sent Event stream. If the request
+// carries a Last-Event-ID, event IDs continue from it.
+//
+// With [WithWarmupProbe], New blocks until the client answers the probe; if it
+// doesn't, the returned stream is already closed.
+//
+// The stream's context is cancelled when the request ends, when a write
+// fails, or when [ResilientSSE.Close] is called.
+func New(w http.ResponseWriter, r *http.Request, opts ...Option) *ResilientSSE {
+	s := &ResilientSSE{r: r, connID: connIDs.Add(1)}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+
+	s.ctx, s.cancel = context.WithCancelCause(r.Context())
+	s.debug = debugRequested(r, s.opts.debug)
+	s.envelope = EnvelopeV1
+	if s.opts.envelope > 0 {
+		s.envelope = negotiateEnvelope(r, s.opts.envelope)
+		w.Header().Set(EnvelopeHeader, strconv.Itoa(int(s.envelope)))
+	}
+	if len(s.opts.serializers) > 0 {
+		s.serializer = negotiateSerializer(r, s.opts.serializers)
+		if s.serializer != nil {
+			w.Header().Set(SerializerHeader, s.serializer.Name())
+		}
+	}
+
+	s.lastEventID = r.Header.Get(LastEventIDHeader)
+	if s.lastEventID == "" {
+		s.lastEventID = r.URL.Query().Get(LastEventIDParam)
+	}
+	if s.lastEventID == "" && s.opts.bookmark != nil {
+		s.lastEventID = strconv.FormatUint(s.opts.bookmark.EventID, 10)
+		s.bookmarked = true
+	}
+	s.seq = s.opts.seq
+	lastID, lastIDErr := strconv.ParseUint(s.lastEventID, 10, 64)
+	if lastIDErr == nil {
+		s.seq = max(s.seq, lastID)
+	}
+
+	var setupErr error
+	if s.opts.strictFraming {
+		setupErr = checkFraming(w)
+	}
+	if s.opts.resumeAuth != nil && s.Resumed() && setupErr == nil {
+		setupErr = s.authorizeResume(w, r)
+	}
+	if s.opts.guard != nil && setupErr == nil {
+		setupErr = s.opts.guard.add(s, w, r)
+	}
+	if s.opts.sessions != nil && setupErr == nil {
+		setupErr = s.openSession(w, r)
+	}
+
+	if s.opts.drift != nil && setupErr == nil {
+		s.resyncWake = make(chan struct{}, 1)
+		if s.opts.drift.c.ReportURL != "" {
+			w.Header().Set(DriftHeader, s.opts.drift.c.ReportURL)
+		}
+	}
+
+	if len(s.opts.compression) > 0 && setupErr == nil {
+		w = s.compress(w, r)
+	}
+	s.w = newStreamWriter(w)
+	s.w.timeout = s.opts.writeTimeout
+	if s.opts.deltaSlots > 0 && setupErr == nil && negotiateDelta(r) {
+		s.w.delta = newDeltaDict(s.opts.deltaSlots)
+		w.Header().Set(DeltaHeader, deltaFormat)
+	}
+	sseOpts := append([]datastar.SSEOption{datastar.WithContext(s.ctx)}, s.opts.sseOpts...)
+	if setupErr != nil {
+		// the client has its answer: keep datastar-go from flushing after it,
+		// which panics on writers that can't
+		s.w.hold()
+	}
+	s.sse = datastar.NewSSE(s.w, r, sseOpts...)
+	if setupErr != nil {
+		s.w.recycle(s.w.release())
+	}
+	s.patcher = patcher{ctx: s.ctx, sse: s.sse, emit: s.emit, emitPlain: s.emitPlain, fail: s.renderFailed}
+	if s.opts.coalesce > 0 {
+		s.patcher.coalesce = s.coalesceSignals
+	}
+	s.lastWrite = time.Now()
+	s.lastEvent = s.lastWrite
+
+	if setupErr != nil {
+		s.cancel(setupErr)
+		return s
+	}
+
+	if s.opts.drainer != nil {
+		if ok, retry := s.opts.drainer.add(s); !ok {
+			s.drain(retry)
+			return s
+		}
+	}
+
+	if s.opts.probe != nil {
+		if err := s.probe(); err != nil {
+			s.cancel(err)
+			return s
+		}
+	}
+
+	if s.opts.replay != nil {
+		last, err := s.opts.replay.LastID()
+		s.seq = max(s.seq, last)
+		switch {
+		case err != nil:
+			// the store is unavailable, so whatever the client missed is lost
+			s.replayGap = s.Resumed()
+		case s.refreshed:
+			// the resume authorizer wants the client sent a snapshot instead
+		case lastIDErr == nil:
+			if err := s.replay(lastID); err != nil {
+				s.failWrite(err)
+			} else {
+				s.runReplayHooks()
+			}
+		case s.Resumed():
+			// an ID we did not issue can't be located in the buffer
+			s.replayGap = true
+		}
+	}
+
+	if s.opts.deliveries != nil {
+		s.openDelivery(lastID, lastIDErr)
+	}
+
+	s.signals = s.opts.signals
+	switch {
+	case s.signals == nil:
+		s.signals = NewSignalStore()
+	case lastIDErr != nil || s.opts.replay == nil || s.replayGap:
+		// the client may have missed some of what the store recorded
+		s.signals.Reset()
+	}
+
+	if s.opts.backpressure != nil {
+		s.startQueue()
+	}
+
+	if s.opts.reconnect != nil {
+		s.reconnect = s.opts.reconnect
+		if s.Resumed() {
+			s.retryAttempt = 1
+		}
+		s.SetRetry(s.reconnect.Delay(s.retryAttempt))
+	}
+
+	if s.opts.sessions != nil && !s.sessionResumed {
+		s.MarshalAndPatchSignals(map[string]string{SessionSignal: s.sessionID})
+	}
+
+	if s.bookmarked {
+		s.patchResume()
+	}
+
+	if s.opts.heartbeat > 0 {
+		s.SetHeartbeat(s.opts.heartbeat)
+	}
+
+	if s.opts.idleTimeout > 0 {
+		s.startIdleWatch()
+	}
+
+	if s.opts.coalesce > 0 {
+		s.startCoalescing()
+	}
+
+	if s.opts.drift != nil && s.opts.driftInterval > 0 {
+		s.startDriftWatch()
+	}
+
+	if s.ctx.Err() == nil {
+		s.runConnectHooks()
+		for _, h := range s.opts.hubs {
+			h.add(s)
+		}
+	}
+
+	return s
+}
+
+// Request returns the request the stream was opened for
+func (s *ResilientSSE) Request() *http.Request {
+	return s.r
+}
+
+// Context returns the stream's context, which is done once the stream ends
+func (s *ResilientSSE) Context() context.Context {
+	return s.ctx
+}
+
+// IsClosed reports whether the stream has ended
+func (s *ResilientSSE) IsClosed() bool {
+	return s.ctx.Err() != nil
+}
+
+// Err returns why the stream ended, or nil while it is open
+func (s *ResilientSSE) Err() error {
+	return context.Cause(s.ctx)
+}
+
+// Close ends the stream, recording cause as the reason ([ErrClosed] if nil),
+// and waits for background work such as heartbeats to stop. Handlers must
+// call Close before returning, since nothing may write to the
+// ResponseWriter afterwards. Closing an already closed stream only waits.
+// The OnDrop hook runs on the first Close.
+func (s *ResilientSSE) Close(cause error) {
+	if cause == nil {
+		cause = ErrClosed
+	}
+	if s.opts.coalesce > 0 {
+		s.mu.Lock()
+		if s.ctx.Err() == nil {
+			s.flushCoalesced()
+		}
+		s.mu.Unlock()
+	}
+	s.bgMu.Lock()
+	s.cancel(cause)
+	s.bgMu.Unlock()
+	for _, h := range s.opts.hubs {
+		h.remove(s)
+	}
+	if s.queue != nil {
+		s.finishQueue()
+	}
+	s.wg.Wait()
+	if s.compressor != nil {
+		s.mu.Lock()
+		s.compressor.close()
+		s.mu.Unlock()
+	}
+	if s.opts.drainer != nil {
+		s.opts.drainer.remove(s)
+	}
+	if s.opts.guard != nil {
+		s.opts.guard.remove(s)
+	}
+	if s.opts.drift != nil {
+		s.opts.drift.remove(s)
+	}
+	if s.deliveries != nil {
+		s.closeDelivery()
+	}
+	s.runDropHooks()
+}
+
+// LastEventID returns the event ID the client resumed from, or "" on a fresh
+// connection
+func (s *ResilientSSE) LastEventID() string {
+	return s.lastEventID
+}
+
+// Resumed reports whether the client reconnected with a Last-Event-ID
+func (s *ResilientSSE) Resumed() bool {
+	return s.lastEventID != ""
+}
+
+// Seq returns the ID of the last event sent, or the sequence the stream
+// started from if nothing has been sent yet. Persist it and pass it to
+// [WithSeq] to keep IDs increasing across server restarts.
+func (s *ResilientSSE) Seq() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.seq
+}
+
+// emit sends one event under the next event ID
+func (s *ResilientSSE) emit(send sendFunc) error {
+	return s.emitGroup([]sendFunc{send}, PriorityNormal)
+}
+
+// emitGroup renders a group of events, tagging only the last one with the
+// next event ID, and writes (or queues, at priority) them in one piece. A
+// failed write ends the stream.
+func (s *ResilientSSE) emitGroup(sends []sendFunc, priority Priority) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ctx.Err(); err != nil {
+		return s.streamErr()
+	}
+	if err := s.flushCoalesced(); err != nil {
+		return err
+	}
+	return s.emitGroupLocked(sends, priority)
+}
+
+// emitGroupLocked is emitGroup for a live stream. s.mu must be held.
+func (s *ResilientSSE) emitGroupLocked(sends []sendFunc, priority Priority) error {
+	frames, start, err := s.renderGroup(sends)
+	if err != nil {
+		return err
+	}
+	return s.sendGroup(len(sends), frames, start, priority)
+}
+
+// renderGroup renders a group of events as event s.seq+1, advancing s.seq,
+// and returns their frames and when rendering started. s.mu must be held.
+func (s *ResilientSSE) renderGroup(sends []sendFunc) ([]byte, time.Time, error) {
+	s.seq++
+	id := strconv.FormatUint(s.seq, 10)
+
+	start := time.Now()
+	s.w.hold()
+	for i, send := range sends {
+		eventID := ""
+		if i == len(sends)-1 {
+			eventID = id
+		}
+		if err := send(eventID); err != nil {
+			s.w.release()
+			s.seq--
+			return nil, start, s.renderFailed(err)
+		}
+	}
+	frames := s.w.release()
+	if len(sends) > 1 {
+		frames = markTx(frames, id)
+	}
+	return frames, start, nil
+}
+
+// sendGroup writes (or queues, at priority) the frames of n events rendered
+// from start, as event s.seq, and records them for replay. s.mu must be held.
+func (s *ResilientSSE) sendGroup(n int, frames []byte, start time.Time, priority Priority) error {
+	var debug *groupDebug
+	if s.debug {
+		debug = &groupDebug{events: n, render: time.Since(start), idle: start.Sub(s.lastWrite)}
+	}
+	wrapped := s.wrapEnvelope(frames, false, debug)
+
+	err := s.sendEvent(s.seq, priority, frames, wrapped)
+	s.tap(wrapped)
+	s.lastWrite = time.Now()
+	if err != nil {
+		reason := DeadWriteFailed
+		if s.queue != nil {
+			reason = DeadAbandoned
+		}
+		s.deadLetter(reason, err, s.seq, frames, false)
+		return err
+	}
+	s.lastEvent = s.lastWrite
+	s.sent.Add(1)
+	if s.opts.metrics != nil {
+		s.opts.metrics.events.Add(1)
+	}
+
+	if s.opts.replay != nil {
+		err = s.opts.replay.Append(s.seq, frames)
+	}
+	if s.queue == nil && !s.debug {
+		// nothing holds on to the frames: the queue would, and so might a tap
+		s.w.recycle(frames)
+	}
+	if err != nil {
+		return fmt.Errorf("resilientsse: recording event %d for replay: %w", s.seq, err)
+	}
+	return nil
+}
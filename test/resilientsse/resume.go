@@ -0,0 +1,58 @@
+package resilientsse
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrResumeUnauthorized is the cause reported by [ResilientSSE.Err] for
+// resumes a [ResumeAuthorizer] rejected
+var ErrResumeUnauthorized = errors.New("resilientsse: resume unauthorized")
+
+// ResumeDecision is what a [ResumeAuthorizer] lets a resuming client do
+type ResumeDecision int
+
+const (
+	// ResumeAllow resumes the stream as usual, replaying what the client
+	// missed
+	ResumeAllow ResumeDecision = iota
+	// ResumeRefresh opens the stream without replaying anything: the client
+	// is reported a [ResilientSSE.ReplayGap], so the app sends it a fresh
+	// snapshot, and the signal store starts over
+	ResumeRefresh
+	// ResumeReject answers 401 Unauthorized; the stream is returned closed,
+	// with [ErrResumeUnauthorized]
+	ResumeReject
+)
+
+// ResumeAuthorizer re-checks the credentials of a client resuming a stream,
+// such as a token that may have expired since it first connected. lastEventID
+// is the event it resumes from.
+type ResumeAuthorizer func(r *http.Request, lastEventID string) ResumeDecision
+
+// WithResumeAuthorizer has authorize decide, before anything is replayed,
+// whether a client resuming with a Last-Event-ID (or [WithBookmark]) may
+// pick up where it left off. A long-lived session outlives short-lived
+// tokens, and replay would otherwise send what the client missed on the
+// strength of the credentials it first connected with. Fresh connections are
+// not checked: the handler authorizes them as it always does.
+func WithResumeAuthorizer(authorize ResumeAuthorizer) Option {
+	return func(o *options) {
+		o.resumeAuth = authorize
+	}
+}
+
+// authorizeResume runs the resume authorizer, answering w with 401 if it
+// rejects the client
+func (s *ResilientSSE) authorizeResume(w http.ResponseWriter, r *http.Request) error {
+	switch s.opts.resumeAuth(r, s.lastEventID) {
+	case ResumeRefresh:
+		s.refreshed = true
+		s.replayGap = true
+	case ResumeReject:
+		w.Header().Set("Cache-Control", "no-store")
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return ErrResumeUnauthorized
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package resilientsse
+
+import (
+	"math"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// ReconnectPolicy computes the reconnect delay the server asks clients to wait,
+// sent as the SSE retry field. Delays grow exponentially from Min by Factor
+// per attempt up to Max, and Jitter (0-1) randomizes that fraction of each
+// delay so clients dropped together don't reconnect together.
+type ReconnectPolicy struct {
+	Min    time.Duration
+	Max    time.Duration
+	Factor float64
+	Jitter float64
+}
+
+// DefaultRetryJitter is the Jitter used by [ResilientSSE.SetReconnectPolicy]
+const DefaultRetryJitter = 0.5
+
+// Delay returns the jittered delay for attempt, where attempt 0 is the first
+// reconnect
+func (p ReconnectPolicy) Delay(attempt int) time.Duration {
+	factor := max(p.Factor, 1)
+	d := float64(p.Min) * math.Pow(factor, float64(attempt))
+	if p.Max > 0 {
+		d = min(d, float64(p.Max))
+	}
+
+	jitter := min(max(p.Jitter, 0), 1)
+	d -= d * jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+// WithReconnectPolicy sends the client a retry delay from p as soon as the
+// stream opens. A resumed stream starts at attempt 1, a fresh one at 0.
+//
+// Clients that manage reconnects themselves, such as the Resilient JS
+// Retryer, ignore the retry field; it steers EventSource and plain Datastar
+// clients.
+func WithReconnectPolicy(p ReconnectPolicy) Option {
+	return func(o *options) {
+		o.reconnect = &p
+	}
+}
+
+// SetRetry tells the client to wait d before reconnecting once this stream
+// ends
+func (s *ResilientSSE) SetRetry(d time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.ctx.Err(); err != nil {
+		return s.streamErr()
+	}
+	if err := s.flushCoalesced(); err != nil {
+		return err
+	}
+
+	err := s.send([]byte("retry: " + strconv.FormatInt(d.Milliseconds(), 10) + "\n\n"))
+	s.lastWrite = time.Now()
+	return err
+}
+
+// SetReconnectPolicy replaces the stream's reconnect policy with one backing
+// off from minDelay to maxDelay by factor, with [DefaultRetryJitter], and
+// sends the client the resulting retry delay
+func (s *ResilientSSE) SetReconnectPolicy(minDelay, maxDelay time.Duration, factor float64) error {
+	s.mu.Lock()
+	s.reconnect = &ReconnectPolicy{Min: minDelay, Max: maxDelay, Factor: factor, Jitter: DefaultRetryJitter}
+	d := s.reconnect.Delay(s.retryAttempt)
+	s.mu.Unlock()
+
+	return s.SetRetry(d)
+}
+
+// Backoff moves the stream's reconnect policy on to the next attempt and
+// sends the client the longer delay. Call it before ending a stream because
+// the server is struggling, so the client waits longer before coming back.
+// Without a policy it does nothing.
+func (s *ResilientSSE) Backoff() error {
+	s.mu.Lock()
+	if s.reconnect == nil {
+		s.mu.Unlock()
+		return nil
+	}
+	s.retryAttempt++
+	d := s.reconnect.Delay(s.retryAttempt)
+	s.mu.Unlock()
+
+	return s.SetRetry(d)
+}
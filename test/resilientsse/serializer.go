@@ -0,0 +1,188 @@
+package resilientsse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+const (
+	// SerializerHeader carries the serializers a client can decode on the
+	// request, comma-separated and preferred first, and the one the server
+	// chose on the response
+	SerializerHeader = "X-Resilient-Serializer"
+
+	// SerializerParam is accepted in place of SerializerHeader on the
+	// request, for clients that cannot set request headers
+	SerializerParam = "resilientSerializer"
+
+	// SignalsField carries the signals of a signal patch encoded by the
+	// stream's [Serializer], in base64, in place of its signals data lines:
+	//
+	//	event: datastar-patch-signals
+	//	id: 42
+	//	resilient-signals: oWFhhQECAwQF
+	//
+	// SSE parsers ignore it, and without data lines the event is never
+	// dispatched, so only a client that asked for the serializer sees it.
+	SignalsField = "resilient-signals"
+)
+
+// Serializer encodes signal patches in a binary format, for
+// [WithSerializers]. [MessagePack] and [CBOR] are built in.
+type Serializer interface {
+	// Name is what clients ask for the serializer by
+	Name() string
+	// Marshal encodes v, a JSON value as encoding/json decodes it with
+	// UseNumber: nil, bool, json.Number, string, []any or map[string]any
+	Marshal(v any) ([]byte, error)
+}
+
+// WithSerializers lets clients negotiate a binary encoding of signal
+// patches. A client asks with [SerializerHeader] or [SerializerParam],
+// listing the serializers it can decode, and gets the first of them the
+// stream has; the choice is sent back in the SerializerHeader response
+// header. A client that asks for none of them gets JSON and no header.
+//
+// The signals of every signal patch are then sent in a [SignalsField]
+// instead, where that is smaller: datasets of integers shrink by about
+// 30%, while small patches, text and decimals, which need a float64 and
+// base64 on top, mostly stay JSON. Replay buffers hold JSON, so events are
+// replayed to each client in the encoding it negotiated.
+//
+// Serve the same serializers with [Capabilities] for clients to pick from.
+func WithSerializers(serializers ...Serializer) Option {
+	return func(o *options) {
+		o.serializers = serializers
+	}
+}
+
+// Serializer returns the serializer negotiated for the stream, nil for JSON
+func (s *ResilientSSE) Serializer() Serializer {
+	return s.serializer
+}
+
+// negotiateSerializer picks the first serializer r asks for that is one of
+// serializers, or nil
+func negotiateSerializer(r *http.Request, serializers []Serializer) Serializer {
+	asked := r.Header.Get(SerializerHeader)
+	if asked == "" {
+		asked = r.URL.Query().Get(SerializerParam)
+	}
+	for name := range strings.SplitSeq(asked, ",") {
+		name = strings.TrimSpace(name)
+		for _, ser := range serializers {
+			if ser.Name() == name {
+				return ser
+			}
+		}
+	}
+	return nil
+}
+
+// Capabilities serves what a server's streams can negotiate, as JSON, for
+// clients to choose from before they connect:
+//
+//	capabilities := resilientsse.Capabilities{Serializers: []resilientsse.Serializer{resilientsse.CBOR}}
+//	mux.Handle("GET /capabilities", capabilities)
+//	...
+//	stream := resilientsse.New(w, r, resilientsse.WithSerializers(capabilities.Serializers...))
+//
+// answers {"serializers":["cbor"]}; Envelope, if set, is listed as
+// "envelope".
+type Capabilities struct {
+	// Envelope is the highest envelope version of [WithEnvelope]
+	Envelope Envelope
+	// Serializers are those of [WithSerializers], preferred first
+	Serializers []Serializer
+}
+
+// ServeHTTP answers with c as JSON
+func (c Capabilities) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Envelope    Envelope `json:"envelope,omitempty"`
+		Serializers []string `json:"serializers"`
+	}{Envelope: c.Envelope, Serializers: []string{}}
+	for _, ser := range c.Serializers {
+		body.Serializers = append(body.Serializers, ser.Name())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// signalsDataLine starts the data lines of a signal patch's signals
+var signalsDataLine = []byte("data: " + datastar.SignalsDatalineLiteral)
+
+// serializeSignals returns frames with the signals of their signal patches
+// encoded by ser, where that makes them smaller
+func serializeSignals(frames []byte, ser Serializer) []byte {
+	if !bytes.Contains(frames, signalsDataLine) {
+		return frames
+	}
+	out := make([]byte, 0, len(frames))
+	for rest := frames; len(rest) > 0; {
+		end := bytes.Index(rest, []byte("\n\n"))
+		if end < 0 {
+			out = append(out, rest...)
+			break
+		}
+		// events end with one or more blank lines
+		next := len(rest) - len(bytes.TrimLeft(rest[end:], "\n"))
+		out = serializeEvent(out, rest[:end+1], ser)
+		out = append(out, rest[end+1:next]...)
+		rest = rest[next:]
+	}
+	return out
+}
+
+// serializeEvent appends event to out, with its signals in a SignalsField if
+// it is a signal patch and the field is the smaller
+func serializeEvent(out, event []byte, ser Serializer) []byte {
+	if !bytes.HasPrefix(event, []byte("event: "+datastar.EventTypePatchSignals+"\n")) {
+		return append(out, event...)
+	}
+
+	var payload []byte
+	size := 0
+	for line := range bytes.Lines(event) {
+		if signals, ok := bytes.CutPrefix(line, signalsDataLine); ok {
+			payload = append(payload, signals...)
+			size += len(line)
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return append(out, event...)
+	}
+	encoded, err := ser.Marshal(v)
+	if err != nil {
+		return append(out, event...)
+	}
+	field := len(SignalsField) + len(": ") + base64.StdEncoding.EncodedLen(len(encoded)) + len("\n")
+	if field >= size {
+		return append(out, event...)
+	}
+
+	// the field takes the place of the first signals line
+	written := false
+	for line := range bytes.Lines(event) {
+		if !bytes.HasPrefix(line, signalsDataLine) {
+			out = append(out, line...)
+			continue
+		}
+		if !written {
+			out = append(out, SignalsField+": "...)
+			out = base64.StdEncoding.AppendEncode(out, encoded)
+			out = append(out, '\n')
+			written = true
+		}
+	}
+	return out
+}
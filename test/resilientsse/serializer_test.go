@@ -0,0 +1,148 @@
+package resilientsse
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSerializerEncodings(t *testing.T) {
+	tests := []struct {
+		json, cbor, msgpack string
+	}{
+		{`0`, "00", "00"},
+		{`24`, "1818", "18"},
+		{`1000`, "1903e8", "cd03e8"},
+		{`1000000000000`, "1b000000e8d4a51000", "cf000000e8d4a51000"},
+		{`-1`, "20", "ff"},
+		{`-100`, "3863", "d09c"},
+		{`-1000`, "3903e7", "d1fc18"},
+		{`1.5`, "fa3fc00000", "ca3fc00000"},
+		{`100000.0`, "fa47c35000", "ca47c35000"},
+		{`1.1`, "fb3ff199999999999a", "cb3ff199999999999a"},
+		{`""`, "60", "a0"},
+		{`"a"`, "6161", "a161"},
+		{`[]`, "80", "90"},
+		{`[1,2,3]`, "83010203", "93010203"},
+		{`{"b":[2,3],"a":1}`, "a26161016162820203", "82a16101a162920203"},
+		{`[true,false,null]`, "83f5f4f6", "93c3c2c0"},
+	}
+	for _, tt := range tests {
+		dec := json.NewDecoder(strings.NewReader(tt.json))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range []struct {
+			ser  Serializer
+			want string
+		}{{CBOR, tt.cbor}, {MessagePack, tt.msgpack}} {
+			got, err := c.ser.Marshal(v)
+			if err != nil {
+				t.Errorf("%s %s: %v", c.ser.Name(), tt.json, err)
+			} else if hex.EncodeToString(got) != c.want {
+				t.Errorf("%s %s = %x, want %s", c.ser.Name(), tt.json, got, c.want)
+			}
+		}
+	}
+}
+
+func TestSerializerNegotiation(t *testing.T) {
+	tests := []struct {
+		header, param string
+		want          string
+	}{
+		{"bson, msgpack, cbor", "", "msgpack"},
+		{"", "cbor", "cbor"},
+		{"bson", "", ""},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/feed?"+SerializerParam+"="+tt.param, nil)
+		if tt.header != "" {
+			r.Header.Set(SerializerHeader, tt.header)
+		}
+		w := newTestWriter()
+		s := New(w, r, WithSerializers(CBOR, MessagePack))
+		s.Close(nil)
+
+		got := ""
+		if s.Serializer() != nil {
+			got = s.Serializer().Name()
+		}
+		if got != tt.want || w.header.Get(SerializerHeader) != tt.want {
+			t.Errorf("asked %q/%q: got %q, header %q, want %q", tt.header, tt.param, got, w.header.Get(SerializerHeader), tt.want)
+		}
+	}
+}
+
+// Signals go out in the negotiated encoding where it's smaller, and are
+// recorded, and replayed to other clients, as JSON
+func TestSerializedSignals(t *testing.T) {
+	buf := NewReplayBuffer(8)
+	w := newTestWriter()
+	s := newStream(w, http.Header{SerializerHeader: {"cbor"}}, WithSerializers(CBOR), WithReplay(buf))
+	s.PatchSignals([]byte(`{"a":[1,-2,1.5,"x",true,null]}`))
+	s.PatchSignals([]byte(`{"n":1}`))
+	s.Close(nil)
+
+	got := w.String()
+	encoded := base64.StdEncoding.EncodeToString([]byte("\xa1\x61\x61\x86\x01\x21\xfa\x3f\xc0\x00\x00\x61\x78\xf5\xf6"))
+	want := "event: datastar-patch-signals\nid: 1\n" + SignalsField + ": " + encoded + "\n\n"
+	if !strings.Contains(got, want) {
+		t.Errorf("stream doesn't carry the CBOR patch %q:\n%s", want, got)
+	}
+	if !strings.Contains(got, "data: signals {\"n\":1}\n") || strings.Count(got, "data: signals") != 1 {
+		t.Errorf("stream should carry only the small patch as JSON:\n%s", got)
+	}
+
+	plain := newTestWriter()
+	newStream(plain, resumeHeader(0), WithSerializers(CBOR), WithReplay(buf)).Close(nil)
+	if replayed := plain.String(); strings.Contains(replayed, SignalsField) || !strings.Contains(replayed, `data: signals {"a":[1,-2,1.5,"x",true,null]}`) {
+		t.Errorf("a JSON client was replayed:\n%s", replayed)
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Capabilities{Envelope: EnvelopeV2, Serializers: []Serializer{CBOR, MessagePack}}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"envelope":2,"serializers":["cbor","msgpack"]}`; got != want {
+		t.Errorf("capabilities = %s, want %s", got, want)
+	}
+
+	rec = httptest.NewRecorder()
+	Capabilities{}.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+	if got, want := strings.TrimSpace(rec.Body.String()), `{"serializers":[]}`; got != want {
+		t.Errorf("empty capabilities = %s, want %s", got, want)
+	}
+}
+
+// Backpressure merges serialized signal patches like JSON ones
+func TestSerializedSignalsCoalesce(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, http.Header{SerializerHeader: {"cbor"}}, WithSerializers(CBOR),
+		WithBackpressure(Backpressure{MaxQueue: 1, Policy: CoalesceSignals}))
+	w.stallWrites()
+	patchRow(t, s, 1)
+	w.waitStalled(t)
+	s.PatchSignals([]byte(`{"a":[1000,2000,3000,4000,5000,6000,7000,8000]}`))
+	s.PatchSignals([]byte(`{"b":[1000,2000,3000,4000,5000,6000,7000,8000]}`))
+
+	if got := s.Dropped(); got != 1 {
+		t.Errorf("Dropped() = %d, want 1", got)
+	}
+	finish(s, w)
+	dec := json.NewDecoder(strings.NewReader(`{"a":[1000,2000,3000,4000,5000,6000,7000,8000],"b":[1000,2000,3000,4000,5000,6000,7000,8000]}`))
+	dec.UseNumber()
+	var merged any
+	dec.Decode(&merged)
+	encoded, _ := CBOR.Marshal(merged)
+	if want := SignalsField + ": " + base64.StdEncoding.EncodeToString(encoded) + "\n"; strings.Count(w.String(), SignalsField) != 1 || !strings.Contains(w.String(), want) {
+		t.Errorf("stream doesn't carry the two patches merged, %q:\n%s", want, w.String())
+	}
+}
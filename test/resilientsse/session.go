@@ -0,0 +1,280 @@
+package resilientsse
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+const (
+	// SessionHeader carries the session ID, in both directions, for clients
+	// that don't use Datastar signals
+	SessionHeader = "X-Resilient-Session"
+
+	// SessionSignal is the Datastar signal a new session's ID is patched into.
+	// Datastar sends signals with every request, so a reconnecting client
+	// presents it without any extra wiring.
+	SessionSignal = "resilientSession"
+)
+
+// SessionStore persists per-session state between connections. State is
+// opaque to the store; [ResilientSSE.SaveSession] stores it as JSON.
+//
+// Implementations must be safe for concurrent use.
+type SessionStore interface {
+	// Load returns the state saved for id, with ok false if there is none
+	Load(id string) (state []byte, ok bool, err error)
+	Save(id string, state []byte) error
+	Delete(id string) error
+}
+
+// WithSessions gives the stream a session that survives reconnects. A client
+// presenting a known session ID (via [SessionHeader] or [SessionSignal])
+// resumes it; any other client is issued a new one, sent back in both the
+// response header and a signal patch.
+func WithSessions(store SessionStore) Option {
+	return func(o *options) {
+		o.sessions = store
+	}
+}
+
+// SessionID returns the stream's session ID, or "" without [WithSessions]
+func (s *ResilientSSE) SessionID() string {
+	s.sessionMu.Lock()
+	defer s.sessionMu.Unlock()
+
+	return s.sessionID
+}
+
+// SessionResumed reports whether the client presented a session that was
+// still in the store
+func (s *ResilientSSE) SessionResumed() bool {
+	return s.sessionResumed
+}
+
+// LoadSession unmarshals the session's saved state into v, leaving v
+// untouched if nothing has been saved
+func (s *ResilientSSE) LoadSession(v any) error {
+	if s.opts.sessions == nil {
+		return nil
+	}
+	state, ok, err := s.opts.sessions.Load(s.SessionID())
+	if err != nil || !ok {
+		return err
+	}
+	return json.Unmarshal(state, v)
+}
+
+// SaveSession marshals v as the session's state
+func (s *ResilientSSE) SaveSession(v any) error {
+	if s.opts.sessions == nil {
+		return nil
+	}
+	state, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.opts.sessions.Save(s.SessionID(), state)
+}
+
+// EndSession deletes the session's state, so the next connection starts over
+func (s *ResilientSSE) EndSession() error {
+	if s.opts.sessions == nil {
+		return nil
+	}
+	return s.opts.sessions.Delete(s.SessionID())
+}
+
+// RotateSession moves the session to a new ID, as apps do with their session
+// cookies after re-authenticating a user, so the old ID no longer resumes it.
+// The saved state moves with it and the stream carries on unchanged: event
+// IDs keep counting, whatever replays the stream keeps replaying it and hub
+// topics keep their place, so a client resuming with the new ID and its
+// Last-Event-ID misses nothing.
+//
+// The new ID is patched into [SessionSignal]. The [SessionHeader] of the
+// response has already been sent with the old ID, so clients that present the
+// header must pick the new ID up from the signal. Nothing else should save
+// the session while it is being rotated.
+func (s *ResilientSSE) RotateSession() (string, error) {
+	if s.opts.sessions == nil {
+		return "", nil
+	}
+	old := s.SessionID()
+	state, ok, err := s.opts.sessions.Load(old)
+	if err != nil {
+		return "", fmt.Errorf("resilientsse: loading session: %w", err)
+	}
+	if !ok {
+		state = []byte("null")
+	}
+	id := newSessionID()
+	if err := s.opts.sessions.Save(id, state); err != nil {
+		return "", fmt.Errorf("resilientsse: saving session: %w", err)
+	}
+	if err := s.opts.sessions.Delete(old); err != nil {
+		return "", fmt.Errorf("resilientsse: deleting session: %w", err)
+	}
+
+	s.sessionMu.Lock()
+	s.sessionID = id
+	s.sessionMu.Unlock()
+	for _, h := range s.opts.hubs {
+		h.renameSession(old, id)
+	}
+	return id, s.MarshalAndPatchSignals(map[string]string{SessionSignal: id})
+}
+
+// openSession resumes the session the client presents, or starts a new one.
+// It runs before the response headers are written.
+func (s *ResilientSSE) openSession(w http.ResponseWriter, r *http.Request) error {
+	id := r.Header.Get(SessionHeader)
+	if id == "" && r.Method == http.MethodGet {
+		var signals map[string]any
+		if err := datastar.ReadSignals(r, &signals); err == nil {
+			id, _ = signals[SessionSignal].(string)
+		}
+	}
+
+	if id != "" {
+		_, ok, err := s.opts.sessions.Load(id)
+		if err != nil {
+			return fmt.Errorf("resilientsse: loading session: %w", err)
+		}
+		s.sessionResumed = ok
+	}
+	if !s.sessionResumed {
+		id = newSessionID()
+		if err := s.opts.sessions.Save(id, []byte("null")); err != nil {
+			return fmt.Errorf("resilientsse: saving session: %w", err)
+		}
+	}
+
+	s.sessionID = id
+	w.Header().Set(SessionHeader, id)
+	return nil
+}
+
+// newSessionID returns a random session ID
+func newSessionID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SessionLimits bounds what a [MemorySessionStore] keeps. Zero limits are no
+// limit.
+type SessionLimits struct {
+	// MaxAge is how long a session is kept after it was last loaded or
+	// saved. A stream only loads its session as it connects, so MaxAge must
+	// outlast the app's streams, or the sessions of connected clients that
+	// never save them expire under them.
+	MaxAge time.Duration
+	// MaxSessions caps the sessions kept, forgetting the least recently used
+	MaxSessions int
+}
+
+// MemorySessionStore is a [SessionStore] that keeps state in memory. Without
+// limits, sessions are kept until deleted, so it suits tests and
+// single-instance servers with a bounded number of clients.
+type MemorySessionStore struct {
+	limits SessionLimits
+
+	mu       sync.Mutex
+	sessions map[string]*list.Element
+	// used orders the sessions by when they were last used, most recent
+	// first
+	used *list.List
+}
+
+// memorySession is the value of an element of MemorySessionStore.used
+type memorySession struct {
+	id    string
+	state []byte
+	used  time.Time
+}
+
+// NewMemorySessionStore creates an empty in-memory session store keeping
+// sessions until deleted
+func NewMemorySessionStore() *MemorySessionStore {
+	return NewMemorySessionStoreWithLimits(SessionLimits{})
+}
+
+// NewMemorySessionStoreWithLimits creates an empty in-memory session store
+// keeping sessions within l
+func NewMemorySessionStoreWithLimits(l SessionLimits) *MemorySessionStore {
+	return &MemorySessionStore{limits: l, sessions: map[string]*list.Element{}, used: list.New()}
+}
+
+func (m *MemorySessionStore) Load(id string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.expire(now)
+	e, ok := m.sessions[id]
+	if !ok {
+		return nil, false, nil
+	}
+	m.touch(e, now)
+	return e.Value.(*memorySession).state, true, nil
+}
+
+func (m *MemorySessionStore) Save(id string, state []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.expire(now)
+	state = append([]byte(nil), state...)
+	if e, ok := m.sessions[id]; ok {
+		e.Value.(*memorySession).state = state
+		m.touch(e, now)
+		return nil
+	}
+	m.sessions[id] = m.used.PushFront(&memorySession{id: id, state: state, used: now})
+	if m.limits.MaxSessions > 0 && m.used.Len() > m.limits.MaxSessions {
+		m.remove(m.used.Back())
+	}
+	return nil
+}
+
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.sessions[id]; ok {
+		m.remove(e)
+	}
+	return nil
+}
+
+// expire drops the sessions unused for over MaxAge, which are the last ones
+// in used. m.mu must be held.
+func (m *MemorySessionStore) expire(now time.Time) {
+	if m.limits.MaxAge <= 0 {
+		return
+	}
+	for e := m.used.Back(); e != nil && now.Sub(e.Value.(*memorySession).used) > m.limits.MaxAge; e = m.used.Back() {
+		m.remove(e)
+	}
+}
+
+// touch marks the session of e used at now. m.mu must be held.
+func (m *MemorySessionStore) touch(e *list.Element, now time.Time) {
+	e.Value.(*memorySession).used = now
+	m.used.MoveToFront(e)
+}
+
+// remove drops the session of e. m.mu must be held.
+func (m *MemorySessionStore) remove(e *list.Element) {
+	delete(m.sessions, e.Value.(*memorySession).id)
+	m.used.Remove(e)
+}
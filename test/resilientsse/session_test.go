@@ -0,0 +1,100 @@
+package resilientsse
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resumeSession opens a stream with sessions, presenting id if set
+func resumeSession(t *testing.T, sessions SessionStore, id string) *ResilientSSE {
+	t.Helper()
+	header := http.Header{}
+	if id != "" {
+		header.Set(SessionHeader, id)
+	}
+	s := newStream(newTestWriter(), header, WithSessions(sessions))
+	t.Cleanup(func() { s.Close(nil) })
+	return s
+}
+
+func TestSessionResume(t *testing.T) {
+	sessions := NewMemorySessionStore()
+	first := resumeSession(t, sessions, "")
+	if first.SessionID() == "" || first.SessionResumed() {
+		t.Fatalf("new stream has session %q, resumed %v", first.SessionID(), first.SessionResumed())
+	}
+	if err := first.SaveSession(map[string]int{"count": 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := resumeSession(t, sessions, first.SessionID())
+	if second.SessionID() != first.SessionID() || !second.SessionResumed() {
+		t.Fatalf("resuming stream has session %q, resumed %v, want %q resumed",
+			second.SessionID(), second.SessionResumed(), first.SessionID())
+	}
+	var state struct{ Count int }
+	if err := second.LoadSession(&state); err != nil || state.Count != 3 {
+		t.Errorf("LoadSession() = %+v, %v, want count 3", state, err)
+	}
+
+	if err := second.EndSession(); err != nil {
+		t.Fatal(err)
+	}
+	if third := resumeSession(t, sessions, first.SessionID()); third.SessionResumed() {
+		t.Error("ended session resumed")
+	}
+}
+
+func TestSessionRotate(t *testing.T) {
+	sessions := NewMemorySessionStore()
+	first := resumeSession(t, sessions, "")
+	first.SaveSession("state")
+	old := first.SessionID()
+
+	id, err := first.RotateSession()
+	if err != nil || id == old || first.SessionID() != id {
+		t.Fatalf("RotateSession() = %q, %v, session %q, want a new ID", id, err, first.SessionID())
+	}
+	if s := resumeSession(t, sessions, old); s.SessionResumed() {
+		t.Error("rotated-away session resumed")
+	}
+	s := resumeSession(t, sessions, id)
+	var state string
+	if err := s.LoadSession(&state); !s.SessionResumed() || err != nil || state != "state" {
+		t.Errorf("rotated session resumed %v with %q, %v, want its state", s.SessionResumed(), state, err)
+	}
+}
+
+func TestMemorySessionStoreMaxAge(t *testing.T) {
+	sessions := NewMemorySessionStoreWithLimits(SessionLimits{MaxAge: 100 * time.Millisecond})
+	sessions.Save("a", []byte("1"))
+	sessions.Save("b", []byte("2"))
+
+	time.Sleep(60 * time.Millisecond)
+	// loading a keeps it for another MaxAge
+	if _, ok, _ := sessions.Load("a"); !ok {
+		t.Fatal("a expired early")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if _, ok, _ := sessions.Load("b"); ok {
+		t.Error("b was kept past MaxAge")
+	}
+	if _, ok, _ := sessions.Load("a"); !ok {
+		t.Error("a expired though it was used")
+	}
+}
+
+func TestMemorySessionStoreMaxSessions(t *testing.T) {
+	sessions := NewMemorySessionStoreWithLimits(SessionLimits{MaxSessions: 2})
+	sessions.Save("a", []byte("1"))
+	sessions.Save("b", []byte("2"))
+	sessions.Load("a")
+	sessions.Save("c", []byte("3"))
+
+	for id, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		if _, ok, _ := sessions.Load(id); ok != want {
+			t.Errorf("session %s kept %v, want %v", id, ok, want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// SignalStore holds the signal state a client has been sent, so that further
+// updates can be reduced to the keys that actually changed. Updates follow
+// signal patch semantics: objects are merged key by key, a nil value removes
+// its key and anything else, arrays included, replaces the old value whole.
+// To patch a growing collection cheaply, key it by ID in an object rather
+// than appending to an array.
+//
+// A diff is only correct if the client received every patch before it, so a
+// stream with [WithBackpressure] should use [CoalesceSignals] rather than
+// [DropOldest], which can discard one for good.
+//
+// A SignalStore is safe for concurrent use.
+type SignalStore struct {
+	mu    sync.Mutex
+	state map[string]any
+}
+
+// NewSignalStore creates an empty SignalStore
+func NewSignalStore() *SignalStore {
+	return &SignalStore{state: map[string]any{}}
+}
+
+// WithSignalStore makes the stream diff signals against st instead of a store
+// of its own, so the state can outlive the connection, e.g. kept per session.
+// st is reset whenever New can't be sure the client has seen everything st
+// recorded: unless the client resumes and any events it missed are replayed
+// in full, it starts over with a complete snapshot.
+func WithSignalStore(st *SignalStore) Option {
+	return func(o *options) {
+		o.signals = st
+	}
+}
+
+// Signals returns the store the stream diffs signals against
+func (s *ResilientSSE) Signals() *SignalStore {
+	return s.signals
+}
+
+// MarshalAndPatchSignalChanges JSON-encodes signals and patches only the parts
+// that differ from what the stream's [SignalStore] says the client already
+// has. Nothing is sent if nothing changed. If the patch can't be sent, the
+// store is reset, so the next change is sent as a complete snapshot.
+func (s *ResilientSSE) MarshalAndPatchSignalChanges(signals any, opts ...datastar.PatchSignalsOption) error {
+	// patches must reach the client in the order the store recorded them
+	s.changesMu.Lock()
+	defer s.changesMu.Unlock()
+
+	patch, err := s.signals.Diff(signals)
+	if err != nil {
+		return s.renderFailed(err)
+	}
+	if patch == nil {
+		return nil
+	}
+	if err := s.MarshalAndPatchSignals(patch, opts...); err != nil {
+		// the store has the patch, but the client may not: start it over
+		s.signals.Reset()
+		return err
+	}
+	return nil
+}
+
+// Diff merges signals into the store and returns the patch that takes the old
+// state to the new one, or nil if they are the same
+func (st *SignalStore) Diff(signals any) (map[string]any, error) {
+	next, err := toSignals(signals)
+	if err != nil {
+		return nil, err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	patch := diffSignals(st.state, next)
+	if len(patch) == 0 {
+		return nil, nil
+	}
+	return patch, nil
+}
+
+// Get returns a copy of the stored state
+func (st *SignalStore) Get() map[string]any {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return copySignals(st.state)
+}
+
+// Reset empties the store, so the next diff is a complete snapshot
+func (st *SignalStore) Reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.state = map[string]any{}
+}
+
+// MarshalJSON encodes the stored state, e.g. for saving in a session
+func (st *SignalStore) MarshalJSON() ([]byte, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	return json.Marshal(st.state)
+}
+
+// UnmarshalJSON replaces the stored state with a saved one
+func (st *SignalStore) UnmarshalJSON(data []byte) error {
+	state := map[string]any{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.state = state
+	return nil
+}
+
+// toSignals normalizes signals to the decoded-JSON form the store compares
+func toSignals(signals any) (map[string]any, error) {
+	b, err := json.Marshal(signals)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal signals: %w", err)
+	}
+	var m map[string]any
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("signals must be a JSON object: %w", err)
+	}
+	return m, nil
+}
+
+// diffSignals applies next to state in place and returns the changes made
+func diffSignals(state, next map[string]any) map[string]any {
+	patch := map[string]any{}
+	for k, v := range next {
+		old, had := state[k]
+		switch {
+		case v == nil:
+			if had {
+				delete(state, k)
+				patch[k] = nil
+			}
+		case isSignalObject(v) && isSignalObject(old):
+			if sub := diffSignals(old.(map[string]any), v.(map[string]any)); len(sub) > 0 {
+				patch[k] = sub
+			}
+		case !had || !reflect.DeepEqual(old, v):
+			obj, ok := v.(map[string]any)
+			if !ok {
+				state[k], patch[k] = v, v
+				continue
+			}
+			// the object replaces a non-object, so its nil members, which
+			// only mean something in a merge, are left out
+			state[k], patch[k] = withoutNils(obj), withoutNils(obj)
+		}
+	}
+	return patch
+}
+
+func isSignalObject(v any) bool {
+	_, ok := v.(map[string]any)
+	return ok
+}
+
+// withoutNils returns a copy of obj without nil members, at any depth
+func withoutNils(obj map[string]any) map[string]any {
+	out := make(map[string]any, len(obj))
+	for k, v := range obj {
+		switch v := v.(type) {
+		case nil:
+		case map[string]any:
+			out[k] = withoutNils(v)
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// copySignals deep-copies the objects in state; other values are immutable
+// once decoded, or replaced rather than modified
+func copySignals(state map[string]any) map[string]any {
+	out := make(map[string]any, len(state))
+	for k, v := range state {
+		if obj, ok := v.(map[string]any); ok {
+			v = copySignals(obj)
+		}
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package resilientsse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSignalStoreDiff(t *testing.T) {
+	st := NewSignalStore()
+	steps := []struct {
+		signals, patch map[string]any
+	}{
+		{
+			signals: map[string]any{"a": 1, "o": map[string]any{"x": 1, "y": 1}, "list": []any{1}},
+			patch:   map[string]any{"a": 1.0, "o": map[string]any{"x": 1.0, "y": 1.0}, "list": []any{1.0}},
+		},
+		// unchanged keys are left out, objects are diffed key by key
+		{
+			signals: map[string]any{"a": 1, "o": map[string]any{"x": 2}},
+			patch:   map[string]any{"o": map[string]any{"x": 2.0}},
+		},
+		// arrays are replaced whole, nil removes a key
+		{
+			signals: map[string]any{"list": []any{1, 2}, "a": nil},
+			patch:   map[string]any{"list": []any{1.0, 2.0}, "a": nil},
+		},
+		// an object replacing a value leaves out its nil members
+		{
+			signals: map[string]any{"list": map[string]any{"1": "one", "2": nil}},
+			patch:   map[string]any{"list": map[string]any{"1": "one"}},
+		},
+		{
+			signals: map[string]any{"o": map[string]any{"x": 2}},
+			patch:   nil,
+		},
+	}
+	for i, step := range steps {
+		patch, err := st.Diff(step.signals)
+		if err != nil {
+			t.Fatalf("step %d: Diff: %v", i, err)
+		}
+		if !reflect.DeepEqual(patch, step.patch) {
+			t.Errorf("step %d: Diff(%v) = %v, want %v", i, step.signals, patch, step.patch)
+		}
+	}
+	want := map[string]any{"o": map[string]any{"x": 2.0, "y": 1.0}, "list": map[string]any{"1": "one"}}
+	if got := st.Get(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Get() = %v, want %v", got, want)
+	}
+}
+
+func TestPatchSignalChanges(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil)
+	s.MarshalAndPatchSignalChanges(map[string]any{"a": 1, "b": 1})
+	s.MarshalAndPatchSignalChanges(map[string]any{"a": 1, "b": 2})
+	s.MarshalAndPatchSignalChanges(map[string]any{"a": 1, "b": 2})
+	s.Close(nil)
+
+	want := []map[string]any{{"a": 1.0, "b": 1.0}, {"b": 2.0}}
+	if got := signalPatches(t, w.String()); !reflect.DeepEqual(got, want) {
+		t.Errorf("signal patches sent = %v, want %v", got, want)
+	}
+}
+
+func TestPatchSignalChangesFailedWrite(t *testing.T) {
+	store := NewSignalStore()
+	replay := NewReplayBuffer(10)
+	w := newTestWriter()
+	s := newStream(w, nil, WithSignalStore(store), WithReplay(replay))
+	s.MarshalAndPatchSignalChanges(map[string]any{"a": 1})
+	w.failWrites()
+	if err := s.MarshalAndPatchSignalChanges(map[string]any{"a": 2}); err == nil {
+		t.Fatal("patching a client that went away = nil, want an error")
+	}
+	s.Close(nil)
+
+	// the replay is complete, but doesn't have a:2, so it is sent again
+	w2 := newTestWriter()
+	resumed := newStream(w2, resumeHeader(eventIDs(w.String())[0]), WithSignalStore(store), WithReplay(replay))
+	resumed.MarshalAndPatchSignalChanges(map[string]any{"a": 2})
+	resumed.Close(nil)
+
+	if got, want := signalPatches(t, w2.String()), []map[string]any{{"a": 2.0}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("signal patches sent after resuming = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package resilientsse
+
+import (
+	"cmp"
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultSourceRetry is the backoff a [Source] without a Retry policy uses
+// between failed fetches
+var DefaultSourceRetry = ReconnectPolicy{Min: time.Second, Max: 30 * time.Second, Factor: 2, Jitter: DefaultRetryJitter}
+
+// Source keeps a stream populated from an upstream that can fail. It fetches
+// a value every Interval and patches it under the Signal signal as
+//
+//	{"value": ..., "stale": false, "updatedAt": <unix ms>}
+//
+// When a fetch fails, the last value fetched successfully is patched again
+// flagged stale, with the error and when the next attempt is due, and the
+// fetch is retried with backoff until it succeeds:
+//
+//	{"value": ..., "stale": true, "error": "...", "updatedAt": ..., "retryAt": ...}
+//
+// so the page keeps showing data, and can say how old it is, rather than
+// going quiet. The last good value is kept by the Source, so a Source shared
+// by several streams gives a new stream something to show straight away.
+// Patches go through the stream's [SignalStore], so only what changed is sent.
+type Source struct {
+	// Signal is the signal the value and its state are patched under
+	Signal string
+	// Fetch loads the current value. It is passed the stream's context.
+	Fetch func(ctx context.Context) (any, error)
+	// Interval is the time between fetches while they succeed; zero means a
+	// second
+	Interval time.Duration
+	// Retry paces the attempts after a failed fetch; the zero value means
+	// DefaultSourceRetry
+	Retry ReconnectPolicy
+
+	mu        sync.Mutex
+	value     any
+	hasValue  bool
+	updatedAt time.Time
+}
+
+// sourceState is what a Source patches under its signal
+type sourceState struct {
+	Value     any  `json:"value"`
+	Stale     bool `json:"stale"`
+	Error     any  `json:"error"`
+	UpdatedAt any  `json:"updatedAt"`
+	RetryAt   any  `json:"retryAt"`
+}
+
+// Run keeps s up to date from the source until the stream ends, returning
+// the stream's error
+func (src *Source) Run(s *ResilientSSE) error {
+	retry := src.Retry
+	if retry == (ReconnectPolicy{}) {
+		retry = DefaultSourceRetry
+	}
+	interval := cmp.Or(src.Interval, time.Second)
+
+	if state, ok := src.last(); ok {
+		s.MarshalAndPatchSignalChanges(map[string]any{src.Signal: state})
+	}
+
+	failures := 0
+	for {
+		value, err := src.Fetch(s.Context())
+		if s.IsClosed() {
+			return s.Err()
+		}
+
+		wait := interval
+		var state sourceState
+		if err == nil {
+			failures = 0
+			state = src.store(value)
+		} else {
+			wait = retry.Delay(failures)
+			failures++
+			state, _ = src.last()
+			state.Stale = true
+			state.Error = err.Error()
+			state.RetryAt = time.Now().Add(wait).UnixMilli()
+		}
+		if err := s.MarshalAndPatchSignalChanges(map[string]any{src.Signal: state}); err != nil {
+			return err
+		}
+
+		select {
+		case <-s.Context().Done():
+			return s.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// store records value as the last good one and returns its fresh state
+func (src *Source) store(value any) sourceState {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	src.value, src.hasValue, src.updatedAt = value, true, time.Now()
+	return sourceState{Value: value, UpdatedAt: src.updatedAt.UnixMilli()}
+}
+
+// last returns the state of the last good value, reporting false if there
+// has never been one
+func (src *Source) last() (sourceState, bool) {
+	src.mu.Lock()
+	defer src.mu.Unlock()
+
+	if !src.hasValue {
+		return sourceState{}, false
+	}
+	stale := time.Since(src.updatedAt) > cmp.Or(src.Interval, time.Second)
+	return sourceState{Value: src.value, Stale: stale, UpdatedAt: src.updatedAt.UnixMilli()}, true
+}
@@ -0,0 +1,75 @@
+package resilientsse
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A failed fetch keeps the last good value on the page, flagged stale, until
+// a retry succeeds
+func TestSourceStaleWhileRevalidate(t *testing.T) {
+	var fetches atomic.Int32
+	src := &Source{
+		Signal:   "feed",
+		Interval: 5 * time.Millisecond,
+		Retry:    ReconnectPolicy{Min: 5 * time.Millisecond, Max: 5 * time.Millisecond},
+		Fetch: func(ctx context.Context) (any, error) {
+			switch fetches.Add(1) {
+			case 1:
+				return 1, nil
+			case 2:
+				return nil, errors.New("upstream down")
+			case 3:
+				return 2, nil
+			}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+
+	w := newTestWriter()
+	s := newStream(w, nil)
+	done := make(chan error)
+	go func() { done <- src.Run(s) }()
+	waitFor(t, "the recovered value", func() bool { return strings.Contains(w.String(), `"value":2`) })
+	s.Close(nil)
+	<-done
+
+	var patches []string
+	for line := range strings.Lines(w.String()) {
+		if p, ok := strings.CutPrefix(line, "data: signals "); ok {
+			patches = append(patches, strings.TrimSpace(p))
+		}
+	}
+	if len(patches) != 3 {
+		t.Fatalf("patches = %q, want fresh, stale and fresh again", patches)
+	}
+	for i, want := range []string{`"stale":false`, `"stale":true`, `"stale":false`} {
+		if !strings.Contains(patches[i], want) {
+			t.Errorf("patch %d = %s, want %s", i, patches[i], want)
+		}
+	}
+	// the stale patch only carries what changed: the value stays as it was
+	if !strings.Contains(patches[0], `"value":1`) || strings.Contains(patches[1], `"value"`) ||
+		!strings.Contains(patches[1], `"error":"upstream down"`) || !strings.Contains(patches[1], `"retryAt":`) {
+		t.Errorf("patches = %q, want value 1 kept with the error and when to retry", patches)
+	}
+	if !strings.Contains(patches[2], `"error":null`) || !strings.Contains(patches[2], `"value":2`) {
+		t.Errorf("recovered patch = %s, want value 2 with the error cleared", patches[2])
+	}
+
+	// a stream joining later is shown the last good value before any fetch
+	w2 := newTestWriter()
+	s2 := newStream(w2, nil)
+	go func() { done <- src.Run(s2) }()
+	waitFor(t, "the cached value", func() bool { return strings.Contains(w2.String(), `"value":2`) })
+	if n := fetches.Load(); n > 4 {
+		t.Errorf("%d fetches, want the value from the Source's cache", n)
+	}
+	s2.Close(nil)
+	<-done
+}
@@ -0,0 +1,141 @@
+package resilientsse
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testWriter is a ResponseWriter recording what a stream writes, whose writes
+// can be stalled like those to a client that stopped reading
+type testWriter struct {
+	header http.Header
+
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	stall   chan struct{}
+	stalled chan struct{}
+	failed  bool
+}
+
+func newTestWriter() *testWriter {
+	return &testWriter{header: http.Header{}, stalled: make(chan struct{}, 1)}
+}
+
+func (w *testWriter) Header() http.Header { return w.header }
+
+func (w *testWriter) WriteHeader(int) {}
+
+func (w *testWriter) Flush() {}
+
+// Write records p, first waiting for resume if the writer is stalled
+func (w *testWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	stall := w.stall
+	w.mu.Unlock()
+	if stall != nil {
+		select {
+		case w.stalled <- struct{}{}:
+		default:
+		}
+		<-stall
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.failed {
+		return 0, errClientGone
+	}
+	return w.buf.Write(p)
+}
+
+// errClientGone is what writes fail with after failWrites
+var errClientGone = errors.New("client gone")
+
+// failWrites makes writes fail, like those to a client that went away
+func (w *testWriter) failWrites() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.failed = true
+}
+
+// stallWrites makes writes block until resume
+func (w *testWriter) stallWrites() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stall = make(chan struct{})
+}
+
+// waitStalled waits for a write to block
+func (w *testWriter) waitStalled(t *testing.T) {
+	t.Helper()
+	select {
+	case <-w.stalled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no write stalled")
+	}
+}
+
+// resume lets stalled writes through
+func (w *testWriter) resume() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.stall != nil {
+		close(w.stall)
+		w.stall = nil
+	}
+}
+
+func (w *testWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.String()
+}
+
+// idLine matches the ID line of an event
+var idLine = regexp.MustCompile(`(?m)^id: (\d+)$`)
+
+// eventIDs returns the IDs of the events in a stream, in order
+func eventIDs(stream string) []uint64 {
+	var ids []uint64
+	for _, m := range idLine.FindAllStringSubmatch(stream, -1) {
+		id, _ := strconv.ParseUint(m[1], 10, 64)
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// newStream opens a stream on w for a request with header
+func newStream(w http.ResponseWriter, header http.Header, opts ...Option) *ResilientSSE {
+	r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	return New(w, r, opts...)
+}
+
+// resumeHeader is the header of a request resuming after event id
+func resumeHeader(id uint64) http.Header {
+	h := http.Header{}
+	h.Set(LastEventIDHeader, strconv.FormatUint(id, 10))
+	return h
+}
+
+// elementPatcher is a stream or one of its lanes
+type elementPatcher interface {
+	PatchElementf(format string, args ...any) error
+}
+
+// patchRow sends an element patch for row n
+func patchRow(t *testing.T, p elementPatcher, n int) {
+	t.Helper()
+	if err := p.PatchElementf(`<li id="row-%d">row</li>`, n); err != nil {
+		t.Fatalf("PatchElementf(row %d): %v", n, err)
+	}
+}
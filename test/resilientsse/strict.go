@@ -0,0 +1,67 @@
+package resilientsse
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrMisframed is the cause reported by [ResilientSSE.Err] for streams
+// [WithStrictFraming] refused to start
+var ErrMisframed = errors.New("resilientsse: response can't carry an event stream")
+
+// WithStrictFraming refuses to start the stream on a response that can't
+// carry one: with a Content-Length, which cuts the stream off once reached,
+// with Connection: close or a Transfer-Encoding other than chunked, which
+// leave the client unable to tell a finished stream from a dropped one, or
+// on a ResponseWriter that can't flush, which holds events back. The client
+// is answered 500 instead, and the stream ends with [ErrMisframed] naming
+// the problem.
+//
+// Misframed responses usually come from middleware setting headers meant for
+// other responses; strict framing turns them into an error at the handler
+// rather than a client reconnecting for no clear reason.
+func WithStrictFraming() Option {
+	return func(o *options) {
+		o.strictFraming = true
+	}
+}
+
+// checkFraming answers 500 and returns an error wrapping ErrMisframed if w
+// can't carry an event stream
+func checkFraming(w http.ResponseWriter) error {
+	var problem string
+	h := w.Header()
+	switch {
+	case h.Get("Content-Length") != "":
+		problem = "Content-Length is set"
+	case strings.EqualFold(h.Get("Connection"), "close"):
+		problem = "Connection: close is set"
+	case h.Get("Transfer-Encoding") != "" && !strings.EqualFold(h.Get("Transfer-Encoding"), "chunked"):
+		problem = "Transfer-Encoding is " + h.Get("Transfer-Encoding")
+	case !canFlush(w):
+		problem = "the ResponseWriter can't flush"
+	default:
+		return nil
+	}
+
+	h.Del("Content-Length")
+	http.Error(w, "misframed event stream", http.StatusInternalServerError)
+	return fmt.Errorf("%w: %s", ErrMisframed, problem)
+}
+
+// canFlush reports whether w, or a ResponseWriter it wraps, can flush, as
+// [http.ResponseController] would find out
+func canFlush(w http.ResponseWriter) bool {
+	for {
+		switch u := w.(type) {
+		case http.Flusher, interface{ FlushError() error }:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = u.Unwrap()
+		default:
+			return false
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package resilientsse
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// noFlushWriter hides its ResponseWriter's Flush
+type noFlushWriter struct{ http.ResponseWriter }
+
+func TestStrictFraming(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		header string
+		value  string
+		wrap   bool
+	}{
+		{name: "content-length", header: "Content-Length", value: "100"},
+		{name: "connection-close", header: "Connection", value: "close"},
+		{name: "identity", header: "Transfer-Encoding", value: "identity"},
+		{name: "no-flush", wrap: true},
+	} {
+		rec := httptest.NewRecorder()
+		var w http.ResponseWriter = rec
+		if c.wrap {
+			w = noFlushWriter{rec}
+		}
+		if c.header != "" {
+			w.Header().Set(c.header, c.value)
+		}
+
+		s := New(w, httptest.NewRequest(http.MethodGet, "/feed", nil), WithStrictFraming())
+		if !errors.Is(s.Err(), ErrMisframed) {
+			t.Errorf("%s: stream started with %v, want ErrMisframed", c.name, s.Err())
+		}
+		if rec.Code != http.StatusInternalServerError {
+			t.Errorf("%s: client answered %d, want 500", c.name, rec.Code)
+		}
+		s.Close(nil)
+	}
+
+	rec := httptest.NewRecorder()
+	s := New(rec, httptest.NewRequest(http.MethodGet, "/feed", nil), WithStrictFraming())
+	defer s.Close(nil)
+	if s.IsClosed() || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("well-framed stream refused with %v", s.Err())
+	}
+}
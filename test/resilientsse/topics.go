@@ -0,0 +1,473 @@
+package resilientsse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/starfederation/datastar-go/datastar"
+)
+
+// ErrNotInHub is returned by [Hub.Subscribe] for a stream that isn't
+// registered with the hub, or has been closed
+var ErrNotInHub = errors.New("resilientsse: stream not registered with hub")
+
+// DefaultTopicReplay is how many published events each topic of a hub keeps
+// for catching up resumed subscribers, unless set with [Hub.SetTopicReplay]
+const DefaultTopicReplay = 256
+
+// DefaultCursorTTL is how long a hub remembers where a closed stream's
+// subscriptions left off for its session's next connection, unless set with
+// [Hub.SetCursorTTL]
+const DefaultCursorTTL = 10 * time.Minute
+
+// topic is a named channel of a hub. mu guards its events and subscribers,
+// and is not held while events are delivered.
+type topic struct {
+	mu     sync.Mutex
+	seq    uint64
+	events []published // the most recent, oldest first
+	size   int
+	subs   map[uint64]*subscription
+}
+
+// published is an event as it was published, rendered again for each stream
+type published struct {
+	seq  uint64
+	data any
+	// send writes the event as published; render writes it with the data a
+	// subscriber's transforms made of it, and is nil for events published
+	// without data
+	send   HubSend
+	render func(s *ResilientSSE, data any) error
+}
+
+// subscription is one stream's subscription to a topic. mu is held while
+// events are delivered to it, so the stream gets the topic's events in
+// publish order.
+type subscription struct {
+	s          *ResilientSSE
+	filters    []TopicFilter
+	transforms []TopicTransform
+
+	mu sync.Mutex
+	// cursor is the seq of the last event sent (or queued) to the stream
+	cursor uint64
+}
+
+// sessionCursors are where a session's subscriptions left off, by topic, when
+// its last stream closed
+type sessionCursors struct {
+	topics map[string]uint64
+	left   time.Time
+}
+
+// TopicEvent is an event published to a topic, as subscription filters and
+// transforms see it
+type TopicEvent struct {
+	Topic string
+	// Seq numbers the topic's events: from 1, or as given to [Hub.PublishDataAt]
+	Seq uint64
+	// Data is what was published with [Hub.PublishData] or
+	// [Hub.PublishSignals], nil for [Hub.Publish]
+	Data any
+}
+
+// TopicFilter reports whether a published event is sent to the subscribed
+// stream s
+type TopicFilter func(s *ResilientSSE, e TopicEvent) bool
+
+// TopicTransform returns the data to render a published event with on the
+// subscribed stream s, or nil to not send it
+type TopicTransform func(s *ResilientSSE, e TopicEvent) any
+
+// SubscribeOption configures a subscription made with [Hub.Subscribe]
+type SubscribeOption func(sub *subscription)
+
+// WithFilter only sends the subscriber the events f accepts, e.g. those it
+// is allowed to see. It can be given several times; every filter must accept
+// an event for it to be sent.
+func WithFilter(f TopicFilter) SubscribeOption {
+	return func(sub *subscription) {
+		sub.filters = append(sub.filters, f)
+	}
+}
+
+// WithTransform sends the subscriber what t makes of each event's data, e.g.
+// redacted, localized or converted to its units, so one published event can
+// be personalized per client. It can be given several times; each transform
+// is passed the previous one's data. Transforms run after the filters, and
+// only apply to events published with data.
+func WithTransform(t TopicTransform) SubscribeOption {
+	return func(sub *subscription) {
+		sub.transforms = append(sub.transforms, t)
+	}
+}
+
+// deliver sends e to the subscriber, reporting false if its filters or
+// transforms dropped it
+func (sub *subscription) deliver(name string, e published) (bool, error) {
+	ev := TopicEvent{Topic: name, Seq: e.seq, Data: e.data}
+	for _, f := range sub.filters {
+		if !f(sub.s, ev) {
+			return false, nil
+		}
+	}
+	if len(sub.transforms) == 0 || e.render == nil {
+		return true, e.send(sub.s)
+	}
+	for _, t := range sub.transforms {
+		if ev.Data = t(sub.s, ev); ev.Data == nil {
+			return false, nil
+		}
+	}
+	return true, e.render(sub.s, ev.Data)
+}
+
+// catchUp delivers the events after the subscriber's cursor, in order,
+// moving the cursor past each one sent. mu must be held.
+func (sub *subscription) catchUp(name string, events []published) error {
+	for _, e := range events {
+		if e.seq <= sub.cursor {
+			continue
+		}
+		if _, err := sub.deliver(name, e); err != nil {
+			return err
+		}
+		sub.cursor = e.seq
+	}
+	return nil
+}
+
+// since returns the kept events numbered above cursor and up to seq
+func (t *topic) since(cursor, seq uint64) []published {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var events []published
+	for _, e := range t.events {
+		if e.seq > cursor && e.seq <= seq {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// SetTopicReplay sets how many published events each topic created from now
+// on keeps for catching up resumed subscribers
+func (h *Hub) SetTopicReplay(size int) {
+	h.topicsMu.Lock()
+	defer h.topicsMu.Unlock()
+
+	h.topicReplay = max(size, 1)
+}
+
+// SetCursorTTL sets how long the hub remembers where a closed stream's
+// subscriptions left off; a session resuming later is not caught up
+func (h *Hub) SetCursorTTL(ttl time.Duration) {
+	h.topicsMu.Lock()
+	defer h.topicsMu.Unlock()
+
+	h.cursorTTL = ttl
+}
+
+// Subscribe adds s to the named topic. s must be registered with the hub
+// (see [WithHub]); it is unsubscribed from everything when it is closed.
+//
+// A stream of a resumed session (see [WithSessions]) that was subscribed to
+// the topic when its previous connection ended is first sent the events
+// published since, as far as the topic still has them, so the client sees
+// every event of the topics it is subscribed to and only those. Events that
+// were sent but lost in flight are replayed by the stream's own [WithReplay]
+// buffer, which should therefore be kept per session.
+//
+// The subscription's filters and transforms (see [WithFilter] and
+// [WithTransform]) are applied to every event as it is sent to s, catch-up
+// included. Subscribing to a topic s is already subscribed to does nothing.
+// If catching up fails, s stays subscribed and its cursor is left after the
+// last event sent, so the session's next connection picks up from there.
+func (h *Hub) Subscribe(s *ResilientSSE, name string, opts ...SubscribeOption) error {
+	t := h.topic(name)
+	t.mu.Lock()
+	if _, ok := t.subs[s.connID]; ok {
+		t.mu.Unlock()
+		return nil
+	}
+
+	h.mu.Lock()
+	if _, ok := h.streams[s.connID]; !ok {
+		h.mu.Unlock()
+		t.mu.Unlock()
+		return ErrNotInHub
+	}
+	h.topicsOf[s.connID] = append(h.topicsOf[s.connID], name)
+	h.mu.Unlock()
+
+	sub := &subscription{s: s, cursor: t.seq}
+	for _, opt := range opts {
+		opt(sub)
+	}
+	var missed []published
+	if cursor, ok := h.takeCursor(s, name); ok {
+		sub.cursor = cursor
+		missed = slices.Clone(t.events)
+	}
+	// publishing to the new subscriber waits for its catch-up
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+	t.subs[s.connID] = sub
+	t.mu.Unlock()
+
+	return sub.catchUp(name, missed)
+}
+
+// Unsubscribe removes s from the named topic, and forgets where its session
+// left off in it
+func (h *Hub) Unsubscribe(s *ResilientSSE, name string) {
+	h.mu.Lock()
+	h.topicsOf[s.connID] = slices.DeleteFunc(h.topicsOf[s.connID], func(t string) bool { return t == name })
+	h.mu.Unlock()
+
+	t := h.topic(name)
+	t.mu.Lock()
+	delete(t.subs, s.connID)
+	t.mu.Unlock()
+
+	if id := s.SessionID(); id != "" {
+		h.topicsMu.Lock()
+		h.forgetCursor(id, name)
+		h.topicsMu.Unlock()
+	}
+}
+
+// Topics returns the topics s is subscribed to
+func (h *Hub) Topics(s *ResilientSSE) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return slices.Clone(h.topicsOf[s.connID])
+}
+
+// Publish sends an event to every subscriber of the named topic and keeps it
+// for catching up subscribers that resume later. send is called once per
+// subscriber, concurrently as with [Hub.Broadcast], and again for every
+// catch-up. A stalled subscriber holds up Publish's return, but neither the
+// other subscribers nor other publishes to the topic; each subscriber still
+// gets the topic's events in order. Publish returns how many subscribers were
+// sent the event.
+//
+// Subscription filters see the event without data, and transforms don't
+// apply to it; use [Hub.PublishData] for events they should work on.
+func (h *Hub) Publish(name string, send HubSend) int {
+	return h.publish(name, published{send: send})
+}
+
+// PublishData is [Hub.Publish] for an event made of data, which render
+// writes to a stream. Subscription filters are passed data, and transforms
+// can replace it per subscriber before it is rendered.
+func (h *Hub) PublishData(name string, data any, render func(s *ResilientSSE, data any) error) int {
+	return h.publish(name, published{
+		data:   data,
+		send:   func(s *ResilientSSE) error { return render(s, data) },
+		render: render,
+	})
+}
+
+// PublishDataAt is [Hub.PublishData] for an event its publisher numbered
+// seq, such as one relayed from another instance by a broker, so a topic's
+// events have the same numbers on every instance and catch-up cursors mean
+// the same everywhere. Numbers must increase but need not be consecutive; an
+// event numbered at or below the topic's last is a duplicate and is dropped,
+// returning 0. Mixing it with the other publish methods on a topic leaves
+// numbering to whichever publishes first.
+func (h *Hub) PublishDataAt(name string, seq uint64, data any, render func(s *ResilientSSE, data any) error) int {
+	return h.publish(name, published{
+		seq:    seq,
+		data:   data,
+		send:   func(s *ResilientSSE) error { return render(s, data) },
+		render: render,
+	})
+}
+
+// PublishSignals publishes a patch of signals with [Hub.PublishData],
+// encoding them only once for the subscribers that don't transform them
+func (h *Hub) PublishSignals(name string, signals any, opts ...datastar.PatchSignalsOption) (int, error) {
+	b, err := json.Marshal(signals)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal signals: %w", err)
+	}
+	return h.publish(name, published{
+		data: signals,
+		send: func(s *ResilientSSE) error { return s.PatchSignals(b, opts...) },
+		render: func(s *ResilientSSE, data any) error {
+			return s.MarshalAndPatchSignals(data, opts...)
+		},
+	}), nil
+}
+
+// publish numbers e, unless it already is, keeps it and delivers it to the
+// topic's subscribers at the time, without holding the topic
+func (h *Hub) publish(name string, e published) int {
+	t := h.topic(name)
+	t.mu.Lock()
+	switch {
+	case e.seq == 0:
+		t.seq++
+		e.seq = t.seq
+	case e.seq <= t.seq:
+		t.mu.Unlock()
+		return 0
+	default:
+		t.seq = e.seq
+	}
+	if len(t.events) == t.size {
+		t.events = slices.Delete(t.events, 0, 1)
+	}
+	t.events = append(t.events, e)
+	subs := make([]*subscription, 0, len(t.subs))
+	for _, sub := range t.subs {
+		subs = append(subs, sub)
+	}
+	t.mu.Unlock()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent := 0
+	for _, sub := range subs {
+		wg.Go(func() {
+			if t.send(name, sub, e) {
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+	return sent
+}
+
+// send delivers e to sub, after any earlier events a concurrent publish
+// hasn't delivered yet, and reports whether the subscriber was sent it
+func (t *topic) send(name string, sub *subscription, e published) bool {
+	sub.mu.Lock()
+	defer sub.mu.Unlock()
+
+	if sub.cursor >= e.seq {
+		// sent by the catch-up of a later event, or before subscribing
+		return false
+	}
+	if sub.cursor < e.seq-1 {
+		// events between the cursor and e may still be on their way
+		if sub.catchUp(name, t.since(sub.cursor, e.seq-1)) != nil {
+			return false
+		}
+	}
+	ok, err := sub.deliver(name, e)
+	if err != nil {
+		return false
+	}
+	sub.cursor = e.seq
+	return ok
+}
+
+// topic returns the named topic, creating it on first use
+func (h *Hub) topic(name string) *topic {
+	h.topicsMu.Lock()
+	defer h.topicsMu.Unlock()
+
+	t, ok := h.topics[name]
+	if !ok {
+		t = &topic{size: h.topicReplay, subs: map[uint64]*subscription{}}
+		h.topics[name] = t
+	}
+	return t
+}
+
+// leaveTopics removes s, which has left the hub, from the named topics,
+// remembering how far it got in each for its session's next connection
+func (h *Hub) leaveTopics(s *ResilientSSE, names []string) {
+	cursors := map[string]uint64{}
+	for _, name := range names {
+		t := h.topic(name)
+		t.mu.Lock()
+		sub, ok := t.subs[s.connID]
+		delete(t.subs, s.connID)
+		t.mu.Unlock()
+		if ok {
+			sub.mu.Lock()
+			cursors[name] = sub.cursor
+			sub.mu.Unlock()
+		}
+	}
+
+	id := s.SessionID()
+	if id == "" || len(cursors) == 0 {
+		return
+	}
+	h.topicsMu.Lock()
+	defer h.topicsMu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.lastSweep) >= replaySweepInterval {
+		h.sweepCursors(now)
+	}
+	h.cursors[id] = &sessionCursors{topics: cursors, left: now}
+}
+
+// sweepCursors forgets the cursors kept longer than the cursor TTL.
+// topicsMu must be held.
+func (h *Hub) sweepCursors(now time.Time) {
+	for id, c := range h.cursors {
+		if now.Sub(c.left) > h.cursorTTL {
+			delete(h.cursors, id)
+		}
+	}
+	h.lastSweep = now
+}
+
+// renameSession moves the topic cursors of session old to session id
+func (h *Hub) renameSession(old, id string) {
+	h.topicsMu.Lock()
+	defer h.topicsMu.Unlock()
+
+	if cursors, ok := h.cursors[old]; ok {
+		h.cursors[id] = cursors
+		delete(h.cursors, old)
+	}
+}
+
+// takeCursor returns, and forgets, where the previous connection of s's
+// session left off in the named topic
+func (h *Hub) takeCursor(s *ResilientSSE, name string) (uint64, bool) {
+	if !s.sessionResumed {
+		return 0, false
+	}
+	id := s.SessionID()
+	h.topicsMu.Lock()
+	defer h.topicsMu.Unlock()
+
+	c, ok := h.cursors[id]
+	if !ok || time.Since(c.left) > h.cursorTTL {
+		h.forgetCursor(id, name)
+		return 0, false
+	}
+	cursor, ok := c.topics[name]
+	h.forgetCursor(id, name)
+	return cursor, ok
+}
+
+// forgetCursor forgets where session id left off in the named topic.
+// topicsMu must be held.
+func (h *Hub) forgetCursor(id, name string) {
+	c, ok := h.cursors[id]
+	if !ok {
+		return
+	}
+	delete(c.topics, name)
+	if len(c.topics) == 0 {
+		delete(h.cursors, id)
+	}
+}
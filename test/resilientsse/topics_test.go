@@ -0,0 +1,148 @@
+package resilientsse
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+)
+
+// publishN publishes signal patches numbering events n to topic t of hub
+func publishN(hub *Hub, t string, ns ...int) {
+	for _, n := range ns {
+		hub.PublishSignals(t, map[string]int{"n": n})
+	}
+}
+
+// numbersSent returns the numbers of the events publishN sent in a stream
+func numbersSent(t *testing.T, stream string) []int {
+	t.Helper()
+	var ns []int
+	for _, patch := range signalPatches(t, stream) {
+		if n, ok := patch["n"].(float64); ok {
+			ns = append(ns, int(n))
+		}
+	}
+	return ns
+}
+
+// waitFor waits until cond holds
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// sessionStream opens a stream of hub on session id, or a new session
+// without one
+func sessionStream(w http.ResponseWriter, hub *Hub, sessions SessionStore, id string) *ResilientSSE {
+	header := http.Header{}
+	if id != "" {
+		header.Set(SessionHeader, id)
+	}
+	return newStream(w, header, WithHub(hub), WithSessions(sessions))
+}
+
+func TestPublishStalledSubscriber(t *testing.T) {
+	hub := NewHub()
+	slowW, fastW := newTestWriter(), newTestWriter()
+	slow := newStream(slowW, nil, WithHub(hub))
+	fast := newStream(fastW, nil, WithHub(hub))
+	for _, s := range []*ResilientSSE{slow, fast} {
+		if err := hub.Subscribe(s, "t"); err != nil {
+			t.Fatalf("Subscribe: %v", err)
+		}
+	}
+
+	slowW.stallWrites()
+	published := make(chan struct{}, 2)
+	go func() {
+		publishN(hub, "t", 1)
+		published <- struct{}{}
+	}()
+	slowW.waitStalled(t)
+	go func() {
+		publishN(hub, "t", 2)
+		published <- struct{}{}
+	}()
+
+	// the other subscriber gets both events while one is stalled
+	waitFor(t, "the fast subscriber's events", func() bool {
+		return len(numbersSent(t, fastW.String())) == 2
+	})
+	slowW.resume()
+	<-published
+	<-published
+	slow.Close(nil)
+	fast.Close(nil)
+
+	if got := numbersSent(t, slowW.String()); !slices.Equal(got, []int{1, 2}) {
+		t.Errorf("stalled subscriber received %v, want [1 2]", got)
+	}
+}
+
+func TestSubscribeCatchesUp(t *testing.T) {
+	hub := NewHub()
+	sessions := NewMemorySessionStore()
+	first := sessionStream(newTestWriter(), hub, sessions, "")
+	hub.Subscribe(first, "t")
+	publishN(hub, "t", 1)
+	first.Close(nil)
+	publishN(hub, "t", 2, 3)
+
+	w := newTestWriter()
+	second := sessionStream(w, hub, sessions, first.SessionID())
+	hub.Subscribe(second, "t")
+	publishN(hub, "t", 4)
+	second.Close(nil)
+
+	if got := numbersSent(t, w.String()); !slices.Equal(got, []int{2, 3, 4}) {
+		t.Errorf("resumed subscriber received %v, want [2 3 4]", got)
+	}
+}
+
+func TestCursorTTL(t *testing.T) {
+	hub := NewHub()
+	hub.SetCursorTTL(time.Millisecond)
+	sessions := NewMemorySessionStore()
+	first := sessionStream(newTestWriter(), hub, sessions, "")
+	hub.Subscribe(first, "t")
+	first.Close(nil)
+	publishN(hub, "t", 1)
+	time.Sleep(5 * time.Millisecond)
+
+	w := newTestWriter()
+	second := sessionStream(w, hub, sessions, first.SessionID())
+	hub.Subscribe(second, "t")
+	second.Close(nil)
+
+	if got := numbersSent(t, w.String()); len(got) != 0 {
+		t.Errorf("subscriber resuming after the cursor TTL received %v, want nothing", got)
+	}
+}
+
+func TestUnsubscribeForgetsCursor(t *testing.T) {
+	hub := NewHub()
+	sessions := NewMemorySessionStore()
+	first := sessionStream(newTestWriter(), hub, sessions, "")
+	hub.Subscribe(first, "a")
+	hub.Subscribe(first, "b")
+	first.Close(nil)
+	publishN(hub, "a", 1)
+
+	second := sessionStream(newTestWriter(), hub, sessions, first.SessionID())
+	defer second.Close(nil)
+	hub.Unsubscribe(second, "a")
+	hub.Subscribe(second, "b")
+
+	hub.topicsMu.Lock()
+	defer hub.topicsMu.Unlock()
+	if n := len(hub.cursors); n != 0 {
+		t.Errorf("hub keeps the cursors of %d sessions, want none", n)
+	}
+}
@@ -0,0 +1,109 @@
+package resilientsse
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ErrTxDone is returned when using a [Tx] after Commit or Rollback
+var ErrTxDone = errors.New("resilientsse: transaction already committed or rolled back")
+
+// TxField marks every event of a patch group but the last, with the ID the
+// last event carries:
+//
+//	event: datastar-patch-elements
+//	data: elements <div id="total">3</div>
+//	resilient-tx: 42
+//
+//	event: datastar-patch-signals
+//	id: 42
+//	data: signals {"count":3}
+//
+// SSE parsers ignore it, so plain datastar clients apply the events as they
+// arrive; the resilient client holds marked events back until the group's
+// last one arrives, and drops them if the connection ends first.
+const TxField = "resilient-tx"
+
+// Tx groups several patches so they are written together. Patches made on a
+// Tx are held until [Tx.Commit], which writes and flushes the whole group in
+// one piece, with no other event of the stream in between.
+//
+// Only the final event of the group carries an event ID, and the group is
+// recorded in the replay buffer as a single entry. A client that loses the
+// connection partway through a group therefore resumes from the event before
+// it, and is replayed the complete group rather than its tail.
+//
+// Every event but the last is marked with a [TxField], so the resilient
+// client applies the group together, once it has all of it, or not at all:
+// a group cut off by a dropped connection is discarded and comes back whole
+// with the replay. Plain datastar clients apply each event as it arrives, so
+// for them patches in a group should be safe to apply again, such as outer or
+// inner patches of elements with IDs, rather than appends.
+//
+// A Tx is not safe for concurrent use.
+type Tx struct {
+	patcher
+	s     *ResilientSSE
+	sends []sendFunc
+	done  bool
+}
+
+// Tx starts a new patch group on the stream
+func (s *ResilientSSE) Tx() *Tx {
+	tx := &Tx{s: s}
+	tx.patcher = patcher{ctx: s.ctx, sse: s.sse, emit: tx.add, fail: s.renderFailed}
+	return tx
+}
+
+// add queues an event until Commit
+func (tx *Tx) add(send sendFunc) error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.sends = append(tx.sends, send)
+	return nil
+}
+
+// Commit sends every patch in the group. Committing an empty group is a no-op.
+func (tx *Tx) Commit() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	tx.done = true
+
+	if len(tx.sends) == 0 {
+		return nil
+	}
+	return tx.s.emitGroup(tx.sends, PriorityNormal)
+}
+
+// Rollback discards the group without sending anything
+func (tx *Tx) Rollback() {
+	tx.done = true
+	tx.sends = nil
+}
+
+// markTx adds a TxField line with id to every event of frames but the last
+func markTx(frames []byte, id string) []byte {
+	field := []byte(TxField + ": " + id + "\n")
+	marked := make([]byte, 0, len(frames)+bytes.Count(frames, []byte("\n\n"))*len(field))
+	for rest := frames; len(rest) > 0; {
+		end := bytes.Index(rest, []byte("\n\n"))
+		if end < 0 {
+			marked = append(marked, rest...)
+			break
+		}
+		// events end with one or more blank lines
+		next := len(rest) - len(bytes.TrimLeft(rest[end:], "\n"))
+		if next == len(rest) {
+			// the last event
+			marked = append(marked, rest...)
+			break
+		}
+		marked = append(marked, rest[:end+1]...)
+		marked = append(marked, field...)
+		marked = append(marked, rest[end+1:next]...)
+		rest = rest[next:]
+	}
+	return marked
+}
@@ -0,0 +1,61 @@
+package resilientsse
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestTxMarksGroup(t *testing.T) {
+	replay := NewReplayBuffer(10)
+	w := newTestWriter()
+	s := newStream(w, nil, WithReplay(replay))
+	patchRow(t, s, 1)
+	tx := s.Tx()
+	patchRow(t, tx, 2)
+	patchRow(t, tx, 3)
+	tx.MarshalAndPatchSignals(map[string]any{"rows": 3})
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("second Commit = %v, want ErrTxDone", err)
+	}
+	s.Close(nil)
+
+	events := regexp.MustCompile(`\n\n+`).Split(strings.TrimRight(w.String(), "\n"), -1)
+	if len(events) != 4 {
+		t.Fatalf("stream has %d events, want 4\n%s", len(events), w.String())
+	}
+	for i, e := range events[1:3] {
+		if !strings.HasSuffix(e, "\n"+TxField+": 2") || strings.Contains(e, "\nid:") {
+			t.Errorf("group event %d isn't marked with the group's ID and only that\n%s", i+1, e)
+		}
+	}
+	if last := events[3]; strings.Contains(last, TxField) || !strings.Contains(last, "id: 2\n") {
+		t.Errorf("last event of the group should carry its ID and no mark\n%s", last)
+	}
+
+	// a client that lost the group is replayed it whole, marks included
+	frames, complete := replay.Since(1)
+	replayed := string(joinFrames(frames))
+	if !complete || !strings.HasSuffix(w.String(), replayed) || strings.Count(replayed, TxField) != 2 {
+		t.Errorf("Since(1) = %q, complete %v; want the group", frames, complete)
+	}
+}
+
+func TestTxRollback(t *testing.T) {
+	w := newTestWriter()
+	s := newStream(w, nil)
+	tx := s.Tx()
+	patchRow(t, tx, 1)
+	tx.Rollback()
+	if err := tx.Commit(); !errors.Is(err, ErrTxDone) {
+		t.Errorf("Commit after Rollback = %v, want ErrTxDone", err)
+	}
+	s.Close(nil)
+	if got := w.String(); got != "" {
+		t.Errorf("rolled back group wrote %q", got)
+	}
+}
@@ -0,0 +1,178 @@
+package resilientsse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned by the stream's sends are classified by what ended the
+// stream, wrapping the cause [ResilientSSE.Err] reports, so a handler can
+// tell a vanished client from a server-side problem:
+//
+//	if err := stream.PatchSignals(signals); errors.Is(err, resilientsse.ErrClientGone) {
+//		return // nothing to clean up: the client resumes from replay
+//	}
+//
+// Errors rendering an event, such as signals that can't be marshalled, are
+// returned unclassified.
+var (
+	// ErrClientGone is returned once the client went away: it cancelled its
+	// request, or a write to it failed
+	ErrClientGone = errors.New("resilientsse: client gone")
+	// ErrWriteTimeout is returned once a write to the client took longer than
+	// [WithWriteTimeout] allows, which usually means it stopped reading
+	ErrWriteTimeout = errors.New("resilientsse: write timeout")
+	// ErrStreamClosed is returned once the server ended the stream, e.g. with
+	// [ResilientSSE.Close] ([ErrClosed]), a drain ([ErrDraining]) or
+	// backpressure ([ErrSlowClient])
+	ErrStreamClosed = errors.New("resilientsse: stream closed by server")
+)
+
+// WithWriteTimeout bounds each write to the client, flush included, with a
+// deadline on its connection. A write that misses it ends the stream with
+// [ErrWriteTimeout], freeing the handler from a client that stopped reading
+// without closing its connection. Writers that don't support deadlines, see
+// [http.ResponseController.SetWriteDeadline], are not bounded.
+func WithWriteTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.writeTimeout = d
+	}
+}
+
+// classifyWrite wraps the error of a failed write in ErrWriteTimeout or
+// ErrClientGone, unless it already is
+func (s *ResilientSSE) classifyWrite(err error) error {
+	switch {
+	case errors.Is(err, ErrClientGone), errors.Is(err, ErrWriteTimeout):
+		return err
+	case s.w.timeout > 0 && !s.w.aborted.Load() && errors.Is(err, os.ErrDeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	default:
+		return fmt.Errorf("%w: %w", ErrClientGone, err)
+	}
+}
+
+// streamErr returns the classified error for sends on the ended stream
+func (s *ResilientSSE) streamErr() error {
+	cause := context.Cause(s.ctx)
+	switch {
+	case errors.Is(cause, ErrClientGone), errors.Is(cause, ErrWriteTimeout):
+		return cause
+	case s.dropReason() == DropClientGone:
+		return fmt.Errorf("%w: %w", ErrClientGone, cause)
+	default:
+		return fmt.Errorf("%w: %w", ErrStreamClosed, cause)
+	}
+}
+
+// streamWriter sits between datastar-go and the client's ResponseWriter.
+// Events rendered by datastar-go are held here rather than forwarded, so the
+// stream can see each complete frame, record it, and write it (or a group of
+// them) to the client in one piece. It is also where the stream writes frames
+// of its own, such as heartbeat comments, that datastar-go has no API for.
+type streamWriter struct {
+	http.ResponseWriter
+	rc *http.ResponseController
+
+	// held collects writes instead of forwarding them while non-nil, in buf,
+	// a buffer from framePool
+	held []byte
+	buf  *[]byte
+
+	// timeout bounds each writeFrames, if positive
+	timeout time.Duration
+	// aborted is set once abort has cut writes short, so that timeout no
+	// longer moves the deadline
+	aborted atomic.Bool
+
+	// delta is set with WithDeltaEncoding, if the client asked for it. It
+	// encodes what is written, past the send queue's drops and merges, so it
+	// records exactly what the client received.
+	delta *deltaDict
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	return &streamWriter{ResponseWriter: w, rc: http.NewResponseController(w)}
+}
+
+// Unwrap lets [http.ResponseController] reach the underlying writer
+func (w *streamWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// FlushError flushes the client's writer, except while holding: datastar-go
+// flushes every event it renders, and flushing from the goroutine rendering
+// would race with a send queue writing to the client. The stream flushes
+// what it writes itself.
+func (w *streamWriter) FlushError() error {
+	if w.held != nil {
+		return nil
+	}
+	return w.rc.Flush()
+}
+
+// Write forwards p to the client, or holds it back while holding
+func (w *streamWriter) Write(p []byte) (int, error) {
+	if w.held != nil {
+		w.held = append(w.held, p...)
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// hold starts holding back writes
+func (w *streamWriter) hold() {
+	w.buf = framePool.Get().(*[]byte)
+	w.held = (*w.buf)[:0]
+}
+
+// release stops holding and returns everything written since hold
+func (w *streamWriter) release() []byte {
+	frames := w.held
+	w.held = nil
+	return frames
+}
+
+// recycle puts frames, returned by the last release, back in the pool.
+// Nothing may use them afterwards.
+func (w *streamWriter) recycle(frames []byte) {
+	if w.buf != nil && cap(frames) <= maxPooledFrame {
+		*w.buf = frames[:0]
+		framePool.Put(w.buf)
+	}
+	w.buf = nil
+}
+
+// writeFrames writes frames to the client and flushes them, within timeout
+func (w *streamWriter) writeFrames(frames ...[]byte) error {
+	if w.timeout > 0 && !w.aborted.Load() {
+		w.rc.SetWriteDeadline(time.Now().Add(w.timeout))
+		defer func() {
+			if !w.aborted.Load() {
+				w.rc.SetWriteDeadline(time.Time{})
+			}
+		}()
+	}
+
+	for _, frame := range frames {
+		if w.delta != nil {
+			frame = w.delta.encode(frame)
+		}
+		if _, err := w.ResponseWriter.Write(frame); err != nil {
+			return err
+		}
+	}
+	return w.rc.Flush()
+}
+
+// abort fails the write in progress, and any after it, e.g. one stuck on a
+// stalled client
+func (w *streamWriter) abort() {
+	w.aborted.Store(true)
+	w.rc.SetWriteDeadline(time.Now())
+}
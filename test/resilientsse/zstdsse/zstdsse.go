@@ -0,0 +1,28 @@
+// Package zstdsse adds zstd to the encodings resilientsse.WithCompression
+// compresses streams with, keeping the zstd dependency out of the core
+// package. Importing it registers the encoding:
+//
+//	stream := resilientsse.New(w, r,
+//		resilientsse.WithCompression(zstdsse.Zstd, resilientsse.Gzip))
+package zstdsse
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"resilient-test/resilientsse"
+)
+
+// Zstd is the zstd content coding
+const Zstd resilientsse.Encoding = "zstd"
+
+// window keeps the memory of a zstd stream close to a gzip one's, rather than
+// the 8MB default window
+const window = 1 << 20
+
+func init() {
+	resilientsse.RegisterEncoding(Zstd, func(w io.Writer) (resilientsse.Compressor, error) {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(window), zstd.WithLowerEncoderMem(true))
+	})
+}
@@ -0,0 +1,73 @@
+package zstdsse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+
+	"resilient-test/resilientsse"
+)
+
+// unzstd returns what the zstd stream in p decompresses to so far, which may
+// stop mid-stream
+func unzstd(t *testing.T, p []byte) string {
+	t.Helper()
+	d, err := zstd.NewReader(bytes.NewReader(p))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	out, _ := io.ReadAll(d)
+	return string(out)
+}
+
+func TestRoundTrip(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+	r.Header.Set("Accept-Encoding", "gzip, zstd")
+	s := resilientsse.New(w, r, resilientsse.WithCompression(Zstd, resilientsse.Gzip))
+	if s.Encoding() != Zstd || w.Header().Get("Content-Encoding") != "zstd" {
+		t.Fatalf("stream encoding %q, Content-Encoding %q, want zstd", s.Encoding(), w.Header().Get("Content-Encoding"))
+	}
+
+	element := `<div id="row">` + strings.Repeat("row ", 50) + `</div>`
+	for i := range 3 {
+		if err := s.PatchElements(element); err != nil {
+			t.Fatal(err)
+		}
+		// flushed with the event, so readable before the stream ends
+		if got := unzstd(t, w.Body.Bytes()); strings.Count(got, "id: ") != i+1 {
+			t.Errorf("after event %d the client can read %d events", i+1, strings.Count(got, "id: "))
+		}
+	}
+	s.Close(nil)
+
+	got := unzstd(t, w.Body.Bytes())
+	for i := 1; i <= 3; i++ {
+		if !strings.Contains(got, fmt.Sprintf("id: %d\n", i)) {
+			t.Errorf("decompressed stream is missing event %d:\n%s", i, got)
+		}
+	}
+	// the window carries across events, so repeated markup costs little
+	if n := w.Body.Len(); n > len(got)/2 {
+		t.Errorf("compressed stream is %d bytes for %d decompressed", n, len(got))
+	}
+}
+
+func TestFallsBackToGzip(t *testing.T) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+	r.Header.Set("Accept-Encoding", "gzip, zstd;q=0")
+	s := resilientsse.New(w, r, resilientsse.WithCompression(Zstd, resilientsse.Gzip))
+	defer s.Close(nil)
+
+	if s.Encoding() != resilientsse.Gzip {
+		t.Errorf("stream encoding %q, want gzip", s.Encoding())
+	}
+}
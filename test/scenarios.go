@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scenario describes a test endpoint and the page generated to exercise it
+type scenario struct {
+	// Name is the slug used for the generated page at /scenarios/{Name}
+	Name        string
+	Title       string
+	Description string
+	Path        string
+	Handler     scenarioHandler
+
+	// Defaults are the knobs used when a request does not override them
+	Defaults scenarioOpts
+
+	// InactivityTimeoutMs is passed to the Retryer on the generated page
+	InactivityTimeoutMs int
+
+	// Expect is evaluated by the generated page once Expect.After has elapsed
+	Expect expectation
+}
+
+// scenarioHandler is a test endpoint that receives its parsed knobs
+type scenarioHandler func(w http.ResponseWriter, r *http.Request, opts scenarioOpts)
+
+// serve parses the request's scenario knobs on top of the scenario defaults
+// currently in effect (see config.go) and runs the handler, rejecting
+// malformed knobs with 400
+func (s scenario) serve(w http.ResponseWriter, r *http.Request) {
+	opts, err := parseScenarioOpts(r, config.defaults(s.Path))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts.name = s.Name
+
+	defer trackConnection(w, r, s.Name)()
+
+	w, wait := chaosWriterFor(w, r, s.Name, opts)
+	defer wait()
+	defer recoverHandler(w, opts)
+	s.Handler(w, r, opts)
+}
+
+// recoverHandler recovers a panic the handler didn't recover itself, e.g. one
+// before it opened its stream (see [resilientsse.ResilientSSE.Recover]): it
+// logs the stack and answers 500, so the client retries
+func recoverHandler(w http.ResponseWriter, opts scenarioOpts) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	if v == http.ErrAbortHandler {
+		panic(v)
+	}
+	opts.logger().Error("handler panicked", "panic", v, "stack", string(debug.Stack()))
+	http.Error(w, "handler failed", http.StatusInternalServerError)
+}
+
+// expectation is the pass/fail condition checked by a generated page
+type expectation struct {
+	After            time.Duration
+	Connected        bool
+	MinReconnections int
+	// MaxReconnections is ignored when negative
+	MaxReconnections int
+	// NoDuplicates fails the page if the assertion API reports that its
+	// session ever held two streams to the scenario at once
+	NoDuplicates bool
+	// MinCount fails the page if the count signal ends up lower, e.g. because
+	// the count started over on a reconnect
+	MinCount int
+}
+
+// scenarios is the registry of every test endpoint, in display order
+var scenarios = []scenario{
+	{
+		Name:                "stable",
+		Title:               "Stable Connection",
+		Description:         "Reliable SSE stream that never fails. Sends updates every 0.5 seconds.",
+		Path:                "/api/stable",
+		Handler:             stableSSE,
+		Defaults:            scenarioOpts{Interval: 500 * time.Millisecond},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "random-failures",
+		Title:               "Random Failures",
+		Description:         "50% chance to fail on connection, disconnects after 4 events. Tests automatic reconnection with backoff.",
+		Path:                "/api/random-failures",
+		Handler:             randomFailuresSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, FailRate: 0.5, FailAfter: 4},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 10 * time.Second, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "delayed-start",
+		Title:               "Delayed Start",
+		Description:         "Delays the connection before it establishes (3 seconds by default).",
+		Path:                "/api/delayed-start",
+		Handler:             delayedStartSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Delay: 3 * time.Second},
+		InactivityTimeoutMs: 3100, // just over the 3 second delay
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "inactivity-test",
+		Title:               "Inactivity Detection",
+		Description:         "Sends 3 events then stops sending data while keeping the connection open.",
+		Path:                "/api/inactivity-test",
+		Handler:             inactivityTestSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, StallAfter: 3},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 5 * time.Second, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "bad-framing",
+		Title:               "Bad Framing",
+		Description:         "Misframed responses: bogus Content-Length (mode=content-length), Connection: close with a dropped chunked body (mode=connection-close), or a close-delimited body without chunking (mode=no-chunked).",
+		Path:                "/api/bad-framing",
+		Handler:             badFramingSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Count: 3, Mode: "content-length"},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 5 * time.Second, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "duplicate-connections",
+		Title:               "Duplicate Connections",
+		Description:         "Short-lived streams that close after 3 fast events, forcing rapid reconnects. Fails if the client ever holds two streams to this endpoint at once.",
+		Path:                "/api/duplicate-connections",
+		Handler:             duplicateConnectionsSSE,
+		Defaults:            scenarioOpts{Interval: 100 * time.Millisecond, Count: 3},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 5 * time.Second, MinReconnections: 1, MaxReconnections: -1, NoDuplicates: true},
+	},
+	{
+		Name:                "header-flip",
+		Title:               "Header Flip",
+		Description:         "Changes critical response headers on every reconnect: a normal stream, then text/plain, a bogus gzip Content-Encoding, a foreign-only CORS policy, and a new cookie requirement. Streams close after 3 events.",
+		Path:                "/api/header-flip",
+		Handler:             headerFlipSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Count: 3, Mode: "cycle"},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 10 * time.Second, MinReconnections: 4, MaxReconnections: -1},
+	},
+	{
+		Name:                "warmup-probe",
+		Title:               "Warm-up Probe",
+		Description:         "Each connection must answer a warm-up probe (a script that calls back to the server) before any events are sent.",
+		Path:                "/api/warmup-probe",
+		Handler:             warmupProbeSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Probe: 2 * time.Second, Mode: "answer"},
+		InactivityTimeoutMs: 2500,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "zombie-probe",
+		Title:               "Zombie Connections",
+		Description:         "Connections that can never complete the warm-up probe. The server drops each one when the probe times out, before sending or replaying anything.",
+		Path:                "/api/zombie-probe",
+		Handler:             warmupProbeSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Probe: 500 * time.Millisecond, Mode: "zombie"},
+		InactivityTimeoutMs: 2500,
+		Expect:              expectation{After: 5 * time.Second, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "envelope-versions",
+		Title:               "Envelope Versions",
+		Description:         "The server speaks envelopes v1 and v2 and each client gets the version it asks for (add resilientEnvelope=2 to ask for v2). v2 events carry an extra resilient: field that datastar ignores. See /tests/5.html for old and new clients side by side.",
+		Path:                "/api/envelope",
+		Handler:             envelopeSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond},
+		InactivityTimeoutMs: 2000,
+		Expect:              expectation{After: 3 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "topics",
+		Title:               "Topic Subscriptions",
+		Description:         "Subscribes to hub topics: clock publishes every second, and POST /api/publish?topic=news&message=... publishes to any topic. A reconnecting session is caught up on what its topics published while it was away. The match and redact knobs filter and rewrite messages for this subscriber only.",
+		Path:                "/api/topics",
+		Handler:             topicsSSE,
+		Defaults:            scenarioOpts{Interval: time.Second, Replay: 100, Topics: "clock,news"},
+		InactivityTimeoutMs: 2500,
+		Expect:              expectation{After: 3 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "flaky-upstream",
+		Title:               "Flaky Upstream",
+		Description:         "The stream stays up but its data source fails half the time. Each failure re-sends the last good quote flagged stale, with the error and the next retry time, and retries with backoff.",
+		Path:                "/api/flaky-upstream",
+		Handler:             flakyUpstreamSSE,
+		Defaults:            scenarioOpts{Interval: 500 * time.Millisecond, FailRate: 0.5},
+		InactivityTimeoutMs: 5000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "session-rotation",
+		Title:               "Session Rotation",
+		Description:         "Rotates the credentials on every connection, as apps do after re-authentication: a new token cookie, a new csrf signal and a new session ID. A reconnect presenting stale credentials is rejected with 403 and starts over; one presenting the new ones carries on counting where it left off. Streams close after 5 events.",
+		Path:                "/api/session-rotation",
+		Handler:             sessionRotationSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Count: 5, Replay: 100},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 8 * time.Second, MinReconnections: 3, MaxReconnections: -1, MinCount: 15},
+	},
+	{
+		Name:                "middleware",
+		Title:               "Middleware",
+		Description:         "A plain datastar handler, written without resilientsse, served through resilientsse.Middleware: its events get IDs, idle gaps get heartbeats and a resuming client is replayed what it missed, without the handler changing. Streams close after 10 events.",
+		Path:                "/api/middleware",
+		Handler:             middlewareSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Count: 10, Heartbeat: time.Second, Replay: 100},
+		InactivityTimeoutMs: 3000,
+		Expect:              expectation{After: 8 * time.Second, Connected: true, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "reconnect-storm",
+		Title:               "Reconnect Storm",
+		Description:         "Every stream is dropped at the same moment every 5 seconds, as in a deploy. Reconnects beyond about one a second per session, or five a second overall, are refused with 429 and a jittered Retry-After. Open the page in several tabs to see the storm spread out.",
+		Path:                "/api/reconnect-storm",
+		Handler:             reconnectStormSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond},
+		InactivityTimeoutMs: 3000,
+		Expect:              expectation{After: 12 * time.Second, Connected: true, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "idle-close",
+		Title:               "Idle Close",
+		Description:         "Sends 3 events then goes quiet, like the inactivity test, but the server notices: after 2 seconds without events it patches a resilientIdle directive telling the client to back off about a second, and closes the stream.",
+		Path:                "/api/idle-close",
+		Handler:             inactivityTestSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, StallAfter: 3, Idle: 2 * time.Second, Retry: time.Second},
+		InactivityTimeoutMs: 8000,
+		Expect:              expectation{After: 10 * time.Second, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "concurrent-writers",
+		Title:               "Concurrent Writers",
+		Description:         "A ticker and four async jobs patch the same stream from their own goroutines, with no lock around the stream. Every event arrives whole, in ID order.",
+		Path:                "/api/concurrent-writers",
+		Handler:             concurrentWritersSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Heartbeat: time.Second},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "priority-lanes",
+		Title:               "Priority Lanes",
+		Description:         "Ten best-effort progress patches and the usual event per interval, with a critical milestone every two intervals, under drop-oldest backpressure. A client that can't keep up loses progress updates first, and gets every milestone in order.",
+		Path:                "/api/priority-lanes",
+		Handler:             priorityLanesSSE,
+		Defaults:            scenarioOpts{Interval: 100 * time.Millisecond, Heartbeat: time.Second, Backpressure: "drop-oldest", MaxQueue: 16},
+		InactivityTimeoutMs: 1000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "address-families",
+		Title:               "Address Family Failover",
+		Description:         "With the server started with -families, dials the dual-stack listeners like a happy-eyeballs client every interval: localhost:8082 answers over IPv6, and localhost:8083, whose IPv6 address drops SYNs, over IPv4 once the client fails over. The families signal shows which family answered and how fast.",
+		Path:                "/api/address-families",
+		Handler:             addressFamiliesSSE,
+		Defaults:            scenarioOpts{Interval: 2 * time.Second, Heartbeat: time.Second},
+		InactivityTimeoutMs: 3000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "exactly-once",
+		Title:               "Exactly-Once Delivery",
+		Description:         "Appends a row every interval as an exactly-once event, walking the rows from the first on every connection. A client resuming with its Last-Event-ID, or after acknowledging at /api/ack, is only sent the rows it doesn't have, never one twice.",
+		Path:                "/api/exactly-once",
+		Handler:             exactlyOnceSSE,
+		Defaults:            scenarioOpts{Interval: 500 * time.Millisecond, Heartbeat: time.Second},
+		InactivityTimeoutMs: 2000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "handler-panic",
+		Title:               "Handler Panic",
+		Description:         "The handler panics after 3 events. The panic and its stack are logged, the client is sent a resilientError patch with a retry, and the stream is closed cleanly, so the client resumes from its last event ID. With mode=before-stream the handler panics before opening its stream and gets a 500.",
+		Path:                "/api/handler-panic",
+		Handler:             handlerPanicSSE,
+		Defaults:            scenarioOpts{Interval: 250 * time.Millisecond, Count: 3, Heartbeat: time.Second},
+		InactivityTimeoutMs: 2000,
+		Expect:              expectation{After: 6 * time.Second, MinReconnections: 1, MaxReconnections: -1},
+	},
+	{
+		Name:                "numeric-series",
+		Title:               "Numeric Series",
+		Description:         "Patches a series of 64 sensor readings, in millidegrees, every 0.5 seconds. The page asks /api/capabilities which serializers the server has and gets the series as base64 CBOR (or MessagePack with serializers=msgpack), about 30% smaller than the JSON; serializers= sends JSON for comparison.",
+		Path:                "/api/numeric-series",
+		Handler:             numericSeriesSSE,
+		Defaults:            scenarioOpts{Interval: 500 * time.Millisecond, Serializers: "cbor,msgpack"},
+		InactivityTimeoutMs: 2000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+	{
+		Name:                "ticker",
+		Title:               "Price Ticker",
+		Description:         "Re-renders a table of 20 prices every 0.5 seconds, a few of them changed. The page asks for delta encoding and, after the first table, is sent binary diffs against the tables it already has, a fraction of their size; delta=0 sends every table whole for comparison.",
+		Path:                "/api/ticker",
+		Handler:             tickerSSE,
+		Defaults:            scenarioOpts{Interval: 500 * time.Millisecond, Delta: 8},
+		InactivityTimeoutMs: 2000,
+		Expect:              expectation{After: 5 * time.Second, Connected: true, MaxReconnections: 0},
+	},
+}
+
+var (
+	// scenarioPages holds the rendered pages, keyed by scenario name
+	scenarioPages   map[string][]byte
+	scenarioPagesMu sync.RWMutex
+)
+
+// renderScenarioPages renders one page per registered scenario plus an index
+// page (keyed by ""), from templates/scenario.html, showing the defaults
+// currently in effect. It runs at startup and again on every config reload.
+func renderScenarioPages() error {
+	tmpl, err := template.ParseFiles("templates/scenario.html")
+	if err != nil {
+		return err
+	}
+
+	pages := map[string][]byte{}
+	for _, s := range scenarios {
+		s.Defaults = config.defaults(s.Path)
+
+		var buf bytes.Buffer
+		if err := tmpl.ExecuteTemplate(&buf, "scenario", s); err != nil {
+			return fmt.Errorf("rendering scenario %q: %w", s.Name, err)
+		}
+		pages[s.Name] = buf.Bytes()
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, "index", scenarios); err != nil {
+		return fmt.Errorf("rendering scenario index: %w", err)
+	}
+	pages[""] = buf.Bytes()
+
+	scenarioPagesMu.Lock()
+	scenarioPages = pages
+	scenarioPagesMu.Unlock()
+
+	log.Printf("🧪 Generated %d scenario pages under /scenarios/\n", len(scenarios))
+	return nil
+}
+
+// serveScenarioPage serves a page generated by renderScenarioPages
+func serveScenarioPage(w http.ResponseWriter, r *http.Request) {
+	scenarioPagesMu.RLock()
+	page, ok := scenarioPages[strings.TrimPrefix(r.URL.Path, "/scenarios/")]
+	scenarioPagesMu.RUnlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
@@ -0,0 +1,88 @@
+//go:build !minimal
+
+package main
+
+// Persistent replay stores, selected with -redis or -replay-log. Builds with
+// -tags minimal leave them out, along with their Redis and bbolt
+// dependencies, and keep replay in memory (see stores_minimal.go).
+
+import (
+	"cmp"
+	"flag"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"resilient-test/resilientsse"
+	"resilient-test/resilientsse/boltreplay"
+	"resilient-test/resilientsse/redisreplay"
+)
+
+var redisAddr = flag.String("redis", "", "keep replay events in the Redis server at this address, so several test servers can resume each other's streams")
+
+var replayLog = flag.String("replay-log", "", "keep replay events in this bbolt file, so streams resume across restarts of the test server")
+
+// redisStores replaces replayBuffers when the server is started with -redis
+var redisStores *redisreplay.Stores
+
+// replayEvents replaces replayBuffers when the server is started with -replay-log
+var replayEvents *boltreplay.Log
+
+// openReplayStores opens the store selected by the flags, if any, and
+// returns a func closing it
+func openReplayStores() (closeStores func()) {
+	switch {
+	case *redisAddr != "":
+		client := redis.NewClient(&redis.Options{Addr: *redisAddr})
+		redisStores = redisreplay.NewStores(client, redisreplay.Config{})
+		log.Printf("🗄️  Replay events kept in Redis at %s\n", *redisAddr)
+		return func() { client.Close() }
+	case *replayLog != "":
+		var err error
+		replayEvents, err = boltreplay.Open(*replayLog, boltreplay.Config{
+			MaxBytes: *replayMaxBytes,
+			MaxAge:   cmp.Or(*replayMaxAge, time.Hour),
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("🗄️  Replay events kept in %s\n", *replayLog)
+		return func() { replayEvents.Close() }
+	}
+	return func() {}
+}
+
+// sizedReplayStore returns the store for key, keeping size events
+func sizedReplayStore(key string, size int) resilientsse.ReplayStore {
+	if redisStores != nil {
+		return redisStores.GetWithSize(key, size)
+	}
+	if replayEvents != nil {
+		return replayEvents.GetWithSize(key, size)
+	}
+	return replayBuffers.GetWithSize(key, size).Store()
+}
+
+// replayStore returns the store for key, as sizedReplayStore made it
+func replayStore(key string) resilientsse.ReplayStore {
+	if redisStores != nil {
+		return redisStores.Get(key)
+	}
+	if replayEvents != nil {
+		return replayEvents.Get(key)
+	}
+	return replayBuffers.Get(key).Store()
+}
+
+// replayStores returns the store selected by the flags, for exporting and
+// importing replay
+func replayStores() replayStoreSet {
+	if redisStores != nil {
+		return redisStores
+	}
+	if replayEvents != nil {
+		return replayEvents
+	}
+	return replayBuffers
+}
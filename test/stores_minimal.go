@@ -0,0 +1,29 @@
+//go:build minimal
+
+package main
+
+import (
+	"resilient-test/resilientsse"
+)
+
+// openReplayStores does nothing: minimal builds keep replay in memory
+func openReplayStores() (closeStores func()) {
+	return func() {}
+}
+
+// sizedReplayStore returns the in-memory buffer for key, keeping size events,
+// as a store
+func sizedReplayStore(key string, size int) resilientsse.ReplayStore {
+	return replayBuffers.GetWithSize(key, size).Store()
+}
+
+// replayStore returns the in-memory buffer for key as a store
+func replayStore(key string) resilientsse.ReplayStore {
+	return replayBuffers.Get(key).Store()
+}
+
+// replayStores returns the in-memory buffers, for exporting and importing
+// replay
+func replayStores() replayStoreSet {
+	return replayBuffers
+}
@@ -0,0 +1,62 @@
+//go:build !minimal
+
+package main
+
+// OpenTelemetry tracing of scenario streams, enabled with -trace. Builds with
+// -tags minimal leave it out, along with the OpenTelemetry dependencies (see
+// tracing_minimal.go).
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+
+	"resilient-test/resilientsse"
+	"resilient-test/resilientsse/otelsse"
+)
+
+var traceFile = flag.String("trace", "", "write an OpenTelemetry span per scenario stream to this file, as JSON")
+
+// tracing is set when the server is started with -trace
+var tracing bool
+
+// openTracing sets up the span exporter selected by -trace, if any, and
+// returns a func flushing and closing it
+func openTracing() (closeTracing func()) {
+	if *traceFile == "" {
+		return func() {}
+	}
+	f, err := os.Create(*traceFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+	if err != nil {
+		log.Fatal(err)
+	}
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	tracing = true
+	log.Printf("🔭 Stream spans written to %s\n", *traceFile)
+
+	return func() {
+		provider.Shutdown(context.Background())
+		f.Close()
+	}
+}
+
+// traceStream traces the stream opened for r, with -trace
+func traceStream(r *http.Request) []resilientsse.Option {
+	if !tracing {
+		return nil
+	}
+	return []resilientsse.Option{otelsse.Trace(r, otelsse.Config{})}
+}
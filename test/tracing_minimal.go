@@ -0,0 +1,19 @@
+//go:build minimal
+
+package main
+
+import (
+	"net/http"
+
+	"resilient-test/resilientsse"
+)
+
+// openTracing does nothing: minimal builds don't trace
+func openTracing() (closeTracing func()) {
+	return func() {}
+}
+
+// traceStream does nothing: minimal builds don't trace
+func traceStream(r *http.Request) []resilientsse.Option {
+	return nil
+}